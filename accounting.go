@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CostReport periodically writes the resources used by calculations since
+// the last report, totalled per owner, for chargeback on shared agents.
+// {time} in the path is replaced by the end of the period, otherwise each
+// report overwrites the last.
+type CostReport struct {
+	Path     string `json:"path"`
+	Format   string `json:"format"`
+	Interval int    `json:"interval"`
+}
+
+func (report *CostReport) Validate() error {
+	if len(report.Path) == 0 {
+		return errors.New("Cost report has no path")
+	}
+	if report.Format != "" && report.Format != "csv" && report.Format != "json" {
+		return errors.New("Unknown cost report format " + report.Format)
+	}
+	if report.Interval <= 0 {
+		report.Interval = 3600
+	}
+	return nil
+}
+
+// Usage is the resources used by one calculation: the CPU time of its
+// command, the size of its workspace over the time the command ran, and the
+// encoded size of its context and result.
+type Usage struct {
+	Calculation      string
+	Owner            string
+	CpuSeconds       float64
+	WorkspaceGBHours float64
+	BytesIn          int64
+	BytesOut         int64
+}
+
+type OwnerCost struct {
+	Owner            string    `json:"owner"`
+	Calculations     int       `json:"calculations"`
+	CpuSeconds       float64   `json:"cpuSeconds"`
+	WorkspaceGBHours float64   `json:"workspaceGBHours"`
+	BytesIn          int64     `json:"bytesIn"`
+	BytesOut         int64     `json:"bytesOut"`
+	From             time.Time `json:"from"`
+	To               time.Time `json:"to"`
+}
+
+type Accounting struct {
+	mutex  sync.Mutex
+	since  time.Time
+	usages []Usage
+}
+
+var accounting = &Accounting{since: time.Now().UTC()}
+
+func (accounting *Accounting) Record(usage Usage) {
+	accounting.mutex.Lock()
+	defer accounting.mutex.Unlock()
+	accounting.usages = append(accounting.usages, usage)
+}
+
+// Take returns the costs per owner since the last call, sorted by owner.
+func (accounting *Accounting) Take() []OwnerCost {
+	accounting.mutex.Lock()
+	usages, from := accounting.usages, accounting.since
+	accounting.usages = nil
+	accounting.since = time.Now().UTC()
+	to := accounting.since
+	accounting.mutex.Unlock()
+
+	byOwner := make(map[string]*OwnerCost)
+	for _, usage := range usages {
+		cost, ok := byOwner[usage.Owner]
+		if !ok {
+			cost = &OwnerCost{Owner: usage.Owner, From: from, To: to}
+			byOwner[usage.Owner] = cost
+		}
+		cost.Calculations++
+		cost.CpuSeconds += usage.CpuSeconds
+		cost.WorkspaceGBHours += usage.WorkspaceGBHours
+		cost.BytesIn += usage.BytesIn
+		cost.BytesOut += usage.BytesOut
+	}
+	costs := make([]OwnerCost, 0, len(byOwner))
+	for _, cost := range byOwner {
+		costs = append(costs, *cost)
+	}
+	sort.Slice(costs, func(i, j int) bool { return costs[i].Owner < costs[j].Owner })
+	return costs
+}
+
+// Export writes the costs since the last export.
+func (report *CostReport) Export() error {
+	costs := accounting.Take()
+	var data []byte
+	var err error
+	if report.Format == "json" {
+		data, err = json.MarshalIndent(costs, "", "  ")
+	} else {
+		data, err = CostsToCsv(costs)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := report.Path
+	if len(costs) > 0 {
+		path = strings.ReplaceAll(path, "{time}", costs[0].To.Format("20060102T150405Z"))
+	} else {
+		path = strings.ReplaceAll(path, "{time}", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(path, data, 0644))
+}
+
+// ExportEvery exports a report every interval until ctx is cancelled.
+func (report *CostReport) ExportEvery(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * time.Duration(report.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := report.Export(); err != nil {
+				log.Println("Could not export cost report: " + err.Error())
+			}
+		}
+	}
+}
+
+func CostsToCsv(costs []OwnerCost) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"owner", "calculations", "cpuSeconds", "workspaceGBHours", "bytesIn", "bytesOut", "from", "to"})
+	for _, cost := range costs {
+		writer.Write([]string{
+			cost.Owner,
+			strconv.Itoa(cost.Calculations),
+			strconv.FormatFloat(cost.CpuSeconds, 'f', 3, 64),
+			strconv.FormatFloat(cost.WorkspaceGBHours, 'f', 6, 64),
+			strconv.FormatInt(cost.BytesIn, 10),
+			strconv.FormatInt(cost.BytesOut, 10),
+			cost.From.Format(time.RFC3339),
+			cost.To.Format(time.RFC3339),
+		})
+	}
+	writer.Flush()
+	return buf.Bytes(), errors.WithStack(writer.Error())
+}
+
+// DirSize is the total size of the files under dirpath.
+func DirSize(dirpath string) int64 {
+	var size int64
+	filepath.Walk(dirpath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCostReportExport(t *testing.T) {
+	accounting.Take()
+	accounting.Record(Usage{Calculation: "a", Owner: "bob", CpuSeconds: 1.5, BytesIn: 100, BytesOut: 10})
+	accounting.Record(Usage{Calculation: "b", Owner: "alice", CpuSeconds: 2, BytesIn: 50})
+	accounting.Record(Usage{Calculation: "c", Owner: "bob", CpuSeconds: 0.5, BytesIn: 100, BytesOut: 20})
+	report := &CostReport{Path: filepath.Join(t.TempDir(), "costs.csv")}
+	if err := report.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := report.Export(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data, err := os.ReadFile(report.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected a header and 2 owners, got %s", data)
+	}
+	if !strings.HasPrefix(lines[1], "alice,1,2.000,") || !strings.HasPrefix(lines[2], "bob,2,2.000,0.000000,200,30,") {
+		t.Errorf("Unexpected report %s", data)
+	}
+	if costs := accounting.Take(); len(costs) != 0 {
+		t.Errorf("Costs not reset after export: %v", costs)
+	}
+}
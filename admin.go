@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// HealthHandler serves whether the server is accepting calculations: 200, or
+// 503 once it is draining to restart or exit.
+func HealthHandler(draining *int32) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if "GET" != request.Method {
+			writer.WriteHeader(404)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		if atomic.LoadInt32(draining) != 0 {
+			writer.WriteHeader(503)
+			writer.Write([]byte(`{"status":"draining"}` + "\n"))
+			return
+		}
+		writer.Write([]byte(`{"status":"ok"}` + "\n"))
+	}
+}
+
+// VersionHandler serves the version of the agent and of its API.
+func VersionHandler() http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if "GET" != request.Method {
+			writer.WriteHeader(404)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"version":       Version,
+			"apiVersion":    ApiVersion,
+			"minApiVersion": MinApiVersion,
+		})
+	}
+}
+
+// watchTermination calls drain on SIGTERM or an interrupt, and cancel on a
+// second one, until ctx is done.
+func watchTermination(ctx context.Context, drain func(os.Signal), cancel func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	for received := 0; ; received++ {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			if received > 0 {
+				log.Println("Received " + sig.String() + " again, cancelling calculations")
+				cancel()
+				return
+			}
+			drain(sig)
+		}
+	}
+}
+
+// ListenAdmin starts serving mux on AdminAddress, for monitoring to be exposed
+// on another port or interface than calculations are submitted to.
+func ListenAdmin(config *Config, mux *http.ServeMux) (*http.Server, error) {
+	listener, err := net.Listen("tcp", config.AdminAddress)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	log.Println("Starting admin server on " + server.Addr)
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Println("Admin server stopped: " + err.Error())
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var draining int32
+	for _, expected := range []int{200, 503} {
+		recorder := httptest.NewRecorder()
+		HealthHandler(&draining)(recorder, httptest.NewRequest("GET", "/health", nil))
+		if recorder.Code != expected {
+			t.Errorf("Expected %d, got %d %s", expected, recorder.Code, recorder.Body.String())
+		}
+		atomic.StoreInt32(&draining, 1)
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	var draining int32
+	admin := http.NewServeMux()
+	HandleVersioned(admin, "/health", HealthHandler(&draining))
+	HandleVersioned(admin, "/version", VersionHandler())
+	server, err := ListenAdmin(&Config{AdminAddress: "127.0.0.1:0"}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	response, err := http.Get("http://" + server.Addr + "/v1/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var version map[string]interface{}
+	data, _ := io.ReadAll(response.Body)
+	if err := json.Unmarshal(data, &version); err != nil || version["version"] != Version {
+		t.Errorf("Unexpected version %s", data)
+	}
+	response, err = http.Get("http://" + server.Addr + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 200 {
+		t.Errorf("The admin server should be healthy, gave %d", response.StatusCode)
+	}
+}
+
+func TestWatchTermination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Signals can't be sent to the process on Windows")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drained, cancelled := make(chan os.Signal, 2), make(chan struct{})
+	go watchTermination(ctx, func(sig os.Signal) { drained <- sig }, func() { close(cancelled) })
+	// Keep the signals from the default handler until it listens for them
+	held := make(chan os.Signal, 2)
+	signal.Notify(held, syscall.SIGTERM)
+	defer signal.Stop(held)
+	time.Sleep(100 * time.Millisecond)
+	process, _ := os.FindProcess(os.Getpid())
+
+	// The first signal drains, and a second cancels the calculations
+	process.Signal(syscall.SIGTERM)
+	select {
+	case sig := <-drained:
+		if sig != syscall.SIGTERM {
+			t.Errorf("Unexpected %v", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not drained on SIGTERM")
+	}
+	process.Signal(syscall.SIGTERM)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not cancelled on a second SIGTERM")
+	}
+	if len(drained) != 0 {
+		t.Error("Drained twice")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// Affinity remembers the calculations this agent has recently run whose
+// inputs are in the input cache, so that the dispatcher can route follow-up
+// versions of a calculation to the agent that already has its inputs.
+type Affinity struct {
+	mutex   sync.Mutex
+	size    int
+	entries []affinityEntry
+}
+
+// affinityEntry is reported only to the host it came from.
+type affinityEntry struct {
+	patchwork.AffinityEntry
+	host string
+}
+
+var affinity = &Affinity{size: 100}
+
+// Record notes the inputs of a calculation from host that are in the input
+// cache, once they have been expanded. Inputs are hashed by their URI, the
+// key of the cache, so hashes of secrets are never reported.
+func (affinity *Affinity) Record(config *Config, host string, context patchwork.CalculationContext) {
+	if len(config.InputCache) == 0 {
+		return
+	}
+	entry := affinityEntry{
+		AffinityEntry: patchwork.AffinityEntry{
+			Calculation: context.Id,
+			InputHashes: make(map[string]string),
+			Time:        time.Now().UTC(),
+		},
+		host: host,
+	}
+	for name, value := range context.Inputs {
+		if key, ok := cachedInputKey(config, value); ok {
+			entry.InputHashes[name] = key
+		}
+	}
+	affinity.mutex.Lock()
+	defer affinity.mutex.Unlock()
+	// Keep only the latest entry for each calculation
+	for i, existing := range affinity.entries {
+		if existing.Calculation.Id == context.Id.Id {
+			affinity.entries = append(affinity.entries[:i], affinity.entries[i+1:]...)
+			break
+		}
+	}
+	if len(entry.InputHashes) == 0 {
+		return
+	}
+	affinity.entries = append(affinity.entries, entry)
+	if len(affinity.entries) > affinity.size {
+		affinity.entries = affinity.entries[len(affinity.entries)-affinity.size:]
+	}
+}
+
+// cachedInputKey returns the cache key of an input that is an artefact in
+// the input cache.
+func cachedInputKey(config *Config, value interface{}) (string, bool) {
+	artefact, ok := value.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	uri, ok := artefact["uri"].(string)
+	if !ok || !strings.HasPrefix(uri, "data:") {
+		return "", false
+	}
+	key := sha256Hex([]byte(uri))
+	_, err := os.Stat(InputCachePath(config, key))
+	return key, err == nil
+}
+
+// Entries returns the calculations from host, or from every host if empty,
+// most recent last. Inputs since removed from the cache are left out, as is
+// a calculation with none left.
+func (affinity *Affinity) Entries(config *Config, host string) []patchwork.AffinityEntry {
+	affinity.mutex.Lock()
+	recorded := make([]affinityEntry, len(affinity.entries))
+	copy(recorded, affinity.entries)
+	affinity.mutex.Unlock()
+	entries := make([]patchwork.AffinityEntry, 0, len(recorded))
+	for _, entry := range recorded {
+		if len(host) > 0 && entry.host != host {
+			continue
+		}
+		hashes := make(map[string]string)
+		for name, hash := range entry.InputHashes {
+			if _, err := os.Stat(InputCachePath(config, hash)); err == nil {
+				hashes[name] = hash
+			}
+		}
+		if len(hashes) > 0 {
+			entry.InputHashes = hashes
+			entries = append(entries, entry.AffinityEntry)
+		}
+	}
+	return entries
+}
+
+// Report sends the host the calculations from it whose inputs are cached.
+func (affinity *Affinity) Report(ctx context.Context, config *Config, logger *log.Logger, host string, token string) error {
+	client, err := NewClient(config, logger, host, token)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(client.SendAffinity(ctx, patchwork.Affinity{
+		AgentId:      config.AgentId,
+		Calculations: affinity.Entries(config, host),
+	}))
+}
+
+// AffinityHandler serves the calculations whose inputs this agent has
+// cached, most recent last.
+func AffinityHandler(config *Config) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if "GET" != request.Method {
+			writer.WriteHeader(404)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(patchwork.Affinity{
+			AgentId:      config.AgentId,
+			Calculations: affinity.Entries(config, ""),
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestAffinity(t *testing.T) {
+	var reported patchwork.Affinity
+	host := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "POST" || request.URL.Path != "/api/agents/affinity" {
+			writer.WriteHeader(404)
+			return
+		}
+		json.NewDecoder(request.Body).Decode(&reported)
+		writer.WriteHeader(204)
+	}))
+	defer host.Close()
+
+	config := &Config{AgentId: "agent", InputCache: t.TempDir()}
+	artefact := patchwork.Artefact{Name: "mesh.txt", ContentType: "text/plain", Uri: "data:text/plain;base64,bWVzaA=="}
+	if err := ReadArtefact(context.Background(), config, log.Default(), t.TempDir(), "mesh", artefact); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	inputs := map[string]interface{}{
+		"mesh":     map[string]interface{}{"name": artefact.Name, "contentType": artefact.ContentType, "uri": artefact.Uri},
+		"speed":    3.0,
+		"uncached": map[string]interface{}{"name": "a.txt", "contentType": "text/plain", "uri": "data:text/plain;base64,YQ=="},
+	}
+	recorded := &Affinity{size: 10}
+	recorded.Record(config, host.URL, patchwork.CalculationContext{Id: patchwork.CalculationId{Id: "calc1"}, Inputs: inputs})
+	recorded.Record(config, host.URL, patchwork.CalculationContext{Id: patchwork.CalculationId{Id: "calc2"}, Inputs: map[string]interface{}{"speed": 3.0}})
+	recorded.Record(config, "http://other", patchwork.CalculationContext{Id: patchwork.CalculationId{Id: "calc3"}, Inputs: inputs})
+
+	if err := recorded.Report(context.Background(), config, log.Default(), host.URL, ""); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	key := sha256Hex([]byte(artefact.Uri))
+	if reported.AgentId != "agent" || len(reported.Calculations) != 1 || reported.Calculations[0].Calculation.Id != "calc1" {
+		t.Fatalf("Expected only calc1 to be reported to its host, got %+v", reported)
+	}
+	if hashes := reported.Calculations[0].InputHashes; len(hashes) != 1 || hashes["mesh"] != key {
+		t.Errorf("Expected only the cached input to be reported, got %v", hashes)
+	}
+	if entries := recorded.Entries(config, ""); len(entries) != 2 {
+		t.Errorf("Expected the calculations of every host, got %+v", entries)
+	}
+
+	// Inputs removed from the cache are no longer reported
+	if err := os.Remove(InputCachePath(config, key)); err != nil {
+		t.Fatal(err)
+	}
+	if entries := recorded.Entries(config, ""); len(entries) != 0 {
+		t.Errorf("Expected nothing once the cache is cleared, got %+v", entries)
+	}
+}
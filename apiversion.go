@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ApiVersion is the latest version of the HTTP API. Its routes are served
+// both under /v<version>/ and, for dispatchers that predate versioning, at
+// the root.
+const (
+	ApiVersion       = 1
+	MinApiVersion    = 1
+	ApiVersionHeader = "X-Agent-Api-Version"
+	apiVersionPrefix = "/v"
+)
+
+// NegotiateApiVersion returns the version of the API a request is served
+// with. A version in the path must be supported; otherwise the dispatcher
+// may ask for one with the X-Agent-Api-Version header and is served the
+// latest version no later than that. Without either, it is the latest.
+func NegotiateApiVersion(request *http.Request) (int, error) {
+	if version, ok := pathApiVersion(request.URL.Path); ok {
+		if version < MinApiVersion || version > ApiVersion {
+			return 0, errors.New("Unsupported API version " + strconv.Itoa(version))
+		}
+		return version, nil
+	}
+	header := request.Header.Get(ApiVersionHeader)
+	if len(header) == 0 {
+		return ApiVersion, nil
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(header))
+	if err != nil || version < MinApiVersion {
+		return 0, errors.New("Unsupported API version " + header)
+	}
+	if version > ApiVersion {
+		version = ApiVersion
+	}
+	return version, nil
+}
+
+// pathApiVersion returns the version a path starting /v<version>/ is for.
+func pathApiVersion(path string) (int, bool) {
+	if !strings.HasPrefix(path, apiVersionPrefix) {
+		return 0, false
+	}
+	end := strings.Index(path[1:], "/")
+	if end < 0 {
+		return 0, false
+	}
+	version, err := strconv.Atoi(path[len(apiVersionPrefix) : end+1])
+	return version, err == nil
+}
+
+// HandleVersioned registers a handler for a route at the root and under the
+// prefix of each supported API version. The handler is only called if a
+// version can be negotiated, which is returned in the X-Agent-Api-Version
+// header.
+func HandleVersioned(mux *http.ServeMux, route string, handler http.HandlerFunc) {
+	versioned := func(writer http.ResponseWriter, request *http.Request) {
+		version, err := NegotiateApiVersion(request)
+		if err != nil {
+			writer.Header().Set(ApiVersionHeader, strconv.Itoa(ApiVersion))
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+		writer.Header().Set(ApiVersionHeader, strconv.Itoa(version))
+		handler(writer, request)
+	}
+	route = strings.TrimPrefix(route, "/")
+	mux.HandleFunc("/"+route, versioned)
+	for version := MinApiVersion; version <= ApiVersion; version++ {
+		mux.HandleFunc(apiVersionPrefix+strconv.Itoa(version)+"/"+route, versioned)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiVersioning(t *testing.T) {
+	mux := http.NewServeMux()
+	HandleVersioned(mux, "/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("calculation"))
+	})
+	HandleVersioned(mux, "/affinity", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("affinity"))
+	})
+	for _, test := range []struct {
+		path    string
+		header  string
+		code    int
+		body    string
+		version string
+	}{
+		{"/", "", 200, "calculation", "1"},
+		{"/v1/", "", 200, "calculation", "1"},
+		{"/affinity", "", 200, "affinity", "1"},
+		{"/v1/affinity", "", 200, "affinity", "1"},
+		{"/", "1", 200, "calculation", "1"},
+		{"/", "7", 200, "calculation", "1"},
+		{"/", "0", 400, "", "1"},
+		{"/", "one", 400, "", "1"},
+		{"/v2/", "", 400, "", "1"},
+		{"/v1/", "0", 200, "calculation", "1"},
+	} {
+		request := httptest.NewRequest("POST", test.path, nil)
+		if len(test.header) > 0 {
+			request.Header.Set(ApiVersionHeader, test.header)
+		}
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != test.code || recorder.Header().Get(ApiVersionHeader) != test.version {
+			t.Errorf("%s with version %q: expected %d version %s, got %d version %s", test.path, test.header,
+				test.code, test.version, recorder.Code, recorder.Header().Get(ApiVersionHeader))
+		}
+		if test.code == 200 && recorder.Body.String() != test.body {
+			t.Errorf("%s: expected %s handler, got %s", test.path, test.body, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// TooManyOutputs handles more output files than MaxOutputFiles: by default
+// the calculation fails with an error saying so, or with
+// OutputOverflow "tar" the files are returned as a single outputs.tar.gz
+// artefact.
+func TooManyOutputs(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, files []string, response *patchwork.CalculationResponse) error {
+	message := "The calculation wrote " + strconv.Itoa(len(files)) + " output files, more than the maximum of " +
+		strconv.Itoa(config.MaxOutputFiles)
+	logger.Println(message)
+	if config.OutputOverflow != "tar" {
+		response.AddErrors(message)
+		return nil
+	}
+	artefact, err := TarOutputs(ctx, config, logger, presigner, dirpath, files)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response.AddLogs(message + ", so they are returned as " + artefact.Name)
+	AddOutput(config, logger, response, artefact.Name, artefact)
+	return nil
+}
+
+// TarOutputs returns the files, which must be in dirpath, as a gzipped tar
+// artefact. Directories are archived with the files in them. The archive is
+// written to a new directory in dirpath and sent like any other output file.
+func TarOutputs(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, files []string) (patchwork.Artefact, error) {
+	logger.Println("Archiving " + strconv.Itoa(len(files)) + " output files")
+	contents := make([]string, 0, len(files))
+	for _, file := range files {
+		regular, err := regularFiles(config, file)
+		if err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+		contents = append(contents, regular...)
+	}
+	tmp, err := os.MkdirTemp(dirpath, ".archive")
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	path := filepath.Join(tmp, "outputs.tar.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	writer := bufio.NewWriter(file)
+	err = writeTar(writer, dirpath, contents)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	artefact, err := MakeArtefact(ctx, config, logger, presigner, path)
+	return artefact, errors.WithStack(err)
+}
+
+func addToTar(archive *tar.Writer, dirpath string, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	name, err := filepath.Rel(dirpath, file)
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	f, err := OpenOutput(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(archive, f)
+	return err
+}
+
+// ArchiveDirectory packages an output directory as a zip or, with
+// DirectoryOutputs "tar", a gzipped tar archive, returning its path. The
+// archive is written to a new directory in dirpath, so that it is sent like
+// any other output file and named after the output directory.
+func ArchiveDirectory(config *Config, logger *log.Logger, dirpath string, dir string) (string, error) {
+	files, err := regularFiles(config, dir)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	tmp, err := os.MkdirTemp(dirpath, ".archive")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	extension := ".zip"
+	if config.DirectoryOutputs == "tar" {
+		extension = ".tar.gz"
+	}
+	path := filepath.Join(tmp, filepath.Base(dir)+extension)
+	logger.Println("Archiving " + strconv.Itoa(len(files)) + " files in output directory " + dir + " as " + path)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if config.DirectoryOutputs == "tar" {
+		err = writeTar(file, dir, files)
+	} else {
+		err = writeZip(file, dir, files)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, errors.WithStack(err)
+}
+
+func writeTar(w io.Writer, dir string, files []string) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := addToTar(archive, dir, file); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, dir string, files []string) error {
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		if err := addToZip(archive, dir, file); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func addToZip(archive *zip.Writer, dir string, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	name, err := filepath.Rel(dir, file)
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	header.Method = zip.Deflate
+	w, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	f, err := OpenOutput(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// regularFiles returns a file, or the regular files in a directory and its
+// subdirectories less any junk. Symbolic links are not followed.
+func regularFiles(config *Config, path string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == path && !entry.IsDir() {
+			files = append(files, file)
+		} else if entry.Type().IsRegular() && (config.KeepJunkFiles || !IsJunkFile(entry.Name())) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files, errors.WithStack(err)
+}
+
+// DataArtefact returns content as an artefact with a data URI.
+func DataArtefact(name string, contentType string, data []byte) patchwork.Artefact {
+	return patchwork.Artefact{
+		Name:        name,
+		ContentType: contentType,
+		Uri:         "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data),
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// StorageError is returned for a response with an unexpected status from an
+// object store.
+type StorageError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *StorageError) Error() string {
+	return err.Message
+}
+
+// exists interprets the error of a request for an object's metadata.
+func exists(err error) (bool, error) {
+	if err == nil {
+		return true, nil
+	}
+	if storageErr, ok := errors.Cause(err).(*StorageError); ok && storageErr.StatusCode == 404 {
+		return false, nil
+	}
+	return false, err
+}
+
+// ValidateArtefactStore checks that the artefact store, if any, is an s3://
+// or gs:// location or an Azure Blob Storage container.
+func ValidateArtefactStore(config *Config) error {
+	if len(config.ArtefactStore) == 0 {
+		return nil
+	}
+	if IsAzureBlobURL(config.ArtefactStore) {
+		_, err := AzureBlobURL(config.ArtefactStore, "")
+		return errors.WithStack(err)
+	}
+	if strings.HasPrefix(config.ArtefactStore, "gs://") {
+		_, err := ParseGCSLocation(config.ArtefactStore)
+		return errors.WithStack(err)
+	}
+	_, err := ParseS3Location(config.ArtefactStore)
+	return errors.WithStack(err)
+}
+
+// StoreArtefact uploads an output file to the artefact store, under its
+// SHA-256 so that identical outputs are stored once, and returns an artefact
+// referring to it by its s3:// or gs:// URI, or the URL of its Azure blob
+// (without the SAS token of the store).
+func StoreArtefact(ctx context.Context, config *Config, logger *log.Logger, path string) (patchwork.Artefact, error) {
+	contentType, err := ArtefactContentType(config, path)
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	name := filepath.Base(path)
+	key := hash + "/" + name
+	artefact := patchwork.Artefact{Name: name, ContentType: contentType}
+	if IsAzureBlobURL(config.ArtefactStore) {
+		blobUrl, err := AzureBlobURL(config.ArtefactStore, key)
+		if err != nil {
+			return artefact, errors.WithStack(err)
+		}
+		artefact.Uri = WithoutQuery(blobUrl)
+		found, err := AzureBlobExists(ctx, config, blobUrl)
+		if alreadyStored(logger, artefact.Uri, found, err) {
+			return artefact, nil
+		}
+		logger.Println("Uploading " + path + " to " + artefact.Uri)
+		err = UploadAzureBlob(ctx, config, blobUrl, path, contentType)
+		return artefact, errors.WithStack(err)
+	}
+	if strings.HasPrefix(config.ArtefactStore, "gs://") {
+		store, err := ParseGCSLocation(config.ArtefactStore)
+		if err != nil {
+			return artefact, errors.WithStack(err)
+		}
+		location := GCSLocation{Bucket: store.Bucket, Object: joinKey(store.Object, key)}
+		artefact.Uri = location.String()
+		found, err := GCSObjectExists(ctx, config, location)
+		if alreadyStored(logger, artefact.Uri, found, err) {
+			return artefact, nil
+		}
+		logger.Println("Uploading " + path + " to " + artefact.Uri)
+		err = UploadGCSFile(ctx, config, location, path, contentType)
+		return artefact, errors.WithStack(err)
+	}
+	store, err := ParseS3Location(config.ArtefactStore)
+	if err != nil {
+		return artefact, errors.WithStack(err)
+	}
+	location := S3Location{Bucket: store.Bucket, Key: joinKey(store.Key, key)}
+	artefact.Uri = location.String()
+	found, err := S3ObjectExists(ctx, config, location)
+	if alreadyStored(logger, artefact.Uri, found, err) {
+		return artefact, nil
+	}
+	logger.Println("Uploading " + path + " to " + artefact.Uri)
+	err = UploadS3File(ctx, config, location, path, contentType, hash)
+	return artefact, errors.WithStack(err)
+}
+
+// alreadyStored reports whether an artefact is already in the store, as when
+// a new version of a calculation produces an output identical to one from a
+// previous version, so need not be uploaded again. If that cannot be checked
+// the artefact is uploaded anyway.
+func alreadyStored(logger *log.Logger, uri string, found bool, err error) bool {
+	if err != nil {
+		logger.Println("Could not check for " + uri + " in the artefact store: " + err.Error())
+		return false
+	}
+	if found {
+		logger.Println("Output " + uri + " is already in the artefact store")
+	}
+	return found
+}
+
+func joinKey(prefix string, key string) string {
+	if prefix = strings.TrimSuffix(prefix, "/"); len(prefix) > 0 {
+		return prefix + "/" + key
+	}
+	return key
+}
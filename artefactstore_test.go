@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// NewStubS3 serves objects PUT to it from memory, as AWS_ENDPOINT_URL, and
+// counts the PUTs.
+func NewStubS3(t *testing.T) (map[string][]byte, *int) {
+	objects := make(map[string][]byte)
+	puts := 0
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(403)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+			puts++
+		case "GET", "HEAD":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	return objects, &puts
+}
+
+func TestArtefactStore(t *testing.T) {
+	objects, puts := NewStubS3(t)
+	config := &Config{ArtefactStore: "s3://results/runs/", MaxInlineSize: 10}
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "small.txt"), []byte("tiny"), 0644)
+	os.WriteFile(filepath.Join(dir, "field.vtu"), []byte("a large field of results"), 0644)
+
+	small, err := MakeArtefact(context.Background(), config, logger, nil, filepath.Join(dir, "small.txt"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(small.Uri) > 0 || len(small.Path) == 0 {
+		t.Errorf("Expected small.txt inline, got %+v", small)
+	}
+	large, err := MakeArtefact(context.Background(), config, logger, nil, filepath.Join(dir, "field.vtu"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.HasPrefix(large.Uri, "s3://results/runs/") || !strings.HasSuffix(large.Uri, "/field.vtu") || len(objects) != 1 {
+		t.Fatalf("Expected field.vtu uploaded, got %s", large.Uri)
+	}
+
+	// An identical output of a later calculation isn't uploaded again
+	if _, err := MakeArtefact(context.Background(), config, logger, nil, filepath.Join(dir, "field.vtu")); err != nil || *puts != 1 {
+		t.Errorf("Expected no upload of an identical output, got %d: %v", *puts, err)
+	}
+
+	inputs := t.TempDir()
+	err = ReadArtefact(context.Background(), config, logger, inputs, "mesh", large)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(inputs, "mesh.vtu"))
+	if string(data) != "a large field of results" {
+		t.Errorf("Unexpected downloaded input %q", data)
+	}
+}
+
+func TestGCSArtefactStore(t *testing.T) {
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/results/o":
+			objects[r.URL.Query().Get("name")], _ = io.ReadAll(r.Body)
+		case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/storage/v1/b/results/o/"):
+			data, ok := objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/results/o/")]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(400)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+	config := &Config{ArtefactStore: "gs://results/runs"}
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "field.vtu"), []byte("a large field of results"), 0644)
+
+	artefact, err := MakeArtefact(context.Background(), config, logger, nil, filepath.Join(dir, "field.vtu"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.HasPrefix(artefact.Uri, "gs://results/runs/") || len(objects) != 1 {
+		t.Fatalf("Expected field.vtu uploaded, got %s", artefact.Uri)
+	}
+	inputs := t.TempDir()
+	err = ReadArtefact(context.Background(), config, logger, inputs, "mesh", artefact)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(inputs, "mesh.vtu"))
+	if string(data) != "a large field of results" {
+		t.Errorf("Unexpected downloaded input %q", data)
+	}
+}
+
+// redirectTransport sends every request to a test server instead.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (transport redirectTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme = transport.target.Scheme
+	request.URL.Host = transport.target.Host
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestAzureArtefactStore(t *testing.T) {
+	blobs := make(map[string][]byte)
+	var authorizations []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metadata/identity/oauth2/token" {
+			w.Write([]byte(`{"access_token": "identity", "expires_in": "3600"}`))
+			return
+		}
+		authorizations = append(authorizations, r.Header.Get("Authorization")+r.URL.Query().Get("sig"))
+		switch r.Method {
+		case "HEAD":
+			if _, ok := blobs[r.URL.Path]; !ok {
+				w.WriteHeader(404)
+			}
+			return
+		case "PUT":
+			if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+				w.WriteHeader(400)
+				return
+			}
+			blobs[r.URL.Path], _ = io.ReadAll(r.Body)
+			w.WriteHeader(201)
+		case "GET":
+			data, ok := blobs[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	host := "https://acct.blob.core.windows.net"
+	clients.Lock()
+	clients.byHost[host] = &http.Client{Transport: redirectTransport{target}}
+	clients.Unlock()
+	defer func() {
+		clients.Lock()
+		delete(clients.byHost, host)
+		clients.Unlock()
+	}()
+	t.Setenv("AZURE_IMDS_ENDPOINT", server.URL)
+
+	config := &Config{ArtefactStore: host + "/results/runs?sv=2021-08-06&sig=c2Vj"}
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "field.vtu"), []byte("a large field of results"), 0644)
+	artefact, err := MakeArtefact(context.Background(), config, logger, nil, filepath.Join(dir, "field.vtu"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.HasPrefix(artefact.Uri, host+"/results/runs/") || strings.Contains(artefact.Uri, "sig") || len(blobs) != 1 {
+		t.Fatalf("Expected field.vtu uploaded, got %s", artefact.Uri)
+	}
+
+	// Without a SAS token, the download is authorised by the managed identity
+	inputs := t.TempDir()
+	err = ReadArtefact(context.Background(), config, logger, inputs, "mesh", artefact)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(inputs, "mesh.vtu"))
+	if string(data) != "a large field of results" {
+		t.Errorf("Unexpected downloaded input %q", data)
+	}
+	if len(authorizations) != 3 || authorizations[1] != "c2Vj" || authorizations[2] != "Bearer identity" {
+		t.Errorf("Unexpected authorizations %v", authorizations)
+	}
+}
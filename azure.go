@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const azureStorageVersion = "2021-08-06"
+
+// IsAzureBlobURL reports whether a URI is of a blob, or a container and
+// prefix, in Azure Blob Storage.
+func IsAzureBlobURL(uri string) bool {
+	parsed, err := url.Parse(uri)
+	return err == nil && parsed.Scheme == "https" && strings.HasSuffix(parsed.Host, ".blob.core.windows.net")
+}
+
+// AzureBlobURL returns the URL of a blob under a container and prefix, with
+// the query (a SAS token) of the prefix.
+func AzureBlobURL(prefix string, name string) (string, error) {
+	parsed, err := url.Parse(prefix)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if len(strings.Trim(parsed.Path, "/")) == 0 {
+		return "", errors.New("No container in " + parsed.Scheme + "://" + parsed.Host)
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/" + name
+	parsed.RawPath = ""
+	return parsed.String(), nil
+}
+
+// WithoutQuery strips the query, which may be a SAS token, from a URL.
+func WithoutQuery(uri string) string {
+	if i := strings.Index(uri, "?"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+var azureToken = struct {
+	sync.Mutex
+	token  string
+	expiry time.Time
+}{}
+
+// AzureAccessToken returns an access token for Azure Storage from the
+// managed identity of the VM, or of the user-assigned identity with client
+// id AZURE_CLIENT_ID. Tokens are cached until a minute before they expire.
+func AzureAccessToken(ctx context.Context, config *Config) (string, error) {
+	azureToken.Lock()
+	defer azureToken.Unlock()
+	if len(azureToken.token) > 0 && time.Now().Add(time.Minute).Before(azureToken.expiry) {
+		return azureToken.token, nil
+	}
+	endpoint := os.Getenv("AZURE_IMDS_ENDPOINT")
+	if len(endpoint) == 0 {
+		endpoint = "http://169.254.169.254"
+	}
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://storage.azure.com/")
+	if clientId := os.Getenv("AZURE_CLIENT_ID"); len(clientId) > 0 {
+		query.Set("client_id", clientId)
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET",
+		strings.TrimSuffix(endpoint, "/")+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	request.Header.Set("Metadata", "true")
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return "", errors.New("Could not get an Azure managed identity token: " + response.Status)
+	}
+	// IMDS gives expires_in as a string
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", errors.WithStack(err)
+	}
+	expiresIn, _ := strconv.Atoi(token.ExpiresIn)
+	azureToken.token = token.AccessToken
+	azureToken.expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return token.AccessToken, nil
+}
+
+// AzureBlobExists reports whether there is a blob at a URL.
+func AzureBlobExists(ctx context.Context, config *Config, blobUrl string) (bool, error) {
+	response, err := azureBlobDo(ctx, config, "HEAD", blobUrl, nil, 0, "")
+	if err == nil {
+		response.Body.Close()
+	}
+	return exists(err)
+}
+
+// UploadAzureBlob streams a file to a block blob. A single Put Blob is
+// limited by Azure to about 5 GB.
+func UploadAzureBlob(ctx context.Context, config *Config, blobUrl string, path string, contentType string) error {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response, err := azureBlobDo(ctx, config, "PUT", blobUrl, file, info.Size(), contentType)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+// DownloadAzureBlob streams a blob to a file.
+func DownloadAzureBlob(ctx context.Context, config *Config, blobUrl string, path string) error {
+	response, err := azureBlobDo(ctx, config, "GET", blobUrl, nil, 0, "")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
+
+// azureBlobDo sends a request for a blob, authorised by the SAS token in its
+// URL if it has one, or else by the managed identity. It returns the response
+// if it succeeded; the caller must close its body.
+func azureBlobDo(ctx context.Context, config *Config, method string, blobUrl string, body io.Reader, length int64, contentType string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, blobUrl, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if body != nil {
+		request.ContentLength = length
+	}
+	request.Header.Set("X-Ms-Version", azureStorageVersion)
+	if method == "PUT" {
+		request.Header.Set("X-Ms-Blob-Type", "BlockBlob")
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if len(request.URL.Query().Get("sig")) == 0 {
+		token, err := AzureAccessToken(ctx, config)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+		return nil, &StorageError{StatusCode: response.StatusCode, Message: method + " " + WithoutQuery(blobUrl) + " failed: " + response.Status + " " + string(message)}
+	}
+	return response, nil
+}
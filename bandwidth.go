@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Bandwidth caps the rate, in bytes per second, of everything the agent
+// uploads and downloads, so that it doesn't saturate a shared connection.
+// The first period of the schedule covering the local time replaces the
+// limits; 0 is no limit.
+type Bandwidth struct {
+	Upload   int64             `json:"upload"`
+	Download int64             `json:"download"`
+	Schedule []BandwidthPeriod `json:"schedule"`
+}
+
+// BandwidthPeriod is the limits during a window of time.
+type BandwidthPeriod struct {
+	TimeWindow
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+func (bandwidth *Bandwidth) Validate() error {
+	if bandwidth.Upload < 0 || bandwidth.Download < 0 {
+		return errors.New("Bandwidth limits can't be negative")
+	}
+	for _, period := range bandwidth.Schedule {
+		if err := period.Validate(); err != nil {
+			return errors.Wrap(err, "Bandwidth schedule")
+		}
+		if period.Upload < 0 || period.Download < 0 {
+			return errors.New("Bandwidth limits can't be negative")
+		}
+	}
+	return nil
+}
+
+// Limits returns the upload and download limits at a time.
+func (bandwidth *Bandwidth) Limits(now time.Time) (int64, int64) {
+	for _, period := range bandwidth.Schedule {
+		if period.Covers(now) {
+			return period.Upload, period.Download
+		}
+	}
+	return bandwidth.Upload, bandwidth.Download
+}
+
+// limiter spaces out transfers sharing a rate, by reserving the time each
+// chunk takes at the rate after those before it.
+type limiter struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// uploads and downloads are shared by all HTTP clients, so that the limits
+// apply to the agent as a whole.
+var uploads, downloads limiter
+
+// wait blocks until n bytes more may be transferred at rate.
+func (limiter *limiter) wait(ctx context.Context, n int, rate int64) error {
+	if rate <= 0 || n <= 0 {
+		return nil
+	}
+	limiter.mutex.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	delay := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	limiter.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledChunk is the most read at once, so that waits are short and
+// frequent rather than long.
+const throttledChunk = 16 * 1024
+
+type throttledReader struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	limiter *limiter
+	rate    func() int64
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttledChunk {
+		p = p[:throttledChunk]
+	}
+	n, err := reader.body.Read(p)
+	if waitErr := reader.limiter.wait(reader.ctx, n, reader.rate()); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+func (reader *throttledReader) Close() error {
+	return reader.body.Close()
+}
+
+// ThrottledTransport limits the rate at which request bodies are sent and
+// response bodies read to the agent's bandwidth limits.
+type ThrottledTransport struct {
+	Transport http.RoundTripper
+	Bandwidth *Bandwidth
+}
+
+func (transport *ThrottledTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx := request.Context()
+	if request.Body != nil && request.Body != http.NoBody {
+		request = request.Clone(ctx)
+		request.Body = &throttledReader{ctx: ctx, body: request.Body, limiter: &uploads, rate: func() int64 {
+			upload, _ := transport.Bandwidth.Limits(time.Now())
+			return upload
+		}}
+	}
+	response, err := transport.Transport.RoundTrip(request)
+	if err != nil {
+		return response, err
+	}
+	response.Body = &throttledReader{ctx: ctx, body: response.Body, limiter: &downloads, rate: func() int64 {
+		_, download := transport.Bandwidth.Limits(time.Now())
+		return download
+	}}
+	return response, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+	bandwidth := &Bandwidth{Upload: 1000, Download: 2000, Schedule: []BandwidthPeriod{
+		{TimeWindow: TimeWindow{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "17:30"}, Upload: 10, Download: 20},
+		{TimeWindow: TimeWindow{Days: []string{"fri"}, From: "22:00", To: "06:00"}, Upload: 100},
+	}}
+	if err := bandwidth.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		time     string
+		upload   int64
+		download int64
+	}{
+		{"2026-10-12 09:00", 10, 20}, // Monday
+		{"2026-10-12 17:30", 1000, 2000},
+		{"2026-10-11 12:00", 1000, 2000}, // Sunday
+		{"2026-10-16 23:00", 100, 0},     // Friday night
+		{"2026-10-17 05:59", 100, 0},     // into Saturday
+		{"2026-10-18 05:59", 1000, 2000},
+	} {
+		now, _ := time.ParseInLocation("2006-01-02 15:04", test.time, time.Local)
+		upload, download := bandwidth.Limits(now)
+		if upload != test.upload || download != test.download {
+			t.Errorf("Expected %d and %d at %s, got %d and %d", test.upload, test.download, test.time, upload, download)
+		}
+	}
+	for _, invalid := range []TimeWindow{{From: "9am", To: "17:00"}, {From: "09:00", To: "17:00", Days: []string{"monday"}}} {
+		if err := (&Bandwidth{Schedule: []BandwidthPeriod{{TimeWindow: invalid}}}).Validate(); err == nil {
+			t.Errorf("Expected an error for %v", invalid)
+		}
+	}
+}
+
+func TestThrottledTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &ThrottledTransport{Transport: http.DefaultTransport, Bandwidth: &Bandwidth{Download: 100000}}}
+	start := time.Now()
+	response, err := client.Post(server.URL, "application/octet-stream", bytes.NewReader(make([]byte, 40000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || len(body) != 40000 {
+		t.Fatalf("Expected the body back, got %d bytes: %v", len(body), err)
+	}
+	// Each 16KB read waits for those before it, 0.32s for the first two
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected the download to be throttled, took %v", elapsed)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	image.RegisterFormat("bmp", "BM", decodeBmp, decodeBmpConfig)
+}
+
+// bmpHeader is the part of the file and info headers of a BMP that describes
+// its pixels.
+type bmpHeader struct {
+	offset      uint32
+	size        uint32
+	width       int
+	height      int
+	topDown     bool
+	bpp         int
+	compression uint32
+	masks       [4]uint32
+	palette     color.Palette
+}
+
+// readBmpHeader reads the headers and palette of a BMP, leaving r at the
+// start of its pixels. Uncompressed bitmaps of 1, 4, 8, 16, 24 or 32 bits
+// per pixel are supported.
+func readBmpHeader(r io.Reader) (*bmpHeader, error) {
+	var file [18]byte
+	if _, err := io.ReadFull(r, file[:]); err != nil || string(file[:2]) != "BM" {
+		return nil, errors.New("Not a BMP")
+	}
+	header := &bmpHeader{offset: binary.LittleEndian.Uint32(file[10:]), size: binary.LittleEndian.Uint32(file[14:])}
+	if header.size < 40 || header.size > 1024 {
+		return nil, errors.New("Unsupported BMP header")
+	}
+	info := make([]byte, header.size-4)
+	if _, err := io.ReadFull(r, info); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	width := int32(binary.LittleEndian.Uint32(info[0:]))
+	height := int32(binary.LittleEndian.Uint32(info[4:]))
+	header.bpp = int(binary.LittleEndian.Uint16(info[10:]))
+	header.compression = binary.LittleEndian.Uint32(info[12:])
+	colors := binary.LittleEndian.Uint32(info[28:])
+	if height < 0 {
+		header.topDown = true
+		height = -height
+	}
+	header.width, header.height = int(width), int(height)
+	if width <= 0 || height <= 0 || int64(width)*int64(height) > 1<<30 {
+		return nil, errors.New("Invalid BMP size")
+	}
+	read := 14 + header.size
+	switch {
+	case header.compression == 0 && (header.bpp == 24 || header.bpp == 32):
+		header.masks = [4]uint32{0xff0000, 0xff00, 0xff, 0}
+	case header.compression == 0 && header.bpp == 16:
+		header.masks = [4]uint32{0x7c00, 0x3e0, 0x1f, 0}
+	case header.compression == 3 && (header.bpp == 16 || header.bpp == 32):
+		// Masks follow a 40 byte header, and are in a larger one
+		if header.size == 40 {
+			var masks [12]byte
+			if _, err := io.ReadFull(r, masks[:]); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			info = append(info, masks[:]...)
+			read += 12
+		}
+		for i := 0; i < 4 && 40+4*i <= len(info); i++ {
+			header.masks[i] = binary.LittleEndian.Uint32(info[36+4*i:])
+		}
+	case header.compression == 0 && (header.bpp == 1 || header.bpp == 4 || header.bpp == 8):
+		if colors == 0 || colors > 1<<header.bpp {
+			colors = 1 << header.bpp
+		}
+		entries := make([]byte, 4*colors)
+		if _, err := io.ReadFull(r, entries); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		read += 4 * colors
+		for i := uint32(0); i < colors; i++ {
+			header.palette = append(header.palette, color.RGBA{entries[4*i+2], entries[4*i+1], entries[4*i], 0xff})
+		}
+	default:
+		return nil, errors.New("Unsupported BMP of " + strconv.Itoa(header.bpp) + " bits with compression " + strconv.Itoa(int(header.compression)))
+	}
+	if header.offset < read {
+		return nil, errors.New("Invalid BMP pixel offset")
+	}
+	_, err := io.CopyN(io.Discard, r, int64(header.offset-read))
+	return header, errors.WithStack(err)
+}
+
+func decodeBmpConfig(r io.Reader) (image.Config, error) {
+	header, err := readBmpHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: header.width, Height: header.height}, nil
+}
+
+func decodeBmp(r io.Reader) (image.Image, error) {
+	reader := bufio.NewReader(r)
+	header, err := readBmpHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, header.width, header.height))
+	// Rows are padded to 4 bytes
+	row := make([]byte, (header.width*header.bpp+31)/32*4)
+	for i := 0; i < header.height; i++ {
+		if _, err := io.ReadFull(reader, row); err != nil {
+			return nil, errors.Wrap(err, "Truncated BMP")
+		}
+		y := header.height - 1 - i
+		if header.topDown {
+			y = i
+		}
+		pix := img.Pix[y*img.Stride:]
+		for x := 0; x < header.width; x++ {
+			var c color.NRGBA
+			switch header.bpp {
+			case 1, 4, 8:
+				bit := x * header.bpp
+				index := int(row[bit/8]>>(8-header.bpp-bit%8)) & (1<<header.bpp - 1)
+				if index >= len(header.palette) {
+					return nil, errors.New("Invalid BMP palette index")
+				}
+				c = color.NRGBAModel.Convert(header.palette[index]).(color.NRGBA)
+			default:
+				var value uint32
+				for b := 0; b < header.bpp/8; b++ {
+					value |= uint32(row[x*header.bpp/8+b]) << (8 * b)
+				}
+				c = color.NRGBA{maskedBmp(value, header.masks[0]), maskedBmp(value, header.masks[1]), maskedBmp(value, header.masks[2]), 0xff}
+				if header.masks[3] != 0 {
+					c.A = maskedBmp(value, header.masks[3])
+				}
+			}
+			pix[4*x], pix[4*x+1], pix[4*x+2], pix[4*x+3] = c.R, c.G, c.B, c.A
+		}
+	}
+	return img, nil
+}
+
+// maskedBmp scales the bits of a value selected by mask to a byte.
+func maskedBmp(value uint32, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	value = (value & mask) >> bits.TrailingZeros32(mask)
+	width := bits.OnesCount32(mask)
+	if width >= 8 {
+		return uint8(value >> (width - 8))
+	}
+	// Repeat the bits to fill the byte, so that full scale is 255
+	scaled := uint32(0)
+	for shift := 8 - width; shift > -width; shift -= width {
+		if shift >= 0 {
+			scaled |= value << shift
+		} else {
+			scaled |= value >> -shift
+		}
+	}
+	return uint8(scaled)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// Canary is a new version of the command for a type of calculation, run
+// alongside the command for Percent of its calculations so that its results
+// can be compared before it replaces the command. Only the command's result
+// is sent; the differences are added to its logs and sent to webhooks in a
+// "canary" event.
+type Canary struct {
+	Type    string  `json:"type"`
+	Command string  `json:"command"`
+	Percent float64 `json:"percent"`
+	// Tolerance is the relative difference allowed between numbers.
+	Tolerance float64 `json:"tolerance"`
+}
+
+func (canary *Canary) Validate() error {
+	if len(canary.Command) == 0 {
+		return errors.New("Canary for type " + canary.Type + " has no command")
+	}
+	if canary.Percent < 0 || canary.Percent > 100 {
+		return errors.New("Canary for type " + canary.Type + " has a percentage outside 0 to 100")
+	}
+	if canary.Tolerance < 0 {
+		return errors.New("Canary for type " + canary.Type + " has a negative tolerance")
+	}
+	return nil
+}
+
+// CanaryFor returns the canary to run for a calculation of a type, if it is
+// one of those chosen to run it.
+func (config *Config) CanaryFor(calculationType string) *Canary {
+	for i := range config.Canaries {
+		canary := &config.Canaries[i]
+		if canary.Type == calculationType && rand.Float64()*100 < canary.Percent {
+			return canary
+		}
+	}
+	return nil
+}
+
+// CanaryReport is how the result of a canary differed from that of the
+// command.
+type CanaryReport struct {
+	Command     string   `json:"command"`
+	ExitCode    int      `json:"exitCode"`
+	Differences []string `json:"differences"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// CanaryRun is a canary running in a workspace of its own.
+type CanaryRun struct {
+	Canary   *Canary
+	Dir      string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	exitCode int
+	response *patchwork.CalculationResponse
+	err      error
+}
+
+// StartCanary expands the inputs of a calculation into a new workspace next
+// to dirpath and runs the canary in it, in the background. Its outputs are
+// kept in the workspace rather than uploaded anywhere.
+func StartCanary(ctx context.Context, config *Config, logger *log.Logger, canary *Canary, dirpath string, calcContext patchwork.CalculationContext, host string, token string) *CanaryRun {
+	ctx, cancel := context.WithCancel(ctx)
+	run := &CanaryRun{Canary: canary, cancel: cancel, done: make(chan struct{})}
+	canaryConfig := *config
+	canaryConfig.ArtefactStore = ""
+	go func() {
+		defer close(run.done)
+		run.Dir, run.err = os.MkdirTemp(filepath.Dir(dirpath), "canary")
+		if run.err != nil {
+			return
+		}
+		logger.Println("Running canary " + canary.Command + " in " + run.Dir)
+		run.exitCode, run.response, run.err = RunInWorkspace(ctx, &canaryConfig, logger, canary.Command, run.Dir, calcContext, host, token)
+	}()
+	return run
+}
+
+// Compare waits for the canary to finish and reports how its result differs
+// from the command's.
+func (run *CanaryRun) Compare(exitCode int, response *patchwork.CalculationResponse) CanaryReport {
+	<-run.done
+	report := CanaryReport{Command: run.Canary.Command, ExitCode: run.exitCode, Differences: make([]string, 0)}
+	if run.err != nil {
+		report.Errors = []string{run.err.Error()}
+		return report
+	}
+	if exitCode != run.exitCode {
+		report.Differences = append(report.Differences, "exit code "+strconv.Itoa(exitCode)+", canary "+strconv.Itoa(run.exitCode))
+	}
+	report.Errors = run.response.Errors
+	report.Differences = append(report.Differences, DiffOutputs(response.Outputs, run.response.Outputs, "canary", run.Canary.Tolerance)...)
+	return report
+}
+
+// Remove stops the canary if it is still running and removes its workspace.
+func (run *CanaryRun) Remove() {
+	run.cancel()
+	<-run.done
+	if len(run.Dir) > 0 {
+		os.RemoveAll(run.Dir)
+	}
+}
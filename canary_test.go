@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestCanaryRun(t *testing.T) {
+	dirpath := filepath.Join(t.TempDir(), "workspace")
+	os.Mkdir(dirpath, 0755)
+	config := &Config{}
+	logger := log.New(os.Stdout, "", 0)
+	canary := &Canary{Type: "beam", Command: "echo 2 > out.txt; exit 1", Percent: 100}
+	run := StartCanary(context.Background(), config, logger, canary, dirpath, patchwork.CalculationContext{}, "", "")
+	defer run.Remove()
+
+	os.WriteFile(filepath.Join(dirpath, "out.txt"), []byte("1\n"), 0644)
+	response := &patchwork.CalculationResponse{Outputs: map[string]interface{}{
+		"out.txt": patchwork.Artefact{Name: "out.txt", Path: filepath.Join(dirpath, "out.txt")},
+	}}
+	report := run.Compare(0, response)
+	expected := []string{"exit code 0, canary 1", "output out.txt: content differs from canary"}
+	if !reflect.DeepEqual(report.Differences, expected) {
+		t.Errorf("Expected %v, got %v (errors %v)", expected, report.Differences, report.Errors)
+	}
+	run.Remove()
+	if _, err := os.Stat(run.Dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the canary workspace to be removed")
+	}
+}
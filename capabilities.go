@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Capabilities describes what an agent accepts and how it is configured, so
+// that a dispatcher can route calculations across agents of different
+// versions and configurations.
+type Capabilities struct {
+	AgentId        string             `json:"agentId"`
+	Version        string             `json:"version"`
+	ApiVersions    []int              `json:"apiVersions"`
+	PayloadFormats []string           `json:"payloadFormats"`
+	InputSchemes   []string           `json:"inputSchemes"`
+	Hosts          []string           `json:"hosts"`
+	Plugins        []PluginCapability `json:"plugins"`
+	Limits         Limits             `json:"limits"`
+	Features       []string           `json:"features"`
+}
+
+type PluginCapability struct {
+	Name    string   `json:"name"`
+	Inputs  []string `json:"inputs,omitempty"`
+	Outputs []string `json:"outputs,omitempty"`
+}
+
+// Limits are in bytes and seconds, 0 meaning unlimited.
+type Limits struct {
+	Concurrency         int   `json:"concurrency"`
+	MaxOutstanding      int   `json:"maxOutstanding"`
+	MaxWait             int   `json:"maxWait"`
+	Timeout             int   `json:"timeout"`
+	MaxTimeout          int   `json:"maxTimeout"`
+	MaxJsonSize         int   `json:"maxJsonSize"`
+	MaxOutputSize       int64 `json:"maxOutputSize"`
+	MaxOutputFiles      int   `json:"maxOutputFiles"`
+	MaxInlineSize       int64 `json:"maxInlineSize,omitempty"`
+	PresignedUploadSize int64 `json:"presignedUploadSize,omitempty"`
+}
+
+// NewCapabilities describes a server with the default host, concurrency and
+// timeout it was started with.
+func NewCapabilities(config *Config, host string, concurrency int, timeout int) Capabilities {
+	capabilities := Capabilities{
+		AgentId:     config.AgentId,
+		Version:     Version,
+		ApiVersions: make([]int, 0),
+		// A calculation id, a CalculationPayload or a Pub/Sub push message
+		PayloadFormats: []string{"id", "payload", "pubsub"},
+		InputSchemes:   []string{"data", "http", "https", "s3", "gs", "azure", "ftp", "sftp"},
+		Hosts:          make([]string, 0),
+		Plugins:        make([]PluginCapability, 0),
+		Limits: Limits{
+			Concurrency:         concurrency,
+			MaxOutstanding:      config.MaxOutstanding,
+			MaxWait:             config.MaxWait,
+			Timeout:             timeout,
+			MaxTimeout:          config.MaxTimeout,
+			MaxJsonSize:         config.MaxJsonSize,
+			MaxOutputSize:       config.MaxOutputSize,
+			MaxOutputFiles:      config.MaxOutputFiles,
+			MaxInlineSize:       config.MaxInlineSize,
+			PresignedUploadSize: config.PresignedUploadSize,
+		},
+		Features: []string{"affinity", "callback", "timeoutOverride"},
+	}
+	if capabilities.Limits.MaxOutstanding > 0 && capabilities.Limits.MaxOutstanding < concurrency {
+		capabilities.Limits.MaxOutstanding = concurrency
+	}
+	if capabilities.Limits.MaxTimeout <= 0 {
+		capabilities.Limits.MaxTimeout = timeout
+	}
+	for version := MinApiVersion; version <= ApiVersion; version++ {
+		capabilities.ApiVersions = append(capabilities.ApiVersions, version)
+	}
+	if len(host) > 0 {
+		capabilities.Hosts = append(capabilities.Hosts, host)
+	}
+	for _, tenant := range config.Tenants {
+		capabilities.Hosts = append(capabilities.Hosts, tenant.Host)
+	}
+	for _, plugin := range config.Plugins {
+		capabilities.Plugins = append(capabilities.Plugins, PluginCapability{Name: plugin.Name, Inputs: plugin.Inputs, Outputs: plugin.Outputs})
+	}
+	for feature, enabled := range map[string]bool{
+		"artefactStore":    len(config.ArtefactStore) > 0,
+		"presignedUpload":  config.PresignedUploadSize > 0,
+		"chunkedUpload":    config.ChunkedUploadSize > 0,
+		"deltaUpload":      config.DeltaUploadSize > 0,
+		"inputArchives":    !config.KeepInputArchives,
+		"gitInputs":        GitAvailable(),
+		"licenseRetry":     config.LicenseRetry != nil,
+		"pathTranslation":  config.PathTranslation != nil,
+		"prefetch":         config.Prefetch > 0,
+		"selfTest":         config.SelfTest != nil,
+		"separateOutputs":  config.SeparateOutputs,
+		"outputOverflow":   config.OutputOverflow == "tar",
+		"directoryOutputs": len(config.DirectoryOutputs) > 0,
+		"webhooks":         len(config.Webhooks) > 0,
+		"costReport":       config.CostReport != nil,
+		"mutualTls":        len(config.TlsClientCa) > 0,
+		"scalarsFirst":     config.ScalarsFirst,
+	} {
+		if enabled {
+			capabilities.Features = append(capabilities.Features, feature)
+		}
+	}
+	sort.Strings(capabilities.Features)
+	return capabilities
+}
+
+// CapabilitiesHandler serves the capabilities of the server.
+func CapabilitiesHandler(capabilities Capabilities) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if "GET" != request.Method {
+			writer.WriteHeader(404)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(capabilities)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	config := &Config{
+		AgentId:        "agent-1",
+		MaxOutstanding: 1,
+		MaxOutputSize:  1000,
+		ArtefactStore:  "s3://bucket/prefix",
+		Tenants:        []Tenant{{Host: "https://tenant.example", Token: "secret"}},
+		Plugins:        []Plugin{{Name: "unzip", Inputs: []string{"*.zip"}}},
+	}
+	recorder := httptest.NewRecorder()
+	CapabilitiesHandler(NewCapabilities(config, "https://host.example", 2, 600))(recorder, httptest.NewRequest("GET", "/capabilities", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	var capabilities Capabilities
+	if err := json.Unmarshal(recorder.Body.Bytes(), &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	if capabilities.AgentId != "agent-1" || len(capabilities.Hosts) != 2 || capabilities.Hosts[1] != "https://tenant.example" {
+		t.Errorf("Unexpected agent or hosts in %+v", capabilities)
+	}
+	if len(capabilities.Plugins) != 1 || capabilities.Plugins[0].Name != "unzip" {
+		t.Errorf("Unexpected plugins %+v", capabilities.Plugins)
+	}
+	limits := capabilities.Limits
+	if limits.Concurrency != 2 || limits.MaxOutstanding != 2 || limits.MaxTimeout != 600 || limits.MaxOutputSize != 1000 {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+	features := map[string]bool{}
+	for _, feature := range capabilities.Features {
+		features[feature] = true
+	}
+	if !features["artefactStore"] || !features["inputArchives"] || features["presignedUpload"] {
+		t.Errorf("Unexpected features %v", capabilities.Features)
+	}
+	if strings.Contains(recorder.Body.String(), "secret") {
+		t.Error("Tenant token leaked in capabilities")
+	}
+
+	recorder = httptest.NewRecorder()
+	CapabilitiesHandler(capabilities)(recorder, httptest.NewRequest("POST", "/capabilities", nil))
+	if recorder.Code != 404 {
+		t.Errorf("Expected 404 for POST, got %d", recorder.Code)
+	}
+}
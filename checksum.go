@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// ChecksumArtefact sets the size and SHA-256 of an artefact from the file it
+// was made from.
+func ChecksumArtefact(artefact *patchwork.Artefact, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	artefact.Size = info.Size()
+	artefact.Sha256 = hash
+	return nil
+}
+
+// VerifyArtefact checks that a file read from an artefact has the size and
+// SHA-256 given by the artefact, if any, as a payload truncated on the way
+// would otherwise be run silently.
+func VerifyArtefact(path string, artefact patchwork.Artefact) error {
+	if artefact.Size > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if info.Size() != artefact.Size {
+			return errors.New("Artefact " + artefact.Name + " is " + strconv.FormatInt(info.Size(), 10) + " bytes, expected " + strconv.FormatInt(artefact.Size, 10))
+		}
+	}
+	if len(artefact.Sha256) > 0 {
+		hash, err := HashFile(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if hash != strings.ToLower(artefact.Sha256) {
+			return errors.New("Artefact " + artefact.Name + " has SHA-256 " + hash + ", expected " + artefact.Sha256)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyArtefact(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "beam.inp"), []byte("*NODE\n1, 0, 0\n"), 0644)
+	artefact, err := MakeArtefact(context.Background(), &Config{}, logger, nil, filepath.Join(dir, "beam.inp"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	sum := sha256.Sum256([]byte("*NODE\n1, 0, 0\n"))
+	if artefact.Size != 14 || artefact.Sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected %+v", artefact)
+	}
+
+	// The artefact as the dispatcher sends it, encoded, and then truncated
+	content := map[string]interface{}{"name": "beam.inp", "contentType": "text/plain", "uri": "data:text/plain;base64,Kk5PREUKMSwgMCwgMAo=", "size": float64(14), "sha256": artefact.Sha256}
+	if ok, err := HandleAsArtefact(context.Background(), &Config{}, logger, t.TempDir(), "mesh", "mesh.inp", content); !ok || err != nil {
+		t.Fatalf("%v %+v", ok, err)
+	}
+	content["uri"] = "data:text/plain;base64,Kk5PREUKMSwgMCwg"
+	if _, err := HandleAsArtefact(context.Background(), &Config{}, logger, t.TempDir(), "mesh", "mesh.inp", content); err == nil || !strings.Contains(err.Error(), "is 12 bytes, expected 14") {
+		t.Errorf("Unexpected %v", err)
+	}
+	delete(content, "size")
+	if _, err := HandleAsArtefact(context.Background(), &Config{}, logger, t.TempDir(), "mesh", "mesh.inp", content); err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("Unexpected %v", err)
+	}
+
+	// Artefacts without checksums are read as before
+	delete(content, "sha256")
+	if _, err := HandleAsArtefact(context.Background(), &Config{}, logger, t.TempDir(), "mesh", "mesh.inp", content); err != nil {
+		t.Errorf("%+v", err)
+	}
+}
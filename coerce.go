@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxCoercedSize is the size of the largest text file returned as a value.
+const maxCoercedSize = 4096
+
+// CoerceOutputFile returns the value in a small .txt or .csv output file, if
+// it holds a single value, or for a .csv file a single row or column, or for
+// a .txt file a number on each line. Numbers are returned as JSON numbers and
+// anything else as strings, in an array if there is more than one. ok is
+// false for any other file, to be returned as an artefact.
+func CoerceOutputFile(file string) (value interface{}, ok bool) {
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext != ".txt" && ext != ".csv" {
+		return nil, false
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.Size() > maxCoercedSize {
+		return nil, false
+	}
+	data, err := ReadOutput(file)
+	if err != nil || !isText(data) {
+		return nil, false
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, false
+	}
+	if ext == ".csv" {
+		return coerceCsv(data)
+	}
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(string(data), "\r\n", "\n")), "\n")
+	if len(lines) == 1 {
+		return coerceValue(lines[0]), true
+	}
+	values := make([]interface{}, len(lines))
+	for i, line := range lines {
+		number, isNumber := coerceNumber(line)
+		if !isNumber {
+			return nil, false
+		}
+		values[i] = number
+	}
+	return values, true
+}
+
+func coerceCsv(data []byte) (interface{}, bool) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, false
+	}
+	cells := make([]string, 0)
+	switch {
+	case len(records) == 1:
+		cells = records[0]
+	default:
+		for _, record := range records {
+			if len(record) != 1 {
+				return nil, false
+			}
+			cells = append(cells, record[0])
+		}
+	}
+	if len(cells) == 1 {
+		return coerceValue(cells[0]), true
+	}
+	values := make([]interface{}, len(cells))
+	for i, cell := range cells {
+		values[i] = coerceValue(cell)
+	}
+	return values, true
+}
+
+// coerceValue returns text as a number if it is one, or else as a string.
+func coerceValue(text string) interface{} {
+	if number, ok := coerceNumber(text); ok {
+		return number
+	}
+	return strings.TrimSpace(text)
+}
+
+// coerceNumber returns text as a JSON number, as written if it is valid JSON,
+// such as 3.14 or 1e-6, or parsed if not, such as .5 or +2. Infinities and
+// NaN aren't numbers in JSON.
+func coerceNumber(text string) (interface{}, bool) {
+	text = strings.TrimSpace(text)
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, false
+	}
+	var number json.Number
+	if json.Unmarshal([]byte(text), &number) == nil {
+		return json.Number(text), true
+	}
+	return f, true
+}
+
+// isText reports whether data looks like text rather than binary, having no
+// NUL bytes and being valid UTF-8.
+func isText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
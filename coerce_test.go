@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoerceOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, test := range map[string]struct {
+		content string
+		value   interface{}
+	}{
+		"pi.txt":        {"3.14\n", json.Number("3.14")},
+		"half.txt":      {" .5 ", 0.5},
+		"status.txt":    {"converged\r\n", "converged"},
+		"modes.txt":     {"12.1\n30.5\r\n61\n", []interface{}{json.Number("12.1"), json.Number("30.5"), json.Number("61")}},
+		"row.csv":       {"\xef\xbb\xbf1, 2e3,steel\n", []interface{}{json.Number("1"), json.Number("2e3"), "steel"}},
+		"column.csv":    {"mass\n12.5\n", []interface{}{"mass", json.Number("12.5")}},
+		"cell.csv":      {"-4\n", json.Number("-4")},
+		"quoted.csv":    {"\"a, b\"\n", "a, b"},
+		"notes.txt":     {"first\nsecond\n", nil},
+		"table.csv":     {"a,b\n1,2\n", nil},
+		"empty.txt":     {"\n", nil},
+		"inf.txt":       {"inf", "inf"},
+		"binary.txt":    {"1\x002", nil},
+		"large.txt":     {strings.Repeat("1\n", maxCoercedSize), nil},
+		"result.dat":    {"1", nil},
+		"unbalance.csv": {"\"a\n", nil},
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(test.content), 0644)
+		value, ok := CoerceOutputFile(path)
+		if ok != (test.value != nil) || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s should be %#v, was %#v %v", name, test.value, value, ok)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CommandMap is the command run for each type of calculation, which is
+// reloaded while the server runs so that a fleet can take on new types of
+// calculation without being redeployed.
+type CommandMap struct {
+	mutex    sync.RWMutex
+	commands map[string]string
+}
+
+func NewCommandMap(commands map[string]string) *CommandMap {
+	return &CommandMap{commands: commands}
+}
+
+func (commandMap *CommandMap) Get(calculationType string) (string, bool) {
+	commandMap.mutex.RLock()
+	defer commandMap.mutex.RUnlock()
+	command, ok := commandMap.commands[calculationType]
+	return command, ok
+}
+
+func (commandMap *CommandMap) Set(commands map[string]string) {
+	commandMap.mutex.Lock()
+	defer commandMap.mutex.Unlock()
+	commandMap.commands = commands
+}
+
+// CommandFor returns the command to run for a type of calculation, or the
+// default command if none is configured for it.
+func (config *Config) CommandFor(calculationType string, command string) string {
+	if config.commandMap != nil {
+		if mapped, ok := config.commandMap.Get(calculationType); ok {
+			return mapped
+		}
+		return command
+	}
+	if mapped, ok := config.Commands[calculationType]; ok {
+		return mapped
+	}
+	return command
+}
+
+func ValidateCommandsSource(config *Config) error {
+	source := config.CommandsSource
+	if len(source) == 0 || (strings.HasPrefix(source, "file:") && len(source) > len("file:")) || IsHTTPURL(source) {
+		return nil
+	}
+	return errors.New("Unknown commands source " + source)
+}
+
+// LoadCommands reads the command map from CommandsSource, a JSON object of
+// commands by calculation type in a file:<path> or at an http(s) URL, or
+// else from the commands of the config, loaded again.
+func LoadCommands(ctx context.Context, config *Config) (map[string]string, error) {
+	commands := make(map[string]string)
+	source := config.CommandsSource
+	if len(source) == 0 {
+		if config.reload == nil {
+			return config.Commands, nil
+		}
+		reloaded, err := config.reload(ctx)
+		if err != nil {
+			return commands, errors.WithStack(err)
+		}
+		return reloaded.Commands, nil
+	}
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "file:") {
+		data, err = os.ReadFile(strings.TrimPrefix(source, "file:"))
+	} else {
+		data, err = fetchCommands(ctx, config, source)
+	}
+	if err != nil {
+		return commands, errors.WithStack(err)
+	}
+	err = json.Unmarshal(data, &commands)
+	return commands, errors.Wrap(err, "Invalid commands from "+WithoutQuery(source))
+}
+
+func fetchCommands(ctx context.Context, config *Config, source string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if auth, ok := artefactAuthFor(config, source); ok {
+		request.Header.Set("Authorization", auth.Authorization)
+	}
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, errors.New("Could not fetch commands from " + WithoutQuery(source) + ": " + response.Status)
+	}
+	data, err := io.ReadAll(response.Body)
+	return data, errors.WithStack(err)
+}
+
+// ReloadCommands replaces the command map, set up by WatchCommands, with
+// that from its source. If it can't be loaded, the commands in use are kept.
+func ReloadCommands(ctx context.Context, config *Config) {
+	commands, err := LoadCommands(ctx, config)
+	if err != nil {
+		log.Println("Could not reload commands, keeping those in use: " + err.Error())
+		return
+	}
+	config.commandMap.Set(commands)
+	log.Println("Loaded commands for " + strconv.Itoa(len(commands)) + " calculation types")
+}
+
+// WatchCommands sets up the command map to be reloaded on SIGHUP, and every
+// CommandsRefresh seconds if set, until ctx is done. It must be called before
+// any calculation is run.
+func WatchCommands(ctx context.Context, config *Config) {
+	config.commandMap = NewCommandMap(config.Commands)
+	if len(config.CommandsSource) > 0 {
+		ReloadCommands(ctx, config)
+	}
+	go watchCommands(ctx, config)
+}
+
+func watchCommands(ctx context.Context, config *Config) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	var refresh <-chan time.Time
+	if config.CommandsRefresh > 0 {
+		ticker := time.NewTicker(time.Second * time.Duration(config.CommandsRefresh))
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Println("Reloading commands on SIGHUP")
+			ReloadCommands(ctx, config)
+		case <-refresh:
+			ReloadCommands(ctx, config)
+		}
+	}
+}
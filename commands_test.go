@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"commands": {"beam": "beam-solver {inputs}"}}`), 0644)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	WatchCommands(ctx, config)
+	if command := config.CommandFor("beam", "default"); command != "beam-solver {inputs}" {
+		t.Errorf("Expected the beam command, got %s", command)
+	}
+	if command := config.CommandFor("plate", "default"); command != "default" {
+		t.Errorf("Expected the default command, got %s", command)
+	}
+
+	os.WriteFile(path, []byte(`{"commands": {"beam": "beam-solver", "plate": "plate-solver"}}`), 0644)
+	ReloadCommands(ctx, config)
+	if command := config.CommandFor("plate", "default"); command != "plate-solver" {
+		t.Errorf("Expected the reloaded plate command, got %s", command)
+	}
+	os.WriteFile(path, []byte(`{"commands": {"plate": 3}}`), 0644)
+	ReloadCommands(ctx, config)
+	if command := config.CommandFor("plate", "default"); command != "plate-solver" {
+		t.Errorf("Expected the commands kept after an invalid config, got %s", command)
+	}
+}
+
+func TestReloadCommandsFromURL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	commands := `{"beam": "beam-solver"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fleet" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(commands))
+	}))
+	defer server.Close()
+	config := &Config{
+		CommandsSource: server.URL + "/commands.json",
+		ArtefactAuth:   []ArtefactAuth{{Prefix: server.URL, Authorization: "Bearer fleet"}},
+	}
+	WatchCommands(ctx, config)
+	if command := config.CommandFor("beam", "default"); command != "beam-solver" {
+		t.Errorf("Expected the commands loaded at startup, got %s", command)
+	}
+	commands = `{"beam": "beam-solver-2"}`
+	ReloadCommands(ctx, config)
+	if command := config.CommandFor("beam", "default"); command != "beam-solver-2" {
+		t.Errorf("Expected the reloaded command, got %s", command)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// CompactJson rewrites a JSON document without whitespace, rounding every
+// non-integer number to the given number of significant digits. Integers are
+// left untouched.
+func CompactJson(data []byte, precision int) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return data, errors.WithStack(err)
+	}
+	out, err := json.Marshal(RoundNumbers(doc, precision))
+	return out, errors.WithStack(err)
+}
+
+func RoundNumbers(value interface{}, precision int) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		s := v.String()
+		if !strings.ContainsAny(s, ".eE") {
+			return v
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return v
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', precision, 64))
+	case []interface{}:
+		for i := range v {
+			v[i] = RoundNumbers(v[i], precision)
+		}
+		return v
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = RoundNumbers(v[key], precision)
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+// SummariseJson describes the top level of a JSON document: its type, size
+// in bytes, and its keys (for an object) or length (for an array).
+func SummariseJson(data []byte) map[string]interface{} {
+	summary := map[string]interface{}{"size": len(data)}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return summary
+	}
+	switch token {
+	case json.Delim('{'):
+		summary["type"] = "object"
+		keys := make([]string, 0)
+		for decoder.More() {
+			key, err := decoder.Token()
+			if err != nil {
+				return summary
+			}
+			var value json.RawMessage
+			if decoder.Decode(&value) != nil {
+				return summary
+			}
+			keys = append(keys, key.(string))
+		}
+		summary["keys"] = keys
+	case json.Delim('['):
+		summary["type"] = "array"
+		length := 0
+		for decoder.More() {
+			var value json.RawMessage
+			if decoder.Decode(&value) != nil {
+				return summary
+			}
+			length++
+		}
+		summary["length"] = length
+	default:
+		summary["type"] = "scalar"
+	}
+	return summary
+}
+
+// MakeJsonArtefact returns a JSON output as an artefact rather than inline,
+// sent as any other output file is, with a summary of its content. Compacted
+// data is written to a new file of the same name first, to be sent instead.
+func MakeJsonArtefact(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, path string, data []byte, compacted bool) (patchwork.Artefact, error) {
+	logger.Println("Converting large JSON file to Artefact")
+	if compacted {
+		dir, err := os.MkdirTemp(filepath.Dir(path), ".json")
+		if err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+		path = filepath.Join(dir, filepath.Base(path))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+	}
+	artefact, err := MakeArtefact(ctx, config, logger, presigner, path)
+	if err != nil {
+		return artefact, errors.WithStack(err)
+	}
+	// The keys of an encrypted document aren't given away
+	if config.Encryption == nil {
+		artefact.Summary = SummariseJson(data)
+	}
+	return artefact, nil
+}
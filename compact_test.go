@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestLargeJsonOutput(t *testing.T) {
+	objects, _ := NewStubS3(t)
+	config := &Config{ArtefactStore: "s3://results/runs/", MaxInlineSize: 10, MaxJsonSize: 20, JsonPrecision: 3}
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "field.json")
+	os.WriteFile(file, []byte(`{"pressure": [1.23456, 2.34567, 3.45678], "steps": 3}`), 0644)
+
+	value, err := HandleOutputFile(context.Background(), config, logger, nil, file)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	artefact, ok := value.(patchwork.Artefact)
+	if !ok {
+		t.Fatalf("Expected an artefact, got %T", value)
+	}
+	if !strings.HasPrefix(artefact.Uri, "s3://results/runs/") || artefact.Name != "field.json" || len(artefact.Sha256) == 0 {
+		t.Fatalf("Expected field.json uploaded to the store, got %+v", artefact)
+	}
+	if keys := artefact.Summary["keys"]; !reflect.DeepEqual(keys, []string{"pressure", "steps"}) {
+		t.Errorf("Expected the keys in the summary, got %v", artefact.Summary)
+	}
+	for _, data := range objects {
+		if string(data) != `{"pressure":[1.23,2.35,3.46],"steps":3}` {
+			t.Errorf("Expected the compacted JSON uploaded, got %s", data)
+		}
+	}
+	if data, _ := os.ReadFile(file); !strings.Contains(string(data), "1.23456") {
+		t.Errorf("Expected the output file to be left as written, got %s", data)
+	}
+
+	// Small documents are still returned inline
+	small := filepath.Join(dir, "small.json")
+	os.WriteFile(small, []byte(`{"a": 1}`), 0644)
+	if value, err := HandleOutputFile(context.Background(), config, logger, nil, small); err != nil || string(value.(json.RawMessage)) != `{"a":1}` {
+		t.Errorf("Expected small.json inline, got %v %v", value, err)
+	}
+}
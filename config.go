@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mime"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the optional agent configuration, loaded from the JSON file
+// given with -config.
+type Config struct {
+	OutputRules          []OutputRule       `json:"outputRules"`
+	ExitCodes            map[string]string  `json:"exitCodes"`
+	LicenseRetry         *LicenseRetry      `json:"licenseRetry"`
+	SelfTest             *SelfTest          `json:"selfTest"`
+	PathTranslation      *PathTranslation   `json:"pathTranslation"`
+	Plugins              []Plugin           `json:"plugins"`
+	Tenants              []Tenant           `json:"tenants"`
+	WasmRuntime          []string           `json:"wasmRuntime"`
+	MaxOutstanding       int                `json:"maxOutstanding"`
+	MaxWait              int                `json:"maxWait"`
+	Prefetch             int                `json:"prefetch"`
+	MaxTimeout           int                `json:"maxTimeout"`
+	AgentId              string             `json:"agentId"`
+	UserAgent            string             `json:"userAgent"`
+	Headers              map[string]string  `json:"headers"`
+	JsonPrecision        int                `json:"jsonPrecision"`
+	MaxJsonSize          int                `json:"maxJsonSize"`
+	SeparateOutputs      bool               `json:"separateOutputs"`
+	MaxOutputSize        int64              `json:"maxOutputSize"`
+	ResultSink           string             `json:"resultSink"`
+	ContextSource        string             `json:"contextSource"`
+	Webhooks             []Webhook          `json:"webhooks"`
+	CostReport           *CostReport        `json:"costReport"`
+	MaxJobsBeforeRestart int                `json:"maxJobsBeforeRestart"`
+	IdleTimeout          int                `json:"idleTimeout"`
+	ShutdownGracePeriod  int                `json:"shutdownGracePeriod"`
+	KeepFailedWorkspaces bool               `json:"keepFailedWorkspaces"`
+	MaxOutputFiles       int                `json:"maxOutputFiles"`
+	OutputOverflow       string             `json:"outputOverflow"`
+	ArtefactStore        string             `json:"artefactStore"`
+	MaxInlineSize        int64              `json:"maxInlineSize"`
+	KeepJunkFiles        bool               `json:"keepJunkFiles"`
+	ArtefactAuth         []ArtefactAuth     `json:"artefactAuth"`
+	PresignedUploadSize  int64              `json:"presignedUploadSize"`
+	ChunkedUploadSize    int64              `json:"chunkedUploadSize"`
+	ChunkSize            int64              `json:"chunkSize"`
+	DeltaUploadSize      int64              `json:"deltaUploadSize"`
+	OptimizeImages       bool               `json:"optimizeImages"`
+	MaxImageSize         int                `json:"maxImageSize"`
+	ValidateOutputs      bool               `json:"validateOutputs"`
+	OutputCollisions     string             `json:"outputCollisions"`
+	CoerceOutputs        bool               `json:"coerceOutputs"`
+	OutputReleaseWait    int                `json:"outputReleaseWait"`
+	SuccessResponse      string             `json:"successResponse"`
+	KeepInputArchives    bool               `json:"keepInputArchives"`
+	PreserveInputNames   bool               `json:"preserveInputNames"`
+	DirectoryOutputs     string             `json:"directoryOutputs"`
+	OutputDepth          int                `json:"outputDepth"`
+	OutputDetection      string             `json:"outputDetection"`
+	DedupeInputs         bool               `json:"dedupeInputs"`
+	Commands             map[string]string  `json:"commands"`
+	CommandsSource       string             `json:"commandsSource"`
+	CommandsRefresh      int                `json:"commandsRefresh"`
+	Command              string             `json:"command"`
+	Include              []string           `json:"include"`
+	Exclude              []string           `json:"exclude"`
+	Canaries             []Canary           `json:"canaries"`
+	CompressResults      bool               `json:"compressResults"`
+	MultipartResults     bool               `json:"multipartResults"`
+	ScalarsFirst         bool               `json:"scalarsFirst"`
+	MaxLogSize           int64              `json:"maxLogSize"`
+	InputCache           string             `json:"inputCache"`
+	Bandwidth            *Bandwidth         `json:"bandwidth"`
+	DeferredUploads      *DeferredUploads   `json:"deferredUploads"`
+	ContentTypes         map[string]string  `json:"contentTypes"`
+	DatasetOutputs       []DatasetOutput    `json:"datasetOutputs"`
+	DatasetExtractor     []string           `json:"datasetExtractor"`
+	SheetOutputs         []SheetOutput      `json:"sheetOutputs"`
+	Report               *Report            `json:"report"`
+	Keepalive            *Keepalive         `json:"keepalive"`
+	GitOutputs           *GitOutputs        `json:"gitOutputs"`
+	AdminAddress         string             `json:"adminAddress"`
+	TlsCert              string             `json:"tlsCert"`
+	TlsKey               string             `json:"tlsKey"`
+	TlsClientCa          string             `json:"tlsClientCa"`
+	Encryption           *Encryption        `json:"encryption"`
+	Middleware           []MiddlewareConfig `json:"middleware"`
+	// Executor runs the commands of calculations, or Executors those of the
+	// types given
+	Executor  *ExecutorConfig           `json:"executor"`
+	Executors map[string]ExecutorConfig `json:"executors"`
+	// ContentSignatures are tried before the built-in ones to detect the
+	// content type of artefacts, and ContentDetector, a command run with the
+	// path of a file, after them
+	ContentSignatures []ContentSignature `json:"contentSignatures"`
+	ContentDetector   []string           `json:"contentDetector"`
+	// reload loads the config again from where it came from, to reload
+	// commands from
+	reload     func(ctx context.Context) (*Config, error)
+	commandMap *CommandMap
+}
+
+func LoadConfig(path string) (*Config, error) {
+	if len(path) == 0 {
+		return &Config{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return &Config{}, errors.WithStack(err)
+	}
+	config, err := ParseConfig(data, "config file "+path)
+	config.reload = func(ctx context.Context) (*Config, error) {
+		return LoadConfig(path)
+	}
+	return config, err
+}
+
+// FetchConfig fetches the config from the host, for a fleet whose config
+// is managed centrally. The bootstrap config identifies the agent to the
+// host.
+func FetchConfig(ctx context.Context, bootstrap *Config, host string, token string) (*Config, error) {
+	client, err := NewClient(bootstrap, log.Default(), host, token)
+	if err != nil {
+		return &Config{}, errors.WithStack(err)
+	}
+	log.Println("Fetching config from " + host)
+	data, err := client.GetAgentConfig(ctx)
+	if err != nil {
+		return &Config{}, errors.Wrap(err, "Could not fetch config from "+host)
+	}
+	config, err := ParseConfig(data, "config from "+host)
+	config.reload = func(ctx context.Context) (*Config, error) {
+		return FetchConfig(ctx, bootstrap, host, token)
+	}
+	return config, err
+}
+
+// ParseConfig parses and validates the JSON of a config, which came from
+// source.
+func ParseConfig(data []byte, source string) (*Config, error) {
+	config := &Config{}
+	err := ValidateConfigSchema(data)
+	if err != nil {
+		return config, errors.Wrap(err, "Invalid "+source)
+	}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return config, errors.Wrap(err, "Invalid "+source)
+	}
+	for code := range config.ExitCodes {
+		if _, err := strconv.Atoi(code); err != nil {
+			return config, errors.New("Exit code " + code + " in " + source + " is not an integer")
+		}
+	}
+	if config.PathTranslation != nil {
+		err = config.PathTranslation.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.LicenseRetry != nil {
+		err = config.LicenseRetry.Compile()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for i := range config.Tenants {
+		err = config.Tenants[i].Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for i := range config.Plugins {
+		err = config.Plugins[i].Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	err = ValidateResultSink(config)
+	if err != nil {
+		return config, errors.WithStack(err)
+	}
+	err = ValidateContextSource(config)
+	if err != nil {
+		return config, errors.WithStack(err)
+	}
+	err = ValidateArtefactStore(config)
+	if err != nil {
+		return config, errors.WithStack(err)
+	}
+	err = ValidateCommandsSource(config)
+	if err != nil {
+		return config, errors.WithStack(err)
+	}
+	if config.Bandwidth != nil {
+		err = config.Bandwidth.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for ext, contentType := range config.ContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return config, errors.Wrap(err, "Invalid content type for "+ext)
+		}
+	}
+	for _, output := range config.DatasetOutputs {
+		err = output.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for _, output := range config.SheetOutputs {
+		err = output.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.Report != nil {
+		err = config.Report.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.Keepalive != nil {
+		err = config.Keepalive.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.GitOutputs != nil {
+		err = config.GitOutputs.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.Encryption != nil {
+		err = config.Encryption.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for _, middleware := range config.Middleware {
+		err = middleware.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.Executor != nil {
+		err = config.Executor.Validate(config)
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for _, executor := range config.Executors {
+		err = executor.Validate(config)
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for _, signature := range config.ContentSignatures {
+		err = signature.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.DeferredUploads != nil {
+		err = config.DeferredUploads.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	if config.CostReport != nil {
+		err = config.CostReport.Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for i := range config.ArtefactAuth {
+		err = config.ArtefactAuth[i].Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for i := range config.Canaries {
+		err = config.Canaries[i].Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for i := range config.Webhooks {
+		err = config.Webhooks[i].Validate()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for _, patterns := range [][]string{config.Include, config.Exclude} {
+		err = ValidatePatterns(patterns)
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	for i := range config.OutputRules {
+		err = config.OutputRules[i].Compile()
+		if err != nil {
+			return config, errors.WithStack(err)
+		}
+	}
+	return config, nil
+}
+
+// ExitCodeMessage returns the configured explanation for an exit code of the
+// wrapped command, if there is one.
+func (config *Config) ExitCodeMessage(code int) (string, bool) {
+	message, ok := config.ExitCodes[strconv.Itoa(code)]
+	return message, ok
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchConfig(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	agentConfig := `{"command": "solver {inputs}", "commands": {"beam": "beam-solver"}, "maxOutputFiles": 50,
+		"outputRules": [{"name": "mass", "regex": "Mass = (\\S+)"}]}`
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/agents/config" || r.Header.Get("X-Agent-Id") != "agent-7" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(agentConfig))
+	}))
+	defer host.Close()
+
+	config, err := FetchConfig(ctx, &Config{AgentId: "agent-7"}, host.URL, "token")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if config.Command != "solver {inputs}" || config.MaxOutputFiles != 50 || len(config.OutputRules) != 1 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if outputs := ExtractOutputs(config.OutputRules, "Mass = 12.5"); outputs["mass"] != 12.5 {
+		t.Errorf("Expected output rules compiled, got %v", outputs)
+	}
+
+	WatchCommands(ctx, config)
+	agentConfig = `{"commands": {"beam": "beam-solver-2"}}`
+	ReloadCommands(ctx, config)
+	if command := config.CommandFor("beam", config.Command); command != "beam-solver-2" {
+		t.Errorf("Expected commands reloaded from the host, got %s", command)
+	}
+
+	agentConfig = `{"maxOutputFiles": "lots"}`
+	_, err = FetchConfig(ctx, &Config{AgentId: "agent-7"}, host.URL, "token")
+	if err == nil || !strings.Contains(err.Error(), "maxOutputFiles: expected an integer") {
+		t.Errorf("Expected the invalid config rejected, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ContentSignature identifies files of a content type by bytes at an offset
+// in them, given as text in Magic or as Hex, or found anywhere in the part of
+// them sniffed if Search is set.
+type ContentSignature struct {
+	ContentType string `json:"contentType"`
+	Magic       string `json:"magic"`
+	Hex         string `json:"hex"`
+	Offset      int    `json:"offset"`
+	Search      bool   `json:"search"`
+}
+
+// sniffSize is how much of a file is read to detect its content type.
+const sniffSize = 4096
+
+// BuiltinSignatures identify engineering formats that http.DetectContentType
+// takes for text/plain or application/octet-stream. They are tried in order
+// after any configured ones, and before the content detector command.
+var BuiltinSignatures = []ContentSignature{
+	{ContentType: "model/step", Magic: "ISO-10303-21;"},
+	// Fixed-format IGES has the section and sequence number of each line in
+	// columns 73 to 80, starting with the start section
+	{ContentType: "model/iges", Magic: "S      1", Offset: 72},
+	{ContentType: "application/x-hdf5", Hex: "894844460d0a1a0a"},
+	{ContentType: "application/x-netcdf", Magic: "CDF\x01"},
+	{ContentType: "application/x-netcdf", Magic: "CDF\x02"},
+	{ContentType: "application/vnd.sqlite3", Magic: "SQLite format 3\x00"},
+	{ContentType: "application/vnd.apache.parquet", Magic: "PAR1"},
+	{ContentType: "application/x-vtk", Magic: "# vtk DataFile"},
+	{ContentType: "application/x-vtu+xml", Magic: `<VTKFile type="UnstructuredGrid"`, Search: true},
+	{ContentType: "application/x-vtk+xml", Magic: "<VTKFile", Search: true},
+	{ContentType: "model/x-gmsh", Magic: "$MeshFormat"},
+	{ContentType: "model/stl", Magic: "solid "},
+	{ContentType: "text/x-nastran", Magic: "BEGIN BULK", Search: true},
+}
+
+func (signature *ContentSignature) Validate() error {
+	if _, _, err := mime.ParseMediaType(signature.ContentType); err != nil {
+		return errors.Wrap(err, "Invalid content type "+signature.ContentType)
+	}
+	if (len(signature.Magic) > 0) == (len(signature.Hex) > 0) {
+		return errors.New("Content signature for " + signature.ContentType + " needs one of magic or hex")
+	}
+	if _, err := hex.DecodeString(signature.Hex); err != nil {
+		return errors.Wrap(err, "Invalid hex in content signature for "+signature.ContentType)
+	}
+	if signature.Offset < 0 {
+		return errors.New("Content signature offset can't be negative")
+	}
+	return nil
+}
+
+// Matches reports whether the start of a file has the signature.
+func (signature *ContentSignature) Matches(head []byte) bool {
+	magic := []byte(signature.Magic)
+	if len(signature.Hex) > 0 {
+		magic, _ = hex.DecodeString(signature.Hex)
+	}
+	if signature.Search {
+		return bytes.Contains(head, magic)
+	}
+	return len(head) >= signature.Offset && bytes.HasPrefix(head[signature.Offset:], magic)
+}
+
+// ArtefactContentType is the content type of an output file: that configured
+// for its extension, if any, otherwise detected from its content by the
+// configured then built-in signatures, the content detector command, and
+// finally http.DetectContentType.
+func ArtefactContentType(config *Config, path string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for pattern, contentType := range config.ContentTypes {
+		if strings.ToLower("."+strings.TrimPrefix(pattern, ".")) == ext {
+			return contentType, nil
+		}
+	}
+	head, err := readHead(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	for _, signatures := range [][]ContentSignature{config.ContentSignatures, BuiltinSignatures} {
+		if contentType, ok := matchSignatures(signatures, head); ok {
+			return contentType, nil
+		}
+	}
+	if len(config.ContentDetector) > 0 {
+		if contentType, ok := runContentDetector(config.ContentDetector, path); ok {
+			return contentType, nil
+		}
+	}
+	return http.DetectContentType(head), nil
+}
+
+// DetectFileContentType detects the content type of a file from its start,
+// by the built-in signatures or http.DetectContentType.
+func DetectFileContentType(path string) (string, error) {
+	head, err := readHead(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if contentType, ok := matchSignatures(BuiltinSignatures, head); ok {
+		return contentType, nil
+	}
+	return http.DetectContentType(head), nil
+}
+
+func matchSignatures(signatures []ContentSignature, head []byte) (string, bool) {
+	for _, signature := range signatures {
+		if signature.Matches(head) {
+			return signature.ContentType, true
+		}
+	}
+	return "", false
+}
+
+func readHead(path string) ([]byte, error) {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.WithStack(err)
+	}
+	return head[:n], nil
+}
+
+// runContentDetector runs a command such as file --brief --mime-type with the
+// path of a file appended, taking what it prints as the file's content type
+// unless it fails or prints something else.
+func runContentDetector(argv []string, path string) (string, bool) {
+	out, err := exec.Command(argv[0], append(argv[1:], path)...).Output()
+	if err != nil {
+		return "", false
+	}
+	contentType := strings.TrimSpace(string(out))
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		return "", false
+	}
+	return contentType, true
+}
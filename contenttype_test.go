@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArtefactContentType(t *testing.T) {
+	dir := t.TempDir()
+	iges := strings.Repeat(" ", 72) + "S      1\n"
+	for name, content := range map[string]string{
+		"part.STEP":  "ISO-10303-21;\nHEADER;\n",
+		"part.igs":   iges,
+		"result.h5":  "\x89HDF\r\n\x1a\n\x00\x00",
+		"mesh.vtu":   "<?xml version=\"1.0\"?>\n<VTKFile type=\"UnstructuredGrid\" version=\"0.1\">\n",
+		"model.bdf":  "SOL 101\nCEND\nBEGIN BULK\nGRID,1,,0.,0.,0.\n",
+		"notes.txt":  "notes",
+		"result.frd": "FRD 2\n",
+	} {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	config := &Config{
+		ContentTypes:      map[string]string{"step": "application/step"},
+		ContentSignatures: []ContentSignature{{ContentType: "application/x-calculix-frd", Magic: "FRD"}},
+	}
+	for name, expected := range map[string]string{
+		"part.STEP":  "application/step",
+		"part.igs":   "model/iges",
+		"result.h5":  "application/x-hdf5",
+		"mesh.vtu":   "application/x-vtu+xml",
+		"model.bdf":  "text/x-nastran",
+		"notes.txt":  "text/plain; charset=utf-8",
+		"result.frd": "application/x-calculix-frd",
+	} {
+		if contentType, err := ArtefactContentType(config, filepath.Join(dir, name)); err != nil || contentType != expected {
+			t.Errorf("Content type of %s should be %s, was %s %v", name, expected, contentType, err)
+		}
+	}
+	if contentType, _ := DetectFileContentType(filepath.Join(dir, "part.STEP")); contentType != "model/step" {
+		t.Errorf("STEP files should be detected by their signature, was %s", contentType)
+	}
+}
+
+func TestContentDetector(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	config := &Config{ContentDetector: []string{"sh", "-c", "echo text/x-notes", "sh"}}
+	if contentType, _ := ArtefactContentType(config, filepath.Join(dir, "notes.txt")); contentType != "text/x-notes" {
+		t.Errorf("Content type should be that printed by the detector, was %s", contentType)
+	}
+	// A detector that fails, or doesn't print a content type, is ignored
+	config.ContentDetector = []string{"false"}
+	if contentType, _ := ArtefactContentType(config, filepath.Join(dir, "notes.txt")); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("Failed detector should fall back to sniffing, was %s", contentType)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// DatasetOutput returns a dataset, or an attribute of one (of the file if
+// Dataset is empty), of HDF5 or NetCDF output files matching the glob
+// pattern File as the output Name, alongside the file itself.
+type DatasetOutput struct {
+	Name      string `json:"name"`
+	File      string `json:"file"`
+	Dataset   string `json:"dataset"`
+	Attribute string `json:"attribute"`
+}
+
+func (output *DatasetOutput) Validate() error {
+	if len(output.Name) == 0 {
+		return errors.New("Dataset output has no name")
+	}
+	if len(output.Dataset) == 0 && len(output.Attribute) == 0 {
+		return errors.New("Dataset output " + output.Name + " needs a dataset or attribute")
+	}
+	_, err := path.Match(output.File, "")
+	return errors.Wrap(err, "Dataset output "+output.Name+" file pattern "+output.File)
+}
+
+// SliceDatasets adds the dataset outputs of an output file to a response,
+// adding an error for any that can't be read.
+func SliceDatasets(config *Config, logger *log.Logger, name string, file string, response *patchwork.CalculationResponse) {
+	for _, output := range config.DatasetOutputs {
+		if matched, _ := path.Match(output.File, name); !matched {
+			continue
+		}
+		logger.Println("Reading output " + output.Name + " from " + name)
+		value, err := ReadDataset(config, file, output.Dataset, output.Attribute)
+		if err != nil {
+			logger.Println("Could not read output " + output.Name + ": " + err.Error())
+			response.AddErrors("Output " + output.Name + " could not be read from " + name + ": " + err.Error())
+			continue
+		}
+		AddOutput(config, logger, response, output.Name, value)
+	}
+}
+
+// ReadDataset reads a dataset or attribute of a NetCDF classic file, or of an
+// HDF5 (including NetCDF-4) file with the dataset extractor command.
+func ReadDataset(config *Config, file string, dataset string, attribute string) (interface{}, error) {
+	head, err := readHead(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if bytes.HasPrefix(head, []byte("CDF")) {
+		return ReadNetcdf(file, dataset, attribute)
+	}
+	if !bytes.HasPrefix(head, []byte("\x89HDF\r\n\x1a\n")) {
+		return nil, errors.New("Not an HDF5 or NetCDF file")
+	}
+	if len(config.DatasetExtractor) == 0 {
+		return nil, errors.New("Reading HDF5 files needs a dataset extractor")
+	}
+	if len(dataset) == 0 {
+		dataset = "/"
+	}
+	args := append(append([]string{}, config.DatasetExtractor[1:]...), file, dataset)
+	if len(attribute) > 0 {
+		args = append(args, attribute)
+	}
+	cmd := exec.Command(config.DatasetExtractor[0], args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "Dataset extractor failed")
+	}
+	var value interface{}
+	err = json.Unmarshal(out, &value)
+	return value, errors.Wrap(err, "Dataset extractor returned invalid JSON")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+// netcdfFixture writes a NetCDF classic file with a global title, a stress
+// variable of 3 doubles in MPa, and record variables t (float) and step (int)
+// of 2 records each.
+func netcdfFixture(t *testing.T, path string) {
+	u32 := func(buf *bytes.Buffer, v uint32) { binary.Write(buf, binary.BigEndian, v) }
+	name := func(buf *bytes.Buffer, s string) {
+		u32(buf, uint32(len(s)))
+		buf.WriteString(s)
+		buf.Write(make([]byte, padded(int64(len(s)))-int64(len(s))))
+	}
+	header := func(begin uint32) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("CDF\x01")
+		u32(&buf, 2)
+		u32(&buf, cdfDimensionTag)
+		u32(&buf, 2)
+		name(&buf, "x")
+		u32(&buf, 3)
+		name(&buf, "time")
+		u32(&buf, 0)
+		u32(&buf, cdfAttributeTag)
+		u32(&buf, 1)
+		name(&buf, "title")
+		u32(&buf, 2)
+		name(&buf, "beam")
+		u32(&buf, cdfVariableTag)
+		u32(&buf, 3)
+		// stress(x), double, with units
+		name(&buf, "stress")
+		u32(&buf, 1)
+		u32(&buf, 0)
+		u32(&buf, cdfAttributeTag)
+		u32(&buf, 1)
+		name(&buf, "units")
+		u32(&buf, 2)
+		name(&buf, "MPa")
+		u32(&buf, 6)
+		u32(&buf, 24)
+		u32(&buf, begin)
+		// t(time), float
+		name(&buf, "t")
+		u32(&buf, 1)
+		u32(&buf, 1)
+		u32(&buf, 0)
+		u32(&buf, 0)
+		u32(&buf, 5)
+		u32(&buf, 4)
+		u32(&buf, begin+24)
+		// step(time), int
+		name(&buf, "step")
+		u32(&buf, 1)
+		u32(&buf, 1)
+		u32(&buf, 0)
+		u32(&buf, 0)
+		u32(&buf, 4)
+		u32(&buf, 4)
+		u32(&buf, begin+28)
+		return buf.Bytes()
+	}
+	data := header(uint32(len(header(0))))
+	buf := bytes.NewBuffer(data)
+	binary.Write(buf, binary.BigEndian, []float64{1.5, math.NaN(), -2})
+	// Records interleave t and step
+	binary.Write(buf, binary.BigEndian, float32(0.5))
+	binary.Write(buf, binary.BigEndian, int32(10))
+	binary.Write(buf, binary.BigEndian, float32(1))
+	binary.Write(buf, binary.BigEndian, int32(20))
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadNetcdf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "result.nc")
+	netcdfFixture(t, path)
+	for _, test := range []struct {
+		dataset   string
+		attribute string
+		value     interface{}
+	}{
+		{"", "title", "beam"},
+		{"stress", "units", "MPa"},
+		{"stress", "", []interface{}{1.5, nil, -2.0}},
+		{"/t", "", []interface{}{0.5, 1.0}},
+		{"step", "", []interface{}{int32(10), int32(20)}},
+	} {
+		value, err := ReadNetcdf(path, test.dataset, test.attribute)
+		if err != nil || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("Reading %s %s should give %v, gave %v %v", test.dataset, test.attribute, test.value, value, err)
+		}
+	}
+	if _, err := ReadNetcdf(path, "strain", ""); err == nil {
+		t.Error("Reading a missing variable should fail")
+	}
+}
+
+func TestReadNetcdfOversized(t *testing.T) {
+	// A CDF-5 variable whose 64-bit dimensions multiply past the range of
+	// int64, wrapping around to a negative number of values
+	var buf bytes.Buffer
+	u32 := func(v uint32) { binary.Write(&buf, binary.BigEndian, v) }
+	u64 := func(v uint64) { binary.Write(&buf, binary.BigEndian, v) }
+	name := func(s string) {
+		u64(uint64(len(s)))
+		buf.WriteString(s)
+		buf.Write(make([]byte, padded(int64(len(s)))-int64(len(s))))
+	}
+	buf.WriteString("CDF\x05")
+	u64(0)
+	u32(cdfDimensionTag)
+	u64(2)
+	name("x")
+	u64(2)
+	name("y")
+	u64(1<<62 + 1)
+	u32(0)
+	u64(0)
+	u32(cdfVariableTag)
+	u64(1)
+	name("field")
+	u64(2)
+	u64(0)
+	u64(1)
+	u32(0)
+	u64(0)
+	u32(6)
+	u64(8)
+	u64(uint64(buf.Len() + 16))
+	path := filepath.Join(t.TempDir(), "corrupt.nc")
+	os.WriteFile(path, buf.Bytes(), 0644)
+	if _, err := ReadNetcdf(path, "field", ""); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Errorf("Expected an oversized variable to be refused, got %v", err)
+	}
+}
+
+func TestSliceDatasets(t *testing.T) {
+	dir := t.TempDir()
+	netcdfFixture(t, filepath.Join(dir, "result.nc"))
+	os.WriteFile(filepath.Join(dir, "model.h5"), []byte("\x89HDF\r\n\x1a\n"), 0644)
+	config := &Config{DatasetOutputs: []DatasetOutput{
+		{Name: "title", File: "*.nc", Attribute: "title"},
+		{Name: "steps", File: "*.nc", Dataset: "step"},
+		{Name: "mass", File: "*.h5", Dataset: "/summary/mass"},
+	}}
+	logger := log.New(io.Discard, "", 0)
+	response := patchwork.NewCalculationResponse()
+	SliceDatasets(config, logger, "result.nc", filepath.Join(dir, "result.nc"), response)
+	SliceDatasets(config, logger, "model.h5", filepath.Join(dir, "model.h5"), response)
+	if response.Outputs["title"] != "beam" || !reflect.DeepEqual(response.Outputs["steps"], []interface{}{int32(10), int32(20)}) {
+		t.Errorf("Unexpected outputs %v", response.Outputs)
+	}
+	if _, ok := response.Outputs["mass"]; ok || len(response.Errors) != 1 {
+		t.Errorf("HDF5 without an extractor should be an error, was %v", response.Errors)
+	}
+
+	config.DatasetExtractor = []string{"sh", "-c", `[ "$2" = /summary/mass ] && echo 12.5`, "sh"}
+	response = patchwork.NewCalculationResponse()
+	SliceDatasets(config, logger, "model.h5", filepath.Join(dir, "model.h5"), response)
+	if response.Outputs["mass"] != 12.5 {
+		t.Errorf("Expected mass from the extractor, was %v %v", response.Outputs, response.Errors)
+	}
+}
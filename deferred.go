@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// DeferredUploads holds back artefacts larger than Size, outside of Window,
+// queueing them in Dir to be uploaded in the window after the result (with a
+// pending reference to each) has been sent.
+type DeferredUploads struct {
+	Size   int64      `json:"size"`
+	Window TimeWindow `json:"window"`
+	Dir    string     `json:"dir"`
+}
+
+// PendingUri refers to an artefact that will be uploaded later.
+const PendingUri = patchwork.PendingUri
+
+// DeferredUploadFile describes a queued upload, next to its content.
+const DeferredUploadFile = "upload.json"
+
+// DeferredTokenFile holds the token of the calculation of a queued upload,
+// readable only by the agent, for hosts it has no configured token for.
+const DeferredTokenFile = "token"
+
+// DeferredUpload is an artefact queued to be uploaded in the window.
+type DeferredUpload struct {
+	Calculation string `json:"calculation"`
+	Host        string `json:"host"`
+	Output      string `json:"output"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	// Complete is set when the result was sent scalars first, for the last
+	// upload queued for the calculation to tell the host it has the whole
+	// result.
+	Complete bool `json:"complete,omitempty"`
+}
+
+func (deferred *DeferredUploads) Validate() error {
+	if len(deferred.Dir) == 0 {
+		return errors.New("Deferred uploads need a dir to queue them in")
+	}
+	if deferred.Size < 0 {
+		return errors.New("Deferred upload size can't be negative")
+	}
+	return errors.Wrap(deferred.Window.Validate(), "Deferred upload window")
+}
+
+// Defers reports whether an artefact of a size is to be uploaded later.
+func (deferred *DeferredUploads) Defers(size int64, now time.Time) bool {
+	return deferred != nil && size > deferred.Size && !deferred.Window.Covers(now)
+}
+
+// DeferUploads moves the content of the pending artefacts of a response to
+// the queue, leaving a reference without content in the response. With
+// complete, the host is told the result is complete once they are all sent.
+func DeferUploads(config *Config, logger *log.Logger, calculation string, host string, token string, complete bool, response *patchwork.CalculationResponse) error {
+	for output, value := range response.Outputs {
+		artefact, ok := value.(patchwork.Artefact)
+		if !ok || artefact.Uri != PendingUri || len(artefact.Path) == 0 {
+			continue
+		}
+		err := os.MkdirAll(config.DeferredUploads.Dir, 0755)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		dir, err := os.MkdirTemp(config.DeferredUploads.Dir, "upload")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		path, err := JoinWithin(dir, artefact.Name)
+		if err != nil {
+			os.RemoveAll(dir)
+			return errors.WithStack(err)
+		}
+		if os.Rename(artefact.Path, path) != nil {
+			if err = copyFile(artefact.Path, path); err != nil {
+				os.RemoveAll(dir)
+				return errors.WithStack(err)
+			}
+		}
+		data, err := json.Marshal(DeferredUpload{Calculation: calculation, Host: host, Output: output, Name: artefact.Name, ContentType: artefact.ContentType, Complete: complete})
+		if err == nil && len(token) > 0 {
+			err = os.WriteFile(filepath.Join(dir, DeferredTokenFile), []byte(token), 0600)
+		}
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, DeferredUploadFile), data, 0644)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return errors.WithStack(err)
+		}
+		logger.Println("Queued upload of " + output + " in " + dir)
+		response.Outputs[output] = patchwork.Artefact{Name: artefact.Name, ContentType: artefact.ContentType, Uri: PendingUri, Summary: artefact.Summary}
+	}
+	return nil
+}
+
+// WatchDeferredUploads sends queued uploads whenever the window is open.
+func WatchDeferredUploads(ctx context.Context, config *Config, host string, token string) {
+	if config.DeferredUploads == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			if config.DeferredUploads.Window.Covers(time.Now()) {
+				SendDeferredUploads(ctx, config, host, token)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// SendDeferredUploads uploads the queued artefacts and tells their hosts
+// where they are, keeping any that fail to be tried again.
+func SendDeferredUploads(ctx context.Context, config *Config, host string, token string) {
+	dirs, _ := filepath.Glob(filepath.Join(config.DeferredUploads.Dir, "upload*"))
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			return
+		}
+		err := sendDeferredUpload(ctx, config, dir, host, token)
+		if err != nil {
+			log.Println(fmt.Sprintf("Could not send upload queued in %s: %+v", dir, err))
+			continue
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func sendDeferredUpload(ctx context.Context, config *Config, dir string, host string, token string) error {
+	data, err := os.ReadFile(filepath.Join(dir, DeferredUploadFile))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var upload DeferredUpload
+	err = json.Unmarshal(data, &upload)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// The calculation may have come with a token of its own
+	uploadToken, err := os.ReadFile(filepath.Join(dir, DeferredTokenFile))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	calc := ResolveTenant(config, patchwork.CalculationPayload{Id: upload.Calculation, Host: upload.Host, Token: string(uploadToken)}, host, token)
+	logger := log.Default()
+	client, err := NewClient(config, logger, calc.Host, calc.Token)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path, err := JoinWithin(dir, upload.Name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	artefact := patchwork.Artefact{Name: upload.Name, ContentType: upload.ContentType, Path: path}
+	if len(config.ArtefactStore) > 0 {
+		artefact, err = StoreArtefact(ctx, config, logger, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if config.PresignedUploadSize > 0 || config.ChunkedUploadSize > 0 {
+		presigner := &Presigner{Config: config, Client: client, Calculation: upload.Calculation}
+		send := presigner.Upload
+		if config.ChunkedUploadSize > 0 {
+			send = presigner.UploadChunked
+		}
+		uploaded, ok, err := send(ctx, logger, path, artefact.ContentType)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ok {
+			artefact = uploaded
+		}
+	}
+	artefact.Summary = SummariseFile(path, artefact.ContentType)
+	log.Println("Sending output " + upload.Output + " of calculation " + upload.Calculation + " queued in " + dir)
+	err = client.SendArtefact(ctx, upload.Calculation, upload.Output, artefact)
+	if err != nil || !upload.Complete || uploadsQueued(config, dir, upload) {
+		return errors.WithStack(err)
+	}
+	log.Println("Completing result of calculation " + upload.Calculation)
+	return errors.WithStack(client.CompleteResult(ctx, upload.Calculation))
+}
+
+// uploadsQueued reports whether uploads other than the one in dir are queued
+// for the same calculation.
+func uploadsQueued(config *Config, dir string, upload DeferredUpload) bool {
+	dirs, _ := filepath.Glob(filepath.Join(config.DeferredUploads.Dir, "upload*"))
+	for _, other := range dirs {
+		if other == dir {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(other, DeferredUploadFile))
+		if err != nil {
+			continue
+		}
+		var queued DeferredUpload
+		if json.Unmarshal(data, &queued) == nil && queued.Calculation == upload.Calculation && queued.Host == upload.Host {
+			return true
+		}
+	}
+	return false
+}
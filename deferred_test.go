@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"patchworkagent/patchwork"
+)
+
+func TestTimeWindowCovers(t *testing.T) {
+	overnight := TimeWindow{Days: []string{"fri"}, From: "22:00", To: "06:00"}
+	// 2024-03-01 is a Friday
+	for _, test := range []struct {
+		time   string
+		covers bool
+	}{
+		{"2024-03-01T21:59:00", false},
+		{"2024-03-01T22:00:00", true},
+		{"2024-03-02T05:59:00", true},
+		{"2024-03-02T06:00:00", false},
+		{"2024-03-02T23:00:00", false},
+		{"2024-03-01T03:00:00", false},
+	} {
+		now, _ := time.ParseInLocation("2006-01-02T15:04:05", test.time, time.Local)
+		if overnight.Covers(now) != test.covers {
+			t.Errorf("Covers(%s) should be %v", test.time, test.covers)
+		}
+	}
+}
+
+func TestDeferUploads(t *testing.T) {
+	dir := t.TempDir()
+	queue := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "mesh.bin"), make([]byte, 2000), 0644)
+	os.WriteFile(filepath.Join(dir, "small.txt"), []byte("small"), 0644)
+	config := &Config{DeferredUploads: &DeferredUploads{Size: 1000, Window: TimeWindow{From: "00:00", To: "00:00"}, Dir: queue}}
+	// The window covers every day, so nothing is deferred
+	if config.DeferredUploads.Defers(2000, time.Now()) {
+		t.Error("Upload deferred within the window")
+	}
+	config.DeferredUploads.Window = TimeWindow{Days: []string{"sun"}, From: "01:00", To: "02:00"}
+	// 2024-03-01 is a Friday
+	friday := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+	if config.DeferredUploads.Defers(500, friday) || !config.DeferredUploads.Defers(2000, friday) {
+		t.Error("Only artefacts over the size should be deferred outside the window")
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	response := patchwork.NewCalculationResponse()
+	response.Outputs["mesh"] = patchwork.Artefact{Name: "mesh.bin", ContentType: "application/octet-stream", Uri: PendingUri, Path: filepath.Join(dir, "mesh.bin")}
+	response.Outputs["small"] = patchwork.Artefact{Name: "small.txt", ContentType: "text/plain", Path: filepath.Join(dir, "small.txt")}
+	err := DeferUploads(config, logger, "beam1", "https://patchwork.example", "payload-token", false, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mesh := response.Outputs["mesh"].(patchwork.Artefact); mesh.Uri != PendingUri || len(mesh.Path) > 0 {
+		t.Errorf("Deferred artefact should be a pending reference: %+v", mesh)
+	}
+	if small := response.Outputs["small"].(patchwork.Artefact); len(small.Path) == 0 {
+		t.Error("Artefact under the size should be left in the result")
+	}
+	queued, _ := filepath.Glob(filepath.Join(queue, "upload*", "mesh.bin"))
+	if len(queued) != 1 {
+		t.Fatalf("Expected the artefact to be queued, found %v", queued)
+	}
+	data, _ := os.ReadFile(filepath.Join(filepath.Dir(queued[0]), DeferredUploadFile))
+	var upload DeferredUpload
+	if json.Unmarshal(data, &upload) != nil || upload.Calculation != "beam1" || upload.Output != "mesh" || upload.Host != "https://patchwork.example" {
+		t.Errorf("Unexpected queued upload %s", data)
+	}
+	// The token isn't in the description, but beside it for the agent only
+	info, err := os.Stat(filepath.Join(filepath.Dir(queued[0]), DeferredTokenFile))
+	if err != nil || (runtime.GOOS != "windows" && info.Mode().Perm() != 0600) || strings.Contains(string(data), "payload-token") {
+		t.Errorf("Expected the token to be kept privately, got %v %v", info, err)
+	}
+}
+
+func TestSendDeferredUploads(t *testing.T) {
+	var received patchwork.DeferredArtefact
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer payload-token" {
+			writer.WriteHeader(401)
+			return
+		}
+		path = request.URL.Path
+		json.NewDecoder(request.Body).Decode(&received)
+	}))
+	defer server.Close()
+	queue := t.TempDir()
+	upload := filepath.Join(queue, "upload1")
+	os.Mkdir(upload, 0755)
+	os.WriteFile(filepath.Join(upload, "log.txt"), []byte("converged"), 0644)
+	data, _ := json.Marshal(DeferredUpload{Calculation: "beam1", Host: server.URL, Output: "log", Name: "log.txt", ContentType: "text/plain"})
+	os.WriteFile(filepath.Join(upload, DeferredUploadFile), data, 0644)
+
+	// A calculation from a host without a configured token is sent with the
+	// token it came with
+	config := &Config{DeferredUploads: &DeferredUploads{Dir: queue}}
+	SendDeferredUploads(context.Background(), config, "https://agent-host.example", "agent-token")
+	if _, err := os.Stat(upload); err != nil {
+		t.Fatal("Upload without its token should be kept in the queue")
+	}
+	os.WriteFile(filepath.Join(upload, DeferredTokenFile), []byte("payload-token"), 0600)
+	SendDeferredUploads(context.Background(), config, "https://agent-host.example", "agent-token")
+	if path != "/api/calculations/artefacts/beam1" || received.Output != "log" {
+		t.Errorf("Unexpected upload of %s to %s", received.Output, path)
+	}
+	if _, content, err := ParseDataUri(received.Artefact.Uri); err != nil || string(content) != "converged" {
+		t.Errorf("Unexpected artefact %+v", received.Artefact)
+	}
+	if _, err := os.Stat(upload); !os.IsNotExist(err) {
+		t.Error("Sent upload was not removed from the queue")
+	}
+}
+
+func TestDeferredUploadsComplete(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		paths = append(paths, request.URL.Path)
+	}))
+	defer server.Close()
+	queue := t.TempDir()
+	for i, upload := range []DeferredUpload{
+		{Calculation: "beam1", Host: server.URL, Output: "mesh", Name: "mesh.bin", Complete: true},
+		{Calculation: "beam1", Host: server.URL, Output: "field", Name: "field.vtu", Complete: true},
+		{Calculation: "beam2", Host: server.URL, Output: "mesh", Name: "mesh.bin"},
+	} {
+		dir := filepath.Join(queue, "upload"+strconv.Itoa(i))
+		os.Mkdir(dir, 0755)
+		os.WriteFile(filepath.Join(dir, upload.Name), []byte("content"), 0644)
+		data, _ := json.Marshal(upload)
+		os.WriteFile(filepath.Join(dir, DeferredUploadFile), data, 0644)
+	}
+
+	// Only the last upload of a result sent scalars first completes it
+	SendDeferredUploads(context.Background(), &Config{DeferredUploads: &DeferredUploads{Dir: queue}}, server.URL, "token")
+	expected := []string{"/api/calculations/artefacts/beam1", "/api/calculations/artefacts/beam1",
+		"/api/calculations/complete/beam1", "/api/calculations/artefacts/beam2"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+}
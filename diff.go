@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// maxValueDifferences is how many differences within one output are listed
+// before the rest are counted.
+const maxValueDifferences = 10
+
+// LoadResponse reads a calculation response written as JSON, such as by a
+// file: result sink.
+func LoadResponse(path string) (*patchwork.CalculationResponse, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	response := patchwork.NewCalculationResponse()
+	err = json.Unmarshal(data, response)
+	return response, errors.Wrap(err, "Invalid response in "+path)
+}
+
+// Diff prints the differences between the outputs of two responses in files,
+// returning 0 if there are none, 1 if there are and 2 if a response can't be
+// read, as diff does.
+func Diff(out io.Writer, path string, otherPath string, tolerance float64) int {
+	response, err := LoadResponse(path)
+	if err != nil {
+		fmt.Fprintln(out, err.Error())
+		return 2
+	}
+	other, err := LoadResponse(otherPath)
+	if err != nil {
+		fmt.Fprintln(out, err.Error())
+		return 2
+	}
+	differences := DiffOutputs(response.Outputs, other.Outputs, filepath.Base(otherPath), tolerance)
+	for _, difference := range differences {
+		fmt.Fprintln(out, difference)
+	}
+	if len(differences) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// DiffOutputs lists how the outputs of a response differ from those of
+// another, named other, in order of output name. Artefacts are compared by
+// their content and other values as JSON, with numbers equal within a
+// relative tolerance.
+func DiffOutputs(outputs map[string]interface{}, others map[string]interface{}, other string, tolerance float64) []string {
+	names := make([]string, 0)
+	for name := range outputs {
+		names = append(names, name)
+	}
+	for name := range others {
+		if _, ok := outputs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	differences := make([]string, 0)
+	for _, name := range names {
+		value, ok := outputs[name]
+		otherValue, otherOk := others[name]
+		if !otherOk {
+			differences = append(differences, "output "+name+" missing from "+other)
+			continue
+		} else if !ok {
+			differences = append(differences, "output "+name+" only from "+other)
+			continue
+		}
+		artefact, ok := asArtefact(value)
+		otherArtefact, otherOk := asArtefact(otherValue)
+		if ok && otherOk {
+			if artefactHash(artefact) != artefactHash(otherArtefact) {
+				differences = append(differences, "output "+name+": content differs from "+other)
+			}
+			continue
+		}
+		found := diffValues("output "+name, normalise(value), normalise(otherValue), other, tolerance, make([]string, 0))
+		if len(found) > maxValueDifferences {
+			more := len(found) - maxValueDifferences
+			found = append(found[:maxValueDifferences], "output "+name+": "+strconv.Itoa(more)+" more differences")
+		}
+		differences = append(differences, found...)
+	}
+	return differences
+}
+
+// diffValues appends the differences between two decoded JSON values,
+// each prefixed with its path.
+func diffValues(path string, a interface{}, b interface{}, other string, tolerance float64, differences []string) []string {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0)
+		for key := range va {
+			keys = append(keys, key)
+		}
+		for key := range vb {
+			if _, ok := va[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ea, okA := va[key]
+			eb, okB := vb[key]
+			if !okB {
+				differences = append(differences, path+"."+key+" missing from "+other)
+			} else if !okA {
+				differences = append(differences, path+"."+key+" only from "+other)
+			} else {
+				differences = diffValues(path+"."+key, ea, eb, other, tolerance, differences)
+			}
+		}
+		return differences
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(va) != len(vb) {
+			return append(differences, path+": "+strconv.Itoa(len(va))+" items, "+other+" "+strconv.Itoa(len(vb)))
+		}
+		for i := range va {
+			differences = diffValues(path+"["+strconv.Itoa(i)+"]", va[i], vb[i], other, tolerance, differences)
+		}
+		return differences
+	case float64:
+		if vb, ok := b.(float64); ok && withinTolerance(va, vb, tolerance) {
+			return differences
+		}
+	default:
+		if reflect.DeepEqual(a, b) {
+			return differences
+		}
+	}
+	return append(differences, path+": "+brief(a)+", "+other+" "+brief(b))
+}
+
+func withinTolerance(a float64, b float64, tolerance float64) bool {
+	return a == b || math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// normalise returns a value as it would be decoded from JSON.
+func normalise(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var decoded interface{}
+	if json.Unmarshal(data, &decoded) != nil {
+		return value
+	}
+	return decoded
+}
+
+// brief returns a value as JSON, shortened for a message.
+func brief(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "?"
+	}
+	if len(data) > 40 {
+		return string(data[:37]) + "..."
+	}
+	return string(data)
+}
+
+// asArtefact returns an output as an artefact if it is one, whether from a
+// response being sent or decoded from one.
+func asArtefact(value interface{}) (patchwork.Artefact, bool) {
+	switch v := value.(type) {
+	case patchwork.Artefact:
+		return v, true
+	case *patchwork.Artefact:
+		if v != nil {
+			return *v, true
+		}
+	case map[string]interface{}:
+		uri, ok := v["uri"].(string)
+		contentType, typed := v["contentType"].(string)
+		if !ok || !typed {
+			return patchwork.Artefact{}, false
+		}
+		name, _ := v["name"].(string)
+		return patchwork.Artefact{Name: name, ContentType: contentType, Uri: uri}, true
+	}
+	return patchwork.Artefact{}, false
+}
+
+// artefactHash identifies the content of an artefact: its SHA-256 where that
+// is known, or else its URI.
+func artefactHash(artefact patchwork.Artefact) string {
+	if len(artefact.Path) > 0 {
+		if hash, err := HashFile(artefact.Path); err == nil {
+			return hash
+		}
+	}
+	if _, data, err := ParseDataUri(artefact.Uri); err == nil {
+		return sha256Hex(data)
+	}
+	// Artefacts in the artefact store are under <prefix>/<sha256>/<name>
+	parts := strings.Split(WithoutQuery(artefact.Uri), "/")
+	if len(parts) >= 2 && len(parts[len(parts)-2]) == sha256.Size*2 {
+		return parts[len(parts)-2]
+	}
+	return artefact.Uri
+}
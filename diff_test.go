@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestDiffOutputs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("same"), 0644)
+	outputs := map[string]interface{}{
+		"result":  3.0,
+		"file":    patchwork.Artefact{Name: "a.txt", Path: filepath.Join(dir, "a.txt")},
+		"missing": "x",
+		"changed": []interface{}{1, 2},
+		"nested":  map[string]interface{}{"stress": 100.0, "mode": "linear"},
+	}
+	others := map[string]interface{}{
+		"result": 3,
+		// The same content as a decoded data URI artefact
+		"file":    map[string]interface{}{"name": "a.txt", "contentType": "text/plain", "uri": "data:text/plain;base64,c2FtZQ=="},
+		"changed": []interface{}{1, 3},
+		"nested":  map[string]interface{}{"stress": 100.5, "mode": "linear", "steps": 2},
+		"extra":   true,
+	}
+	expected := []string{
+		"output changed[1]: 2, b.json 3",
+		"output extra only from b.json",
+		"output missing missing from b.json",
+		"output nested.steps only from b.json",
+		"output nested.stress: 100, b.json 100.5",
+	}
+	if differences := DiffOutputs(outputs, others, "b.json", 0); !reflect.DeepEqual(differences, expected) {
+		t.Errorf("Expected %v, got %v", expected, differences)
+	}
+	expected = []string{
+		"output changed[1]: 2, b.json 3",
+		"output extra only from b.json",
+		"output missing missing from b.json",
+		"output nested.steps only from b.json",
+	}
+	if differences := DiffOutputs(outputs, others, "b.json", 0.01); !reflect.DeepEqual(differences, expected) {
+		t.Errorf("Expected %v within tolerance, got %v", expected, differences)
+	}
+
+	others["file"] = map[string]interface{}{"name": "a.txt", "contentType": "text/plain", "uri": "data:text/plain;base64,b3RoZXI="}
+	differences := DiffOutputs(map[string]interface{}{"file": outputs["file"]}, map[string]interface{}{"file": others["file"]}, "b.json", 0)
+	if !reflect.DeepEqual(differences, []string{"output file: content differs from b.json"}) {
+		t.Errorf("Expected the artefact to differ, got %v", differences)
+	}
+}
+
+func TestDiffOutputsLimit(t *testing.T) {
+	a := make([]interface{}, 20)
+	b := make([]interface{}, 20)
+	for i := range a {
+		a[i], b[i] = float64(i), float64(i+1)
+	}
+	differences := DiffOutputs(map[string]interface{}{"u": a}, map[string]interface{}{"u": b}, "b.json", 0)
+	if len(differences) != maxValueDifferences+1 || differences[maxValueDifferences] != "output u: 10 more differences" {
+		t.Errorf("Expected the differences to be limited, got %v", differences)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.json")
+	b := filepath.Join(dir, "b.json")
+	os.WriteFile(a, []byte(`{"logs":[],"errors":[],"outputs":{"u":[1.0,2.0]}}`), 0644)
+	os.WriteFile(b, []byte(`{"logs":["other"],"errors":[],"outputs":{"u":[1.0,2.001]}}`), 0644)
+	var out bytes.Buffer
+	if status := Diff(&out, a, b, 0); status != 1 || out.String() != "output u[1]: 2, b.json 2.001\n" {
+		t.Errorf("Expected a difference, got %d: %s", status, out.String())
+	}
+	out.Reset()
+	if status := Diff(&out, a, b, 0.001); status != 0 || out.Len() != 0 {
+		t.Errorf("Expected no differences within tolerance, got %d: %s", status, out.String())
+	}
+	if status := Diff(&out, a, filepath.Join(dir, "missing.json"), 0); status != 2 {
+		t.Errorf("Expected a missing response to fail, got %d", status)
+	}
+}
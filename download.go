@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ArtefactAuth is the Authorization header sent when downloading input
+// artefacts whose http(s) URLs are under Prefix, or for sftp:// and ftp://
+// URLs the Username and Password, or for sftp:// the PrivateKey file, logged
+// in with. KnownHosts, if set, is the known_hosts file sftp servers are
+// checked against in place of the user's.
+type ArtefactAuth struct {
+	Prefix        string `json:"prefix"`
+	Authorization string `json:"authorization"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	PrivateKey    string `json:"privateKey"`
+	KnownHosts    string `json:"knownHosts"`
+}
+
+func (auth *ArtefactAuth) Validate() error {
+	parsed, err := url.Parse(auth.Prefix)
+	if err != nil || len(parsed.Host) == 0 {
+		return errors.New("Invalid artefact URL prefix " + auth.Prefix)
+	}
+	switch parsed.Scheme {
+	case "http", "https", "sftp", "ftp":
+		return nil
+	}
+	return errors.New("Invalid artefact URL prefix " + auth.Prefix)
+}
+
+// Matches reports whether a URL is under the prefix: it has the same scheme
+// and host, and a path starting with that of the prefix at a / boundary, so
+// that credentials are never sent to a host that only looks like it, such as
+// https://files.example.evil.net for https://files.example.
+func (auth *ArtefactAuth) Matches(fileUrl string) bool {
+	prefix, err := url.Parse(auth.Prefix)
+	if err != nil || len(prefix.Host) == 0 {
+		return false
+	}
+	parsed, err := url.Parse(fileUrl)
+	if err != nil || !strings.EqualFold(parsed.Scheme, prefix.Scheme) || !strings.EqualFold(parsed.Host, prefix.Host) {
+		return false
+	}
+	path, prefixPath := parsed.EscapedPath(), prefix.EscapedPath()
+	if len(prefixPath) == 0 || strings.HasSuffix(prefixPath, "/") {
+		return strings.HasPrefix(path, prefixPath)
+	}
+	return path == prefixPath || strings.HasPrefix(path, prefixPath+"/")
+}
+
+// artefactAuthFor returns the first of the configured artefactAuth whose
+// prefix a URL is under.
+func artefactAuthFor(config *Config, fileUrl string) (ArtefactAuth, bool) {
+	for _, auth := range config.ArtefactAuth {
+		if auth.Matches(fileUrl) {
+			return auth, true
+		}
+	}
+	return ArtefactAuth{}, false
+}
+
+// IsHTTPURL reports whether a URI is an http or https URL.
+func IsHTTPURL(uri string) bool {
+	return strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")
+}
+
+// DownloadHTTPFile streams the content at a URL to a file, authorised by the
+// first of the configured artefactAuth whose prefix it is under.
+func DownloadHTTPFile(ctx context.Context, config *Config, fileUrl string, path string) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if auth, ok := artefactAuthFor(config, fileUrl); ok {
+		request.Header.Set("Authorization", auth.Authorization)
+	}
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return errors.New("Could not download " + WithoutQuery(fileUrl) + ": " + response.Status)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"patchworkagent/patchwork"
+)
+
+func TestReadHTTPArtefact(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private/beam.msh" && r.Header.Get("Authorization") != "Bearer files" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte("nodes 12\n"))
+	}))
+	defer server.Close()
+	logger := log.New(io.Discard, "", 0)
+	config := &Config{ArtefactAuth: []ArtefactAuth{{Prefix: server.URL + "/private/", Authorization: "Bearer files"}}}
+	dir := t.TempDir()
+
+	for _, path := range []string{"/public/beam.msh", "/private/beam.msh"} {
+		err := ReadArtefact(context.Background(), config, logger, dir, "mesh", patchwork.Artefact{Name: "beam.msh", ContentType: "text/plain", Uri: server.URL + path})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "mesh.msh"))
+		if string(data) != "nodes 12\n" {
+			t.Errorf("Unexpected content %q from %s", data, path)
+		}
+	}
+	err := ReadArtefact(context.Background(), &Config{}, logger, dir, "mesh", patchwork.Artefact{Name: "beam.msh", Uri: server.URL + "/private/beam.msh"})
+	if err == nil {
+		t.Error("Expected an unauthorised download to fail")
+	}
+}
+
+func TestReadArtefactCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("nodes"))
+		w.(http.Flusher).Flush()
+		// Stall until the agent gives up
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := ReadArtefact(ctx, &Config{}, log.New(io.Discard, "", 0), t.TempDir(), "mesh", patchwork.Artefact{Name: "beam.msh", Uri: server.URL + "/beam.msh"})
+	if err == nil {
+		t.Error("Expected a stalled download to be cancelled")
+	}
+}
+
+func TestArtefactAuthMatches(t *testing.T) {
+	for _, c := range []struct {
+		prefix, url string
+		expected    bool
+	}{
+		{"https://files.example", "https://files.example/beam.msh", true},
+		{"https://files.example", "https://FILES.example/beam.msh", true},
+		{"https://files.example", "https://files.example.evil.net/beam.msh", false},
+		{"https://files.example", "https://files.example@evil.net/beam.msh", false},
+		{"https://files.example", "https://files.example:8443/beam.msh", false},
+		{"https://files.example", "http://files.example/beam.msh", false},
+		{"https://files.example/private/", "https://files.example/private/beam.msh", true},
+		{"https://files.example/private/", "https://files.example/public/beam.msh", false},
+		{"https://files.example/private", "https://files.example/private/beam.msh", true},
+		{"https://files.example/private", "https://files.example/private", true},
+		{"https://files.example/private", "https://files.example/privateer/beam.msh", false},
+		{"ftp://files.example/decks/", "ftp://files.example/decks/wing.dat", true},
+	} {
+		auth := ArtefactAuth{Prefix: c.prefix}
+		if auth.Matches(c.url) != c.expected {
+			t.Errorf("Expected %s under %s: %v", c.url, c.prefix, c.expected)
+		}
+	}
+
+	// A lookalike host is never sent the token
+	authorization := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("nodes"))
+	}))
+	defer server.Close()
+	config := &Config{ArtefactAuth: []ArtefactAuth{{Prefix: "http://127.0.0.1", Authorization: "Bearer files"}}}
+	lookalike := "http://127.0.0.1@" + server.Listener.Addr().String() + "/beam.msh"
+	if err := DownloadHTTPFile(context.Background(), config, lookalike, filepath.Join(t.TempDir(), "beam.msh")); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if authorization == "Bearer files" {
+		t.Errorf("Expected no authorization sent to %s, got %s", lookalike, authorization)
+	}
+}
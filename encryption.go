@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionFormat is the Encryption of artefacts encrypted by the agent: a
+// header naming the key and holding the data key wrapped by it, then the
+// content in AES-256-GCM chunks.
+const EncryptionFormat = "patchwork-envelope-v1"
+
+const encryptionMagic = "PWENC\x00\x01"
+const encryptionChunkSize = 64 << 10
+
+var gcpKmsKeyName = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+
+// Encryption encrypts output artefacts before they are uploaded, each with a
+// data key of its own wrapped by Key: "awskms:<key id or ARN>", with the AWS
+// credentials in the environment, "gcpkms:projects/.../cryptoKeys/<key>",
+// with Google application default credentials, or "file:<path>" to a file of
+// 32 bytes, raw, base64 or hex.
+type Encryption struct {
+	Key string `json:"key"`
+}
+
+func (encryption *Encryption) Validate() error {
+	scheme, key, _ := strings.Cut(encryption.Key, ":")
+	switch {
+	case scheme == "awskms" && len(key) > 0:
+		return nil
+	case scheme == "gcpkms" && gcpKmsKeyName.MatchString(key):
+		return nil
+	case scheme == "file" && len(key) > 0:
+		_, err := readKeyFile(key)
+		return errors.WithStack(err)
+	}
+	return errors.New("Invalid encryption key " + encryption.Key)
+}
+
+// readKeyFile reads a 256-bit key from a file.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("Key file " + path + " doesn't hold a 256-bit key")
+}
+
+// keyFingerprint names a key file key in encrypted artefacts without
+// revealing it.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(append([]byte("patchwork key "), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+// newDataKey generates a data key, returning it, the name of the key it is
+// wrapped by, and it wrapped.
+func newDataKey(ctx context.Context, config *Config) ([]byte, string, []byte, error) {
+	scheme, name, _ := strings.Cut(config.Encryption.Key, ":")
+	if scheme == "awskms" {
+		var result struct {
+			CiphertextBlob []byte
+			Plaintext      []byte
+		}
+		err := awsKmsCall(ctx, config, "GenerateDataKey", map[string]string{"KeyId": name, "KeySpec": "AES_256"}, &result)
+		return result.Plaintext, config.Encryption.Key, result.CiphertextBlob, errors.WithStack(err)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", nil, errors.WithStack(err)
+	}
+	if scheme == "gcpkms" {
+		var result struct {
+			Ciphertext []byte `json:"ciphertext"`
+		}
+		err := gcpKmsCall(ctx, config, name, "encrypt", map[string][]byte{"plaintext": key}, &result)
+		return key, config.Encryption.Key, result.Ciphertext, errors.WithStack(err)
+	}
+	kek, err := readKeyFile(name)
+	if err != nil {
+		return nil, "", nil, errors.WithStack(err)
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, "", nil, errors.WithStack(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", nil, errors.WithStack(err)
+	}
+	return key, "file:" + keyFingerprint(kek), aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// unwrapDataKey unwraps the data key of an encrypted artefact with the key it
+// names. Key files are only those configured.
+func unwrapDataKey(ctx context.Context, config *Config, keyName string, wrapped []byte) ([]byte, error) {
+	scheme, name, _ := strings.Cut(keyName, ":")
+	switch scheme {
+	case "awskms":
+		var result struct {
+			Plaintext []byte
+		}
+		err := awsKmsCall(ctx, config, "Decrypt", map[string]interface{}{"KeyId": name, "CiphertextBlob": wrapped}, &result)
+		return result.Plaintext, errors.WithStack(err)
+	case "gcpkms":
+		if !gcpKmsKeyName.MatchString(name) {
+			return nil, errors.New("Invalid encryption key " + keyName)
+		}
+		var result struct {
+			Plaintext []byte `json:"plaintext"`
+		}
+		err := gcpKmsCall(ctx, config, name, "decrypt", map[string][]byte{"ciphertext": wrapped}, &result)
+		return result.Plaintext, errors.WithStack(err)
+	case "file":
+		configured := ""
+		if config.Encryption != nil && strings.HasPrefix(config.Encryption.Key, "file:") {
+			configured = strings.TrimPrefix(config.Encryption.Key, "file:")
+		}
+		if len(configured) == 0 {
+			return nil, errors.New("Artefact is encrypted with key file " + name + ", but none is configured")
+		}
+		kek, err := readKeyFile(configured)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if keyFingerprint(kek) != name {
+			return nil, errors.New("Artefact is encrypted with key file " + name + ", not the one configured")
+		}
+		aead, err := newGCM(kek)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(wrapped) < aead.NonceSize() {
+			return nil, errors.New("Invalid wrapped key")
+		}
+		key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+		return key, errors.WithStack(err)
+	}
+	return nil, errors.New("Unknown encryption key " + keyName)
+}
+
+// awsKmsCall calls an action of AWS KMS, at AWS_ENDPOINT_URL_KMS if set.
+func awsKmsCall(ctx context.Context, config *Config, action string, body interface{}, result interface{}) error {
+	creds, err := AWSCredentialsFromEnv()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_KMS")
+	if len(endpoint) == 0 {
+		endpoint = "https://kms." + creds.Region + ".amazonaws.com/"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "TrentService."+action)
+	SignAWSRequest(request, data, "kms", creds, time.Now())
+	return errors.WithStack(kmsDo(config, request, "AWS KMS "+action, result))
+}
+
+// gcpKmsCall calls a method of a Cloud KMS key.
+func gcpKmsCall(ctx context.Context, config *Config, name string, method string, body interface{}, result interface{}) error {
+	token, err := GoogleAccessToken(ctx, config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", "https://cloudkms.googleapis.com/v1/"+name+":"+method, bytes.NewReader(data))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+	return errors.WithStack(kmsDo(config, request, "Cloud KMS "+method, result))
+}
+
+func kmsDo(config *Config, request *http.Request, operation string, result interface{}) error {
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return errors.New(operation + " failed: " + response.Status + " " + string(message))
+	}
+	return errors.WithStack(json.NewDecoder(response.Body).Decode(result))
+}
+
+// chunkNonce is the nonce of a chunk: a prefix random to the artefact, the
+// index of the chunk and whether it is the last, so that chunks can't be
+// reordered or dropped.
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix[:7])
+	binary.BigEndian.PutUint32(nonce[7:11], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// readChunk reads up to len(buf) bytes, returning fewer only at the end.
+func readChunk(reader io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, errors.WithStack(err)
+}
+
+// EncryptFile encrypts a file, under a data key of its own, to a file of the
+// same name in dir.
+func EncryptFile(ctx context.Context, config *Config, path string, dir string) (string, error) {
+	key, keyName, wrapped, err := newDataKey(ctx, config)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not get a data key")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", errors.WithStack(err)
+	}
+	var header bytes.Buffer
+	header.WriteString(encryptionMagic)
+	binary.Write(&header, binary.BigEndian, uint16(len(keyName)))
+	header.WriteString(keyName)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	header.Write(prefix)
+
+	in, err := OpenOutput(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer in.Close()
+	target := filepath.Join(dir, filepath.Base(path))
+	out, err := os.Create(target)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer out.Close()
+	writer := bufio.NewWriter(out)
+	writer.Write(header.Bytes())
+	chunk, next := make([]byte, encryptionChunkSize), make([]byte, encryptionChunkSize)
+	n, err := readChunk(in, chunk)
+	for index := uint32(0); err == nil; index++ {
+		m := 0
+		if n == len(chunk) {
+			m, err = readChunk(in, next)
+		}
+		last := m == 0
+		writer.Write(aead.Seal(nil, chunkNonce(prefix, index, last), chunk[:n], header.Bytes()))
+		if last {
+			break
+		}
+		chunk, next, n = next, chunk, m
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if err := writer.Flush(); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return target, errors.WithStack(out.Close())
+}
+
+// DecryptFile decrypts a file in place if it was encrypted by EncryptFile,
+// returning whether it was.
+func DecryptFile(ctx context.Context, config *Config, path string) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer in.Close()
+	reader := bufio.NewReaderSize(in, encryptionChunkSize+64)
+	if magic, err := reader.Peek(len(encryptionMagic)); err != nil || string(magic) != encryptionMagic {
+		return false, nil
+	}
+	var header bytes.Buffer
+	field := func(size int) ([]byte, error) {
+		data := make([]byte, size)
+		_, err := io.ReadFull(io.TeeReader(reader, &header), data)
+		return data, errors.Wrap(err, "Invalid encrypted artefact")
+	}
+	length := func() (int, error) {
+		data, err := field(2)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint16(data)), nil
+	}
+	field(len(encryptionMagic))
+	size, err := length()
+	if err != nil {
+		return true, err
+	}
+	keyName, err := field(size)
+	if err != nil {
+		return true, err
+	}
+	size, err = length()
+	if err != nil {
+		return true, err
+	}
+	wrapped, err := field(size)
+	if err != nil {
+		return true, err
+	}
+	prefix, err := field(7)
+	if err != nil {
+		return true, err
+	}
+	key, err := unwrapDataKey(ctx, config, string(keyName), wrapped)
+	if err != nil {
+		return true, errors.Wrap(err, "Could not unwrap the data key")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), ".decrypting")
+	if err != nil {
+		return true, errors.WithStack(err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	writer := bufio.NewWriter(out)
+	chunk := make([]byte, encryptionChunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := readChunk(reader, chunk)
+		if err != nil {
+			return true, errors.WithStack(err)
+		}
+		_, err = reader.Peek(1)
+		last := err == io.EOF
+		plain, err := aead.Open(chunk[:0], chunkNonce(prefix, index, last), chunk[:n], header.Bytes())
+		if err != nil {
+			return true, errors.New("Encrypted artefact has been altered or truncated")
+		}
+		writer.Write(plain)
+		if last {
+			break
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return true, errors.WithStack(err)
+	}
+	if err := out.Close(); err != nil {
+		return true, errors.WithStack(err)
+	}
+	in.Close()
+	return true, errors.WithStack(os.Rename(out.Name(), path))
+}
+
+// MakeEncryptedArtefact encrypts an output file and uploads it as
+// MakeArtefact does, as an artefact with the name and content type of the
+// file. It isn't summarised, as that would reveal its content.
+func MakeEncryptedArtefact(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, path string) (patchwork.Artefact, error) {
+	contentType, err := ArtefactContentType(config, path)
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".encrypted")
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	logger.Println("Encrypting " + filepath.Base(path) + " with " + config.Encryption.Key)
+	encrypted, err := EncryptFile(ctx, config, path, dir)
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	artefact, err := uploadArtefact(ctx, config, logger, presigner, encrypted)
+	if err == nil {
+		err = ChecksumArtefact(&artefact, encrypted)
+	}
+	artefact.ContentType = contentType
+	artefact.Encryption = EncryptionFormat
+	return artefact, errors.WithStack(err)
+}
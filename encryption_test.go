@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptFileWithKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	os.WriteFile(keyFile, []byte(hex.EncodeToString(bytes.Repeat([]byte{7}, 32))+"\n"), 0600)
+	config := &Config{Encryption: &Encryption{Key: "file:" + keyFile}}
+	if err := config.Encryption.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sizes around the chunk size, as the last chunk is marked
+	for _, size := range []int{0, 10, encryptionChunkSize, 2*encryptionChunkSize + 1} {
+		content := bytes.Repeat([]byte("stress "), size/7+1)[:size]
+		path := filepath.Join(dir, "stress.csv")
+		os.WriteFile(path, content, 0644)
+		encrypted, err := EncryptFile(context.Background(), config, path, t.TempDir())
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		data, _ := os.ReadFile(encrypted)
+		if size > 0 && bytes.Contains(data, content) {
+			t.Fatal("Content is in plaintext")
+		}
+		decrypted, err := DecryptFile(context.Background(), config, encrypted)
+		if err != nil || !decrypted {
+			t.Fatalf("%d: %v %+v", size, decrypted, err)
+		}
+		if data, _ := os.ReadFile(encrypted); !bytes.Equal(data, content) {
+			t.Errorf("%d: decrypted to %d bytes", size, len(data))
+		}
+	}
+
+	// Truncated or altered artefacts are refused
+	path := filepath.Join(dir, "model.inp")
+	os.WriteFile(path, bytes.Repeat([]byte("x"), 3*encryptionChunkSize), 0644)
+	encrypted, _ := EncryptFile(context.Background(), config, path, t.TempDir())
+	data, _ := os.ReadFile(encrypted)
+	for _, altered := range [][]byte{data[:len(data)-encryptionChunkSize-16], append(append([]byte{}, data[:100]...), append([]byte{data[100] ^ 1}, data[101:]...)...)} {
+		os.WriteFile(encrypted, altered, 0644)
+		if _, err := DecryptFile(context.Background(), config, encrypted); err == nil {
+			t.Error("Expected altered artefact to be refused")
+		}
+	}
+
+	// Plain files are left alone, and other keys are refused
+	if decrypted, err := DecryptFile(context.Background(), config, path); decrypted || err != nil {
+		t.Errorf("%v %v", decrypted, err)
+	}
+	os.WriteFile(encrypted, data, 0644)
+	os.WriteFile(keyFile, bytes.Repeat([]byte{8}, 32), 0600)
+	if _, err := DecryptFile(context.Background(), config, encrypted); err == nil || !strings.Contains(err.Error(), "not the one configured") {
+		t.Errorf("Unexpected %v", err)
+	}
+}
+
+func TestEncryptFileWithAWSKMS(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{3}, 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") || !strings.Contains(r.Header.Get("Authorization"), "/kms/aws4_request") {
+			w.WriteHeader(403)
+			return
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.GenerateDataKey":
+			json.NewEncoder(w).Encode(map[string]interface{}{"KeyId": body["KeyId"], "Plaintext": dataKey, "CiphertextBlob": []byte("wrapped")})
+		case "TrentService.Decrypt":
+			if body["CiphertextBlob"] != "d3JhcHBlZA==" || body["KeyId"] != "alias/designs" {
+				w.WriteHeader(400)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Plaintext": dataKey})
+		}
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_KMS", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	dir := t.TempDir()
+	config := &Config{Encryption: &Encryption{Key: "awskms:alias/designs"}}
+	path := filepath.Join(dir, "stress.csv")
+	os.WriteFile(path, []byte("1,2,3"), 0644)
+	artefact, err := MakeArtefact(context.Background(), config, log.New(io.Discard, "", 0), nil, path)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if artefact.Name != "stress.csv" || artefact.Encryption != EncryptionFormat || artefact.Summary != nil {
+		t.Errorf("Unexpected %+v", artefact)
+	}
+
+	// Decrypting needs no encryption to be configured, as the key is named
+	input := filepath.Join(dir, "input.csv")
+	data, _ := os.ReadFile(artefact.Path)
+	os.WriteFile(input, data, 0644)
+	if decrypted, err := DecryptFile(context.Background(), &Config{}, input); !decrypted || err != nil {
+		t.Fatalf("%v %+v", decrypted, err)
+	}
+	if data, _ := os.ReadFile(input); string(data) != "1,2,3" {
+		t.Errorf("Decrypted to %q", data)
+	}
+}
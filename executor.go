@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Execution is a command of a calculation to run. Dir is the workspace on the
+// agent host and Workspace the same directory as the backend sees it.
+type Execution struct {
+	Command   string
+	Dir       string
+	Workspace string
+	Env       []string
+	Stdout    io.Writer
+	Stderr    io.Writer
+}
+
+// Executor is a backend running the commands of calculations. Execute returns
+// the CPU time used, if known, and an error with an ExitCode method if the
+// command failed.
+type Executor interface {
+	Execute(ctx context.Context, execution Execution) (time.Duration, error)
+}
+
+// ExecutorFactory makes an executor from its options in the config file.
+type ExecutorFactory func(config *Config, options json.RawMessage) (Executor, error)
+
+// ExecutorConfig is the backend to run commands with, by the name it is
+// registered with.
+type ExecutorConfig struct {
+	Name    string          `json:"name"`
+	Options json.RawMessage `json:"options"`
+}
+
+var executorFactories = map[string]ExecutorFactory{
+	"shell":      ShellExecutor,
+	"argv":       ArgvExecutor,
+	"docker":     DockerExecutor,
+	"kubernetes": KubernetesExecutor,
+	"slurm":      SlurmExecutor,
+	"ssh":        SSHExecutor,
+}
+
+var executorLock sync.Mutex
+
+// RegisterExecutor registers a backend, for builds of the agent with their
+// own to register them in an init function.
+func RegisterExecutor(name string, factory ExecutorFactory) {
+	executorLock.Lock()
+	defer executorLock.Unlock()
+	executorFactories[name] = factory
+}
+
+// Validate checks the executor is known and its options are valid.
+func (executor ExecutorConfig) Validate(config *Config) error {
+	_, err := executor.New(config)
+	return err
+}
+
+func (executor ExecutorConfig) New(config *Config) (Executor, error) {
+	executorLock.Lock()
+	factory, ok := executorFactories[executor.Name]
+	executorLock.Unlock()
+	if !ok {
+		return nil, errors.New("Unknown executor " + executor.Name)
+	}
+	made, err := factory(config, executor.Options)
+	return made, errors.Wrap(err, "Invalid options of executor "+executor.Name)
+}
+
+// ExecutorFor returns the executor for a type of calculation, or the default
+// executor if none is configured for it, by default running the command with
+// the shell.
+func (config *Config) ExecutorFor(calculationType string) (Executor, error) {
+	if executor, ok := config.Executors[calculationType]; ok {
+		return executor.New(config)
+	}
+	if config.Executor != nil {
+		return config.Executor.New(config)
+	}
+	return shellExecutor{}, nil
+}
+
+// runExecution runs a local process for an execution, returning its CPU time.
+func runExecution(cmd *exec.Cmd, execution Execution) (time.Duration, error) {
+	if cmd.Dir == "" {
+		cmd.Dir = execution.Dir
+	}
+	if cmd.Env == nil {
+		cmd.Env = execution.Env
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = execution.Stdout
+	}
+	cmd.Stderr = execution.Stderr
+	err := cmd.Run()
+	var cpu time.Duration
+	if cmd.ProcessState != nil {
+		cpu = cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+	return cpu, err
+}
+
+// envNames are the names of variables in an environment.
+func envNames(env []string) []string {
+	names := make([]string, len(env))
+	for i, variable := range env {
+		names[i], _, _ = strings.Cut(variable, "=")
+	}
+	return names
+}
+
+// shellQuote quotes an argument for a POSIX shell.
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// splitArgs splits a command line into arguments at unquoted whitespace, as
+// a POSIX shell would without expanding anything.
+func splitArgs(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case quote == '\'' && c != '\'':
+			arg.WriteRune(c)
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(c)
+		case c == '\\':
+			escaped, inArg = true, true
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("Unterminated quote in command")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Empty command")
+	}
+	return args, nil
+}
+
+type shellExecutor struct{}
+
+// ShellExecutor runs commands with bash, or cmd on Windows, on the agent
+// host. It is the default.
+func ShellExecutor(config *Config, options json.RawMessage) (Executor, error) {
+	return shellExecutor{}, decodeOptions(options, &struct{}{})
+}
+
+func (shellExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	command := strings.TrimSuffix(strings.TrimPrefix(execution.Command, "\""), "\"")
+	if runtime.GOOS == "windows" {
+		return runExecution(exec.CommandContext(ctx, "cmd", "/c", command), execution)
+	}
+	return runExecution(exec.CommandContext(ctx, "bash", "-c", command), execution)
+}
+
+type argvExecutor struct{}
+
+// ArgvExecutor runs commands directly, split into arguments as a shell would
+// but without one, so nothing in them is expanded.
+func ArgvExecutor(config *Config, options json.RawMessage) (Executor, error) {
+	return argvExecutor{}, decodeOptions(options, &struct{}{})
+}
+
+func (argvExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	args, err := splitArgs(execution.Command)
+	if err != nil {
+		return 0, err
+	}
+	return runExecution(exec.CommandContext(ctx, args[0], args[1:]...), execution)
+}
+
+type dockerExecutor struct {
+	Image string   `json:"image"`
+	Args  []string `json:"args"`
+}
+
+// DockerExecutor runs commands with bash in a new container of an image, with
+// the workspace mounted where the command sees it. Variables are passed by
+// name, so secrets aren't on the command line.
+func DockerExecutor(config *Config, options json.RawMessage) (Executor, error) {
+	var executor dockerExecutor
+	if err := decodeOptions(options, &executor); err != nil {
+		return nil, err
+	}
+	if len(executor.Image) == 0 {
+		return nil, errors.New("No image is given")
+	}
+	return executor, nil
+}
+
+func (executor dockerExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	args := []string{"run", "--rm", "-v", execution.Dir + ":" + execution.Workspace, "-w", execution.Workspace}
+	for _, name := range envNames(execution.Env) {
+		args = append(args, "-e", name)
+	}
+	args = append(append(args, executor.Args...), executor.Image, "bash", "-c", execution.Command)
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Env = append(os.Environ(), execution.Env...)
+	return runExecution(cmd, execution)
+}
+
+type kubernetesExecutor struct {
+	Image     string          `json:"image"`
+	Namespace string          `json:"namespace"`
+	Overrides json.RawMessage `json:"overrides"`
+}
+
+// KubernetesExecutor runs commands with bash in a new pod of an image, with
+// kubectl. The workspace must be on a volume the pod mounts, given in
+// overrides of its spec, and translated to where it is mounted.
+func KubernetesExecutor(config *Config, options json.RawMessage) (Executor, error) {
+	var executor kubernetesExecutor
+	if err := decodeOptions(options, &executor); err != nil {
+		return nil, err
+	}
+	if len(executor.Image) == 0 {
+		return nil, errors.New("No image is given")
+	}
+	return executor, nil
+}
+
+func (executor kubernetesExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	id := make([]byte, 6)
+	rand.Read(id)
+	args := []string{"run", "patchwork-" + hex.EncodeToString(id), "--image=" + executor.Image,
+		"--restart=Never", "--rm", "--attach", "--quiet", "-i"}
+	if len(executor.Namespace) > 0 {
+		args = append(args, "--namespace="+executor.Namespace)
+	}
+	if len(executor.Overrides) > 0 {
+		args = append(args, "--overrides="+string(executor.Overrides))
+	}
+	// The variables are sent in a script on stdin, rather than in the pod spec
+	args = append(args, "--command", "--", "bash", "-s")
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = strings.NewReader(remoteScript(execution))
+	return runExecution(cmd, execution)
+}
+
+type slurmExecutor struct {
+	Args []string `json:"args"`
+}
+
+// SlurmExecutor runs commands with bash as Slurm jobs with srun, which waits
+// for them and relays their output. The workspace must be on a filesystem
+// the compute nodes share.
+func SlurmExecutor(config *Config, options json.RawMessage) (Executor, error) {
+	var executor slurmExecutor
+	return executor, decodeOptions(options, &executor)
+}
+
+func (executor slurmExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	args := []string{"--chdir=" + execution.Workspace, "--export=" + strings.Join(envNames(execution.Env), ",")}
+	args = append(append(args, executor.Args...), "bash", "-c", execution.Command)
+	cmd := exec.CommandContext(ctx, "srun", args...)
+	cmd.Env = append(os.Environ(), execution.Env...)
+	return runExecution(cmd, execution)
+}
+
+type sshExecutor struct {
+	Host string   `json:"host"`
+	Args []string `json:"args"`
+}
+
+// SSHExecutor runs commands with bash on another machine over ssh, which must
+// see the workspace, such as on a shared filesystem.
+func SSHExecutor(config *Config, options json.RawMessage) (Executor, error) {
+	var executor sshExecutor
+	if err := decodeOptions(options, &executor); err != nil {
+		return nil, err
+	}
+	if len(executor.Host) == 0 || strings.HasPrefix(executor.Host, "-") {
+		return nil, errors.New("Invalid host " + executor.Host)
+	}
+	return executor, nil
+}
+
+func (executor sshExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	args := append([]string{"-o", "BatchMode=yes"}, executor.Args...)
+	args = append(args, "--", executor.Host, "bash", "-s")
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = strings.NewReader(remoteScript(execution))
+	return runExecution(cmd, execution)
+}
+
+// remoteScript is a script running an execution in bash where the agent's
+// environment isn't inherited.
+func remoteScript(execution Execution) string {
+	var script bytes.Buffer
+	for _, variable := range execution.Env {
+		name, value, _ := strings.Cut(variable, "=")
+		script.WriteString("export " + name + "=" + shellQuote(value) + "\n")
+	}
+	script.WriteString("cd " + shellQuote(execution.Workspace) + " || exit 1\n")
+	script.WriteString("exec bash -c " + shellQuote(execution.Command) + " </dev/null\n")
+	return script.String()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type exitCode int
+
+func (code exitCode) Error() string { return "exit status " + strconv.Itoa(int(code)) }
+func (code exitCode) ExitCode() int { return int(code) }
+
+type recordingExecutor struct {
+	executions *[]Execution
+}
+
+func (executor recordingExecutor) Execute(ctx context.Context, execution Execution) (time.Duration, error) {
+	*executor.executions = append(*executor.executions, execution)
+	execution.Stdout.Write([]byte("queued\n"))
+	return time.Second, exitCode(3)
+}
+
+func TestExecutorFor(t *testing.T) {
+	var executions []Execution
+	RegisterExecutor("recording", func(config *Config, options json.RawMessage) (Executor, error) {
+		return recordingExecutor{&executions}, nil
+	})
+	config, err := ParseConfig([]byte(`{"executors": {"fea": {"name": "recording"}, "literal": {"name": "argv"}}}`), "test")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	code, cpu := RunCommand(context.Background(), config, log.Default(), "fea", "solve {workspace}", dir, "host", "token", map[string]string{"KEY": "secret"}, &stdout, &stderr)
+	if code != 3 || cpu != time.Second || stdout.String() != "queued\n" || len(executions) != 1 {
+		t.Fatalf("Unexpected %d %v %q %v", code, cpu, stdout.String(), executions)
+	}
+	if executions[0].Command != "solve "+dir || executions[0].Dir != dir || executions[0].Env[len(executions[0].Env)-1] != "KEY=secret" {
+		t.Errorf("Unexpected %+v", executions[0])
+	}
+
+	// Types without an executor of their own run with the shell
+	if runtime.GOOS != "windows" {
+		stdout.Reset()
+		RunCommand(context.Background(), config, log.Default(), "literal", `echo '$HOST' "a  b"`, dir, "host", "token", nil, &stdout, &stderr)
+		RunCommand(context.Background(), config, log.Default(), "other", `echo $HOST`, dir, "host", "token", nil, &stdout, &stderr)
+		if stdout.String() != "$HOST a  b\nhost\n" {
+			t.Errorf("Unexpected %q", stdout.String())
+		}
+	}
+
+	for _, invalid := range []string{`{"executor": {"name": "missing"}}`, `{"executor": {"name": "docker"}}`, `{"executors": {"fea": {"name": "ssh", "options": {"host": "-oProxyCommand=x"}}}}`} {
+		if _, err := ParseConfig([]byte(invalid), "test"); err == nil {
+			t.Errorf("Expected %s to be refused", invalid)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`solver -i "beam model.inp" --name='it''s' a\ b ""`)
+	if err != nil || !reflect.DeepEqual(args, []string{"solver", "-i", "beam model.inp", "--name=its", "a b", ""}) {
+		t.Errorf("Unexpected %q %v", args, err)
+	}
+	if _, err := splitArgs(`solver "beam`); err == nil {
+		t.Error("Expected unterminated quote to be refused")
+	}
+}
+
+func TestRemoteScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil || runtime.GOOS == "windows" {
+		t.Skip("bash is not installed")
+	}
+	dir := t.TempDir()
+	cmd := exec.Command("bash", "-s")
+	cmd.Env = []string{}
+	cmd.Stdin = strings.NewReader(remoteScript(Execution{Command: `echo "$KEY" $(pwd)`, Workspace: dir, Env: []string{"KEY=it's $HOME"}}))
+	output, err := cmd.Output()
+	if err != nil || string(output) != "it's $HOME "+dir+"\n" {
+		t.Errorf("Unexpected %q %v", output, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// IsArchiveType reports whether inputs of a content type are archives that
+// are expanded into directories.
+func IsArchiveType(contentType string) bool {
+	switch strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]) {
+	case "application/zip", "application/x-zip-compressed", "application/gzip", "application/x-gzip":
+		return true
+	}
+	return false
+}
+
+// ExpandArchive expands a zip or gzipped tar archive into the directory
+// target. A gzipped file that isn't a tar archive is left as it is, and
+// expanded is false. Entries that would be written outside target are
+// rejected, and anything but files and directories is skipped.
+func ExpandArchive(logger *log.Logger, archive string, contentType string, target string) (expanded bool, err error) {
+	if !strings.Contains(contentType, "gzip") {
+		return true, errors.WithStack(expandZip(logger, archive, target))
+	}
+	file, err := os.Open(archive)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer file.Close()
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	reader := tar.NewReader(decompressed)
+	header, err := reader.Next()
+	if err != nil {
+		logger.Println("Input " + archive + " is not a tar archive, leaving it compressed")
+		return false, nil
+	}
+	logger.Println("Expanding input archive " + archive + " into " + target)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return false, errors.WithStack(err)
+	}
+	for ; err == nil; header, err = reader.Next() {
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = makeEntryDir(target, header.Name)
+		case tar.TypeReg:
+			err = writeEntry(target, header.Name, reader)
+		default:
+			logger.Println("Skipping " + header.Name + " in " + archive + ", which is not a file or directory")
+		}
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+	}
+	if err != io.EOF {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+func expandZip(logger *log.Logger, archive string, target string) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer reader.Close()
+	logger.Println("Expanding input archive " + archive + " into " + target)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, entry := range reader.File {
+		mode := entry.Mode()
+		if mode.IsDir() {
+			err = makeEntryDir(target, entry.Name)
+		} else if mode.IsRegular() {
+			var content io.ReadCloser
+			content, err = entry.Open()
+			if err == nil {
+				err = writeEntry(target, entry.Name, content)
+				content.Close()
+			}
+		} else {
+			logger.Println("Skipping " + entry.Name + " in " + archive + ", which is not a file or directory")
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// entryPath returns where an archive entry is expanded to, which must be
+// inside target.
+func entryPath(target string, name string) (string, error) {
+	// Leading slashes are dropped, as tar does
+	path, err := JoinWithin(target, strings.TrimLeft(name, "/"))
+	if err != nil {
+		return "", errors.New("Archive entry " + name + " is outside the archive")
+	}
+	return path, nil
+}
+
+func makeEntryDir(target string, name string) error {
+	path, err := entryPath(target, name)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(os.MkdirAll(path, 0755))
+}
+
+func writeEntry(target string, name string, content io.Reader) error {
+	path, err := entryPath(target, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestExpandArchiveInputs(t *testing.T) {
+	var zipped bytes.Buffer
+	zipWriter := zip.NewWriter(&zipped)
+	for name, content := range map[string]string{"mesh/beam.msh": "nodes 12\n", "solver.cfg": "iterations = 10\n"} {
+		w, _ := zipWriter.Create(name)
+		w.Write([]byte(content))
+	}
+	zipWriter.Close()
+
+	var tarred bytes.Buffer
+	gz := gzip.NewWriter(&tarred)
+	tarWriter := tar.NewWriter(gz)
+	tarWriter.WriteHeader(&tar.Header{Name: "mesh/", Typeflag: tar.TypeDir, Mode: 0755})
+	tarWriter.WriteHeader(&tar.Header{Name: "mesh/beam.msh", Typeflag: tar.TypeReg, Mode: 0644, Size: 9})
+	tarWriter.Write([]byte("nodes 12\n"))
+	tarWriter.Close()
+	gz.Close()
+
+	var escaping bytes.Buffer
+	zipWriter = zip.NewWriter(&escaping)
+	w, _ := zipWriter.Create("../escaped.txt")
+	w.Write([]byte("outside"))
+	zipWriter.Close()
+
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+	for name, artefact := range map[string]patchwork.Artefact{
+		"model": {Name: "model.zip", ContentType: "application/zip", Uri: "data:application/zip;base64," + base64.StdEncoding.EncodeToString(zipped.Bytes())},
+		"tree":  {Name: "tree.tar.gz", ContentType: "application/gzip", Uri: "data:application/gzip;base64," + base64.StdEncoding.EncodeToString(tarred.Bytes())},
+	} {
+		if err := ReadArtefact(context.Background(), &Config{}, logger, dir, name, artefact); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name, "mesh", "beam.msh"))
+		if err != nil || string(data) != "nodes 12\n" {
+			t.Errorf("Expected %s expanded, got %q: %v", name, data, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "model.zip")); !os.IsNotExist(err) {
+		t.Error("Expected the archive to be removed once expanded")
+	}
+
+	err := ReadArtefact(context.Background(), &Config{}, logger, dir, "evil", patchwork.Artefact{Name: "evil.zip", ContentType: "application/zip",
+		Uri: "data:application/zip;base64," + base64.StdEncoding.EncodeToString(escaping.Bytes())})
+	if err == nil {
+		t.Error("Expected an archive escaping its directory to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("Archive entry was written outside its directory")
+	}
+
+	if err := ReadArtefact(context.Background(), &Config{KeepInputArchives: true}, logger, dir, "kept", patchwork.Artefact{Name: "kept.zip", ContentType: "application/zip",
+		Uri: "data:application/zip;base64," + base64.StdEncoding.EncodeToString(zipped.Bytes())}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "kept.zip")); err != nil {
+		t.Errorf("Expected the archive to be kept: %v", err)
+	}
+}
+
+func TestPreserveInputNames(t *testing.T) {
+	artefact := func(name string, content string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "contentType": "text/plain",
+			"uri": "data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte(content))}
+	}
+	dir := t.TempDir()
+	calcContext := patchwork.CalculationContext{Inputs: map[string]interface{}{
+		"deck":    artefact("main.inp", "*INCLUDE, INPUT=loads.inc"),
+		"loads":   artefact("loads.inc", "first"),
+		"more":    artefact("LOADS.inc", "second"),
+		"license": artefact("license.dat", "key"),
+		"depth":   3,
+	}}
+	err := ExpandContext(context.Background(), &Config{PreserveInputNames: true}, log.New(io.Discard, "", 0), dir, calcContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, content := range map[string]string{
+		"main.inp":    "*INCLUDE, INPUT=loads.inc",
+		"loads.inc":   "first",
+		"LOADS-2.inc": "second",
+		"license.dat": "key",
+		"depth.json":  "3",
+	} {
+		if data, err := os.ReadFile(filepath.Join(dir, file)); err != nil || string(data) != content {
+			t.Errorf("Expected %s to contain %q, was %q %v", file, content, data, err)
+		}
+	}
+}
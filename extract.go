@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OutputRule pulls a scalar value out of the command's stdout and returns it
+// as an output. Either Regex (the first capture group, or the whole match if
+// there are no groups) or JsonPath (e.g. "$.results[0].stress", evaluated
+// against any line of stdout that is a JSON document) must be set. Match is
+// "last" (the default), "first" or "all".
+type OutputRule struct {
+	Name     string `json:"name"`
+	Regex    string `json:"regex"`
+	JsonPath string `json:"jsonPath"`
+	Match    string `json:"match"`
+	regex    *regexp.Regexp
+}
+
+func (rule *OutputRule) Compile() error {
+	if len(rule.Name) == 0 {
+		return errors.New("Output rule has no name")
+	}
+	if len(rule.Regex) == 0 && len(rule.JsonPath) == 0 {
+		return errors.New("Output rule " + rule.Name + " needs a regex or jsonPath")
+	}
+	switch rule.Match {
+	case "", "last", "first", "all":
+	default:
+		return errors.New("Output rule " + rule.Name + " has unknown match " + rule.Match)
+	}
+	if len(rule.Regex) > 0 {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return errors.Wrap(err, "Output rule "+rule.Name)
+		}
+		rule.regex = re
+	}
+	return nil
+}
+
+func ExtractOutputs(rules []OutputRule, stdout string) map[string]interface{} {
+	outputs := make(map[string]interface{})
+	for _, rule := range rules {
+		var values []interface{}
+		if rule.regex != nil {
+			values = ExtractRegex(rule.regex, stdout)
+		} else {
+			values = ExtractJsonPath(rule.JsonPath, stdout)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		switch rule.Match {
+		case "first":
+			outputs[rule.Name] = values[0]
+		case "all":
+			outputs[rule.Name] = values
+		default:
+			outputs[rule.Name] = values[len(values)-1]
+		}
+	}
+	return outputs
+}
+
+func ExtractRegex(re *regexp.Regexp, stdout string) []interface{} {
+	values := make([]interface{}, 0)
+	for _, match := range re.FindAllStringSubmatch(stdout, -1) {
+		if len(match) > 1 {
+			values = append(values, ParseScalar(match[1]))
+		} else {
+			values = append(values, ParseScalar(match[0]))
+		}
+	}
+	return values
+}
+
+func ExtractJsonPath(path string, stdout string) []interface{} {
+	values := make([]interface{}, 0)
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "{") && !strings.HasPrefix(line, "[") {
+			continue
+		}
+		var doc interface{}
+		if json.Unmarshal([]byte(line), &doc) != nil {
+			continue
+		}
+		value, ok := EvaluateJsonPath(path, doc)
+		if ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// EvaluateJsonPath supports the dotted/indexed subset of JSONPath, e.g.
+// "$.a.b[2].c" or "$['a']".
+func EvaluateJsonPath(path string, doc interface{}) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	current := doc
+	for len(path) > 0 {
+		var key string
+		index := -1
+		switch {
+		case strings.HasPrefix(path, "['"):
+			end := strings.Index(path, "']")
+			if end < 0 {
+				return nil, false
+			}
+			key = path[2:end]
+			path = path[end+2:]
+		case strings.HasPrefix(path, "["):
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return nil, false
+			}
+			i, err := strconv.Atoi(path[1:end])
+			if err != nil {
+				return nil, false
+			}
+			index = i
+			path = path[end+1:]
+		case strings.HasPrefix(path, "."):
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			key = path[:end]
+			path = path[end:]
+		default:
+			return nil, false
+		}
+		if index >= 0 {
+			array, ok := current.([]interface{})
+			if !ok || index >= len(array) {
+				return nil, false
+			}
+			current = array[index]
+		} else {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			current, ok = object[key]
+			if !ok {
+				return nil, false
+			}
+		}
+	}
+	return current, true
+}
+
+// ParseScalar returns s as a number or boolean if it looks like one, and as
+// a trimmed string otherwise.
+func ParseScalar(s string) interface{} {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return s
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestEvaluateJsonPath(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"results": [{"stress": 412.3}, {"stress": 380}], "a.b": {"c": true}, "name": "beam"}`), &doc)
+	for _, c := range []struct {
+		path     string
+		expected interface{}
+		ok       bool
+	}{
+		{"$.results[0].stress", 412.3, true},
+		{"$.results[1].stress", 380.0, true},
+		{" $.name ", "beam", true},
+		{"$['a.b'].c", true, true},
+		{"$['results'][1]['stress']", 380.0, true},
+		{"$", doc, true},
+		{"$.results[2].stress", nil, false},
+		{"$.results[-1]", nil, false},
+		{"$.results[x]", nil, false},
+		{"$.results[0", nil, false},
+		{"$['results'", nil, false},
+		{"$.missing", nil, false},
+		{"$.name.first", nil, false},
+		{"$.name[0]", nil, false},
+		{"$results", nil, false},
+	} {
+		value, ok := EvaluateJsonPath(c.path, doc)
+		if ok != c.ok || !reflect.DeepEqual(value, c.expected) {
+			t.Errorf("%s: expected %v %v, got %v %v", c.path, c.expected, c.ok, value, ok)
+		}
+	}
+}
+
+func TestExtractRegex(t *testing.T) {
+	stdout := "Iteration 1 residual = 1e-3\nIteration 2 residual = 2.5e-6\nConverged: true\nSolver: direct\n"
+	for _, c := range []struct {
+		regex    string
+		expected []interface{}
+	}{
+		{`residual = (\S+)`, []interface{}{1e-3, 2.5e-6}},
+		{`Iteration \d`, []interface{}{"Iteration 1", "Iteration 2"}},
+		{`Converged: (\w+)`, []interface{}{true}},
+		{`Solver: (\w+)`, []interface{}{"direct"}},
+		{`(\w+) = (\S+)`, []interface{}{"residual", "residual"}},
+		{`Diverged at (\d+)`, []interface{}{}},
+	} {
+		if values := ExtractRegex(regexp.MustCompile(c.regex), stdout); !reflect.DeepEqual(values, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.regex, c.expected, values)
+		}
+	}
+}
+
+func TestExtractOutputs(t *testing.T) {
+	stdout := "Mass = 12.5\n{\"summary\": {\"mass\": 12.5, \"step\": 1}}\nnot json {\n{\"summary\": {\"step\": 2}}\nMass = 13\n"
+	rules := []OutputRule{
+		{Name: "last", Regex: `Mass = (\S+)`},
+		{Name: "first", Regex: `Mass = (\S+)`, Match: "first"},
+		{Name: "all", Regex: `Mass = (\S+)`, Match: "all"},
+		{Name: "step", JsonPath: "$.summary.step"},
+		{Name: "mass", JsonPath: "$.summary.mass", Match: "all"},
+		{Name: "missing", Regex: `Volume = (\S+)`},
+	}
+	for i := range rules {
+		if err := rules[i].Compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]interface{}{
+		"last":  13.0,
+		"first": 12.5,
+		"all":   []interface{}{12.5, 13.0},
+		"step":  2.0,
+		"mass":  []interface{}{12.5},
+	}
+	if outputs := ExtractOutputs(rules, stdout); !reflect.DeepEqual(outputs, expected) {
+		t.Errorf("Expected %v, got %v", expected, outputs)
+	}
+
+	for _, invalid := range []OutputRule{{Regex: "x"}, {Name: "a"}, {Name: "a", Regex: "("}, {Name: "a", Regex: "x", Match: "most"}} {
+		if err := invalid.Compile(); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
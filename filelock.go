@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sharingAttempts is how many times an output file another process has open
+// is tried, backing off from sharingBackoff, about 1.5s in all.
+const sharingAttempts = 6
+const sharingBackoff = 50 * time.Millisecond
+
+// isSharingViolation reports whether err is Windows refusing a file because
+// another process has it open (ERROR_SHARING_VIOLATION) or locked
+// (ERROR_LOCK_VIOLATION), as happens when a child of the command is slow to
+// exit.
+func isSharingViolation(err error) bool {
+	var errno syscall.Errno
+	if runtime.GOOS != "windows" || !errors.As(err, &errno) {
+		return false
+	}
+	return errno == 32 || errno == 33
+}
+
+// OpenOutput opens an output file for reading, retrying with backoff while
+// another process has it open.
+func OpenOutput(path string) (*os.File, error) {
+	backoff := sharingBackoff
+	for attempt := 1; ; attempt++ {
+		file, err := os.Open(path)
+		if err == nil || attempt == sharingAttempts || !isSharingViolation(err) {
+			return file, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// ReadOutput reads an output file as os.ReadFile does, retrying as OpenOutput
+// does.
+func ReadOutput(path string) ([]byte, error) {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// WaitForOutputs waits up to OutputReleaseWait seconds for the files in
+// dirpath to be closed by other processes before they are packaged. A file is
+// open if it can't be renamed to itself, which Windows refuses unless those
+// that have it open share it for deletion, and few do. Files still open when
+// the time is up are logged and left to be retried as they are read.
+func WaitForOutputs(config *Config, logger *log.Logger, dirpath string) {
+	if config.OutputReleaseWait <= 0 {
+		return
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(config.OutputReleaseWait))
+	filepath.WalkDir(dirpath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		for {
+			err := os.Rename(path, path)
+			if !isSharingViolation(err) {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				logger.Println("Output file " + path + " is still open after " + strconv.Itoa(config.OutputReleaseWait) + "s")
+				return nil
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+}
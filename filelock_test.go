@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestReadOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "result.txt")
+	os.WriteFile(path, []byte("3.14"), 0644)
+	data, err := ReadOutput(path)
+	if err != nil || string(data) != "3.14" {
+		t.Errorf("Should read the output, gave %q %v", data, err)
+	}
+	// Other errors aren't retried
+	started := time.Now()
+	if _, err := ReadOutput(filepath.Join(dir, "missing.txt")); !os.IsNotExist(err) || time.Since(started) > sharingBackoff {
+		t.Errorf("A missing output should fail at once, gave %v", err)
+	}
+	if isSharingViolation(errors.WithStack(&os.PathError{Op: "open", Path: path, Err: syscall.ENOENT})) {
+		t.Error("Only sharing violations should be retried")
+	}
+}
+
+func TestWaitForOutputs(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "plots"), 0755)
+	os.WriteFile(filepath.Join(dir, "plots", "stress.png"), []byte("png"), 0644)
+	os.WriteFile(filepath.Join(dir, "solver.log"), []byte("done"), 0644)
+	started := time.Now()
+	WaitForOutputs(&Config{OutputReleaseWait: 1}, log.New(io.Discard, "", 0), dir)
+	if elapsed := time.Since(started); elapsed > time.Second/2 {
+		t.Errorf("Closed outputs shouldn't be waited for, took %v", elapsed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "plots", "stress.png")); err != nil {
+		t.Errorf("Outputs should be left as they were: %v", err)
+	}
+}
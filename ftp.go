@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RedactedUrl returns a URL without any password, for logs.
+func RedactedUrl(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return WithoutQuery(uri)
+	}
+	return parsed.Redacted()
+}
+
+// ftpCredentials returns the user and password to log in to the server of a
+// URL with: those in the URL, which the calculation context may give, or else
+// those of the first matching artefactAuth.
+func ftpCredentials(config *Config, parsed *url.URL) (string, string, ArtefactAuth) {
+	redacted := *parsed
+	redacted.User = nil
+	auth, _ := artefactAuthFor(config, redacted.String())
+	if parsed.User != nil {
+		password, _ := parsed.User.Password()
+		return parsed.User.Username(), password, auth
+	}
+	return auth.Username, auth.Password, auth
+}
+
+// ftpPath is the file a URL refers to, relative to the directory logged in
+// to, unless it starts with %2F.
+func ftpPath(parsed *url.URL) (string, error) {
+	file := strings.TrimPrefix(parsed.Path, "/")
+	if len(file) == 0 || strings.ContainsAny(file, "\r\n\x00") {
+		return "", errors.New("Invalid file in " + parsed.Redacted())
+	}
+	return file, nil
+}
+
+// DownloadFTPFile streams a file from an FTP server to a file, in passive
+// mode, logged in as the user of the URL or of a matching artefactAuth, or
+// else anonymously.
+func DownloadFTPFile(ctx context.Context, config *Config, fileUrl string, path string) error {
+	parsed, err := url.Parse(fileUrl)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := ftpPath(parsed)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	user, password, _ := ftpCredentials(config, parsed)
+	if len(user) == 0 {
+		user, password = "anonymous", "anonymous@"
+	}
+	address := parsed.Host
+	if len(parsed.Port()) == 0 {
+		address = net.JoinHostPort(parsed.Hostname(), "21")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	control := textproto.NewConn(conn)
+	fail := func(err error) error {
+		return errors.Wrap(err, "Could not download "+parsed.Redacted())
+	}
+	if _, _, err := control.ReadResponse(220); err != nil {
+		return fail(err)
+	}
+	code, _, err := ftpCommand(control, 0, "USER "+user)
+	if err != nil {
+		return fail(err)
+	}
+	if code == 331 {
+		if _, _, err := ftpCommand(control, 230, "PASS "+password); err != nil {
+			return fail(err)
+		}
+	} else if code != 230 {
+		return fail(errors.New("USER: " + strconv.Itoa(code)))
+	}
+	if _, _, err := ftpCommand(control, 200, "TYPE I"); err != nil {
+		return fail(err)
+	}
+	port, err := ftpPassivePort(control)
+	if err != nil {
+		return fail(err)
+	}
+	// Data is fetched from the host of the control connection, whatever a
+	// server behind NAT says its address is
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	data, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fail(err)
+	}
+	defer data.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		data.SetDeadline(deadline)
+	}
+	code, message, err := ftpCommand(control, 0, "RETR "+file)
+	if err != nil {
+		return fail(err)
+	}
+	if code != 125 && code != 150 {
+		return fail(errors.New("RETR: " + strconv.Itoa(code) + " " + message))
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(out, data)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	data.Close()
+	if err != nil {
+		return fail(err)
+	}
+	if _, _, err := control.ReadResponse(226); err != nil {
+		return fail(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	ftpCommand(control, 0, "QUIT")
+	return nil
+}
+
+// ftpCommand sends a command, returning the response, which must have the
+// code expected unless that is 0.
+func ftpCommand(control *textproto.Conn, expected int, command string) (int, string, error) {
+	if err := control.PrintfLine("%s", command); err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+	code, message, err := control.ReadResponse(expected)
+	if err != nil {
+		verb, _, _ := strings.Cut(command, " ")
+		return code, message, errors.New(verb + ": " + err.Error())
+	}
+	return code, message, nil
+}
+
+// ftpPassivePort asks the server for a port to fetch data from, with EPSV or
+// else PASV.
+func ftpPassivePort(control *textproto.Conn) (int, error) {
+	code, message, err := ftpCommand(control, 0, "EPSV")
+	if err == nil && code == 229 {
+		// 229 Entering Extended Passive Mode (|||port|)
+		start, end := strings.Index(message, "(|||"), strings.LastIndex(message, "|)")
+		if start >= 0 && end > start+4 {
+			port, err := strconv.Atoi(message[start+4 : end])
+			if err == nil && port > 0 && port < 65536 {
+				return port, nil
+			}
+		}
+	}
+	_, message, err = ftpCommand(control, 227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	start, end := strings.Index(message, "("), strings.LastIndex(message, ")")
+	if start < 0 || end < start {
+		return 0, errors.New("PASV: " + message)
+	}
+	fields := strings.Split(message[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, errors.New("PASV: " + message)
+	}
+	high, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	low, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil || high < 0 || high > 255 || low < 0 || low > 255 {
+		return 0, errors.New("PASV: " + message)
+	}
+	return high<<8 | low, nil
+}
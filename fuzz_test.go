@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func FuzzParsePayload(f *testing.F) {
+	f.Add("abc123")
+	f.Add(`{"id": "abc123", "host": "https://patchwork.example", "timeoutSeconds": 60}`)
+	f.Add(`{"message": {"messageId": "1", "data": "eyJpZCI6ICJhYmMxMjMifQ=="}}`)
+	f.Add(`{"message": {"data": 5}}`)
+	f.Add(`{"context": {"id": {"id": "abc123"}, "inputs": {"geometry": {"length": 2}}}}`)
+	f.Fuzz(func(t *testing.T, payload string) {
+		calc, err := ParsePayload(payload, "https://default.example", "token")
+		if err == nil && len(calc.Id) == 0 && strings.HasPrefix(payload, "{") {
+			t.Errorf("Parsed %q without a calculation id", payload)
+		}
+	})
+}
+
+func FuzzExpandContext(f *testing.F) {
+	f.Add(`{"inputs": {"geometry": {"length": 2}}}`)
+	f.Add(`{"inputs": {"mesh": {"name": "mesh.msh", "contentType": "text/plain", "uri": "data:text/plain;base64,MSAyCg=="}}}`)
+	f.Add(`{"inputs": {"mesh": {"name": 5, "contentType": [], "uri": "data:"}}}`)
+	f.Add(`{"inputs": {"../escape": 1, "list": [1, 2], "text": "hello", "nothing": null}}`)
+	f.Fuzz(func(t *testing.T, data string) {
+		var calcContext patchwork.CalculationContext
+		if json.Unmarshal([]byte(data), &calcContext) != nil {
+			return
+		}
+		parent := t.TempDir()
+		dir := filepath.Join(parent, "workspace")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		ExpandContext(context.Background(), &Config{}, log.Default(), dir, calcContext)
+		// Whatever the inputs, nothing may be written outside the workspace
+		entries, _ := os.ReadDir(parent)
+		if len(entries) != 1 {
+			t.Errorf("Inputs of %s written outside the workspace", data)
+		}
+		entries, _ = os.ReadDir(dir)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				t.Errorf("Inputs of %s created directory %s", data, entry.Name())
+			}
+		}
+	})
+}
+
+func FuzzParseDataUri(f *testing.F) {
+	f.Add("data:text/plain;base64,aGVsbG8=")
+	f.Add("data:text/plain,hello%20world")
+	f.Add("data:,")
+	f.Add("data:text/plain;base64")
+	f.Fuzz(func(t *testing.T, uri string) {
+		contentType, data, err := ParseDataUri(uri)
+		if err != nil {
+			return
+		}
+		encoded := "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+		_, roundTripped, err := ParseDataUri(encoded)
+		if err != nil || string(roundTripped) != string(data) {
+			t.Errorf("Data URI %q did not round trip: %v", uri, err)
+		}
+		// Decoding as it is read gives the same content
+		streamedType, reader, err := DataUriReader(uri)
+		if err != nil || streamedType != contentType {
+			t.Fatalf("Data URI %q could not be read: %v", uri, err)
+		}
+		streamed, err := io.ReadAll(reader)
+		if err != nil || string(streamed) != string(data) {
+			t.Errorf("Data URI %q read differently: %v", uri, err)
+		}
+	})
+}
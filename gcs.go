@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GCSLocation is an object, or a prefix, given as gs://bucket/object.
+type GCSLocation struct {
+	Bucket string
+	Object string
+}
+
+func ParseGCSLocation(location string) (GCSLocation, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return GCSLocation{}, errors.New("Not a gs:// location: " + location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+	if len(parts[0]) == 0 {
+		return GCSLocation{}, errors.New("No bucket in " + location)
+	}
+	gcs := GCSLocation{Bucket: parts[0]}
+	if len(parts) > 1 {
+		gcs.Object = parts[1]
+	}
+	return gcs, nil
+}
+
+func (gcs GCSLocation) String() string {
+	return "gs://" + gcs.Bucket + "/" + gcs.Object
+}
+
+// gcsEndpoint is the JSON API of Cloud Storage, or of the emulator at
+// STORAGE_EMULATOR_HOST, which like Google's own libraries is used without
+// authentication.
+func gcsEndpoint() (string, bool) {
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); len(emulator) > 0 {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		return strings.TrimSuffix(emulator, "/"), true
+	}
+	return "https://storage.googleapis.com", false
+}
+
+// GCSObjectExists reports whether there is an object at a location.
+func GCSObjectExists(ctx context.Context, config *Config, gcs GCSLocation) (bool, error) {
+	endpoint, _ := gcsEndpoint()
+	objectUrl := endpoint + "/storage/v1/b/" + url.PathEscape(gcs.Bucket) + "/o/" + url.PathEscape(gcs.Object)
+	response, err := gcsDo(ctx, config, "GET", objectUrl, gcs, nil, 0, "")
+	if err == nil {
+		response.Body.Close()
+	}
+	return exists(err)
+}
+
+// UploadGCSFile streams a file to a Cloud Storage object.
+func UploadGCSFile(ctx context.Context, config *Config, gcs GCSLocation, path string, contentType string) error {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	endpoint, _ := gcsEndpoint()
+	objectUrl := endpoint + "/upload/storage/v1/b/" + url.PathEscape(gcs.Bucket) +
+		"/o?uploadType=media&name=" + url.QueryEscape(gcs.Object)
+	response, err := gcsDo(ctx, config, "POST", objectUrl, gcs, file, info.Size(), contentType)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+// DownloadGCSFile streams a Cloud Storage object to a file.
+func DownloadGCSFile(ctx context.Context, config *Config, gcs GCSLocation, path string) error {
+	endpoint, _ := gcsEndpoint()
+	objectUrl := endpoint + "/storage/v1/b/" + url.PathEscape(gcs.Bucket) +
+		"/o/" + url.PathEscape(gcs.Object) + "?alt=media"
+	response, err := gcsDo(ctx, config, "GET", objectUrl, gcs, nil, 0, "")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
+
+// gcsDo sends an authenticated request to the JSON API, returning the
+// response if it succeeded. The caller must close its body.
+func gcsDo(ctx context.Context, config *Config, method string, objectUrl string, gcs GCSLocation, body io.Reader, length int64, contentType string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, objectUrl, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if body != nil {
+		request.ContentLength = length
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if _, emulated := gcsEndpoint(); !emulated {
+		token, err := GoogleAccessToken(ctx, config)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+		return nil, &StorageError{StatusCode: response.StatusCode, Message: method + " " + gcs.String() + " failed: " + response.Status + " " + string(message)}
+	}
+	return response, nil
+}
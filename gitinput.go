@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitSource is an input given as {"git": {"url": ..., "ref": ...}}: a
+// repository whose ref, a branch, tag or commit (by default HEAD), is cloned
+// into a directory named after the input.
+type GitSource struct {
+	Url string `json:"url"`
+	Ref string `json:"ref"`
+}
+
+// asGitSource returns the repository an input value is, if it is one.
+func asGitSource(content interface{}) (GitSource, bool) {
+	object, ok := content.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return GitSource{}, false
+	}
+	source, ok := object["git"].(map[string]interface{})
+	if !ok {
+		return GitSource{}, false
+	}
+	repository, ok := source["url"].(string)
+	if !ok || len(repository) == 0 {
+		return GitSource{}, false
+	}
+	ref, _ := source["ref"].(string)
+	return GitSource{Url: repository, Ref: ref}, true
+}
+
+// Validate checks the repository is fetched over http(s), ssh or git, and
+// that neither it nor the ref could be taken by git as an option.
+func (source *GitSource) Validate() error {
+	scp := !strings.Contains(source.Url, "://") && strings.Contains(source.Url, "@") && strings.Contains(source.Url, ":")
+	if strings.HasPrefix(source.Url, "-") || (!IsHTTPURL(source.Url) && !scp &&
+		!strings.HasPrefix(source.Url, "ssh://") && !strings.HasPrefix(source.Url, "git://")) {
+		return errors.New("Invalid git repository " + source.Url)
+	}
+	if strings.HasPrefix(source.Ref, "-") || strings.ContainsAny(source.Ref, ": \t\r\n\x00") {
+		return errors.New("Invalid git ref " + source.Ref)
+	}
+	return nil
+}
+
+// GitAvailable reports whether git is installed to clone git inputs.
+func GitAvailable() bool {
+	_, err := exec.LookPath("git")
+	return err == nil
+}
+
+// CloneGitInput fetches the ref of a repository, with no history, into a
+// directory of the workspace named after the input. Repositories at http(s)
+// URLs are authorised by the first of the configured artefactAuth whose
+// prefix they start with.
+func CloneGitInput(ctx context.Context, config *Config, logger *log.Logger, dirpath string, name string, source GitSource) error {
+	if err := source.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	target, err := JoinWithin(dirpath, name)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ref := source.Ref
+	if len(ref) == 0 {
+		ref = "HEAD"
+	}
+	env := gitEnv(config, source.Url, "")
+	logger.Println("Cloning input " + name + " from " + source.redacted() + " at " + ref)
+	if _, err := runGit(ctx, env, "", "init", "-q", target); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, args := range [][]string{
+		{"remote", "add", "origin", source.Url},
+		{"fetch", "-q", "--depth", "1", "origin", ref},
+		{"checkout", "-q", "FETCH_HEAD"},
+	} {
+		if _, err := runGit(ctx, env, target, args...); err != nil {
+			return errors.Wrap(err, "Could not clone "+source.redacted()+" at "+ref)
+		}
+	}
+	commit, err := runGit(ctx, env, target, "rev-parse", "HEAD")
+	if err == nil {
+		logger.Println("Cloned input " + name + " at commit " + commit)
+	}
+	return nil
+}
+
+// gitEnv is the environment git is run in for a repository, never prompting,
+// and sending authorization, if given, or else that of the first of the
+// configured artefactAuth whose prefix the repository is under.
+func gitEnv(config *Config, repository string, authorization string) []string {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=http:https:ssh:git")
+	if len(os.Getenv("GIT_SSH_COMMAND")) == 0 {
+		env = append(env, "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	}
+	if len(authorization) == 0 {
+		if auth, ok := artefactAuthFor(config, repository); ok {
+			authorization = auth.Authorization
+		}
+	}
+	if len(authorization) > 0 {
+		// Passed in the environment, so as not to be seen in the command line
+		env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: "+authorization)
+	}
+	return env
+}
+
+// redacted returns the URL of the repository without any password or query.
+func (source *GitSource) redacted() string {
+	parsed, err := url.Parse(source.Url)
+	if err != nil {
+		return source.Url
+	}
+	parsed.RawQuery = ""
+	return parsed.Redacted()
+}
+
+// runGit runs a git command in dir, if given, returning its output.
+func runGit(ctx context.Context, env []string, dir string, args ...string) (string, error) {
+	command := args[0]
+	if len(dir) > 0 {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.New("git " + command + " failed: " + strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
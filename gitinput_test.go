@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newGitServer serves a bare repository, solver.git, over http with the
+// commits v1 (tagged v1) and v2 on main, recording the Authorization header
+// of the last request for the function returned to give.
+func newGitServer(t *testing.T) (*httptest.Server, string, func() string) {
+	backend, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git has no exec path")
+	}
+	root := t.TempDir()
+	repository := filepath.Join(root, "solver.git")
+	work := filepath.Join(root, "work")
+	git := func(dir string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+			"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, out)
+		}
+	}
+	os.MkdirAll(work, 0755)
+	git(work, "init", "-q", "-b", "main")
+	os.WriteFile(filepath.Join(work, "solve.py"), []byte("v1"), 0644)
+	git(work, "add", ".")
+	git(work, "commit", "-q", "-m", "v1")
+	git(work, "tag", "v1")
+	os.WriteFile(filepath.Join(work, "solve.py"), []byte("v2"), 0644)
+	git(work, "commit", "-q", "-am", "v2")
+	git(root, "clone", "-q", "--bare", work, repository)
+	git(repository, "config", "http.receivepack", "true")
+
+	var mutex sync.Mutex
+	var lastAuthorization string
+	authorization := func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return lastAuthorization
+	}
+	handler := &cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(backend)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		lastAuthorization = r.Header.Get("Authorization")
+		mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, repository, authorization
+}
+
+func TestCloneGitInput(t *testing.T) {
+	if !GitAvailable() {
+		t.Skip("git is not installed")
+	}
+	server, repository, authorization := newGitServer(t)
+	logger := log.New(io.Discard, "", 0)
+	config := &Config{ArtefactAuth: []ArtefactAuth{{Prefix: server.URL + "/", Authorization: "Bearer secret"}}}
+	dir := t.TempDir()
+	for name, ref := range map[string]string{"latest": "", "release": "v1", "branch": "main"} {
+		content := map[string]interface{}{"git": map[string]interface{}{"url": server.URL + "/solver.git", "ref": ref}}
+		if err := ExpandContextFile(context.Background(), config, logger, dir, name, "", content); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	for name, expected := range map[string]string{"latest": "v2", "release": "v1", "branch": "v2"} {
+		data, err := os.ReadFile(filepath.Join(dir, name, "solve.py"))
+		if err != nil || string(data) != expected {
+			t.Errorf("%s should have been cloned at %s, was %q %v", name, expected, data, err)
+		}
+	}
+	if authorization() != "Bearer secret" {
+		t.Errorf("The clone should be authorised, was %q", authorization())
+	}
+
+	for _, source := range []GitSource{
+		{Url: server.URL + "/solver.git", Ref: "missing"},
+		{Url: "file://" + repository},
+		{Url: "ext::sh -c touch% /tmp/pwned"},
+		{Url: "--upload-pack=touch /tmp/pwned"},
+		{Url: server.URL + "/solver.git", Ref: "--upload-pack=touch"},
+		{Url: server.URL + "/solver.git", Ref: "main:refs/heads/x"},
+	} {
+		if CloneGitInput(context.Background(), config, logger, dir, "bad", source) == nil {
+			t.Errorf("Cloning %v should fail", source)
+		}
+		os.RemoveAll(filepath.Join(dir, "bad"))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// GitOutputs commits the output files of calculations whose command
+// succeeded (those matching Files, if given) to Branch of the repository at
+// Remote and pushes them, as the Author "Name <email>". The push is authorised by
+// the secret input of the calculation named Credential, if given, as a
+// "user:password" or a bearer token. With Only, the files pushed are returned
+// as references to the commit rather than as artefacts.
+type GitOutputs struct {
+	Remote     string   `json:"remote"`
+	Branch     string   `json:"branch"`
+	Credential string   `json:"credential"`
+	Files      []string `json:"files"`
+	Only       bool     `json:"only"`
+	Author     string   `json:"author"`
+}
+
+func (outputs *GitOutputs) Validate() error {
+	if len(outputs.Branch) == 0 {
+		return errors.New("Git outputs need a branch")
+	}
+	source := GitSource{Url: outputs.Remote, Ref: outputs.Branch}
+	if err := source.Validate(); err != nil {
+		return errors.WithStack(err)
+	}
+	if len(outputs.Author) > 0 && (!strings.Contains(outputs.Author, " <") || !strings.HasSuffix(outputs.Author, ">")) {
+		return errors.New("Git author " + outputs.Author + " should be Name <email>")
+	}
+	return ValidatePatterns(outputs.Files)
+}
+
+// GitPush is the commit PushGitOutputs pushed, and the outputs in it.
+type GitPush struct {
+	Commit string
+	Files  []string
+}
+
+// PushGitOutputs commits the output files in dirpath changed since the
+// snapshot before to the configured branch, which is created if it doesn't
+// exist, and pushes it. Nothing is pushed if no files match.
+func PushGitOutputs(ctx context.Context, config *Config, logger *log.Logger, dirpath string, before Snapshot, calculation string, inputs map[string]interface{}) (*GitPush, error) {
+	outputs := config.GitOutputs
+	files, err := GetChangedFiles(config, logger, dirpath, before)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pushed := &GitPush{}
+	for _, file := range files {
+		name := OutputName(dirpath, file)
+		if info, err := os.Lstat(file); err != nil || !info.Mode().IsRegular() || IsJunkFile(path.Base(name)) || !IncludesOutput(config, name) {
+			continue
+		}
+		if len(outputs.Files) == 0 || MatchesAny(outputs.Files, name, path.Base(name)) {
+			pushed.Files = append(pushed.Files, name)
+		}
+	}
+	if len(pushed.Files) == 0 {
+		return nil, nil
+	}
+	authorization := ""
+	if len(outputs.Credential) > 0 {
+		credential, ok := SecretValue(inputs[outputs.Credential])
+		if !ok {
+			return nil, errors.New("Input " + outputs.Credential + " should be a secret holding the git credential")
+		}
+		if strings.Contains(credential, ":") {
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credential))
+		} else {
+			authorization = "Bearer " + credential
+		}
+	}
+	author := outputs.Author
+	if len(author) == 0 {
+		author = "patchworkagent <patchworkagent@" + config.AgentId + ">"
+	}
+	name, email, _ := strings.Cut(strings.TrimSuffix(author, ">"), " <")
+	env := append(gitEnv(config, outputs.Remote, authorization), "GIT_AUTHOR_NAME="+name, "GIT_AUTHOR_EMAIL="+email,
+		"GIT_COMMITTER_NAME="+name, "GIT_COMMITTER_EMAIL="+email)
+
+	clone, err := os.MkdirTemp("", "gitoutputs")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(clone)
+	remote := GitSource{Url: outputs.Remote}
+	logger.Println("Pushing " + strconv.Itoa(len(pushed.Files)) + " outputs to " + outputs.Branch + " of " + remote.redacted())
+	if _, err := runGit(ctx, env, "", "init", "-q", clone); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := runGit(ctx, env, clone, "remote", "add", "origin", outputs.Remote); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := runGit(ctx, env, clone, "fetch", "-q", "--depth", "1", "origin", outputs.Branch); err == nil {
+		_, err = runGit(ctx, env, clone, "checkout", "-q", "-B", outputs.Branch, "FETCH_HEAD")
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else if heads, lsErr := runGit(ctx, env, clone, "ls-remote", "--heads", "origin", outputs.Branch); lsErr == nil && len(heads) == 0 {
+		logger.Println("Creating branch " + outputs.Branch)
+		if _, err := runGit(ctx, env, clone, "checkout", "-q", "--orphan", outputs.Branch); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	} else {
+		return nil, errors.WithStack(err)
+	}
+	for _, name := range pushed.Files {
+		target, err := JoinWithin(clone, name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := copyFile(filepath.Join(dirpath, filepath.FromSlash(name)), target); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if _, err := runGit(ctx, env, clone, "add", "-A"); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// diff --quiet fails if there are changes to commit
+	if _, err := runGit(ctx, env, clone, "diff", "--cached", "--quiet"); err == nil {
+		logger.Println("Outputs are unchanged on " + outputs.Branch)
+	} else {
+		if _, err := runGit(ctx, env, clone, "commit", "-q", "-m", "Outputs of calculation "+calculation); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, err := runGit(ctx, env, clone, "push", "-q", "origin", "HEAD:refs/heads/"+outputs.Branch); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	pushed.Commit, err = runGit(ctx, env, clone, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	logger.Println("Pushed outputs to " + outputs.Branch + " at " + pushed.Commit)
+	return pushed, nil
+}
+
+// GitOutputsConfig is the config outputs are packaged with once pushed, which
+// leaves them out if they are only to be pushed.
+func GitOutputsConfig(config *Config, pushed *GitPush) *Config {
+	if pushed == nil || !config.GitOutputs.Only {
+		return config
+	}
+	escape := strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?", "[", "\\[")
+	exclude := append([]string{}, config.Exclude...)
+	for _, name := range pushed.Files {
+		exclude = append(exclude, escape.Replace(name))
+	}
+	return config.WithOutputPatterns(nil, exclude)
+}
+
+// AddGitOutputs records the push of outputs in the response: its commit in
+// the logs, and with Only, each output as
+// {"git": {"url": ..., "ref": <commit>, "path": ...}}. A failed push is an
+// error of the calculation, whose outputs are returned as usual.
+func AddGitOutputs(config *Config, logger *log.Logger, response *patchwork.CalculationResponse, pushed *GitPush, err error) {
+	if err != nil {
+		logger.Println("Could not push outputs: " + err.Error())
+		response.AddErrors("Outputs could not be pushed to " + config.GitOutputs.Branch + ": " + err.Error())
+		return
+	}
+	if pushed == nil {
+		return
+	}
+	response.AddLogs("Pushed " + strconv.Itoa(len(pushed.Files)) + " outputs to " + config.GitOutputs.Branch + " at " + pushed.Commit)
+	if !config.GitOutputs.Only {
+		return
+	}
+	remote := GitSource{Url: config.GitOutputs.Remote}
+	for _, name := range pushed.Files {
+		AddOutput(config, logger, response, name, map[string]interface{}{
+			"git": map[string]interface{}{"url": remote.redacted(), "ref": pushed.Commit, "path": name},
+		})
+	}
+}
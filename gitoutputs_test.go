@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestPushGitOutputs(t *testing.T) {
+	if !GitAvailable() {
+		t.Skip("git is not installed")
+	}
+	server, _, authorization := newGitServer(t)
+	logger := log.New(io.Discard, "", 0)
+	config := &Config{AgentId: "agent-1", OutputDepth: 1, GitOutputs: &GitOutputs{
+		Remote: server.URL + "/solver.git", Branch: "results", Credential: "git", Files: []string{"model/*"}, Only: true,
+	}}
+	if err := config.GitOutputs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string]interface{}{"git": map[string]interface{}{"secret": true, "value": "agent:password"}}
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "model"), 0755)
+	os.WriteFile(filepath.Join(dir, "model", "beam.inp"), []byte("updated"), 0644)
+	os.WriteFile(filepath.Join(dir, "stress.csv"), []byte("1,2"), 0644)
+
+	// The branch is created by the first push, and added to by the next
+	var commits []string
+	for _, content := range []string{"updated", "refined"} {
+		os.WriteFile(filepath.Join(dir, "model", "beam.inp"), []byte(content), 0644)
+		pushed, err := PushGitOutputs(context.Background(), config, logger, dir, Snapshot{}, "c1", inputs)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if !reflect.DeepEqual(pushed.Files, []string{"model/beam.inp"}) || len(pushed.Commit) != 40 {
+			t.Fatalf("Unexpected push %+v", pushed)
+		}
+		commits = append(commits, pushed.Commit)
+	}
+	if commits[0] == commits[1] || authorization() != "Basic "+base64.StdEncoding.EncodeToString([]byte("agent:password")) {
+		t.Errorf("Expected two authorised commits, got %v with %q", commits, authorization())
+	}
+	clone := t.TempDir()
+	source := GitSource{Url: config.GitOutputs.Remote, Ref: "results"}
+	if err := CloneGitInput(context.Background(), config, logger, clone, "results", source); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(clone, "results", "model", "beam.inp")); err != nil || string(data) != "refined" {
+		t.Errorf("The branch should have the outputs, had %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(clone, "results", "stress.csv")); err == nil {
+		t.Error("Only outputs matching files should be pushed")
+	}
+
+	// Pushed outputs are returned as references to the commit
+	pushed := &GitPush{Commit: commits[1], Files: []string{"model/beam.inp"}}
+	if packaging := GitOutputsConfig(config, pushed); IncludesOutput(packaging, "model/beam.inp") || !IncludesOutput(packaging, "stress.csv") {
+		t.Error("Only the pushed outputs should be left out")
+	}
+	response := patchwork.NewCalculationResponse()
+	AddGitOutputs(config, logger, response, pushed, nil)
+	expected := map[string]interface{}{"git": map[string]interface{}{"url": server.URL + "/solver.git", "ref": commits[1], "path": "model/beam.inp"}}
+	if !reflect.DeepEqual(response.Outputs["model/beam.inp"], expected) {
+		t.Errorf("Unexpected output %v", response.Outputs)
+	}
+
+	// A push without its credential fails
+	if _, err := PushGitOutputs(context.Background(), config, logger, dir, Snapshot{}, "c1", map[string]interface{}{}); err == nil {
+		t.Error("A push without a credential should fail")
+	}
+}
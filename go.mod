@@ -1,5 +1,5 @@
 module patchworkagent
 
-go 1.17
+go 1.18
 
 require github.com/pkg/errors v0.9.1
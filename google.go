@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// googleScopes are those of the Cloud Storage artefact store and of Cloud KMS
+// keys encrypting artefacts.
+const googleScopes = "https://www.googleapis.com/auth/devstorage.read_write https://www.googleapis.com/auth/cloudkms"
+
+// GoogleCredentials is a credentials file as found by application default
+// credentials: a service account key or the user credentials of
+// `gcloud auth application-default login`.
+type GoogleCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+var googleToken = struct {
+	sync.Mutex
+	token  string
+	expiry time.Time
+}{}
+
+// GoogleAccessToken returns an OAuth2 access token found as application
+// default credentials do: from the file in GOOGLE_APPLICATION_CREDENTIALS,
+// the gcloud user credentials, or else the metadata server (as on GKE and
+// GCE). Tokens are cached until a minute before they expire.
+func GoogleAccessToken(ctx context.Context, config *Config) (string, error) {
+	googleToken.Lock()
+	defer googleToken.Unlock()
+	if len(googleToken.token) > 0 && time.Now().Add(time.Minute).Before(googleToken.expiry) {
+		return googleToken.token, nil
+	}
+	var request *http.Request
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if len(path) == 0 {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(path); err != nil {
+				path = ""
+			}
+		}
+	}
+	if len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		var creds GoogleCredentials
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return "", errors.Wrap(err, "Invalid Google credentials "+path)
+		}
+		request, err = creds.TokenRequest(ctx, time.Now())
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	} else {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if len(host) == 0 {
+			host = "metadata.google.internal"
+		}
+		var err error
+		request, err = http.NewRequestWithContext(ctx, "GET",
+			"http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		request.Header.Set("Metadata-Flavor", "Google")
+	}
+	httpClient, err := ClientFor(config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return "", errors.New("Could not get a Google access token from " + request.URL.Host + ": " + response.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", errors.WithStack(err)
+	}
+	googleToken.token = token.AccessToken
+	googleToken.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return token.AccessToken, nil
+}
+
+// TokenRequest is the request exchanging the credentials for an access
+// token: a signed JWT for a service account, or the refresh token of a user.
+func (creds GoogleCredentials) TokenRequest(ctx context.Context, now time.Time) (*http.Request, error) {
+	tokenUri := creds.TokenUri
+	if len(tokenUri) == 0 {
+		tokenUri = "https://oauth2.googleapis.com/token"
+	}
+	form := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		assertion, err := creds.SignJWT(tokenUri, now)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientId)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return nil, errors.New("Unsupported Google credentials type " + creds.Type)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenUri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
+
+// SignJWT returns a JWT asserting the service account, for an hour, signed
+// with its RS256 private key.
+func (creds GoogleCredentials) SignJWT(audience string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("No private key in Google credentials for " + creds.ClientEmail)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("Private key in Google credentials for " + creds.ClientEmail + " is not RSA")
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": googleScopes,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceAccountTokenRequest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	creds := GoogleCredentials{
+		Type:        "service_account",
+		ClientEmail: "agent@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenUri:    "https://oauth2.example/token",
+	}
+	request, err := creds.TokenRequest(context.Background(), time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if request.URL.String() != creds.TokenUri {
+		t.Errorf("Token requested from %s", request.URL)
+	}
+	request.ParseForm()
+	parts := strings.Split(request.PostForm.Get("assertion"), ".")
+	if len(parts) != 3 {
+		t.Fatalf("Invalid JWT %q", request.PostForm.Get("assertion"))
+	}
+	var claims map[string]interface{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+	if claims["iss"] != creds.ClientEmail || claims["aud"] != creds.TokenUri || claims["exp"] != float64(1700003600) {
+		t.Errorf("Unexpected claims %v", claims)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Error(err)
+	}
+}
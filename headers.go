@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"patchworkagent/patchworkclient"
+
+	"github.com/pkg/errors"
+)
+
+// UserAgent identifies the agent, its version and the machine it runs on in
+// requests to the host, unless overridden by the configured userAgent.
+func UserAgent(config *Config) string {
+	if len(config.UserAgent) > 0 {
+		return config.UserAgent
+	}
+	hostname, _ := os.Hostname()
+	return "patchworkagent/" + Version + " (" + hostname + ")"
+}
+
+// AgentHeaders are the agent's identifying and configured metadata headers
+// (e.g. team or cost-center tags) added to every request to the host.
+func AgentHeaders(config *Config) http.Header {
+	header := make(http.Header)
+	header.Set("User-Agent", UserAgent(config))
+	header.Set("X-Agent-Id", config.AgentId)
+	for name, value := range config.Headers {
+		header.Set(name, value)
+	}
+	return header
+}
+
+// NewClient returns a client for the API of a host, using the host's tenant
+// HTTP client and the agent's headers, logging to the given logger.
+func NewClient(config *Config, logger *log.Logger, host string, token string) (*patchworkclient.Client, error) {
+	httpClient, err := ClientFor(config, host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	client := patchworkclient.New(strings.TrimSuffix(host, "/"), token)
+	client.HTTPClient = httpClient
+	client.Header = AgentHeaders(config)
+	client.Logger = logger
+	client.Compress = config.CompressResults
+	client.Multipart = config.MultipartResults
+	client.ScalarsFirst = config.ScalarsFirst
+	return client, nil
+}
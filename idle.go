@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Activity tracks the calculations the server is handling, so that an agent
+// with nothing to do can shut down.
+type Activity struct {
+	mutex  sync.Mutex
+	active int
+	last   time.Time
+}
+
+func NewActivity() *Activity {
+	return &Activity{last: time.Now()}
+}
+
+func (activity *Activity) Begin() {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	activity.active++
+}
+
+func (activity *Activity) End() {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	activity.active--
+	activity.last = time.Now()
+}
+
+// IdleFor is how long the server has had no calculations, or 0 while it has
+// some.
+func (activity *Activity) IdleFor() time.Duration {
+	activity.mutex.Lock()
+	defer activity.mutex.Unlock()
+	if activity.active > 0 {
+		return 0
+	}
+	return time.Since(activity.last)
+}
+
+// WatchIdle calls onIdle once the server has been idle for timeout.
+func (activity *Activity) WatchIdle(ctx context.Context, timeout time.Duration, onIdle func()) {
+	interval := timeout / 10
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if activity.IdleFor() >= timeout {
+				onIdle()
+				return
+			}
+		}
+	}
+}
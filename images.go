@@ -0,0 +1,150 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxOptimizedPixels is the size of the largest image that is converted or
+// downscaled, as it is held in memory to be.
+const maxOptimizedPixels = 1 << 26
+
+// OptimizeImage returns the file to send for an image output. With
+// OptimizeImages, BMP and TIFF images are converted to PNG, unless that is
+// no smaller. With MaxImageSize, PNG, JPEG, BMP and TIFF images wider or
+// taller than it are scaled down to fit. The new file is written to a new
+// directory in dirpath, and any other file is returned as it is.
+func OptimizeImage(config *Config, logger *log.Logger, dirpath string, file string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	convert := config.OptimizeImages && (ext == ".bmp" || ext == ".dib" || ext == ".tif" || ext == ".tiff")
+	resizable := config.MaxImageSize > 0 && (convert || ext == ".png" || ext == ".jpg" || ext == ".jpeg")
+	if !convert && !resizable {
+		return file, nil
+	}
+	// Links are left to be checked as outputs
+	info, err := os.Lstat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return file, nil
+	}
+	in, err := OpenOutput(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer in.Close()
+	size, format, err := image.DecodeConfig(in)
+	if err != nil {
+		logger.Println("Not optimizing image " + file + ": " + err.Error())
+		return file, nil
+	}
+	if size.Width*size.Height > maxOptimizedPixels {
+		logger.Println("Not optimizing image " + file + " of " + strconv.Itoa(size.Width) + "x" + strconv.Itoa(size.Height) + " pixels")
+		return file, nil
+	}
+	scale := resizable && (size.Width > config.MaxImageSize || size.Height > config.MaxImageSize)
+	if !convert && !scale {
+		return file, nil
+	}
+	in.Seek(0, 0)
+	img, _, err := image.Decode(in)
+	if err != nil {
+		logger.Println("Not optimizing image " + file + ": " + err.Error())
+		return file, nil
+	}
+	var optimized *image.RGBA
+	if scale {
+		optimized = downscale(img, config.MaxImageSize)
+	} else {
+		optimized = image.NewRGBA(img.Bounds())
+		draw.Draw(optimized, optimized.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+
+	dir, err := os.MkdirTemp(dirpath, ".images")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	name := filepath.Base(file)
+	if format != "jpeg" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".png"
+	}
+	path := filepath.Join(dir, name)
+	out, err := os.Create(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if format == "jpeg" {
+		err = jpeg.Encode(out, optimized, &jpeg.Options{Quality: 90})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(out, optimized)
+	}
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	written, err := os.Stat(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !scale && written.Size() >= info.Size() {
+		logger.Println("Keeping image " + file + ", as PNG is no smaller")
+		os.RemoveAll(dir)
+		return file, nil
+	}
+	bounds := optimized.Bounds()
+	logger.Println("Optimized image " + file + " of " + strconv.FormatInt(info.Size(), 10) + " bytes to " + name + " of " +
+		strconv.Itoa(bounds.Dx()) + "x" + strconv.Itoa(bounds.Dy()) + " pixels and " + strconv.FormatInt(written.Size(), 10) + " bytes")
+	return path, nil
+}
+
+// downscale shrinks an image to fit within size by size pixels, each new
+// pixel the average of those of the image it covers.
+func downscale(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	newWidth, newHeight := size, size
+	if width > height {
+		newHeight = (height*size + width/2) / width
+	} else {
+		newWidth = (width*size + height/2) / height
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		y0, y1 := y*height/newHeight, (y+1)*height/newHeight
+		for x := 0; x < newWidth; x++ {
+			x0, x1 := x*width/newWidth, (x+1)*width/newWidth
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				pix := src.Pix[sy*src.Stride+4*x0 : sy*src.Stride+4*x1]
+				for i, v := range pix {
+					sum[i%4] += int(v)
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			offset := y*dst.Stride + 4*x
+			for i := range sum {
+				dst.Pix[offset+i] = uint8((sum[i] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
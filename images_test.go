@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPixel is the colour of a pixel of the test images.
+func testPixel(x int, y int) color.NRGBA {
+	return color.NRGBA{uint8(x * 7), uint8(y * 13), uint8((x * y) % 5 * 50), 0xff}
+}
+
+// bmpFixture is a bottom-up 24 bit BMP of testPixel.
+func bmpFixture(width int, height int) []byte {
+	stride := (width*3 + 3) / 4 * 4
+	var buf bytes.Buffer
+	buf.WriteString("BM")
+	binary.Write(&buf, binary.LittleEndian, []uint32{uint32(54 + stride*height), 0, 54, 40, uint32(width), uint32(height)})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 24})
+	binary.Write(&buf, binary.LittleEndian, []uint32{0, uint32(stride * height), 2835, 2835, 0, 0})
+	for y := height - 1; y >= 0; y-- {
+		row := make([]byte, stride)
+		for x := 0; x < width; x++ {
+			c := testPixel(x, y)
+			row[3*x], row[3*x+1], row[3*x+2] = c.B, c.G, c.R
+		}
+		buf.Write(row)
+	}
+	return buf.Bytes()
+}
+
+// encodeTiffLzw compresses data as TIFF does, widening codes once the table
+// reaches the next power of two.
+func encodeTiffLzw(data []byte) []byte {
+	var out []byte
+	var acc uint32
+	bits := 0
+	emit := func(code int, width int) {
+		acc = acc<<width | uint32(code)
+		bits += width
+		for bits >= 8 {
+			out = append(out, byte(acc>>(bits-8)))
+			bits -= 8
+		}
+	}
+	width := 9
+	emit(256, width)
+	table := make(map[string]int)
+	code := func(s string) int {
+		if len(s) == 1 {
+			return int(s[0])
+		}
+		return table[s]
+	}
+	next := 258
+	prefix := string(data[:1])
+	for _, b := range data[1:] {
+		s := prefix + string([]byte{b})
+		if _, ok := table[s]; ok {
+			prefix = s
+			continue
+		}
+		emit(code(prefix), width)
+		table[s] = next
+		next++
+		if next == 1<<width && width < 12 {
+			width++
+		}
+		if next == 4094 {
+			emit(256, width)
+			table, next, width = make(map[string]int), 258, 9
+		}
+		prefix = string([]byte{b})
+	}
+	emit(code(prefix), width)
+	emit(257, width)
+	if bits > 0 {
+		out = append(out, byte(acc<<(8-bits)))
+	}
+	return out
+}
+
+// tiffFixture is a little endian RGB TIFF of testPixel, in two strips
+// compressed with compression.
+func tiffFixture(width int, height int, compression uint16) []byte {
+	rows := make([][]byte, 2)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := testPixel(x, y)
+			rows[2*y/height] = append(rows[2*y/height], c.R, c.G, c.B)
+		}
+	}
+	strips := make([][]byte, 2)
+	for i, strip := range rows {
+		switch compression {
+		case tiffNone:
+			strips[i] = strip
+		case tiffLzw:
+			strips[i] = encodeTiffLzw(strip)
+		case tiffDeflate:
+			var buf bytes.Buffer
+			writer := zlib.NewWriter(&buf)
+			writer.Write(strip)
+			writer.Close()
+			strips[i] = buf.Bytes()
+		case tiffPackBits:
+			// Runs of the first byte, then literals
+			strips[i] = []byte{0xfe, strip[0]}
+			for rest := strip[3:]; len(rest) > 0; {
+				n := len(rest)
+				if n > 128 {
+					n = 128
+				}
+				strips[i] = append(append(strips[i], byte(n-1)), rest[:n]...)
+				rest = rest[n:]
+			}
+		}
+	}
+	if compression == tiffPackBits {
+		// The run above stands for three copies of the first byte
+		for i := range rows {
+			rows[i][1], rows[i][2] = rows[i][0], rows[i][0]
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, binary.LittleEndian, uint32(8))
+	entries := []struct {
+		tag, kind uint16
+		values    []uint32
+	}{
+		{tiffWidth, 4, []uint32{uint32(width)}},
+		{tiffHeight, 4, []uint32{uint32(height)}},
+		{tiffBitsPerSample, 3, []uint32{8, 8, 8}},
+		{tiffCompression, 3, []uint32{uint32(compression)}},
+		{tiffPhotometric, 3, []uint32{tiffRgb}},
+		{tiffStripOffsets, 4, []uint32{0, 0}},
+		{tiffSamplesPerPixel, 3, []uint32{3}},
+		{tiffStripByteCounts, 4, []uint32{uint32(len(strips[0])), uint32(len(strips[1]))}},
+	}
+	// Values that don't fit in an entry, then the strips, follow the directory
+	extra := 8 + 2 + 12*len(entries) + 4
+	offsets := make([]uint32, len(entries))
+	for i, entry := range entries {
+		if len(entry.values)*map[uint16]int{3: 2, 4: 4}[entry.kind] > 4 {
+			offsets[i] = uint32(extra)
+			extra += 4 * len(entry.values)
+		}
+	}
+	entries[5].values = []uint32{uint32(extra), uint32(extra + len(strips[0]))}
+	binary.Write(&buf, binary.LittleEndian, uint16(len(entries)))
+	for i, entry := range entries {
+		binary.Write(&buf, binary.LittleEndian, []uint16{entry.tag, entry.kind})
+		binary.Write(&buf, binary.LittleEndian, uint32(len(entry.values)))
+		if offsets[i] > 0 {
+			binary.Write(&buf, binary.LittleEndian, offsets[i])
+		} else if entry.kind == 3 {
+			binary.Write(&buf, binary.LittleEndian, []uint16{uint16(entry.values[0]), 0})
+		} else {
+			binary.Write(&buf, binary.LittleEndian, entry.values[0])
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+	for i, entry := range entries {
+		if offsets[i] == 0 {
+			continue
+		}
+		for _, value := range entry.values {
+			if entry.kind == 3 {
+				binary.Write(&buf, binary.LittleEndian, []uint16{uint16(value), 0})
+			} else {
+				binary.Write(&buf, binary.LittleEndian, value)
+			}
+		}
+	}
+	buf.Write(strips[0])
+	buf.Write(strips[1])
+	return buf.Bytes()
+}
+
+func checkTestPixels(t *testing.T, name string, img image.Image, width int, height int) {
+	if img.Bounds() != image.Rect(0, 0, width, height) {
+		t.Fatalf("%s should be %dx%d, was %v", name, width, height, img.Bounds())
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if c := color.NRGBAModel.Convert(img.At(x, y)); c != testPixel(x, y) {
+				t.Fatalf("%s pixel %d,%d should be %v, was %v", name, x, y, testPixel(x, y), c)
+			}
+		}
+	}
+}
+
+func TestDecodeImages(t *testing.T) {
+	img, format, err := image.Decode(bytes.NewReader(bmpFixture(5, 3)))
+	if err != nil || format != "bmp" {
+		t.Fatalf("BMP should decode, gave %s %v", format, err)
+	}
+	checkTestPixels(t, "BMP", img, 5, 3)
+
+	for _, compression := range []uint16{tiffNone, tiffLzw, tiffDeflate, tiffPackBits} {
+		data := tiffFixture(37, 30, compression)
+		img, format, err := image.Decode(bytes.NewReader(data))
+		if err != nil || format != "tiff" {
+			t.Fatalf("TIFF with compression %d should decode, gave %s %v", compression, format, err)
+		}
+		if compression == tiffPackBits {
+			// Only the runs differ from testPixel
+			if c := color.NRGBAModel.Convert(img.At(1, 0)); c != testPixel(1, 0) {
+				t.Errorf("PackBits TIFF pixel should be %v, was %v", testPixel(1, 0), c)
+			}
+			continue
+		}
+		checkTestPixels(t, "TIFF", img, 37, 30)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(tiffFixture(37, 30, 7))); err == nil {
+		t.Error("TIFF with JPEG compression should be unsupported")
+	}
+}
+
+func TestOptimizeImage(t *testing.T) {
+	dir := t.TempDir()
+	logger := log.New(io.Discard, "", 0)
+	os.WriteFile(filepath.Join(dir, "plot.bmp"), bmpFixture(300, 200), 0644)
+	os.WriteFile(filepath.Join(dir, "field.tiff"), tiffFixture(37, 30, tiffNone), 0644)
+
+	file, err := OptimizeImage(&Config{OptimizeImages: true}, logger, dir, filepath.Join(dir, "field.tiff"))
+	if err != nil || filepath.Base(file) != "field.png" || !IsWithin(dir, file) {
+		t.Fatalf("TIFF should be converted to PNG in the workspace, gave %s %v", file, err)
+	}
+	converted, _ := os.Open(file)
+	img, format, err := image.Decode(converted)
+	converted.Close()
+	if err != nil || format != "png" {
+		t.Fatalf("Converted image should be a PNG, was %s %v", format, err)
+	}
+	checkTestPixels(t, "Converted TIFF", img, 37, 30)
+
+	file, err = OptimizeImage(&Config{OptimizeImages: true, MaxImageSize: 100}, logger, dir, filepath.Join(dir, "plot.bmp"))
+	if err != nil || !strings.HasSuffix(file, "plot.png") {
+		t.Fatalf("BMP should be converted to PNG, gave %s %v", file, err)
+	}
+	summary := SummariseFile(file, "image/png")
+	if summary["width"] != 100 || summary["height"] != 67 {
+		t.Errorf("BMP should be scaled to 100x67, was %v", summary)
+	}
+
+	// Without either, images are left alone
+	for _, config := range []*Config{{}, {MaxImageSize: 400}} {
+		if file, _ := OptimizeImage(config, logger, dir, filepath.Join(dir, "plot.bmp")); file != filepath.Join(dir, "plot.bmp") {
+			t.Errorf("Image shouldn't be optimized with %+v, was %s", config, file)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// WriteCachedArtefact writes an artefact in a data URI to a file from the
+// input cache, a directory of decoded artefacts named by the SHA-256 of
+// their URI, decoding it into the cache first if it isn't there. With
+// SeparateOutputs the file is hard linked to the cache, as inputs are
+// read-only; otherwise it is copied, so that a command changing an input
+// can't change the cache.
+func WriteCachedArtefact(ctx context.Context, config *Config, logger *log.Logger, path string, artefact patchwork.Artefact) error {
+	cached := InputCachePath(config, sha256Hex([]byte(artefact.Uri)))
+	if _, err := os.Stat(cached); os.IsNotExist(err) {
+		err = cacheArtefact(cached, artefact)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if err != nil {
+		return errors.WithStack(err)
+	} else {
+		logger.Println("Using cached input file for " + path)
+	}
+	if config.SeparateOutputs {
+		if err := os.Link(cached, path); err == nil {
+			logger.Println("Linked input file " + path + " to " + cached)
+			return nil
+		}
+	}
+	logger.Println("Copying input file " + path + " from " + cached)
+	return errors.WithStack(copyFile(cached, path))
+}
+
+// InputCachePath is where an artefact is kept in the input cache, by the
+// SHA-256 (hex) of its URI.
+func InputCachePath(config *Config, key string) string {
+	return filepath.Join(config.InputCache, key[:2], key)
+}
+
+// cacheArtefact decodes an artefact into the cache, writing it under another
+// name first so that concurrent calculations never see it half written.
+func cacheArtefact(cached string, artefact patchwork.Artefact) error {
+	_, content, err := DataUriReader(artefact.Uri)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.MkdirAll(filepath.Dir(cached), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cached), ".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(tmp, content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cached)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return errors.WithStack(err)
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestInputCache(t *testing.T) {
+	cache := t.TempDir()
+	artefact := patchwork.Artefact{Name: "mesh.txt", ContentType: "text/plain", Uri: "data:text/plain;base64,bWVzaA=="}
+	first, second := t.TempDir(), t.TempDir()
+	config := &Config{InputCache: cache}
+	if err := ReadArtefact(context.Background(), config, log.Default(), first, "mesh", artefact); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	config.SeparateOutputs = true
+	if err := ReadArtefact(context.Background(), config, log.Default(), second, "mesh", artefact); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, dir := range []string{first, second} {
+		if data, _ := os.ReadFile(filepath.Join(dir, "mesh.txt")); string(data) != "mesh" {
+			t.Errorf("Expected the decoded input in %s, got %q", dir, data)
+		}
+	}
+	key := sha256Hex([]byte(artefact.Uri))
+	cached, err := os.Stat(filepath.Join(cache, key[:2], key))
+	if err != nil {
+		t.Fatalf("Expected the input in the cache: %v", err)
+	}
+	copied, _ := os.Stat(filepath.Join(first, "mesh.txt"))
+	linked, _ := os.Stat(filepath.Join(second, "mesh.txt"))
+	if os.SameFile(cached, copied) {
+		t.Errorf("Expected a copy of the cached input without separate outputs")
+	}
+	if !os.SameFile(cached, linked) {
+		t.Errorf("Expected a link to the cached input with separate outputs")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// PreservedInputFiles chooses the files to write input artefacts to under
+// their own names, by input name. Inputs are taken in order of name, and an
+// artefact whose name is already taken, ignoring case, is numbered from 2
+// before its extension, so deck.inc becomes deck-2.inc. Artefacts with names
+// that aren't valid file names are left out, to be named after their inputs.
+func PreservedInputFiles(logger *log.Logger, inputs map[string]interface{}) map[string]string {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, name := range names {
+		artefact, ok := asArtefact(inputs[name])
+		if !ok || !ValidInputName(artefact.Name) {
+			continue
+		}
+		file := artefact.Name
+		for i := 2; taken[strings.ToLower(file)]; i++ {
+			file = numberedName(artefact.Name, i)
+		}
+		if file != artefact.Name {
+			logger.Println("Writing input " + name + " to " + file + " as " + artefact.Name + " is taken")
+		}
+		taken[strings.ToLower(file)] = true
+		files[name] = file
+	}
+	return files
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"patchworkagent/patchwork"
+	"patchworkagent/patchworkclient"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata/golden")
+
+// TestGolden runs each calculation in testdata/golden against a stub server
+// serving its context.json, with its config.json, and compares the response
+// the agent uploads with response.json. The command is this test binary
+// acting as a canned solver (see TestHelperCommand), so the results are the
+// same on every platform. Run with -update to rewrite the golden files.
+func TestGolden(t *testing.T) {
+	cases, err := os.ReadDir(filepath.Join("testdata", "golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cases {
+		name := c.Name()
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join("testdata", "golden", name)
+			response := RunGolden(t, dir, name)
+			golden := filepath.Join(dir, "response.json")
+			if *update {
+				err := os.WriteFile(golden, response, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bytes.ReplaceAll(expected, []byte("\r\n"), []byte("\n"))) != string(response) {
+				t.Errorf("Response differs from %s:\n%s", golden, response)
+			}
+		})
+	}
+}
+
+// RunGolden runs a calculation against a stub server and returns the
+// response it uploaded, indented with sorted keys.
+func RunGolden(t *testing.T, dir string, name string) []byte {
+	calcContext, err := os.ReadFile(filepath.Join(dir, "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, uploaded := NewStubHost(t, name, calcContext)
+	defer server.Close()
+
+	configPath := filepath.Join(dir, "config.json")
+	if _, err := os.Stat(configPath); err != nil {
+		configPath = ""
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RunCalculation(context.Background(), config, HelperCommand(t, name), &Job{
+		Host:        server.URL,
+		Token:       "token",
+		Calculation: name,
+		Dir:         t.TempDir(),
+		Timeout:     60,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var response interface{}
+	err = json.Unmarshal(*uploaded, &response)
+	if err != nil {
+		t.Fatalf("Invalid response %s: %v", *uploaded, err)
+	}
+	indented, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(indented, '\n')
+}
+
+// NewStubHost serves the context of a calculation, and records the result
+// uploaded for it.
+func NewStubHost(t *testing.T, name string, calcContext []byte) (*httptest.Server, *[]byte) {
+	uploaded := new([]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/calculations/remote/"+name:
+			w.Write(calcContext)
+		case r.Method == "POST" && r.URL.Path == "/api/calculations/logs/"+name:
+		case r.Method == "POST" && r.URL.Path == "/api/calculations/remote/"+name:
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				var err error
+				body, err = gzip.NewReader(r.Body)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			*uploaded, _ = io.ReadAll(body)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	return server, uploaded
+}
+
+// HelperCommand is the command running this test binary as the solver for
+// the golden case name.
+func HelperCommand(t *testing.T, name string) string {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The agent strips quotes around the whole command, so it mustn't start
+	// with the quoted executable; "cd . &&" works in both bash and cmd
+	return fmt.Sprintf("cd . && \"%s\" -test.run=^TestHelperCommand$ -- %s", executable, name)
+}
+
+// TestOutputsReadFromWorkspace runs a calculation as the server does, in a
+// workspace other than the agent's working directory, which holds a stale
+// output of the same name, and checks that the outputs are read from the
+// workspace.
+func TestOutputsReadFromWorkspace(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "scalar-outputs", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, uploaded := NewStubHost(t, "scalar-outputs", calcContext)
+	defer server.Close()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentDir := t.TempDir()
+	os.WriteFile(filepath.Join(agentDir, "result.json"), []byte(`{"area": 99}`), 0644)
+	if err := os.Chdir(agentDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+
+	workspace, err := os.MkdirTemp(agentDir, "calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RunCalculation(context.Background(), &Config{}, HelperCommand(t, "scalar-outputs"), &Job{
+		Host:        server.URL,
+		Token:       "token",
+		Calculation: "scalar-outputs",
+		Dir:         workspace,
+		Timeout:     60,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var response struct {
+		Outputs map[string]json.RawMessage `json:"outputs"`
+	}
+	if err := json.Unmarshal(*uploaded, &response); err != nil {
+		t.Fatal(err)
+	}
+	if string(response.Outputs["result.json"]) != `{"area":1}` {
+		t.Errorf("Expected result.json from the workspace, got %s", response.Outputs["result.json"])
+	}
+}
+
+// TestResultCallback checks that the result of a calculation with a callback
+// is posted to the callback rather than the host.
+func TestResultCallback(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "scalar-outputs", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, uploaded := NewStubHost(t, "scalar-outputs", calcContext)
+	defer server.Close()
+	var authorization string
+	var called []byte
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		called, _ = io.ReadAll(r.Body)
+	}))
+	defer callback.Close()
+
+	err = RunCalculation(context.Background(), &Config{}, HelperCommand(t, "scalar-outputs"), &Job{
+		Host:        server.URL,
+		Token:       "token",
+		Calculation: "scalar-outputs",
+		Dir:         t.TempDir(),
+		Timeout:     60,
+		Callback:    &patchwork.Callback{Url: callback.URL + "/results/1", Authorization: "Basic c2VjcmV0"},
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(*uploaded) > 0 {
+		t.Error("Result was posted to the host")
+	}
+	if authorization != "Basic c2VjcmV0" || !strings.Contains(string(called), "result.json") {
+		t.Errorf("Unexpected callback with %s: %s", authorization, called)
+	}
+}
+
+// TestPresignedUpload checks that a large output is uploaded to a URL
+// presigned by the host, and only referred to in the result.
+func TestPresignedUpload(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "scalar-outputs", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, uploaded := NewStubHost(t, "scalar-outputs", calcContext)
+	defer host.Close()
+	var stored []byte
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Query().Get("signature") != "abc" {
+			w.WriteHeader(403)
+			return
+		}
+		stored, _ = io.ReadAll(r.Body)
+	}))
+	defer storage.Close()
+	presign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/calculations/uploads/scalar-outputs" {
+			// Anything else is for the host
+			host.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		var upload patchwork.UploadRequest
+		json.NewDecoder(r.Body).Decode(&upload)
+		json.NewEncoder(w).Encode(patchwork.PresignedUpload{
+			Url: storage.URL + "/" + upload.Name + "?signature=abc",
+			Uri: "https://files.example/" + upload.Name,
+		})
+	}))
+	defer presign.Close()
+
+	err = RunCalculation(context.Background(), &Config{PresignedUploadSize: 10}, HelperCommand(t, "scalar-outputs"), &Job{
+		Host:        presign.URL,
+		Token:       "token",
+		Calculation: "scalar-outputs",
+		Dir:         t.TempDir(),
+		Timeout:     60,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var response struct {
+		Outputs map[string]json.RawMessage `json:"outputs"`
+	}
+	if err := json.Unmarshal(*uploaded, &response); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(response.Outputs["report.txt"]), `"uri":"https://files.example/report.txt"`) {
+		t.Errorf("Expected report.txt to refer to the upload, got %s", response.Outputs["report.txt"])
+	}
+	if string(stored) != "Mesh has 2 lines\n" {
+		t.Errorf("Unexpected upload %q", stored)
+	}
+}
+
+// TestDeltaUpload checks that an output is sent as a delta against the
+// previous version the host has, which the host can apply.
+func TestDeltaUpload(t *testing.T) {
+	previous := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	path := filepath.Join(t.TempDir(), "mesh.vtu")
+	os.WriteFile(path, append(append([]byte{}, previous[:30000]...), append([]byte("changed"), previous[30000:]...)...), 0644)
+	var applied bytes.Buffer
+	var header http.Header
+	host := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/calculations/signatures/calc1/mesh.vtu":
+			signatures, _ := patchwork.ComputeSignatures(bytes.NewReader(previous), 2048)
+			signatures.Uri = "https://files.example/v1/mesh.vtu"
+			json.NewEncoder(w).Encode(signatures)
+		case "/api/calculations/deltas/calc1/mesh.vtu":
+			header = r.Header
+			if err := patchwork.ApplyDelta(&applied, bytes.NewReader(previous), r.Body); err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(patchwork.Artefact{Uri: "https://files.example/v2/mesh.vtu"})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer host.Close()
+
+	presigner := &Presigner{Config: &Config{}, Client: patchworkclient.New(host.URL, "token"), Calculation: "calc1"}
+	artefact, ok, err := presigner.UploadDelta(context.Background(), log.Default(), path, "application/x-vtu+xml")
+	if err != nil || !ok {
+		t.Fatalf("Expected a delta upload, got %v %+v", ok, err)
+	}
+	content, _ := os.ReadFile(path)
+	hash, _ := HashFile(path)
+	if !bytes.Equal(applied.Bytes(), content) || header.Get("X-Content-Sha256") != hash || header.Get("X-Base-Uri") != "https://files.example/v1/mesh.vtu" {
+		t.Errorf("Unexpected delta with %v", header)
+	}
+	if artefact.Uri != "https://files.example/v2/mesh.vtu" || artefact.Name != "mesh.vtu" {
+		t.Errorf("Unexpected artefact %+v", artefact)
+	}
+
+	// Without a previous version the output is sent some other way
+	presigner.Calculation = "calc2"
+	if _, ok, err := presigner.UploadDelta(context.Background(), log.Default(), path, "application/x-vtu+xml"); ok || err != nil {
+		t.Errorf("Expected no delta upload, got %v %v", ok, err)
+	}
+}
+
+// TestManifest checks the summary of a calculation given to the command
+// line caller.
+func TestManifest(t *testing.T) {
+	for _, name := range []string{"scalar-outputs", "failing-command"} {
+		calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", name, "context.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, _ := NewStubHost(t, name, calcContext)
+		defer server.Close()
+		manifest := &Manifest{}
+		err = RunCalculation(context.Background(), &Config{}, HelperCommand(t, name), &Job{
+			Host:        server.URL,
+			Token:       "token",
+			Calculation: name,
+			Dir:         t.TempDir(),
+			Timeout:     60,
+			Manifest:    manifest,
+		})
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if name == "failing-command" {
+			if manifest.Status != "failed" || *manifest.ExitCode != 3 || manifest.ExitStatus() != ExitExecutionFailed {
+				t.Errorf("Expected an execution failure with exit code 3, got %+v", manifest)
+			}
+			continue
+		}
+		if manifest.Status != "succeeded" || manifest.ExitStatus() != 0 || len(manifest.Outputs) != 2 {
+			t.Fatalf("Unexpected manifest %+v", manifest)
+		}
+		report := manifest.Outputs[0]
+		if report.Name != "report.txt" || report.Size != 17 || !strings.HasPrefix(report.ContentType, "text/plain") || len(report.Uri) > 0 {
+			t.Errorf("Unexpected output %+v", report)
+		}
+		summary := manifest.Summary("agent-1")
+		if summary.Calculation != name || summary.AgentId != "agent-1" || summary.Status != "succeeded" || summary.Outputs != 2 ||
+			summary.BytesUploaded != report.Size+manifest.Outputs[1].Size {
+			t.Errorf("Unexpected summary %+v", summary)
+		}
+	}
+}
+
+// TestManifestFetchFailure checks that a calculation whose context can't be
+// fetched is told apart from one that fails to run.
+func TestManifestFetchFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+	manifest := &Manifest{}
+	err := RunCalculation(context.Background(), &Config{}, HelperCommand(t, "scalar-outputs"), &Job{
+		Host:        server.URL,
+		Token:       "token",
+		Calculation: "missing",
+		Dir:         t.TempDir(),
+		Timeout:     60,
+		Manifest:    manifest,
+	})
+	if err == nil || manifest.Failure != "fetch" || manifest.ExitStatus() != ExitFetchFailed {
+		t.Errorf("Expected a fetch failure, got %+v: %v", manifest, err)
+	}
+}
+
+// TestHelperCommand is not a real test: when run by RunGolden as the
+// calculation command, it behaves as the solver for the golden case named
+// after "--" on its command line.
+func TestHelperCommand(t *testing.T) {
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return
+	}
+	var geometry struct {
+		Length float64 `json:"length"`
+		Width  float64 `json:"width"`
+	}
+	data, err := os.ReadFile(filepath.Join(os.Getenv("INPUTS"), "geometry.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &geometry)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	switch args[1] {
+	case "scalar-outputs":
+		fmt.Println("Solving beam")
+		mesh, err := os.ReadFile("mesh.msh")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		result, _ := json.Marshal(map[string]float64{"area": geometry.Length * geometry.Width})
+		os.WriteFile("result.json", result, 0644)
+		lines := len(strings.Split(strings.TrimSpace(string(mesh)), "\n"))
+		os.WriteFile("report.txt", []byte(fmt.Sprintf("Mesh has %d lines\n", lines)), 0644)
+		fmt.Println("Max stress = 412.3 MPa")
+	case "separate-outputs":
+		fmt.Println("Solving beam")
+		result, _ := json.Marshal(map[string]float64{"area": geometry.Length * geometry.Width})
+		os.WriteFile(filepath.Join(os.Getenv("OUTPUTS"), "result.json"), result, 0644)
+		os.WriteFile("scratch.txt", []byte("Not an output\n"), 0644)
+	case "failing-command":
+		fmt.Println("Solving beam")
+		fmt.Fprintln(os.Stderr, "Length must be positive")
+		os.Exit(3)
+	}
+	os.Exit(0)
+}
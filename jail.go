@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// windowsDevices are names Windows opens as devices in any directory,
+// whatever their extension.
+var windowsDevices = []string{"con", "prn", "aux", "nul",
+	"com1", "com2", "com3", "com4", "com5", "com6", "com7", "com8", "com9",
+	"lpt1", "lpt2", "lpt3", "lpt4", "lpt5", "lpt6", "lpt7", "lpt8", "lpt9"}
+
+// JoinWithin returns the path of a file named by the calculation, such as an
+// input, artefact or archive entry, relative to dir. Both / and \ separate
+// directories in it, whatever the platform. It fails if the name is empty,
+// absolute or has a drive, contains NUL, or leads outside dir, whether by ..
+// or through a symlink already in dir.
+func JoinWithin(dir string, name string) (string, error) {
+	if len(name) == 0 || strings.ContainsRune(name, 0) {
+		return "", errors.New("Invalid name " + strings.ReplaceAll(name, "\x00", "\\0"))
+	}
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(slashed, "/") || filepath.IsAbs(name) || len(filepath.VolumeName(name)) > 0 ||
+		(len(name) >= 2 && name[1] == ':') {
+		return "", errors.New("Name " + name + " is absolute")
+	}
+	path := filepath.Join(dir, filepath.FromSlash(slashed))
+	if !IsWithin(dir, path) || path == filepath.Clean(dir) {
+		return "", errors.New("Name " + name + " is outside the workspace")
+	}
+	if runtime.GOOS == "windows" {
+		for _, part := range strings.Split(slashed, "/") {
+			base := strings.ToLower(strings.TrimRight(part, ". "))
+			if i := strings.Index(base, "."); i >= 0 {
+				base = base[:i]
+			}
+			for _, device := range windowsDevices {
+				if base == device {
+					return "", errors.New("Name " + name + " is a device")
+				}
+			}
+		}
+	}
+	// The deepest part of the path that exists must resolve to within dir
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return path, nil
+	}
+	for existing := path; IsWithin(dir, existing); existing = filepath.Dir(existing) {
+		if _, err := os.Lstat(existing); err != nil {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err != nil || !IsWithin(resolvedDir, resolved) {
+			return "", errors.New("Name " + name + " is outside the workspace through a symlink")
+		}
+		break
+	}
+	return path, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+var hostileNames = []string{
+	"",
+	".",
+	"..",
+	"../x",
+	"../../etc/cron.d/x",
+	"a/../../x",
+	"a/b/../../..",
+	"..\\..\\x",
+	"a\\..\\..\\x",
+	"/etc/passwd",
+	"\\etc\\passwd",
+	"C:\\Windows\\x",
+	"C:x",
+	"x\x00.txt",
+}
+
+func TestJoinWithin(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range hostileNames {
+		if path, err := JoinWithin(dir, name); err == nil {
+			t.Errorf("Name %q should be rejected, gave %s", name, path)
+		}
+	}
+	for name, expected := range map[string]string{
+		"deck.inp":       "deck.inp",
+		"a/b/../c.txt":   "a/c.txt",
+		"sub\\mesh.msh":  "sub/mesh.msh",
+		"..hidden":       "..hidden",
+		"a..b/..c":       "a..b/..c",
+		"./results.json": "results.json",
+	} {
+		if path, err := JoinWithin(dir, name); err != nil || path != filepath.Join(dir, filepath.FromSlash(expected)) {
+			t.Errorf("Name %q should be %s, was %s %v", name, expected, path, err)
+		}
+	}
+
+	// A symlink in the directory can't be followed out of it
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Skip("Symlinks aren't supported")
+	}
+	for _, name := range []string{"link", "link/x", "link/a/b"} {
+		if _, err := JoinWithin(dir, name); err == nil {
+			t.Errorf("Name %q through a symlink out of the directory should be rejected", name)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.Symlink(filepath.Join(dir, "sub"), filepath.Join(dir, "inside"))
+	if _, err := JoinWithin(dir, "inside/x"); err != nil {
+		t.Errorf("Symlinks within the directory should be followed: %v", err)
+	}
+}
+
+func TestHostileInputs(t *testing.T) {
+	artefact := func(name string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "contentType": "text/plain",
+			"uri": "data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte("x"))}
+	}
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "inputs")
+	os.Mkdir(dir, 0755)
+	logger := log.New(io.Discard, "", 0)
+	for _, config := range []*Config{{}, {PreserveInputNames: true}} {
+		for _, name := range hostileNames {
+			// As the name of an input, and of an artefact
+			calcContext := patchwork.CalculationContext{Inputs: map[string]interface{}{name: 1}}
+			if err := ExpandContext(context.Background(), config, logger, dir, calcContext); err == nil {
+				t.Errorf("Input %q should be rejected", name)
+			}
+			calcContext = patchwork.CalculationContext{Inputs: map[string]interface{}{"deck": artefact(name)}}
+			ExpandContext(context.Background(), config, logger, dir, calcContext)
+		}
+	}
+	entries, _ := os.ReadDir(parent)
+	if len(entries) != 1 {
+		t.Errorf("Files were written outside the inputs: %v", entries)
+	}
+	if err := (&FileSink{Path: dir}).SendResult(context.Background(), "../escaped", patchwork.NewCalculationResponse()); err == nil {
+		t.Error("Calculation id leading outside the sink should be rejected")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoWorker is returned by a Job's WaitTurn when no worker became free in
+// time to run it.
+var ErrNoWorker = errors.New("No worker available")
+
+// Job is a calculation to be run in the workspace Dir, reporting to Host.
+type Job struct {
+	Host        string
+	Token       string
+	Calculation string
+	Dir         string
+	Timeout     int
+	// Queued is when the calculation was accepted, if not when it is run.
+	Queued time.Time
+	// Context, if set, is the context of the calculation, so that it needn't
+	// be fetched.
+	Context *patchwork.CalculationContext
+	// Callback, if set, is where the result is posted instead.
+	Callback *patchwork.Callback
+	// WaitTurn, if set, is called once the inputs have been expanded and
+	// blocks until the calculation may be run.
+	WaitTurn func() error
+	// Logger, if set, is used for the messages about this calculation in
+	// place of one prefixed with its id.
+	Logger *log.Logger
+	// Manifest, if set, is filled in with the outcome of the calculation.
+	Manifest *Manifest
+	// Include and Exclude, if set, replace the configured patterns for which
+	// output files are returned.
+	Include []string
+	Exclude []string
+	// Workspaces, if set, is the directory to create the workspace of the
+	// calculation in, once its type is known, which is then Dir.
+	Workspaces string
+	// Keep is set if the workspace is to be kept after the calculation.
+	Keep bool
+}
+
+type PubSubPayload struct {
+	Message PubSubMessage `json:"message"`
+}
+
+type PubSubMessage struct {
+	MessageId   string `json:"messageId"`
+	PublishTime string `json:"publishTime"`
+	Data        string `json:"data"`
+}
+
+// ParsePayload reads the body of a request to run a calculation: either a
+// bare calculation id, to be run against the default host, a JSON
+// CalculationPayload, or a Google Pub/Sub push message wrapping one. A
+// payload with an inline context needn't repeat the calculation id.
+func ParsePayload(payload string, host string, token string) (patchwork.CalculationPayload, error) {
+	calc, err := parsePayload(payload, host, token)
+	if err == nil && calc.Callback != nil {
+		callback, err := url.Parse(calc.Callback.Url)
+		if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") || len(callback.Host) == 0 {
+			return calc, errors.New("Invalid callback URL " + calc.Callback.Url)
+		}
+	}
+	for _, patterns := range [][]string{calc.Include, calc.Exclude} {
+		if err == nil {
+			err = ValidatePatterns(patterns)
+		}
+	}
+	return calc, err
+}
+
+func parsePayload(payload string, host string, token string) (patchwork.CalculationPayload, error) {
+	var calc patchwork.CalculationPayload
+	if !strings.HasPrefix(payload, "{") {
+		calc.Id = payload
+		calc.Host = host
+		calc.Token = token
+		return calc, nil
+	}
+	err := json.Unmarshal(StringToBytes(payload), &calc)
+	if err == nil && calc.Context != nil && len(calc.Id) == 0 {
+		calc.Id = calc.Context.Id.Id
+	}
+	if err == nil && len(calc.Id) > 0 {
+		return calc, nil
+	}
+	// It might be in the Google PubSub format
+	var pubsub PubSubPayload
+	err = json.Unmarshal(StringToBytes(payload), &pubsub)
+	if err != nil {
+		return calc, errors.Wrap(err, "Unrecognised payload")
+	}
+	data, err := base64.StdEncoding.DecodeString(pubsub.Message.Data)
+	if err != nil {
+		return calc, errors.Wrap(err, "Invalid Pub/Sub message data")
+	}
+	err = json.Unmarshal(data, &calc)
+	if err != nil {
+		return calc, errors.Wrap(err, "Invalid Pub/Sub message data")
+	}
+	if calc.Context != nil && len(calc.Id) == 0 {
+		calc.Id = calc.Context.Id.Id
+	}
+	if len(calc.Id) == 0 {
+		return calc, errors.New("No calculation id in payload")
+	}
+	return calc, nil
+}
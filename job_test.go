@@ -0,0 +1,20 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestParsePayloadInlineContext(t *testing.T) {
+	inline := `{"host": "https://patchwork.example", "context": {"id": {"id": "calc1"}, "inputs": {"geometry": {"length": 2}}}}`
+	pubsub := `{"message": {"data": "` + base64.StdEncoding.EncodeToString([]byte(inline)) + `"}}`
+	for _, payload := range []string{inline, pubsub} {
+		calc, err := ParsePayload(payload, "https://default.example", "token")
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if calc.Id != "calc1" || calc.Context == nil || calc.Context.Inputs["geometry"] == nil {
+			t.Errorf("Unexpected payload %+v from %s", calc, payload)
+		}
+	}
+}
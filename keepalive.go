@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeepaliveStatusTrailer carries the status of a calculation whose response
+// was committed by whitespace keepalives.
+const KeepaliveStatusTrailer = "X-Calculation-Status"
+
+// Keepalive keeps the connection of a dispatcher waiting for a calculation in
+// server mode from being closed as idle by proxies and load balancers, by
+// sending something every Interval seconds (by default 30): with Mode
+// "processing" a 102 Processing interim response, or with "whitespace" a
+// space of the body, once the status has been sent as 200.
+type Keepalive struct {
+	Interval int    `json:"interval"`
+	Mode     string `json:"mode"`
+}
+
+func (keepalive *Keepalive) Validate() error {
+	if keepalive.Interval < 0 {
+		return errors.New("Keepalive interval can't be negative")
+	}
+	switch keepalive.Mode {
+	case "", "processing", "whitespace":
+		return nil
+	}
+	return errors.New("Unknown keepalive mode " + keepalive.Mode)
+}
+
+// Start sends keepalives on writer until a status is written to the
+// keepaliveWriter it returns, or it is stopped.
+func (keepalive *Keepalive) Start(writer http.ResponseWriter) *keepaliveWriter {
+	interval := time.Second * time.Duration(keepalive.Interval)
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	wrapped := &keepaliveWriter{ResponseWriter: writer, whitespace: keepalive.Mode == "whitespace", done: make(chan struct{})}
+	if wrapped.whitespace {
+		writer.Header().Set("Trailer", KeepaliveStatusTrailer)
+	}
+	wrapped.wait.Add(1)
+	go func() {
+		defer wrapped.wait.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-wrapped.done:
+				return
+			case <-ticker.C:
+				wrapped.ping()
+			}
+		}
+	}()
+	return wrapped
+}
+
+// keepaliveWriter is a ResponseWriter sending keepalives until its status is
+// written. Once whitespace has committed the response as 200, the status is
+// sent in the KeepaliveStatusTrailer, and as {"status": ...} in the body if
+// nothing else is written, which stays valid JSON after the whitespace.
+type keepaliveWriter struct {
+	http.ResponseWriter
+	whitespace bool
+	mutex      sync.Mutex
+	committed  bool
+	stopped    bool
+	status     int
+	done       chan struct{}
+	wait       sync.WaitGroup
+}
+
+func (writer *keepaliveWriter) ping() {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.stopped {
+		return
+	}
+	if writer.whitespace {
+		if !writer.committed {
+			writer.ResponseWriter.WriteHeader(200)
+			writer.committed = true
+		}
+		writer.ResponseWriter.Write([]byte(" "))
+		if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	} else {
+		// Interim responses are sent at once, leaving the status to be written
+		writer.ResponseWriter.WriteHeader(http.StatusProcessing)
+	}
+}
+
+// Stop stops the keepalives, and ends a committed response with its status
+// if nothing else was written.
+func (writer *keepaliveWriter) Stop() {
+	writer.halt()
+	if writer.status > 0 {
+		writer.ResponseWriter.Write([]byte(`{"status": ` + strconv.Itoa(writer.status) + "}"))
+		writer.status = 0
+	}
+}
+
+// halt stops the keepalives, returning once no more will be sent.
+func (writer *keepaliveWriter) halt() {
+	writer.mutex.Lock()
+	if !writer.stopped {
+		writer.stopped = true
+		close(writer.done)
+	}
+	writer.mutex.Unlock()
+	writer.wait.Wait()
+}
+
+func (writer *keepaliveWriter) WriteHeader(status int) {
+	writer.halt()
+	if !writer.committed {
+		writer.ResponseWriter.WriteHeader(status)
+		return
+	}
+	writer.Header().Set(KeepaliveStatusTrailer, strconv.Itoa(status))
+	writer.status = status
+}
+
+func (writer *keepaliveWriter) Write(data []byte) (int, error) {
+	writer.halt()
+	writer.status = 0
+	return writer.ResponseWriter.Write(data)
+}
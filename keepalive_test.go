@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	for _, mode := range []string{"processing", "whitespace"} {
+		keepalive := &Keepalive{Interval: 1, Mode: mode}
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			wrapped := keepalive.Start(writer)
+			defer wrapped.Stop()
+			time.Sleep(1500 * time.Millisecond)
+			wrapped.WriteHeader(500)
+		}))
+		interim := 0
+		trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim++
+			return nil
+		}}
+		request, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "POST", server.URL, nil)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		server.Close()
+		switch mode {
+		case "processing":
+			if interim != 1 || response.StatusCode != 500 || len(body) != 0 {
+				t.Errorf("Expected a 102 then 500, got %d interim then %d %q", interim, response.StatusCode, body)
+			}
+		case "whitespace":
+			if response.StatusCode != 200 || string(body) != ` {"status": 500}` || response.Trailer.Get(KeepaliveStatusTrailer) != "500" {
+				t.Errorf("Expected whitespace then a 500 status, got %d %q %v", response.StatusCode, body, response.Trailer)
+			}
+		}
+	}
+	if (&Keepalive{Mode: "bytes"}).Validate() == nil {
+		t.Error("Unknown modes should be invalid")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLicenseUnavailable is returned by RunCalculation when the command kept
+// failing to get a license and LicenseRetry.Requeue is set, so that the
+// calculation is handed back to the dispatcher rather than reported as failed.
+var ErrLicenseUnavailable = errors.New("License unavailable")
+
+// LicenseRetry describes how to recognise a license failure of the command
+// (by exit code or by a regex matched against stdout/stderr) and how long to
+// wait before trying again.
+type LicenseRetry struct {
+	Patterns  []string `json:"patterns"`
+	ExitCodes []int    `json:"exitCodes"`
+	Delay     int      `json:"delay"`
+	Attempts  int      `json:"attempts"`
+	Requeue   bool     `json:"requeue"`
+	patterns  []*regexp.Regexp
+}
+
+func (retry *LicenseRetry) Compile() error {
+	retry.patterns = make([]*regexp.Regexp, len(retry.Patterns))
+	for i, pattern := range retry.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrap(err, "License retry pattern "+pattern)
+		}
+		retry.patterns[i] = re
+	}
+	if retry.Delay <= 0 {
+		retry.Delay = 60
+	}
+	return nil
+}
+
+func (retry *LicenseRetry) IsLicenseFailure(exitCode int, stdout string, stderr string) bool {
+	if retry == nil || exitCode == 0 {
+		return false
+	}
+	for _, code := range retry.ExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	for _, re := range retry.patterns {
+		if re.MatchString(stdout) || re.MatchString(stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait sleeps for the configured delay, returning early with an error if the
+// calculation is cancelled or times out in the meantime.
+func (retry *LicenseRetry) Wait(ctx context.Context) error {
+	timer := time.NewTimer(time.Second * time.Duration(retry.Delay))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
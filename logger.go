@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// NewJobLogger returns a logger for one calculation, prefixing its messages
+// with the calculation id so that those of concurrent calculations can be
+// told apart.
+func NewJobLogger(calculation string) *log.Logger {
+	return log.New(log.Writer(), "["+calculation+"] ", log.Flags()|log.Lmsgprefix)
+}
+
+// LineWriter writes whole lines to out, each with a prefix, so that the
+// output of concurrent commands is interleaved by line rather than by write.
+// Flush writes any final incomplete line.
+type LineWriter struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+	// Redactor, if set, replaces text in each line
+	Redactor *strings.Replacer
+}
+
+func NewLineWriter(out io.Writer, prefix string) *LineWriter {
+	return &LineWriter{out: out, prefix: prefix}
+}
+
+func (writer *LineWriter) Write(p []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.buf = append(writer.buf, p...)
+	for {
+		i := bytes.IndexByte(writer.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := append([]byte(writer.prefix), writer.redact(writer.buf[:i+1])...)
+		writer.buf = writer.buf[i+1:]
+		if _, err := writer.out.Write(line); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (writer *LineWriter) Flush() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if len(writer.buf) == 0 {
+		return nil
+	}
+	line := append([]byte(writer.prefix), writer.redact(writer.buf)...)
+	writer.buf = nil
+	_, err := writer.out.Write(append(line, '\n'))
+	return err
+}
+
+func (writer *LineWriter) redact(line []byte) []byte {
+	if writer.Redactor == nil {
+		return line
+	}
+	return []byte(writer.Redactor.Replace(string(line)))
+}
+
+// redactBuffer replaces text in what was written to a buffer after start.
+func redactBuffer(redactor *strings.Replacer, buffer *bytes.Buffer, start int) {
+	written := redactor.Replace(string(buffer.Bytes()[start:]))
+	buffer.Truncate(start)
+	buffer.WriteString(written)
+}
+
+// LogTail returns the last MaxLogSize bytes of the output of a command, from
+// the start of a line, or all of it if it is shorter or there is no limit.
+func LogTail(config *Config, output string) string {
+	if config.MaxLogSize <= 0 || int64(len(output)) <= config.MaxLogSize {
+		return output
+	}
+	tail := output[int64(len(output))-config.MaxLogSize:]
+	if i := strings.IndexByte(tail, '\n'); i >= 0 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
+
+// SpillLogs returns the stdout and stderr of a command longer than
+// MaxLogSize, of which only the tail is in the logs, as stdout.log and
+// stderr.log artefacts, written to a new directory in dirpath.
+func SpillLogs(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, stdout string, stderr string, response *patchwork.CalculationResponse) error {
+	dir := ""
+	for _, spill := range []struct{ name, output string }{{"stdout.log", stdout}, {"stderr.log", stderr}} {
+		if config.MaxLogSize <= 0 || int64(len(spill.output)) <= config.MaxLogSize {
+			continue
+		}
+		if _, ok := response.Outputs[spill.name]; ok {
+			response.AddErrors("The full " + strings.TrimSuffix(spill.name, ".log") + " was not returned, as there is an output " + spill.name)
+			continue
+		}
+		if len(dir) == 0 {
+			var err error
+			dir, err = os.MkdirTemp(dirpath, ".logs")
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		path := filepath.Join(dir, spill.name)
+		logger.Println("Writing " + strconv.Itoa(len(spill.output)) + " bytes of " + strings.TrimSuffix(spill.name, ".log") + " to " + path)
+		err := os.WriteFile(path, []byte(spill.output), 0644)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		artefact, err := MakeArtefact(ctx, config, logger, presigner, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		response.SetOutput(spill.name, artefact)
+		response.AddLogs("The " + strconv.Itoa(len(spill.output)) + " bytes of " + strings.TrimSuffix(spill.name, ".log") +
+			" were returned as " + spill.name + ", with only the end in the logs")
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes of a calculation run from the command line, by how it failed.
+// Invalid flags or config exit with 1.
+const (
+	ExitFetchFailed     = 10
+	ExitExecutionFailed = 11
+	ExitTimeout         = 12
+	ExitUploadFailed    = 13
+	// ExitRequeued is EX_TEMPFAIL of sysexits.h, asking to be run again later
+	ExitRequeued = 75
+)
+
+// Manifest summarises how a calculation run from the command line ended and
+// what it returned, for scripts driving the agent.
+type Manifest struct {
+	Calculation string `json:"calculation"`
+	// Status is succeeded, failed, requeued (the license was unavailable) or
+	// alreadyRun.
+	Status string `json:"status"`
+	// Failure is why a failed calculation failed: fetch (before its command
+	// ran), execution (its command exited with an error), timeout or upload
+	// (of its result).
+	Failure  string           `json:"failure,omitempty"`
+	ExitCode *int             `json:"exitCode,omitempty"`
+	Duration float64          `json:"durationSeconds"`
+	Outputs  []ManifestOutput `json:"outputs"`
+	Errors   []string         `json:"errors,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+type ManifestOutput struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	// Uri is where an artefact was uploaded, if not embedded in the result.
+	Uri string `json:"uri,omitempty"`
+}
+
+// Fill records the outcome of a calculation. The size of an output is that
+// of the file it was read from, if any, otherwise that of its value.
+func (manifest *Manifest) Fill(calculation string, dirpath string, response *patchwork.CalculationResponse, started *time.Time, exitCode *int, timedOut bool, alreadyRun bool, duration time.Duration, err error) {
+	manifest.Calculation = calculation
+	manifest.ExitCode = exitCode
+	manifest.Duration = duration.Seconds()
+	manifest.Outputs = make([]ManifestOutput, 0)
+	switch {
+	case alreadyRun:
+		manifest.Status = "alreadyRun"
+	case errors.Cause(err) == ErrLicenseUnavailable:
+		manifest.Status = "requeued"
+	case err != nil && started == nil:
+		manifest.Status, manifest.Failure = "failed", "fetch"
+	case err != nil:
+		manifest.Status, manifest.Failure = "failed", "upload"
+	case timedOut:
+		manifest.Status, manifest.Failure = "failed", "timeout"
+	case exitCode == nil || *exitCode != 0:
+		manifest.Status, manifest.Failure = "failed", "execution"
+	default:
+		manifest.Status = "succeeded"
+	}
+	if err != nil {
+		manifest.Error = err.Error()
+	}
+	if response == nil {
+		return
+	}
+	manifest.Errors = response.Errors
+	for name, value := range response.Outputs {
+		output := ManifestOutput{Name: name, ContentType: "application/json"}
+		artefact, isArtefact := value.(patchwork.Artefact)
+		if isArtefact {
+			output.ContentType = artefact.ContentType
+			if len(artefact.Uri) > 0 && !strings.HasPrefix(artefact.Uri, "data:") {
+				output.Uri = WithoutQuery(artefact.Uri)
+			}
+		}
+		// The content of an artefact in a file isn't encoded to measure it
+		if info, err := os.Stat(filepath.Join(dirpath, name)); err == nil && info.Mode().IsRegular() {
+			output.Size = info.Size()
+		} else if isArtefact && len(artefact.Path) > 0 {
+			if info, err := os.Stat(artefact.Path); err == nil {
+				output.Size = info.Size()
+			}
+		} else if isArtefact && artefact.Size > 0 {
+			output.Size = artefact.Size
+		} else if data, err := json.Marshal(value); err == nil {
+			output.Size = int64(len(data))
+		}
+		manifest.Outputs = append(manifest.Outputs, output)
+	}
+	sort.Slice(manifest.Outputs, func(i, j int) bool {
+		return manifest.Outputs[i].Name < manifest.Outputs[j].Name
+	})
+}
+
+// ExitStatus is the exit code of the agent for the calculation.
+func (manifest *Manifest) ExitStatus() int {
+	if manifest.Status == "requeued" {
+		return ExitRequeued
+	}
+	switch manifest.Failure {
+	case "fetch":
+		return ExitFetchFailed
+	case "execution":
+		return ExitExecutionFailed
+	case "timeout":
+		return ExitTimeout
+	case "upload":
+		return ExitUploadFailed
+	}
+	return 0
+}
+
+// Write writes the manifest as JSON to a file, or to stdout if path is "-".
+func (manifest *Manifest) Write(path string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(path, data, 0644))
+}
+
+// JobSummary is the body of the response to a dispatcher for a calculation
+// run in server mode, with SuccessResponse "summary", so that it can log the
+// outcome without asking the host.
+type JobSummary struct {
+	Calculation string  `json:"calculation"`
+	AgentId     string  `json:"agentId"`
+	Status      string  `json:"status"`
+	Duration    float64 `json:"durationSeconds"`
+	Outputs     int     `json:"outputs"`
+	// BytesUploaded is the size of the outputs returned, wherever they were
+	// uploaded.
+	BytesUploaded int64 `json:"bytesUploaded"`
+}
+
+// Summary summarises the manifest of a calculation run by the agent.
+func (manifest *Manifest) Summary(agentId string) JobSummary {
+	summary := JobSummary{
+		Calculation: manifest.Calculation,
+		AgentId:     agentId,
+		Status:      manifest.Status,
+		Duration:    manifest.Duration,
+		Outputs:     len(manifest.Outputs),
+	}
+	for _, output := range manifest.Outputs {
+		summary.BytesUploaded += output.Size
+	}
+	return summary
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"patchworkagent/patchwork"
+)
+
+func TestManifestOutputSizes(t *testing.T) {
+	dir := t.TempDir()
+	// An output sent under another name than its file's, as when archived
+	path := filepath.Join(t.TempDir(), "results.zip")
+	os.WriteFile(path, make([]byte, 3000), 0644)
+	response := patchwork.NewCalculationResponse()
+	response.Outputs["results"] = patchwork.Artefact{Name: "results.zip", ContentType: "application/zip", Path: path}
+	response.Outputs["stored"] = patchwork.Artefact{Name: "field.vtu", ContentType: "application/x-vtu+xml", Uri: "s3://bucket/field.vtu", Size: 5000}
+	response.Outputs["mass"] = 12.5
+	exitCode := 0
+	manifest := &Manifest{}
+	manifest.Fill("calc1", dir, response, &time.Time{}, &exitCode, false, false, time.Second, nil)
+	sizes := make(map[string]int64)
+	for _, output := range manifest.Outputs {
+		sizes[output.Name] = output.Size
+	}
+	if sizes["results"] != 3000 || sizes["stored"] != 5000 || sizes["mass"] != 4 {
+		t.Errorf("Unexpected sizes %v", sizes)
+	}
+}
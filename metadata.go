@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SummariseFile describes the content of an output file of a known type, for
+// the UI to show without downloading it: the width and height of an image,
+// the rows and columns of a CSV file, or the element count and bounding box
+// of an STL or OBJ mesh. It returns nil for other files, or if the file can't
+// be read as its type.
+func SummariseFile(path string, contentType string) map[string]interface{} {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case strings.HasPrefix(contentType, "image/"):
+		return summariseImage(file)
+	case ext == ".csv" || strings.HasPrefix(contentType, "text/csv"):
+		return summariseCsv(file)
+	case ext == ".stl":
+		return summariseStl(file)
+	case ext == ".obj":
+		return summariseObj(file)
+	}
+	return nil
+}
+
+func summariseImage(file *os.File) map[string]interface{} {
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil
+	}
+	return map[string]interface{}{"type": "image", "format": format, "width": config.Width, "height": config.Height}
+}
+
+// summariseCsv counts the records of a CSV file, including any header, and
+// the fields of its first.
+func summariseCsv(file *os.File) map[string]interface{} {
+	reader := csv.NewReader(bufio.NewReader(file))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.ReuseRecord = true
+	rows, columns := 0, 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		if rows == 0 {
+			columns = len(record)
+		}
+		rows++
+	}
+	return map[string]interface{}{"type": "table", "rows": rows, "columns": columns}
+}
+
+// bounds is the bounding box of the vertices of a mesh.
+type bounds struct {
+	min, max [3]float64
+	empty    bool
+}
+
+func newBounds() *bounds {
+	return &bounds{empty: true}
+}
+
+func (b *bounds) add(vertex [3]float64) {
+	for i, v := range vertex {
+		if b.empty || v < b.min[i] {
+			b.min[i] = v
+		}
+		if b.empty || v > b.max[i] {
+			b.max[i] = v
+		}
+	}
+	b.empty = false
+}
+
+func meshSummary(elements int, vertices int, b *bounds) map[string]interface{} {
+	summary := map[string]interface{}{"type": "mesh", "elements": elements, "vertices": vertices}
+	if !b.empty {
+		summary["bounds"] = map[string]interface{}{"min": b.min[:], "max": b.max[:]}
+	}
+	return summary
+}
+
+// summariseStl reads an STL file, binary or ASCII, counting its triangles.
+func summariseStl(file *os.File) map[string]interface{} {
+	reader := bufio.NewReader(file)
+	// A binary STL has an 80 byte header and a count of triangles of 50
+	// bytes each, which an ASCII one is unlikely to match
+	header := make([]byte, 84)
+	n, _ := io.ReadFull(reader, header)
+	if info, err := file.Stat(); err == nil && n == 84 &&
+		info.Size() == 84+50*int64(binary.LittleEndian.Uint32(header[80:])) {
+		count := int(binary.LittleEndian.Uint32(header[80:]))
+		b := newBounds()
+		triangle := make([]byte, 50)
+		for i := 0; i < count; i++ {
+			if _, err := io.ReadFull(reader, triangle); err != nil {
+				return nil
+			}
+			// Each triangle is a normal then three vertices, of 3 float32s
+			for v := 1; v <= 3; v++ {
+				var vertex [3]float64
+				for j := range vertex {
+					vertex[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(triangle[(v*3+j)*4:])))
+				}
+				b.add(vertex)
+			}
+		}
+		return meshSummary(count, 3*count, b)
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(header[:n]), []byte("solid")) {
+		return nil
+	}
+	b := newBounds()
+	triangles, vertices := 0, 0
+	scanner := bufio.NewScanner(io.MultiReader(bytes.NewReader(header[:n]), reader))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "facet":
+			triangles++
+		case "vertex":
+			vertex, ok := parseVertex(fields[1:])
+			if !ok {
+				return nil
+			}
+			b.add(vertex)
+			vertices++
+		}
+	}
+	if scanner.Err() != nil {
+		return nil
+	}
+	return meshSummary(triangles, vertices, b)
+}
+
+// summariseObj reads a Wavefront OBJ file, counting its faces.
+func summariseObj(file *os.File) map[string]interface{} {
+	b := newBounds()
+	faces, vertices := 0, 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "f":
+			faces++
+		case "v":
+			vertex, ok := parseVertex(fields[1:])
+			if !ok {
+				return nil
+			}
+			b.add(vertex)
+			vertices++
+		}
+	}
+	if scanner.Err() != nil {
+		return nil
+	}
+	return meshSummary(faces, vertices, b)
+}
+
+func parseVertex(fields []string) ([3]float64, bool) {
+	var vertex [3]float64
+	if len(fields) < 3 {
+		return vertex, false
+	}
+	for i := range vertex {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return vertex, false
+		}
+		vertex[i] = v
+	}
+	return vertex, true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSummariseFile(t *testing.T) {
+	dir := t.TempDir()
+	file, _ := os.Create(filepath.Join(dir, "plot.png"))
+	png.Encode(file, image.NewGray(image.Rect(0, 0, 640, 480)))
+	file.Close()
+	os.WriteFile(filepath.Join(dir, "loads.csv"), []byte("node,fx,fy\n1,0.5,\"2,5\"\n2,1.5,3\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "part.obj"), []byte("# part\nv 0 0 0\nv 1 0 -2\nv 0 3 0\nf 1 2 3\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "ascii.stl"), []byte("solid part\nfacet normal 0 0 1\nouter loop\nvertex 0 0 0\nvertex 2 0 0\nvertex 0 1 5\nendloop\nendfacet\nendsolid part\n"), 0644)
+	// A binary STL of one triangle
+	stl := make([]byte, 84+50)
+	binary.LittleEndian.PutUint32(stl[80:], 1)
+	for i, v := range []float32{0, 0, 1, -1, 0, 0, 1, 0, 0, 0, 4, 0} {
+		binary.LittleEndian.PutUint32(stl[84+i*4:], math.Float32bits(v))
+	}
+	os.WriteFile(filepath.Join(dir, "binary.stl"), stl, 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+
+	for _, test := range []struct {
+		name        string
+		contentType string
+		summary     map[string]interface{}
+	}{
+		{"plot.png", "image/png", map[string]interface{}{"type": "image", "format": "png", "width": 640, "height": 480}},
+		{"loads.csv", "text/plain; charset=utf-8", map[string]interface{}{"type": "table", "rows": 3, "columns": 3}},
+		{"part.obj", "text/plain; charset=utf-8", map[string]interface{}{"type": "mesh", "elements": 1, "vertices": 3,
+			"bounds": map[string]interface{}{"min": []float64{0, 0, -2}, "max": []float64{1, 3, 0}}}},
+		{"ascii.stl", "text/plain; charset=utf-8", map[string]interface{}{"type": "mesh", "elements": 1, "vertices": 3,
+			"bounds": map[string]interface{}{"min": []float64{0, 0, 0}, "max": []float64{2, 1, 5}}}},
+		{"binary.stl", "application/octet-stream", map[string]interface{}{"type": "mesh", "elements": 1, "vertices": 3,
+			"bounds": map[string]interface{}{"min": []float64{-1, 0, 0}, "max": []float64{1, 4, 0}}}},
+		{"notes.txt", "text/plain; charset=utf-8", nil},
+	} {
+		summary := SummariseFile(filepath.Join(dir, test.name), test.contentType)
+		if !reflect.DeepEqual(summary, test.summary) {
+			t.Errorf("Summary of %s should be %v, was %v", test.name, test.summary, summary)
+		}
+	}
+}
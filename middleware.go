@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Middleware wraps the handler of calculations.
+type Middleware func(http.Handler) http.Handler
+
+// MiddlewareFactory makes a middleware from its options in the config file.
+type MiddlewareFactory func(config *Config, options json.RawMessage) (Middleware, error)
+
+// MiddlewareConfig is a middleware to wrap the handler of calculations in,
+// by the name it is registered with.
+type MiddlewareConfig struct {
+	Name    string          `json:"name"`
+	Options json.RawMessage `json:"options"`
+}
+
+var middlewareFactories = map[string]MiddlewareFactory{
+	"auth":      AuthMiddleware,
+	"rateLimit": RateLimitMiddleware,
+	"audit":     AuditMiddleware,
+	"tracing":   TracingMiddleware,
+}
+
+var middlewareLock sync.Mutex
+
+// RegisterMiddleware registers a middleware, for builds of the agent with
+// their own to register them in an init function.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+	middlewareFactories[name] = factory
+}
+
+func (middleware MiddlewareConfig) Validate() error {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+	if _, ok := middlewareFactories[middleware.Name]; !ok {
+		return errors.New("Unknown middleware " + middleware.Name)
+	}
+	return nil
+}
+
+// ChainMiddleware wraps a handler in the configured middlewares, the first
+// outermost.
+func ChainMiddleware(config *Config, handler http.Handler) (http.Handler, error) {
+	middlewareLock.Lock()
+	defer middlewareLock.Unlock()
+	for i := len(config.Middleware) - 1; i >= 0; i-- {
+		factory, ok := middlewareFactories[config.Middleware[i].Name]
+		if !ok {
+			return nil, errors.New("Unknown middleware " + config.Middleware[i].Name)
+		}
+		middleware, err := factory(config, config.Middleware[i].Options)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid options of middleware "+config.Middleware[i].Name)
+		}
+		handler = middleware(handler)
+	}
+	return handler, nil
+}
+
+func decodeOptions(options json.RawMessage, value interface{}) error {
+	if len(options) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(options)))
+	decoder.DisallowUnknownFields()
+	return errors.WithStack(decoder.Decode(value))
+}
+
+// AuthMiddleware accepts only requests with one of the bearer tokens in
+// tokens, or in the environment variable tokenEnv, separated by commas.
+func AuthMiddleware(config *Config, options json.RawMessage) (Middleware, error) {
+	var auth struct {
+		Tokens   []string `json:"tokens"`
+		TokenEnv string   `json:"tokenEnv"`
+	}
+	if err := decodeOptions(options, &auth); err != nil {
+		return nil, err
+	}
+	tokens := auth.Tokens
+	if len(auth.TokenEnv) > 0 {
+		for _, token := range strings.Split(os.Getenv(auth.TokenEnv), ",") {
+			if token = strings.TrimSpace(token); len(token) > 0 {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("No tokens are given")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+			for _, token := range tokens {
+				if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+					next.ServeHTTP(writer, request)
+					return
+				}
+			}
+			log.Println("Rejecting unauthorised request from " + request.RemoteAddr)
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writer.WriteHeader(401)
+		})
+	}, nil
+}
+
+// RateLimitMiddleware turns away requests beyond perMinute, allowing bursts
+// of up to burst, with 429 for the dispatcher to deliver them again later.
+func RateLimitMiddleware(config *Config, options json.RawMessage) (Middleware, error) {
+	var limit struct {
+		PerMinute float64 `json:"perMinute"`
+		Burst     int     `json:"burst"`
+	}
+	if err := decodeOptions(options, &limit); err != nil {
+		return nil, err
+	}
+	if limit.PerMinute <= 0 {
+		return nil, errors.New("perMinute must be positive")
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	var lock sync.Mutex
+	tokens, last := float64(limit.Burst), time.Now()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			lock.Lock()
+			now := time.Now()
+			tokens += now.Sub(last).Minutes() * limit.PerMinute
+			if tokens > float64(limit.Burst) {
+				tokens = float64(limit.Burst)
+			}
+			last = now
+			allowed := tokens >= 1
+			if allowed {
+				tokens--
+			}
+			wait := (1 - tokens) / limit.PerMinute * 60
+			lock.Unlock()
+			if !allowed {
+				log.Println("Rejecting request over the rate limit")
+				writer.Header().Set("Retry-After", strconv.Itoa(int(wait)+1))
+				writer.WriteHeader(429)
+				return
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}, nil
+}
+
+// statusWriter records the status written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (writer *statusWriter) WriteHeader(status int) {
+	if writer.status == 0 {
+		writer.status = status
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *statusWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = 200
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *statusWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// AuditMiddleware logs every request with its outcome, to the file path if
+// given as JSON lines, otherwise to the log.
+func AuditMiddleware(config *Config, options json.RawMessage) (Middleware, error) {
+	var audit struct {
+		Path string `json:"path"`
+	}
+	if err := decodeOptions(options, &audit); err != nil {
+		return nil, err
+	}
+	var lock sync.Mutex
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			start := time.Now()
+			recorder := &statusWriter{ResponseWriter: writer}
+			next.ServeHTTP(recorder, request)
+			if len(audit.Path) == 0 {
+				log.Println("Audit: " + request.Method + " " + request.URL.Path + " from " + request.RemoteAddr + " " + strconv.Itoa(recorder.status))
+				return
+			}
+			data, _ := json.Marshal(map[string]interface{}{
+				"time":            start.UTC().Format(time.RFC3339),
+				"remote":          request.RemoteAddr,
+				"method":          request.Method,
+				"path":            request.URL.Path,
+				"status":          recorder.status,
+				"durationSeconds": time.Since(start).Seconds(),
+			})
+			lock.Lock()
+			defer lock.Unlock()
+			file, err := os.OpenFile(audit.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				log.Println("Could not write audit log: " + err.Error())
+				return
+			}
+			defer file.Close()
+			file.Write(append(data, '\n'))
+		})
+	}, nil
+}
+
+var traceparent = regexp.MustCompile(`^00-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// TracingMiddleware continues the W3C trace context of requests, or starts
+// one, giving the trace id in the traceparent of the response and the log.
+func TracingMiddleware(config *Config, options json.RawMessage) (Middleware, error) {
+	if err := decodeOptions(options, &struct{}{}); err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			ids := make([]byte, 24)
+			rand.Read(ids)
+			trace := hex.EncodeToString(ids[:16])
+			if match := traceparent.FindStringSubmatch(request.Header.Get("traceparent")); match != nil {
+				trace = match[1]
+			}
+			writer.Header().Set("traceparent", "00-"+trace+"-"+hex.EncodeToString(ids[16:])+"-01")
+			log.Println("Trace " + trace + ": " + request.Method + " " + request.URL.Path)
+			next.ServeHTTP(writer, request)
+		})
+	}, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChainMiddleware(t *testing.T) {
+	var order []string
+	RegisterMiddleware("test", func(config *Config, options json.RawMessage) (Middleware, error) {
+		var name string
+		json.Unmarshal(options, &name)
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(writer, request)
+			})
+		}, nil
+	})
+	audit := filepath.Join(t.TempDir(), "audit.log")
+	config := &Config{Middleware: []MiddlewareConfig{
+		{Name: "audit", Options: json.RawMessage(`{"path": "` + filepath.ToSlash(audit) + `"}`)},
+		{Name: "test", Options: json.RawMessage(`"outer"`)},
+		{Name: "auth", Options: json.RawMessage(`{"tokens": ["secret"]}`)},
+		{Name: "test", Options: json.RawMessage(`"inner"`)},
+		{Name: "rateLimit", Options: json.RawMessage(`{"perMinute": 1, "burst": 1}`)},
+	}}
+	for _, middleware := range config.Middleware {
+		if err := middleware.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler, err := ChainMiddleware(config, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(202)
+	}))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	var statuses []int
+	for _, token := range []string{"wrong", "secret", "secret"} {
+		request := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		statuses = append(statuses, recorder.Code)
+	}
+	// Unauthorised requests don't use up the rate limit
+	if statuses[0] != 401 || statuses[1] != 202 || statuses[2] != 429 {
+		t.Errorf("Unexpected %v", statuses)
+	}
+	if strings.Join(order, ",") != "outer,outer,inner,outer,inner" {
+		t.Errorf("Unexpected order %v", order)
+	}
+	data, _ := os.ReadFile(audit)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], `"status":202`) {
+		t.Errorf("Unexpected audit log %s", data)
+	}
+
+	if err := (MiddlewareConfig{Name: "missing"}).Validate(); err == nil {
+		t.Error("Expected unknown middleware to be refused")
+	}
+	if _, err := ChainMiddleware(&Config{Middleware: []MiddlewareConfig{{Name: "auth"}}}, handler); err == nil {
+		t.Error("Expected auth without tokens to be refused")
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	middleware, err := TracingMiddleware(&Config{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	request := httptest.NewRequest("POST", "/", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if parent := recorder.Header().Get("traceparent"); !strings.HasPrefix(parent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || parent[36:52] == "00f067aa0ba902b7" {
+		t.Errorf("Unexpected traceparent %s", parent)
+	}
+}
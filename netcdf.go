@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NetCDF classic files (CDF-1, and CDF-2 and CDF-5 with 64-bit offsets and
+// data) are read natively; NetCDF-4 files are HDF5.
+
+const (
+	cdfDimensionTag = 0x0A
+	cdfVariableTag  = 0x0B
+	cdfAttributeTag = 0x0C
+)
+
+// maxDatasetValues is the most values of a dataset returned as JSON.
+const maxDatasetValues = 100000
+
+type cdfDimension struct {
+	name   string
+	length int64
+}
+
+type cdfVariable struct {
+	name       string
+	dims       []int64
+	attributes map[string]interface{}
+	ncType     int64
+	vsize      int64
+	begin      int64
+}
+
+type cdfFile struct {
+	numrecs    int64
+	dims       []cdfDimension
+	attributes map[string]interface{}
+	variables  []cdfVariable
+}
+
+// cdfReader reads the header of a NetCDF classic file, keeping the first
+// error.
+type cdfReader struct {
+	reader  *bufio.Reader
+	version byte
+	err     error
+}
+
+func (r *cdfReader) read(n int) []byte {
+	data := make([]byte, n)
+	if r.err == nil {
+		_, r.err = io.ReadFull(r.reader, data)
+	}
+	return data
+}
+
+func (r *cdfReader) uint32() int64 {
+	return int64(binary.BigEndian.Uint32(r.read(4)))
+}
+
+// count reads a count or length, 64-bit in CDF-5.
+func (r *cdfReader) count() int64 {
+	if r.version == 5 {
+		n := int64(binary.BigEndian.Uint64(r.read(8)))
+		if n < 0 && r.err == nil {
+			r.err = errors.New("Invalid NetCDF count")
+		}
+		return n
+	}
+	return r.uint32()
+}
+
+// offset reads a file offset, 64-bit in CDF-2 and CDF-5.
+func (r *cdfReader) offset() int64 {
+	if r.version == 1 {
+		return r.uint32()
+	}
+	return int64(binary.BigEndian.Uint64(r.read(8)))
+}
+
+func (r *cdfReader) name() string {
+	n := r.count()
+	if n > 1<<16 && r.err == nil {
+		r.err = errors.New("Invalid NetCDF name")
+	}
+	if r.err != nil {
+		return ""
+	}
+	data := r.read(int(padded(n)))
+	return string(data[:n])
+}
+
+// list reads the tag and length of a dimension, attribute or variable list,
+// which is absent if both are zero.
+func (r *cdfReader) list(tag int64) int64 {
+	found, n := r.uint32(), r.count()
+	if r.err == nil && found != tag && (found != 0 || n != 0) {
+		r.err = errors.New("Invalid NetCDF header")
+	}
+	if n > 1<<24 && r.err == nil {
+		r.err = errors.New("Invalid NetCDF header")
+	}
+	return n
+}
+
+func (r *cdfReader) attributes() map[string]interface{} {
+	attributes := make(map[string]interface{})
+	n := r.list(cdfAttributeTag)
+	for i := int64(0); i < n && r.err == nil; i++ {
+		name := r.name()
+		ncType, count := r.uint32(), r.count()
+		size, ok := cdfTypeSize(ncType)
+		if !ok || count > maxDatasetValues {
+			r.err = errors.New("Unsupported NetCDF attribute " + name)
+			break
+		}
+		data := r.read(int(padded(count * size)))
+		if r.err == nil {
+			attributes[name] = cdfValues(ncType, data[:count*size], []int64{count}, true)
+		}
+	}
+	return attributes
+}
+
+func padded(n int64) int64 {
+	return (n + 3) / 4 * 4
+}
+
+func cdfTypeSize(ncType int64) (int64, bool) {
+	switch ncType {
+	case 1, 2, 7:
+		return 1, true
+	case 3, 8:
+		return 2, true
+	case 4, 5, 9:
+		return 4, true
+	case 6, 10, 11:
+		return 8, true
+	}
+	return 0, false
+}
+
+// readNetcdfHeader reads the dimensions, attributes and variables of a
+// NetCDF classic file.
+func readNetcdfHeader(file *os.File) (*cdfFile, error) {
+	r := &cdfReader{reader: bufio.NewReader(file)}
+	magic := r.read(4)
+	if r.err != nil || string(magic[:3]) != "CDF" || (magic[3] != 1 && magic[3] != 2 && magic[3] != 5) {
+		return nil, errors.New("Not a NetCDF classic file")
+	}
+	r.version = magic[3]
+	// The record count is all ones while the file is still being written
+	cdf := &cdfFile{}
+	if r.version == 5 {
+		cdf.numrecs = int64(binary.BigEndian.Uint64(r.read(8)))
+	} else {
+		cdf.numrecs = int64(int32(binary.BigEndian.Uint32(r.read(4))))
+	}
+	if cdf.numrecs < 0 {
+		cdf.numrecs = 0
+	}
+	n := r.list(cdfDimensionTag)
+	for i := int64(0); i < n && r.err == nil; i++ {
+		cdf.dims = append(cdf.dims, cdfDimension{name: r.name(), length: r.count()})
+	}
+	cdf.attributes = r.attributes()
+	n = r.list(cdfVariableTag)
+	for i := int64(0); i < n && r.err == nil; i++ {
+		variable := cdfVariable{name: r.name()}
+		ndims := r.count()
+		for j := int64(0); j < ndims && r.err == nil; j++ {
+			dim := r.count()
+			if dim >= int64(len(cdf.dims)) {
+				r.err = errors.New("Invalid dimension of NetCDF variable " + variable.name)
+			}
+			variable.dims = append(variable.dims, dim)
+		}
+		variable.attributes = r.attributes()
+		variable.ncType, variable.vsize, variable.begin = r.uint32(), r.count(), r.offset()
+		cdf.variables = append(cdf.variables, variable)
+	}
+	return cdf, errors.Wrap(r.err, "Invalid NetCDF header")
+}
+
+// isRecord reports whether a variable varies along the record dimension.
+func (cdf *cdfFile) isRecord(variable *cdfVariable) bool {
+	return len(variable.dims) > 0 && cdf.dims[variable.dims[0]].length == 0
+}
+
+// ReadNetcdf reads a variable (dataset) or attribute of a NetCDF classic
+// file, or a global attribute if dataset is empty.
+func ReadNetcdf(path string, dataset string, attribute string) (interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	cdf, err := readNetcdfHeader(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(dataset) == 0 {
+		value, ok := cdf.attributes[attribute]
+		if !ok {
+			return nil, errors.New("No attribute " + attribute)
+		}
+		return value, nil
+	}
+	var variable *cdfVariable
+	for i := range cdf.variables {
+		if cdf.variables[i].name == strings.TrimPrefix(dataset, "/") {
+			variable = &cdf.variables[i]
+		}
+	}
+	if variable == nil {
+		return nil, errors.New("No variable " + dataset)
+	}
+	if len(attribute) > 0 {
+		value, ok := variable.attributes[attribute]
+		if !ok {
+			return nil, errors.New("No attribute " + attribute + " of " + dataset)
+		}
+		return value, nil
+	}
+	size, ok := cdfTypeSize(variable.ncType)
+	if !ok {
+		return nil, errors.New("Unsupported type of variable " + dataset)
+	}
+	shape := make([]int64, len(variable.dims))
+	count := int64(1)
+	for i, dim := range variable.dims {
+		shape[i] = cdf.dims[dim].length
+		if i == 0 && cdf.isRecord(variable) {
+			shape[i] = cdf.numrecs
+		}
+		// Checked before multiplying, as 64-bit lengths could overflow
+		if shape[i] < 0 || (count > 0 && shape[i] > maxDatasetValues/count) {
+			return nil, errors.New("Variable " + dataset + " has more than " + strconv.Itoa(maxDatasetValues) + " values")
+		}
+		count *= shape[i]
+	}
+	data := make([]byte, count*size)
+	if !cdf.isRecord(variable) {
+		_, err = file.ReadAt(data, variable.begin)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read variable "+dataset)
+		}
+		return cdfValues(variable.ncType, data, shape, false), nil
+	}
+	// Each record holds a slab of every record variable, unpadded if there
+	// is only one
+	var recsize int64
+	records := 0
+	for i := range cdf.variables {
+		if cdf.isRecord(&cdf.variables[i]) {
+			recsize += cdf.variables[i].vsize
+			records++
+		}
+	}
+	slab := count * size
+	if cdf.numrecs > 0 {
+		slab /= cdf.numrecs
+	}
+	if records == 1 {
+		recsize = slab
+	}
+	for record := int64(0); record < cdf.numrecs; record++ {
+		_, err = file.ReadAt(data[record*slab:(record+1)*slab], variable.begin+record*recsize)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read variable "+dataset)
+		}
+	}
+	return cdfValues(variable.ncType, data, shape, false), nil
+}
+
+// cdfValues decodes big-endian values of a type into nested arrays of a
+// shape, with the last dimension of characters as strings. A single value is
+// returned as a scalar if scalar is set, as it is for attributes. NaN and
+// infinities, which JSON can't represent, become null.
+func cdfValues(ncType int64, data []byte, shape []int64, scalar bool) interface{} {
+	if ncType == 2 {
+		if len(shape) == 0 {
+			return strings.TrimRight(string(data), "\x00")
+		}
+		length := shape[len(shape)-1]
+		strs := make([]interface{}, 0)
+		for i := int64(0); length > 0 && i+length <= int64(len(data)); i += length {
+			strs = append(strs, strings.TrimRight(string(data[i:i+length]), "\x00"))
+		}
+		if len(shape) == 1 {
+			if len(strs) == 0 {
+				return ""
+			}
+			return strs[0]
+		}
+		return reshape(strs, shape[:len(shape)-1])
+	}
+	size, _ := cdfTypeSize(ncType)
+	values := make([]interface{}, 0, int64(len(data))/size)
+	for i := int64(0); i+size <= int64(len(data)); i += size {
+		values = append(values, cdfValue(ncType, data[i:i+size]))
+	}
+	if len(shape) == 0 || (scalar && len(values) == 1) {
+		if len(values) == 0 {
+			return nil
+		}
+		return values[0]
+	}
+	return reshape(values, shape)
+}
+
+func cdfValue(ncType int64, data []byte) interface{} {
+	switch ncType {
+	case 1:
+		return int8(data[0])
+	case 7:
+		return data[0]
+	case 3:
+		return int16(binary.BigEndian.Uint16(data))
+	case 8:
+		return binary.BigEndian.Uint16(data)
+	case 4:
+		return int32(binary.BigEndian.Uint32(data))
+	case 9:
+		return binary.BigEndian.Uint32(data)
+	case 10:
+		return int64(binary.BigEndian.Uint64(data))
+	case 11:
+		return binary.BigEndian.Uint64(data)
+	case 5:
+		return finite(float64(math.Float32frombits(binary.BigEndian.Uint32(data))))
+	default:
+		return finite(math.Float64frombits(binary.BigEndian.Uint64(data)))
+	}
+}
+
+func finite(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return value
+}
+
+// reshape nests a flat list of values as an array of a shape.
+func reshape(values []interface{}, shape []int64) []interface{} {
+	if len(shape) <= 1 || shape[0] == 0 {
+		return values
+	}
+	stride := int64(len(values)) / shape[0]
+	nested := make([]interface{}, 0, shape[0])
+	for i := int64(0); i < shape[0]; i++ {
+		nested = append(nested, reshape(values[i*stride:(i+1)*stride], shape[1:]))
+	}
+	return nested
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JunkPatterns match files that operating systems, editors and crashes leave
+// behind, which are not returned as outputs unless KeepJunkFiles is set.
+var JunkPatterns = []string{".DS_Store", "._*", "Thumbs.db", "desktop.ini", "core", "core.*", "*.swp", "*.swo", "*~", "#*#", ".#*"}
+
+// IsJunkFile reports whether a file name matches JunkPatterns.
+func IsJunkFile(name string) bool {
+	for _, pattern := range JunkPatterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOutputFile returns why a file in the workspace must not be returned as
+// an output, or an empty string if it may be. Symbolic links are followed
+// only to regular files inside the workspace, anything but a regular file
+// (sockets, FIFOs, devices, directories) is skipped, and files larger than
+// MaxOutputSize are skipped.
+func CheckOutputFile(config *Config, dirpath string, file string) (string, error) {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			return "it is a broken symbolic link", nil
+		}
+		workspace, err := filepath.EvalSymlinks(dirpath)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if !IsWithin(workspace, target) {
+			return "it links outside the workspace", nil
+		}
+		info, err = os.Stat(target)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	if !info.Mode().IsRegular() {
+		return "it is not a regular file", nil
+	}
+	if config.MaxOutputSize > 0 && info.Size() > config.MaxOutputSize {
+		return "its size of " + strconv.FormatInt(info.Size(), 10) + " bytes exceeds the maximum of " +
+			strconv.FormatInt(config.MaxOutputSize, 10), nil
+	}
+	return "", nil
+}
+
+// IsWithin reports whether path is dir or inside it.
+func IsWithin(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// IncludesOutput reports whether an output file, named by its path in the
+// workspace, matches the Include patterns, if there are any, and none of
+// the Exclude patterns. Patterns are matched against the base name too, so
+// that *.tmp matches in subdirectories.
+func IncludesOutput(config *Config, name string) bool {
+	base := path.Base(name)
+	if len(config.Include) > 0 && !MatchesAny(config.Include, name, base) {
+		return false
+	}
+	return !MatchesAny(config.Exclude, name, base)
+}
+
+// ValidatePatterns checks that glob patterns are well-formed.
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("Invalid pattern " + pattern)
+		}
+	}
+	return nil
+}
+
+// WithOutputPatterns returns the config with the Include and Exclude
+// patterns of a calculation in place of those configured, where given.
+func (config *Config) WithOutputPatterns(include []string, exclude []string) *Config {
+	if include == nil && exclude == nil {
+		return config
+	}
+	patterned := *config
+	if include != nil {
+		patterned.Include = include
+	}
+	if exclude != nil {
+		patterned.Exclude = exclude
+	}
+	return &patterned
+}
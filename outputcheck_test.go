@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"patchworkagent/patchwork"
+)
+
+func TestPackageResultSkipsUnsafeFiles(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := SnapshotFiles(&Config{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "small.txt"), []byte("small"), 0644)
+	os.WriteFile(filepath.Join(dir, "large.txt"), []byte(strings.Repeat("x", 100)), 0644)
+	if err := os.Symlink(outside, filepath.Join(dir, "escape.txt")); err != nil {
+		t.Skip("Symbolic links not supported: ", err)
+	}
+	os.Symlink(filepath.Join(dir, "small.txt"), filepath.Join(dir, "inside.txt"))
+	os.Symlink(filepath.Join(dir, "missing.txt"), filepath.Join(dir, "broken.txt"))
+
+	response, err := PackageResult(context.Background(), &Config{MaxOutputSize: 50}, log.Default(), nil, dir, before, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, name := range []string{"small.txt", "inside.txt"} {
+		if _, ok := response.Outputs[name]; !ok {
+			t.Errorf("Expected output %s in %v", name, response.Outputs)
+		}
+	}
+	for _, name := range []string{"large.txt", "escape.txt", "broken.txt"} {
+		if _, ok := response.Outputs[name]; ok {
+			t.Errorf("Unexpected output %s", name)
+		}
+	}
+	if len(response.Errors) != 3 {
+		t.Errorf("Expected 3 skipped files in errors, got %v", response.Errors)
+	}
+}
+
+func TestPackageResultTooManyFiles(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(dir, "cell"+strconv.Itoa(i)+".txt"), []byte("x"), 0644)
+	}
+	response, err := PackageResult(context.Background(), &Config{MaxOutputFiles: 3}, log.Default(), nil, dir, Snapshot{}, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(response.Outputs) != 0 || len(response.Errors) != 1 || !strings.Contains(response.Errors[0], "5 output files") {
+		t.Errorf("Expected the calculation to fail, got %+v", response)
+	}
+
+	response, err = PackageResult(context.Background(), &Config{MaxOutputFiles: 3, OutputOverflow: "tar"}, log.Default(), nil, dir, Snapshot{}, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	artefact, ok := response.Outputs["outputs.tar.gz"].(patchwork.Artefact)
+	if !ok || len(response.Outputs) != 1 || len(response.Errors) != 0 {
+		t.Fatalf("Expected a single archive, got %+v", response)
+	}
+	// It is written to a file, to be sent as other output files are
+	if len(artefact.Path) == 0 || len(artefact.Sha256) == 0 {
+		t.Fatalf("Expected the archive in a file, got %+v", artefact)
+	}
+	file, err := os.Open(artefact.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tar.NewReader(gz)
+	count := 0
+	for {
+		if _, err := archive.Next(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 5 {
+		t.Errorf("Expected 5 files in the archive, got %d", count)
+	}
+}
+
+func TestPackageResultIgnoresJunk(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"result.txt", ".DS_Store", "Thumbs.db", "core.1234", ".model.inp.swp", "model.inp~"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+	response, err := PackageResult(context.Background(), &Config{MaxOutputFiles: 1}, log.Default(), nil, dir, Snapshot{}, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := response.Outputs["result.txt"]; !ok || len(response.Outputs) != 1 || len(response.Errors) != 0 {
+		t.Errorf("Expected only result.txt, got %+v", response)
+	}
+
+	response, err = PackageResult(context.Background(), &Config{KeepJunkFiles: true}, log.Default(), nil, dir, Snapshot{}, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(response.Outputs) != 6 {
+		t.Errorf("Expected junk files kept, got %v", response.Outputs)
+	}
+}
+
+func TestPackageResultDirectories(t *testing.T) {
+	for _, format := range []string{"", "zip", "tar"} {
+		dir := t.TempDir()
+		os.MkdirAll(filepath.Join(dir, "mesh"), 0755)
+		os.WriteFile(filepath.Join(dir, "mesh", "beam.msh"), []byte("nodes 12\n"), 0644)
+		os.MkdirAll(filepath.Join(dir, "inputs"), 0755)
+		os.WriteFile(filepath.Join(dir, "inputs", "model.inp"), []byte("model"), 0644)
+		before, err := SnapshotFiles(&Config{}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(filepath.Join(dir, "results", "fields"), 0755)
+		os.WriteFile(filepath.Join(dir, "results", "summary.txt"), []byte("converged"), 0644)
+		os.WriteFile(filepath.Join(dir, "results", "fields", "u.vtk"), []byte("displacement"), 0644)
+		os.WriteFile(filepath.Join(dir, "results", ".DS_Store"), []byte("x"), 0644)
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(filepath.Join(dir, "mesh", "beam.msh"), later, later)
+
+		response, err := PackageResult(context.Background(), &Config{DirectoryOutputs: format}, log.Default(), nil, dir, before, "", "", nil)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if format == "" {
+			if len(response.Outputs) != 0 {
+				t.Errorf("Expected directories to be skipped, got %v", response.Outputs)
+			}
+			continue
+		}
+		extension := ".zip"
+		if format == "tar" {
+			extension = ".tar.gz"
+		}
+		if len(response.Outputs) != 2 {
+			t.Errorf("Expected results and mesh only, got %v", response.Outputs)
+		}
+		artefact, ok := response.Outputs["results"+extension].(patchwork.Artefact)
+		if !ok {
+			t.Fatalf("Expected results%s in %v", extension, response.Outputs)
+		}
+		names := make([]string, 0)
+		if format == "zip" {
+			archive, err := zip.OpenReader(artefact.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range archive.File {
+				names = append(names, entry.Name)
+			}
+			archive.Close()
+		} else {
+			file, err := os.Open(artefact.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive := tar.NewReader(gz)
+			for header, err := archive.Next(); err == nil; header, err = archive.Next() {
+				names = append(names, header.Name)
+			}
+			file.Close()
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != "fields/u.vtk,summary.txt" {
+			t.Errorf("Unexpected entries in %s: %v", format, names)
+		}
+		if _, ok := response.Outputs["mesh"+extension]; !ok {
+			t.Errorf("Expected the changed mesh directory in %v", response.Outputs)
+		}
+	}
+}
+
+func TestPackageResultSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "inputs"), 0755)
+	os.WriteFile(filepath.Join(dir, "inputs", "model.inp"), []byte("model"), 0644)
+	os.WriteFile(filepath.Join(dir, "inputs", "mesh.msh"), []byte("mesh"), 0644)
+	before, err := SnapshotFiles(&Config{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "results", "step_001", "deep"), 0755)
+	os.WriteFile(filepath.Join(dir, "results", "step_001", "u.vtk"), []byte("displacement"), 0644)
+	os.WriteFile(filepath.Join(dir, "results", "step_001", "deep", "too.txt"), []byte("deep"), 0644)
+	os.WriteFile(filepath.Join(dir, "results", "summary.txt"), []byte("converged"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "inputs", "mesh.msh"), later, later)
+
+	response, err := PackageResult(context.Background(), &Config{}, log.Default(), nil, dir, before, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(response.Outputs) != 0 {
+		t.Errorf("Expected no outputs at the default depth, got %v", response.Outputs)
+	}
+
+	response, err = PackageResult(context.Background(), &Config{OutputDepth: 2}, log.Default(), nil, dir, before, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, name := range []string{"results/step_001/u.vtk", "results/summary.txt", "inputs/mesh.msh"} {
+		if _, ok := response.Outputs[name]; !ok {
+			t.Errorf("Expected output %s in %v", name, response.Outputs)
+		}
+	}
+	if len(response.Outputs) != 3 {
+		t.Errorf("Expected 3 outputs, got %v", response.Outputs)
+	}
+}
+
+func TestPackageResultHashDetection(t *testing.T) {
+	for _, detection := range []string{"mtime", "hash"} {
+		config := &Config{OutputDetection: detection, DirectoryOutputs: "zip"}
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "touched.txt"), []byte("same"), 0644)
+		os.WriteFile(filepath.Join(dir, "edited.txt"), []byte("before"), 0644)
+		os.MkdirAll(filepath.Join(dir, "mesh"), 0755)
+		os.WriteFile(filepath.Join(dir, "mesh", "beam.msh"), []byte("nodes 12\n"), 0644)
+		before, err := SnapshotFiles(config, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		os.WriteFile(filepath.Join(dir, "edited.txt"), []byte("after!"), 0644)
+		os.Chtimes(filepath.Join(dir, "edited.txt"), before["edited.txt"].ModTime, before["edited.txt"].ModTime)
+		os.Chtimes(filepath.Join(dir, "touched.txt"), later, later)
+		os.Chtimes(filepath.Join(dir, "mesh", "beam.msh"), later, later)
+
+		response, err := PackageResult(context.Background(), config, log.Default(), nil, dir, before, "", "", nil)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		names := make([]string, 0)
+		for name := range response.Outputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		expected := "mesh.zip,touched.txt"
+		if detection == "hash" {
+			expected = "edited.txt"
+		}
+		if strings.Join(names, ",") != expected {
+			t.Errorf("Expected %s detecting by %s, got %v", expected, detection, names)
+		}
+	}
+}
+
+func TestPackageResultDedupeInputs(t *testing.T) {
+	config := &Config{DedupeInputs: true}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "beam.inp"), []byte("*NODE"), 0644)
+	os.WriteFile(filepath.Join(dir, "material.inp"), []byte("*MATERIAL"), 0644)
+	os.WriteFile(filepath.Join(dir, "empty.txt"), nil, 0644)
+	before, err := SnapshotFiles(config, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An input touched, an input copied, an input edited, and new files
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "beam.inp"), later, later)
+	os.WriteFile(filepath.Join(dir, "copy.inp"), []byte("*NODE"), 0644)
+	os.WriteFile(filepath.Join(dir, "material.inp"), []byte("*MATERIAL, NAME=STEEL"), 0644)
+	os.WriteFile(filepath.Join(dir, "stress.csv"), []byte("1,2"), 0644)
+	os.WriteFile(filepath.Join(dir, "warnings.txt"), nil, 0644)
+
+	response, err := PackageResult(context.Background(), config, log.Default(), nil, dir, before, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	names := make([]string, 0)
+	for name := range response.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "material.inp,stress.csv,warnings.txt" {
+		t.Errorf("Unexpected outputs %v", names)
+	}
+}
+
+func TestPackageResultIncludeExclude(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "results"), 0755)
+	for _, name := range []string{"report.txt", "scratch.tmp", "core.42", "results/u.vtk", "results/restart.rst", "results/partial.tmp"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+	outputs := func(config *Config) string {
+		response, err := PackageResult(context.Background(), config, log.Default(), nil, dir, Snapshot{}, "", "", nil)
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		names := make([]string, 0)
+		for name := range response.Outputs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	config := &Config{OutputDepth: 1, KeepJunkFiles: true, Exclude: []string{"*.tmp", "core.*", "*.rst"}}
+	if names := outputs(config); names != "report.txt,results/u.vtk" {
+		t.Errorf("Unexpected outputs excluding scratch files: %s", names)
+	}
+	if names := outputs(config.WithOutputPatterns([]string{"results/*"}, nil)); names != "results/u.vtk" {
+		t.Errorf("Unexpected outputs including results only: %s", names)
+	}
+	if names := outputs(config.WithOutputPatterns(nil, []string{})); names != "core.42,report.txt,results/partial.tmp,results/restart.rst,results/u.vtk,scratch.tmp" {
+		t.Errorf("Unexpected outputs with the exclusions overridden: %s", names)
+	}
+	if len(config.Include) != 0 {
+		t.Error("Overriding the patterns of a calculation changed the config")
+	}
+}
+
+func TestPackageResultSpillsLogs(t *testing.T) {
+	dir := t.TempDir()
+	before, err := SnapshotFiles(&Config{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := strings.Repeat("iteration\n", 10) + "converged\n"
+	config := &Config{MaxLogSize: 25}
+	response, err := PackageResult(context.Background(), config, log.Default(), nil, dir, before, stdout, "warning\n", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	artefact, ok := response.Outputs["stdout.log"].(patchwork.Artefact)
+	if !ok {
+		t.Fatalf("Expected stdout as an artefact in %v", response.Outputs)
+	}
+	if data, _ := os.ReadFile(artefact.Path); string(data) != stdout {
+		t.Errorf("Expected all of stdout in the artefact, got %q", data)
+	}
+	if _, ok := response.Outputs["stderr.log"]; ok {
+		t.Errorf("Unexpected artefact for short stderr")
+	}
+	expected := []string{"iteration", "converged", "The 110 bytes of stdout were returned as stdout.log, with only the end in the logs"}
+	if !reflect.DeepEqual(response.Logs, expected) {
+		t.Errorf("Expected %v, got %v", expected, response.Logs)
+	}
+	if !reflect.DeepEqual(response.Errors, []string{"warning"}) {
+		t.Errorf("Unexpected errors %v", response.Errors)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// OutputManifestFiles are the names of the manifests a command may write in
+// the outputs directory to list its outputs, in order of preference.
+var OutputManifestFiles = []string{"outputs.json", "manifest.yaml"}
+
+// OutputManifestEntry is an output listed in a manifest: a file, by its path
+// in the outputs directory, or a value.
+type OutputManifestEntry struct {
+	File  string      `json:"file"`
+	Value interface{} `json:"value"`
+}
+
+// OutputManifest is the outputs a command listed, by output name.
+type OutputManifest map[string]OutputManifestEntry
+
+// FindOutputManifest returns the manifest written or changed by the command
+// in dirpath since the snapshot before, and its path, or nil if there isn't
+// one.
+func FindOutputManifest(config *Config, dirpath string, before Snapshot) (OutputManifest, string, error) {
+	for _, name := range OutputManifestFiles {
+		path := filepath.Join(dirpath, name)
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		state, err := fileState(config, path, info)
+		if err != nil {
+			return nil, path, errors.WithStack(err)
+		}
+		if previous, ok := before[name]; ok && !state.Changed(config, previous) {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, path, errors.WithStack(err)
+		}
+		var manifest OutputManifest
+		if strings.HasSuffix(name, ".json") {
+			manifest, err = ParseJsonOutputManifest(data)
+		} else {
+			manifest, err = ParseYamlOutputManifest(data)
+		}
+		return manifest, path, errors.Wrap(err, "Invalid output manifest "+name)
+	}
+	return nil, "", nil
+}
+
+// ParseJsonOutputManifest parses a JSON object of outputs by name, each the
+// path of a file or an object with either a "file" or a "value".
+func ParseJsonOutputManifest(data []byte) (OutputManifest, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	manifest := make(OutputManifest)
+	for name, value := range raw {
+		var entry OutputManifestEntry
+		var file string
+		if json.Unmarshal(value, &file) == nil {
+			entry.File = file
+		} else {
+			decoder := json.NewDecoder(bytes.NewReader(value))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&entry); err != nil {
+				return nil, errors.Wrap(err, "Output "+name)
+			}
+		}
+		if err := entry.validate(name); err != nil {
+			return nil, err
+		}
+		manifest[name] = entry
+	}
+	return manifest, nil
+}
+
+// ParseYamlOutputManifest parses the subset of YAML used for manifests: a
+// mapping of output names to file paths, or to a nested mapping with a file
+// or a value, all scalars, quoted or not, with # comments. Values are parsed
+// as JSON where they can be, so that numbers and booleans are kept.
+func ParseYamlOutputManifest(data []byte) (OutputManifest, error) {
+	manifest := make(OutputManifest)
+	current := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(text)
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		key, value, ok := yamlLine(trimmed)
+		if !ok {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": expected key: value")
+		}
+		key = yamlScalar(key)
+		if text[0] != ' ' && text[0] != '\t' {
+			current = key
+			if len(value) > 0 {
+				manifest[key] = OutputManifestEntry{File: yamlScalar(value)}
+			} else {
+				manifest[key] = OutputManifestEntry{}
+			}
+			continue
+		}
+		if len(current) == 0 {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": unexpected indentation")
+		}
+		entry := manifest[current]
+		switch key {
+		case "file":
+			entry.File = yamlScalar(value)
+		case "value":
+			var decoded interface{}
+			if json.Unmarshal([]byte(value), &decoded) == nil {
+				entry.Value = decoded
+			} else {
+				entry.Value = yamlScalar(value)
+			}
+		default:
+			return nil, errors.New("line " + strconv.Itoa(line) + ": unknown field " + key + " of output " + current)
+		}
+		manifest[current] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for name, entry := range manifest {
+		if err := entry.validate(name); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// yamlLine splits a line into its key and value at the first ": ", or a ":"
+// ending the line, outside quotes, dropping any comment: a # after
+// whitespace outside quotes. Quotes are only those that start a key or value.
+func yamlLine(text string) (string, string, bool) {
+	colon, end := -1, len(text)
+	start := true
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case start && (c == '"' || c == '\''):
+			i = yamlClosingQuote(text, i)
+			if i < 0 {
+				return "", "", false
+			}
+			start = false
+		case c == ' ' || c == '\t':
+			if i+1 < len(text) && text[i+1] == '#' {
+				end = i
+				i = len(text)
+			}
+		case c == ':' && colon < 0 && (i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\t'):
+			colon = i
+			start = true
+		default:
+			start = false
+		}
+	}
+	if colon < 0 || colon > end {
+		return "", "", false
+	}
+	return strings.TrimSpace(text[:colon]), strings.TrimSpace(text[colon+1 : end]), true
+}
+
+// yamlClosingQuote returns the index of the quote closing the one at start,
+// or -1 if there is none.
+func yamlClosingQuote(text string, start int) int {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case quote == '\'' && text[i] == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+func yamlScalar(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				return unquoted
+			}
+			return value[1 : len(value)-1]
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+func (entry OutputManifestEntry) validate(name string) error {
+	if (len(entry.File) > 0) == (entry.Value != nil) {
+		return errors.New("Output " + name + " must have either a file or a value")
+	}
+	return nil
+}
+
+// Names returns the output names of a manifest in order.
+func (manifest OutputManifest) Names() []string {
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
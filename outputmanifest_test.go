@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseOutputManifests(t *testing.T) {
+	expected := OutputManifest{
+		"stress":  {File: "results/stress.csv"},
+		"mesh":    {File: "mesh.vtk"},
+		"maximum": {Value: 12.5},
+		"solver":  {Value: "beam 2"},
+	}
+	manifest, err := ParseJsonOutputManifest([]byte(`{
+		"stress": "results/stress.csv",
+		"mesh": {"file": "mesh.vtk"},
+		"maximum": {"value": 12.5},
+		"solver": {"value": "beam 2"}
+	}`))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("Expected %v, got %v", expected, manifest)
+	}
+	manifest, err = ParseYamlOutputManifest([]byte("# outputs\nstress: results/stress.csv\nmesh:\n  file: \"mesh.vtk\"\nmaximum:\n  value: 12.5\nsolver:\n  value: beam 2\n"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("Expected %v, got %v", expected, manifest)
+	}
+
+	for _, invalid := range []string{`{"a": {}}`, `{"a": {"file": "x", "value": 1}}`, `{"a": {"path": "x"}}`, `[]`} {
+		if _, err := ParseJsonOutputManifest([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+	// Comments and quoted colons, hashes and quotes
+	manifest, err = ParseYamlOutputManifest([]byte("stress: results/stress.csv  # main result\n" +
+		"\"mesh: fine\": \"mesh #1.vtk\" # quoted\n" +
+		"'it''s': 'a: b.csv'\n" +
+		"maximum:   # the peak\n  value: 12.5 # MPa\n" +
+		"windows: C:\\results\\out.csv\n"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected = OutputManifest{
+		"stress":     {File: "results/stress.csv"},
+		"mesh: fine": {File: "mesh #1.vtk"},
+		"it's":       {File: "a: b.csv"},
+		"maximum":    {Value: 12.5},
+		"windows":    {File: `C:\results\out.csv`},
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("Expected %v, got %v", expected, manifest)
+	}
+
+	for _, invalid := range []string{"a:\n", "  file: x\n", "a:\n  path: x\n", "a\n", "\"a: b\n", "a # b: c\n"} {
+		if _, err := ParseYamlOutputManifest([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestPackageResultOutputManifest(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "old.txt"), []byte("unchanged"), 0644)
+	before, err := SnapshotFiles(&Config{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "results"), 0755)
+	os.WriteFile(filepath.Join(dir, "results", "stress.json"), []byte(`[1,2]`), 0644)
+	os.WriteFile(filepath.Join(dir, "scratch.txt"), []byte("scratch"), 0644)
+	os.WriteFile(filepath.Join(dir, "outputs.json"), []byte(`{
+		"stress": "results/stress.json",
+		"previous": "old.txt",
+		"maximum": {"value": 2},
+		"missing": "missing.txt",
+		"escape": "../secret.txt"
+	}`), 0644)
+
+	response, err := PackageResult(context.Background(), &Config{}, log.Default(), nil, dir, before, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	names := make([]string, 0)
+	for name := range response.Outputs {
+		names = append(names, name)
+	}
+	if len(names) != 3 || response.Outputs["stress"] == nil || response.Outputs["previous"] == nil {
+		t.Errorf("Expected only the outputs listed in the manifest, got %v", names)
+	}
+	if data, _ := json.Marshal(response.Outputs["maximum"]); string(data) != "2" {
+		t.Errorf("Expected the value from the manifest, got %s", data)
+	}
+	if len(response.Errors) != 2 {
+		t.Errorf("Expected errors for the missing and escaping files, got %v", response.Errors)
+	}
+
+	// An invalid manifest is ignored in favour of the changed files
+	os.WriteFile(filepath.Join(dir, "outputs.json"), []byte(`{"stress": 3}`), 0644)
+	response, err = PackageResult(context.Background(), &Config{}, log.Default(), nil, dir, before, "", "", nil)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := response.Outputs["scratch.txt"]; !ok || len(response.Errors) != 1 {
+		t.Errorf("Expected the changed files and an error, got %v and %v", response.Outputs, response.Errors)
+	}
+}
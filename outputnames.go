@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+)
+
+// numberedName numbers a name before its extension, so deck.inc becomes
+// deck-2.inc.
+func numberedName(name string, i int) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(i) + ext
+}
+
+// takenName returns the output of a response with a name, ignoring case, if
+// there is one.
+func takenName(response *patchwork.CalculationResponse, name string) (string, bool) {
+	if _, ok := response.Outputs[name]; ok {
+		return name, true
+	}
+	for taken := range response.Outputs {
+		if strings.EqualFold(taken, name) {
+			return taken, true
+		}
+	}
+	return "", false
+}
+
+// AddOutput adds an output to a response, applying OutputCollisions if an
+// output already has its name, ignoring case: with "suffix" the new output is
+// numbered from 2, with "error" it is left out with an error, and otherwise
+// it replaces the one before. Collisions are noted in the logs of the
+// calculation.
+func AddOutput(config *Config, logger *log.Logger, response *patchwork.CalculationResponse, name string, value interface{}) {
+	taken, ok := takenName(response, name)
+	if !ok {
+		response.SetOutput(name, value)
+		return
+	}
+	switch config.OutputCollisions {
+	case "suffix":
+		numbered := name
+		for i := 2; ok; i++ {
+			numbered = numberedName(name, i)
+			_, ok = takenName(response, numbered)
+		}
+		logger.Println("Output " + name + " is taken, returning it as " + numbered)
+		response.AddLogs("There is more than one output " + name + ", so one was returned as " + numbered)
+		response.SetOutput(numbered, value)
+	case "error":
+		logger.Println("Output " + name + " is taken, leaving it out")
+		response.AddErrors("There is more than one output " + name + ", so only the first was returned")
+	default:
+		logger.Println("Output " + name + " is taken, replacing it")
+		response.AddLogs("There is more than one output " + name + ", so only the last was returned")
+		delete(response.Outputs, taken)
+		response.SetOutput(name, value)
+	}
+}
+
+// CheckInputCollisions applies OutputCollisions to outputs with the names of
+// inputs of the calculation, ignoring case, as the two would be confused:
+// with "suffix" the output is numbered from 2, with "error" it is left out
+// with an error, and otherwise it is kept. Collisions are noted in the logs
+// of the calculation.
+func CheckInputCollisions(config *Config, logger *log.Logger, inputs map[string]interface{}, response *patchwork.CalculationResponse) {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, input := range names {
+		name, ok := takenName(response, input)
+		if !ok {
+			continue
+		}
+		switch config.OutputCollisions {
+		case "suffix":
+			numbered := name
+			taken := true
+			for i := 2; taken; i++ {
+				numbered = numberedName(name, i)
+				_, taken = takenName(response, numbered)
+				if _, isInput := inputs[numbered]; isInput {
+					taken = true
+				}
+			}
+			logger.Println("Output " + name + " has the name of an input, returning it as " + numbered)
+			response.AddLogs("Output " + name + " has the name of an input, so was returned as " + numbered)
+			response.SetOutput(numbered, response.Outputs[name])
+			delete(response.Outputs, name)
+		case "error":
+			logger.Println("Output " + name + " has the name of an input, leaving it out")
+			response.AddErrors("Output " + name + " has the name of an input, so was not returned")
+			delete(response.Outputs, name)
+		default:
+			logger.Println("Output " + name + " has the name of an input")
+			response.AddLogs("Output " + name + " has the name of an input")
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestAddOutput(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	for policy, expected := range map[string]map[string]interface{}{
+		"":       {"result.csv": 3.0, "mass": 1.0},
+		"last":   {"result.csv": 3.0, "mass": 1.0},
+		"suffix": {"Result.csv": 2.0, "result-2.csv": 3.0, "mass": 1.0, "mass-2": 4.0},
+		"error":  {"Result.csv": 2.0, "mass": 1.0},
+	} {
+		config := &Config{OutputCollisions: policy}
+		response := patchwork.NewCalculationResponse()
+		AddOutput(config, logger, response, "mass", 1.0)
+		AddOutput(config, logger, response, "Result.csv", 2.0)
+		AddOutput(config, logger, response, "result.csv", 3.0)
+		if policy == "suffix" {
+			AddOutput(config, logger, response, "mass", 4.0)
+		}
+		if !reflect.DeepEqual(response.Outputs, expected) {
+			t.Errorf("With %q, outputs should be %v, were %v", policy, expected, response.Outputs)
+		}
+		if reported := len(response.Logs) + len(response.Errors); reported == 0 {
+			t.Errorf("With %q, the collision should be reported", policy)
+		}
+	}
+}
+
+func TestCheckInputCollisions(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	inputs := map[string]interface{}{"mesh": "x", "Load": 2.0, "mesh-2": "y"}
+	for policy, expected := range map[string]map[string]interface{}{
+		"":       {"mesh": 1.0, "load": 2.0, "stress": 3.0},
+		"suffix": {"mesh-3": 1.0, "load-2": 2.0, "stress": 3.0},
+		"error":  {"stress": 3.0},
+	} {
+		response := patchwork.NewCalculationResponse()
+		response.Outputs = map[string]interface{}{"mesh": 1.0, "load": 2.0, "stress": 3.0}
+		CheckInputCollisions(&Config{OutputCollisions: policy}, logger, inputs, response)
+		if !reflect.DeepEqual(response.Outputs, expected) {
+			t.Errorf("With %q, outputs should be %v, were %v", policy, expected, response.Outputs)
+		}
+	}
+}
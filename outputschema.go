@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// outputSchemaTtl is how long the output schema of a type of calculation is
+// used before it is fetched again.
+const outputSchemaTtl = 10 * time.Minute
+
+type cachedSchema struct {
+	schema  *Schema
+	fetched time.Time
+}
+
+// outputSchemas are the output schemas fetched, by host and type of
+// calculation, nil if the host has none.
+var outputSchemas = struct {
+	sync.Mutex
+	entries map[string]cachedSchema
+}{entries: make(map[string]cachedSchema)}
+
+// OutputSchema returns the schema of the outputs of a type of calculation
+// from its host, or nil if it has none.
+func OutputSchema(ctx context.Context, config *Config, logger *log.Logger, host string, token string, calculationType string) (*Schema, error) {
+	key := host + "\x00" + calculationType
+	outputSchemas.Lock()
+	cached, ok := outputSchemas.entries[key]
+	outputSchemas.Unlock()
+	if ok && time.Since(cached.fetched) < outputSchemaTtl {
+		return cached.schema, nil
+	}
+	client, err := NewClient(config, logger, host, token)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, err := client.GetOutputSchema(ctx, calculationType)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var schema *Schema
+	if data != nil {
+		schema = &Schema{}
+		if err := json.Unmarshal(data, schema); err != nil {
+			return nil, errors.Wrap(err, "Invalid output schema")
+		}
+	}
+	outputSchemas.Lock()
+	outputSchemas.entries[key] = cachedSchema{schema: schema, fetched: time.Now()}
+	outputSchemas.Unlock()
+	return schema, nil
+}
+
+// ValidateOutputs checks the outputs of a calculation against the schema of
+// its type, adding each violation to the response, both as an error and in
+// its violations. A schema that can't be fetched is logged and skipped, so
+// as not to fail the calculation.
+func ValidateOutputs(ctx context.Context, config *Config, logger *log.Logger, host string, token string, calculationType string, response *patchwork.CalculationResponse) {
+	if len(calculationType) == 0 {
+		return
+	}
+	schema, err := OutputSchema(ctx, config, logger, host, token, calculationType)
+	if err != nil {
+		logger.Println("Not validating outputs, as the schema of " + calculationType + " could not be fetched: " + err.Error())
+		return
+	}
+	if schema == nil {
+		return
+	}
+	outputs, err := schemaValue(response.Outputs)
+	if err != nil {
+		logger.Println("Not validating outputs: " + err.Error())
+		return
+	}
+	violations := schema.Violations("", outputs)
+	for _, violation := range violations {
+		response.AddErrors("Output " + violation.Path + " doesn't match the schema of " + calculationType + ": " + violation.Message)
+	}
+	if len(violations) > 0 {
+		logger.Println("Outputs have " + strconv.Itoa(len(violations)) + " violations of the schema of " + calculationType)
+		response.Violations = append(response.Violations, violations...)
+	}
+}
+
+// schemaValue returns the outputs as they are encoded, decoded with
+// UseNumber, but with artefacts reduced to their name, content type and any
+// URI rather than reading their content.
+func schemaValue(outputs map[string]interface{}) (map[string]interface{}, error) {
+	value := make(map[string]interface{}, len(outputs))
+	for name, output := range outputs {
+		if artefact, ok := output.(patchwork.Artefact); ok {
+			reduced := map[string]interface{}{"name": artefact.Name, "contentType": artefact.ContentType}
+			if len(artefact.Uri) > 0 {
+				reduced["uri"] = artefact.Uri
+			}
+			value[name] = reduced
+			continue
+		}
+		data, err := json.Marshal(output)
+		if err != nil {
+			return nil, errors.Wrap(err, "Output "+name)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var decoded interface{}
+		if err := decoder.Decode(&decoded); err != nil {
+			return nil, errors.Wrap(err, "Output "+name)
+		}
+		value[name] = decoded
+	}
+	return value, nil
+}
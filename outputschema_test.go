@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestValidateOutputs(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path != "/api/calculations/schemas/beam" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"type": "object", "required": ["mass", "stress"], "properties": {
+			"mass": {"type": "number", "minimum": 0},
+			"deflection": {"type": "number", "maximum": 0.01},
+			"mesh": {"type": "object", "required": ["contentType"], "properties": {"contentType": {"enum": ["model/stl"]}}}
+		}}`))
+	}))
+	defer server.Close()
+
+	logger := log.New(io.Discard, "", 0)
+	response := patchwork.NewCalculationResponse()
+	response.SetOutput("mass", -2.5)
+	response.SetOutput("deflection", json.RawMessage(`0.05`))
+	response.SetOutput("mesh", patchwork.Artefact{Name: "beam.stl", ContentType: "model/stl", Uri: "s3://results/beam.stl"})
+	for i := 0; i < 2; i++ {
+		ValidateOutputs(context.Background(), &Config{}, logger, server.URL, "token", "beam", response)
+	}
+	expected := []patchwork.Violation{
+		{Path: "stress", Message: "missing"},
+		{Path: "deflection", Message: "0.05 is more than the maximum of 0.01"},
+		{Path: "mass", Message: "-2.5 is less than the minimum of 0"},
+	}
+	if fetches != 1 || !reflect.DeepEqual(response.Violations, append(expected, expected...)) || len(response.Errors) != 6 {
+		t.Errorf("Unexpected violations %v and errors %v after %d fetches", response.Violations, response.Errors, fetches)
+	}
+	var buf bytes.Buffer
+	response.WriteJSON(&buf)
+	var encoded patchwork.CalculationResponse
+	if err := json.Unmarshal(buf.Bytes(), &encoded); err != nil || len(encoded.Violations) != 6 {
+		t.Errorf("Violations should be encoded, gave %s", buf.String())
+	}
+
+	// Types without a schema aren't validated
+	response = patchwork.NewCalculationResponse()
+	ValidateOutputs(context.Background(), &Config{}, logger, server.URL, "token", "plate", response)
+	if len(response.Violations) != 0 || len(response.Errors) != 0 {
+		t.Errorf("Outputs without a schema should be valid, gave %v", response.Errors)
+	}
+	buf.Reset()
+	response.WriteJSON(&buf)
+	if buf.String() != `{"logs":[],"errors":[],"outputs":{}}` {
+		t.Errorf("A response without violations should be encoded as before, was %s", buf.String())
+	}
+}
@@ -0,0 +1,281 @@
+package patchwork
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// BlockSignatures describe the blocks of a previous version of an artefact,
+// at Uri, for a new version to be sent as a delta against it. Weak is the
+// rsync rolling checksum of a block and Strong its SHA-256 (hex).
+type BlockSignatures struct {
+	Uri       string           `json:"uri"`
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"blockSize"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// DeltaContentType is the content type of a delta written by WriteDelta.
+const DeltaContentType = "application/vnd.patchwork.delta"
+
+// A delta is deltaMagic and the block size (uint32), then operations: 'C'
+// with the index and number of blocks (uint32 each) to copy from the
+// previous version, or 'L' with a length (uint32) and that many new bytes.
+var deltaMagic = []byte("PWDELTA\x01")
+
+// maxLiteral bounds the new bytes held before they are written.
+const maxLiteral = 64 << 10
+
+// weakSum is the rsync rolling checksum of a block.
+func weakSum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+func strongSum(block []byte) string {
+	sum := sha256.Sum256(block)
+	return hex.EncodeToString(sum[:])
+}
+
+// ComputeSignatures reads content and returns the signatures of its blocks.
+func ComputeSignatures(r io.Reader, blockSize int) (BlockSignatures, error) {
+	signatures := BlockSignatures{BlockSize: blockSize, Blocks: make([]BlockSignature, 0)}
+	if blockSize <= 0 {
+		return signatures, errors.New("Block size must be positive")
+	}
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			a, b := weakSum(block[:n])
+			signatures.Blocks = append(signatures.Blocks, BlockSignature{Weak: a | b<<16, Strong: strongSum(block[:n])})
+			signatures.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return signatures, nil
+		}
+		if err != nil {
+			return signatures, errors.WithStack(err)
+		}
+	}
+}
+
+// deltaWriter writes the operations of a delta, merging copies of
+// consecutive blocks.
+type deltaWriter struct {
+	w         io.Writer
+	copyStart uint32
+	copyCount uint32
+	copied    int64
+}
+
+func (d *deltaWriter) copyBlock(index uint32) error {
+	if d.copyCount > 0 && d.copyStart+d.copyCount == index {
+		d.copyCount++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.copyStart, d.copyCount = index, 1
+	return nil
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+	op := make([]byte, 9)
+	op[0] = 'C'
+	binary.BigEndian.PutUint32(op[1:], d.copyStart)
+	binary.BigEndian.PutUint32(op[5:], d.copyCount)
+	d.copyCount = 0
+	_, err := d.w.Write(op)
+	return errors.WithStack(err)
+}
+
+func (d *deltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	op := make([]byte, 5)
+	op[0] = 'L'
+	binary.BigEndian.PutUint32(op[1:], uint32(len(data)))
+	_, err := d.w.Write(append(op, data...))
+	return errors.WithStack(err)
+}
+
+// WriteDelta writes a delta that turns the previous version with the given
+// signatures into the content read from r, returning how many bytes of the
+// content were copied from the previous version rather than sent.
+func WriteDelta(w io.Writer, r io.Reader, signatures BlockSignatures) (int64, error) {
+	blockSize := signatures.BlockSize
+	if blockSize <= 0 {
+		return 0, errors.New("Block size must be positive")
+	}
+	header := make([]byte, len(deltaMagic)+4)
+	copy(header, deltaMagic)
+	binary.BigEndian.PutUint32(header[len(deltaMagic):], uint32(blockSize))
+	if _, err := w.Write(header); err != nil {
+		return 0, errors.WithStack(err)
+	}
+	byWeak := make(map[uint32][]int, len(signatures.Blocks))
+	for i, block := range signatures.Blocks {
+		byWeak[block.Weak] = append(byWeak[block.Weak], i)
+	}
+	// The last block of the previous version may be short, and is only
+	// matched by the end of the content
+	lastSize := int(signatures.Size - int64(len(signatures.Blocks)-1)*int64(blockSize))
+	match := func(window []byte, a uint32, b uint32) int {
+		indices := byWeak[a|b<<16]
+		if len(indices) == 0 {
+			return -1
+		}
+		strong := strongSum(window)
+		for _, i := range indices {
+			if signatures.Blocks[i].Strong == strong && (i < len(signatures.Blocks)-1 || len(window) == lastSize) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	delta := &deltaWriter{w: w}
+	reader := bufio.NewReader(r)
+	// buf holds new bytes not yet written followed by the window
+	buf := make([]byte, 0, maxLiteral+blockSize)
+	fill := func() (int, error) {
+		n := 0
+		for n < blockSize {
+			c, err := reader.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return n, errors.WithStack(err)
+			}
+			buf = append(buf, c)
+			n++
+		}
+		return n, nil
+	}
+	n, err := fill()
+	if err != nil {
+		return 0, err
+	}
+	a, b := weakSum(buf)
+	for n == blockSize {
+		window := buf[len(buf)-blockSize:]
+		if i := match(window, a, b); i >= 0 {
+			if err = delta.literal(buf[:len(buf)-blockSize]); err != nil {
+				return delta.copied, err
+			}
+			if err = delta.copyBlock(uint32(i)); err != nil {
+				return delta.copied, err
+			}
+			delta.copied += int64(blockSize)
+			buf = buf[:0]
+			if n, err = fill(); err != nil {
+				return delta.copied, err
+			}
+			a, b = weakSum(buf)
+			continue
+		}
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return delta.copied, errors.WithStack(err)
+		}
+		out := uint32(window[0])
+		buf = append(buf, c)
+		a = (a - out + uint32(c)) & 0xffff
+		b = (b - uint32(blockSize)*out + a) & 0xffff
+		if len(buf)-blockSize >= maxLiteral {
+			if err = delta.literal(buf[:len(buf)-blockSize]); err != nil {
+				return delta.copied, err
+			}
+			buf = append(buf[:0], buf[len(buf)-blockSize:]...)
+		}
+	}
+	if n > 0 && n < blockSize {
+		if i := match(buf[len(buf)-n:], a, b); i >= 0 {
+			if err = delta.literal(buf[:len(buf)-n]); err != nil {
+				return delta.copied, err
+			}
+			delta.copied += int64(n)
+			if err = delta.copyBlock(uint32(i)); err != nil {
+				return delta.copied, err
+			}
+			buf = buf[:0]
+		}
+	}
+	if err = delta.literal(buf); err != nil {
+		return delta.copied, err
+	}
+	return delta.copied, delta.flushCopy()
+}
+
+// ApplyDelta writes the content a delta describes, copying blocks from the
+// previous version.
+func ApplyDelta(w io.Writer, previous io.ReaderAt, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(deltaMagic)+4)
+	if _, err := io.ReadFull(reader, header); err != nil || !bytes.Equal(header[:len(deltaMagic)], deltaMagic) {
+		return errors.New("Not a delta")
+	}
+	blockSize := int64(binary.BigEndian.Uint32(header[len(deltaMagic):]))
+	op := make([]byte, 9)
+	for {
+		kind, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		switch kind {
+		case 'C':
+			if _, err = io.ReadFull(reader, op[1:9]); err != nil {
+				return errors.Wrap(err, "Truncated delta")
+			}
+			start := int64(binary.BigEndian.Uint32(op[1:])) * blockSize
+			length := int64(binary.BigEndian.Uint32(op[5:])) * blockSize
+			_, err = io.Copy(w, io.NewSectionReader(previous, start, length))
+		case 'L':
+			if _, err = io.ReadFull(reader, op[1:5]); err != nil {
+				return errors.Wrap(err, "Truncated delta")
+			}
+			length := int64(binary.BigEndian.Uint32(op[1:]))
+			var copied int64
+			copied, err = io.CopyN(w, reader, length)
+			if err == nil && copied < length {
+				err = io.ErrUnexpectedEOF
+			}
+		default:
+			return errors.Errorf("Unknown delta operation %q", kind)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
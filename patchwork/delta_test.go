@@ -0,0 +1,49 @@
+package patchwork
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	previous := make([]byte, 200000)
+	random.Read(previous)
+	edited := append([]byte{}, previous[:5000]...)
+	edited = append(edited, []byte("inserted")...)
+	edited = append(edited, previous[5000:120000]...)
+	edited = append(edited, previous[120100:]...)
+	for name, content := range map[string][]byte{
+		"unchanged": previous,
+		"edited":    edited,
+		"empty":     {},
+		"new":       []byte("nothing in common"),
+		"truncated": previous[:150000],
+		"prefixed":  append([]byte("header"), previous[len(previous)-1500:]...),
+	} {
+		signatures, err := ComputeSignatures(bytes.NewReader(previous), 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var delta bytes.Buffer
+		copied, err := WriteDelta(&delta, bytes.NewReader(content), signatures)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var result bytes.Buffer
+		err = ApplyDelta(&result, bytes.NewReader(previous), &delta)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(result.Bytes(), content) {
+			t.Errorf("%s: content differs after applying the delta", name)
+		}
+		if name == "unchanged" && (copied != int64(len(previous)) || delta.Len() > 100) {
+			t.Errorf("Expected an unchanged file to be copied, got %d bytes copied and a delta of %d", copied, delta.Len())
+		}
+		if name == "edited" && int64(len(edited))-copied > 3*1024 {
+			t.Errorf("Expected most of an edited file to be copied, got %d of %d", copied, len(edited))
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package patchwork
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// plainArtefact is an Artefact without its MarshalJSON method.
+type plainArtefact Artefact
+
+// MarshalJSON encodes the artefact, reading its content from Path if it has
+// no Uri. Use WriteJSON to encode it without holding the content in memory.
+func (artefact Artefact) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	err := artefact.WriteJSON(&buf)
+	return buf.Bytes(), err
+}
+
+// WriteJSON encodes the artefact to w, streaming the content of Path, if it
+// has no Uri, through a base64 encoder.
+func (artefact Artefact) WriteJSON(w io.Writer) error {
+	if len(artefact.Uri) > 0 || len(artefact.Path) == 0 {
+		data, err := json.Marshal(plainArtefact(artefact))
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		return err
+	}
+	file, err := os.Open(artefact.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Encode everything but the content of the URI, which is left open at
+	// the end of the object
+	artefact.Uri = "data:" + artefact.ContentType + ";base64,"
+	data, err := json.Marshal(plainArtefact(artefact))
+	if err != nil {
+		return err
+	}
+	uri, err := json.Marshal(artefact.Uri)
+	if err != nil {
+		return err
+	}
+	// The field can't be mistaken for part of another, as quotes within
+	// strings are escaped
+	field := append([]byte(`,"uri":`), uri[:len(uri)-1]...)
+	uriStart := bytes.Index(data, field)
+	if uriStart < 0 {
+		return errors.New("Could not find the URI of artefact " + artefact.Name)
+	}
+	uriEnd := uriStart + len(field)
+	if _, err := w.Write(data[:uriEnd]); err != nil {
+		return err
+	}
+	encoder := base64.NewEncoder(base64.StdEncoding, w)
+	if _, err := io.Copy(encoder, file); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	_, err = w.Write(data[uriEnd:])
+	return err
+}
+
+// WriteJSON encodes the deferred artefact to w as json.Marshal would, but
+// streaming the content of the artefact.
+func (deferred DeferredArtefact) WriteJSON(w io.Writer) error {
+	output, err := json.Marshal(deferred.Output)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `{"output":`+string(output)+`,"artefact":`); err != nil {
+		return err
+	}
+	if err := deferred.Artefact.WriteJSON(w); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "}")
+	return err
+}
+
+// WriteJSON encodes the response to w as json.Marshal would, but streaming
+// the content of artefacts with a Path rather than holding it in memory.
+func (response *CalculationResponse) WriteJSON(w io.Writer) error {
+	logs, err := json.Marshal(response.Logs)
+	if err != nil {
+		return err
+	}
+	errs, err := json.Marshal(response.Errors)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `{"logs":`+string(logs)+`,"errors":`+string(errs)+`,"outputs":`); err != nil {
+		return err
+	}
+	if response.Outputs == nil {
+		_, err := io.WriteString(w, "null}")
+		return err
+	}
+	names := make([]string, 0, len(response.Outputs))
+	for name := range response.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	separator := "{"
+	for _, name := range names {
+		key, err := json.Marshal(name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, separator+string(key)+":"); err != nil {
+			return err
+		}
+		separator = ","
+		if artefact, ok := response.Outputs[name].(Artefact); ok {
+			err = artefact.WriteJSON(w)
+		} else {
+			var value []byte
+			value, err = json.Marshal(response.Outputs[name])
+			if err == nil {
+				_, err = w.Write(value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if separator == "{" {
+		_, err = io.WriteString(w, "{}")
+	} else {
+		_, err = io.WriteString(w, "}")
+	}
+	if err == nil && len(response.Violations) > 0 {
+		var violations []byte
+		violations, err = json.Marshal(response.Violations)
+		if err == nil {
+			_, err = io.WriteString(w, `,"violations":`+string(violations))
+		}
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "}")
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+// Package patchwork contains the types exchanged between the Patchwork
+// server, dispatchers and calculation agents.
+package patchwork
+
+import "time"
+
+type Artefact struct {
+	Name        string                 `json:"name"`
+	ContentType string                 `json:"contentType"`
+	Uri         string                 `json:"uri"`
+	Summary     map[string]interface{} `json:"summary,omitempty"`
+	// Encryption, if set, is the format the content is encrypted in.
+	Encryption string `json:"encryption,omitempty"`
+	// Size and Sha256 (hex), if set, are those of the content, for it to be
+	// checked when it is read.
+	Size   int64  `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+	// Path, if set and Uri isn't, is a file whose content is encoded as a
+	// data URI when the artefact is, so that it needn't be held in memory.
+	Path string `json:"-"`
+}
+
+type CalculationId struct {
+	DocumentType string `json:"documentType"`
+	Type         string `json:"type"`
+	Id           string `json:"id"`
+	Version      string `json:"version"`
+	Path         string `json:"path"`
+}
+
+// CalculationPayload is what a dispatcher sends an agent to run a
+// calculation. It may carry the whole context of the calculation, so that the
+// agent needn't fetch it.
+type CalculationPayload struct {
+	Id             string              `json:"id"`
+	Host           string              `json:"host"`
+	Token          string              `json:"token"`
+	TimeoutSeconds int                 `json:"timeoutSeconds"`
+	Context        *CalculationContext `json:"context,omitempty"`
+	Callback       *Callback           `json:"callback,omitempty"`
+	// Include and Exclude, if set, replace the agent's patterns for which
+	// output files are returned.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Callback is where the result of a calculation is POSTed instead of its
+// host, with the given Authorization header if set.
+type Callback struct {
+	Url           string `json:"url"`
+	Authorization string `json:"authorization,omitempty"`
+}
+
+// UploadRequest asks the host where to upload an output that is too large
+// to send in the result.
+type UploadRequest struct {
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+// PresignedUpload is where to PUT the content of an output, with the given
+// headers, and the Uri to refer to it by in the result.
+type PresignedUpload struct {
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Uri     string            `json:"uri"`
+}
+
+// Affinity reports the calculations whose inputs an agent has cached, so
+// that follow-up versions can be routed to it.
+type Affinity struct {
+	AgentId      string          `json:"agentId"`
+	Calculations []AffinityEntry `json:"calculations"`
+}
+
+// AffinityEntry is a calculation an agent has run, with the SHA-256 of the
+// URI of each of its inputs that the agent has cached.
+type AffinityEntry struct {
+	Calculation CalculationId     `json:"calculation"`
+	InputHashes map[string]string `json:"inputHashes"`
+	Time        time.Time         `json:"time"`
+}
+
+// PendingUri refers to an artefact that is sent after the result.
+const PendingUri = "pending:"
+
+// DeferredArtefact is an output of a calculation, returned in its result as
+// pending, that has since been uploaded.
+type DeferredArtefact struct {
+	Output   string   `json:"output"`
+	Artefact Artefact `json:"artefact"`
+}
+
+type CalculationContext struct {
+	Id           CalculationId          `json:"id"`
+	Owner        string                 `json:"owner"`
+	Inputs       map[string]interface{} `json:"inputs"`
+	FailedInputs map[string]string      `json:"failedInputs"`
+}
+
+// CompletedCalculation is a calculation that has been run, with the context
+// it was run with and the result stored for it.
+type CompletedCalculation struct {
+	Context CalculationContext  `json:"context"`
+	Result  CalculationResponse `json:"result"`
+}
+
+// CalculationResponse is the result of a calculation sent back to the
+// server. Output values are any JSON values; JSON documents that are already
+// encoded can be added as json.RawMessage, and files as Artefacts.
+type CalculationResponse struct {
+	Logs    []string               `json:"logs"`
+	Errors  []string               `json:"errors"`
+	Outputs map[string]interface{} `json:"outputs"`
+	// Violations are the ways in which the outputs don't match the schema
+	// of the calculation's type, if it was checked.
+	Violations []Violation `json:"violations,omitempty"`
+}
+
+// Violation is a problem with the value at Path in the outputs of a
+// calculation.
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// NewCalculationResponse returns an empty response, which is encoded with
+// empty rather than null logs, errors and outputs.
+func NewCalculationResponse() *CalculationResponse {
+	return &CalculationResponse{
+		Logs:    make([]string, 0),
+		Errors:  make([]string, 0),
+		Outputs: make(map[string]interface{}),
+	}
+}
+
+func (response *CalculationResponse) AddLogs(lines ...string) {
+	response.Logs = append(response.Logs, lines...)
+}
+
+func (response *CalculationResponse) AddErrors(lines ...string) {
+	response.Errors = append(response.Errors, lines...)
+}
+
+func (response *CalculationResponse) SetOutput(name string, value interface{}) {
+	if response.Outputs == nil {
+		response.Outputs = make(map[string]interface{})
+	}
+	response.Outputs[name] = value
+}
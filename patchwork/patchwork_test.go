@@ -0,0 +1,139 @@
+package patchwork
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEmptyResponseEncoding(t *testing.T) {
+	data, err := json.Marshal(NewCalculationResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"logs":[],"errors":[],"outputs":{}}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	response := NewCalculationResponse()
+	response.AddLogs("Starting", "Done")
+	response.AddErrors("Warning: mesh is coarse")
+	response.SetOutput("maxStress", 412.3)
+	response.SetOutput("results.json", json.RawMessage(`{"mass": 12.5, "nodes": [1, 2, 3]}`))
+	response.SetOutput("plot.png", Artefact{Name: "plot.png", ContentType: "image/png", Uri: "data:image/png;base64,iVBORw0KGgo="})
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded CalculationResponse
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Logs, response.Logs) {
+		t.Errorf("Logs: expected %v, got %v", response.Logs, decoded.Logs)
+	}
+	if !reflect.DeepEqual(decoded.Errors, response.Errors) {
+		t.Errorf("Errors: expected %v, got %v", response.Errors, decoded.Errors)
+	}
+	expected := map[string]interface{}{
+		"maxStress":    412.3,
+		"results.json": map[string]interface{}{"mass": 12.5, "nodes": []interface{}{1.0, 2.0, 3.0}},
+		"plot.png":     map[string]interface{}{"name": "plot.png", "contentType": "image/png", "uri": "data:image/png;base64,iVBORw0KGgo="},
+	}
+	if !reflect.DeepEqual(decoded.Outputs, expected) {
+		t.Errorf("Outputs: expected %v, got %v", expected, decoded.Outputs)
+	}
+
+}
+
+func TestArtefactRoundTrip(t *testing.T) {
+	artefact := Artefact{
+		Name:        "results.json",
+		ContentType: "application/json",
+		Uri:         "data:application/json;base64,e30=",
+		Summary:     map[string]interface{}{"type": "object", "size": 2.0},
+	}
+	data, err := json.Marshal(artefact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Artefact
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, artefact) {
+		t.Errorf("Expected %v, got %v", artefact, decoded)
+	}
+}
+
+func TestFileArtefactStreaming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(path, []byte("Max stress = 412.3 MPa\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	response := NewCalculationResponse()
+	response.AddLogs("Done <quickly>")
+	response.SetOutput("maxStress", 412.3)
+	response.SetOutput("report.txt", Artefact{Name: "report.txt", ContentType: "text/plain", Path: path})
+	var streamed bytes.Buffer
+	if err := response.WriteJSON(&streamed); err != nil {
+		t.Fatal(err)
+	}
+	response.SetOutput("report.txt", Artefact{Name: "report.txt", ContentType: "text/plain",
+		Uri: "data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte("Max stress = 412.3 MPa\n"))})
+	expected, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed.String() != string(expected) {
+		t.Errorf("Expected %s, got %s", expected, streamed.String())
+	}
+	// Encoded in memory, an artefact with a path is the same
+	response.SetOutput("report.txt", Artefact{Name: "report.txt", ContentType: "text/plain", Path: path})
+	marshalled, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(marshalled) != string(expected) {
+		t.Errorf("Expected %s, got %s", expected, marshalled)
+	}
+	streamed.Reset()
+	if err := NewCalculationResponse().WriteJSON(&streamed); err != nil || streamed.String() != `{"logs":[],"errors":[],"outputs":{}}` {
+		t.Errorf("Unexpected empty response %s: %v", streamed.String(), err)
+	}
+}
+
+func TestFileArtefactAwkwardNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "content")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, artefact := range []Artefact{
+		{Name: `x;base64,`, ContentType: "text/plain", Path: path},
+		{Name: `a","uri":"data:text/plain;base64,`, ContentType: "text/plain", Path: path},
+		{Name: "mesh", ContentType: "text/plain;base64,", Path: path},
+	} {
+		data, err := json.Marshal(artefact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Artefact
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Invalid JSON for %q: %s", artefact.Name, data)
+		}
+		expected := "data:" + artefact.ContentType + ";base64," + base64.StdEncoding.EncodeToString([]byte("content"))
+		if decoded.Name != artefact.Name || decoded.ContentType != artefact.ContentType || decoded.Uri != expected {
+			t.Errorf("Unexpected encoding of %q: %s", artefact.Name, data)
+		}
+	}
+}
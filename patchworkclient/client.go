@@ -0,0 +1,826 @@
+// Package patchworkclient is a client for the calculation API of a Patchwork
+// host, as used by calculation agents.
+package patchworkclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// ErrAlreadyRun is returned by GetContext when the host reports that the
+// calculation has already been run.
+var ErrAlreadyRun = errors.New("Calculation already run")
+
+// ErrResultTooLarge is returned by PostResult when the host rejects the
+// result with 413 Request Entity Too Large.
+var ErrResultTooLarge = errors.New("Result too large")
+
+// Client talks to the calculation API of Host, authenticating with Token.
+// Requests that fail with a network error, 429 or a 5xx status are retried
+// up to Retries times, waiting Backoff before the first retry and twice as
+// long before each following one.
+type Client struct {
+	Host       string
+	Token      string
+	HTTPClient *http.Client
+	// Header is added to every request
+	Header  http.Header
+	Retries int
+	Backoff time.Duration
+	Logger  *log.Logger
+	// ResultURL, if set, is where results are posted instead of the host.
+	ResultURL string
+	// Compress, if set, sends results gzip compressed from the start, rather
+	// than only once the host rejects them as too large.
+	Compress bool
+	// Multipart, if set, sends results as multipart/form-data, with the
+	// content of each artefact in a part of its own.
+	Multipart bool
+	// ScalarsFirst, if set, sends results with their artefacts pending, and
+	// the artefacts after them.
+	ScalarsFirst bool
+}
+
+func New(host string, token string) *Client {
+	return &Client{
+		Host:       host,
+		Token:      token,
+		HTTPClient: &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+		Header:     make(http.Header),
+		Retries:    3,
+		Backoff:    time.Second,
+		Logger:     log.Default(),
+	}
+}
+
+// StatusError is returned for a response with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (err *StatusError) Error() string {
+	return err.Status
+}
+
+func (client *Client) url(path string) string {
+	host := client.Host
+	for len(host) > 0 && host[len(host)-1] == '/' {
+		host = host[:len(host)-1]
+	}
+	return host + path
+}
+
+// authorize adds the token and headers of the client to a request.
+func (client *Client) authorize(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+client.Token)
+	for name, values := range client.Header {
+		req.Header[name] = values
+	}
+}
+
+// do sends a request built by newRequest, retrying transient failures, and
+// returns the response of the last attempt. The caller must close its body.
+func (client *Client) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	backoff := client.Backoff
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req = req.WithContext(ctx)
+		client.authorize(req)
+		resp, err := client.HTTPClient.Do(req)
+		transient := err != nil || resp.StatusCode == 429 || resp.StatusCode >= 500
+		if !transient || attempt >= client.Retries || ctx.Err() != nil {
+			return resp, errors.WithStack(err)
+		}
+		if err != nil {
+			client.Logger.Println("Request to " + req.URL.String() + " failed, retrying: " + err.Error())
+		} else {
+			client.Logger.Println("Request to " + req.URL.String() + " failed, retrying: " + resp.Status)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.WithStack(ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// GetContext fetches the context, including the inputs, of a calculation,
+// asking for it gzip compressed.
+func (client *Client) GetContext(ctx context.Context, calculation string) (patchwork.CalculationContext, error) {
+	var dat patchwork.CalculationContext
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", client.url("/api/calculations/remote/"+calculation), nil)
+		if err == nil {
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		return req, err
+	})
+	if err != nil {
+		return dat, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	// HTTP code to indicate we already ran the calculation
+	if resp.StatusCode == 208 {
+		return dat, ErrAlreadyRun
+	}
+	if resp.StatusCode != 200 {
+		return dat, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := decodedBody(resp)
+	if err != nil {
+		return dat, errors.WithStack(err)
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&dat)
+	return dat, errors.WithStack(err)
+}
+
+// decodedBody returns the body of a response, decompressed if it is gzip
+// encoded. Setting Accept-Encoding stops the transport decompressing it.
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.NopCloser(resp.Body), nil
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	return reader, errors.WithStack(err)
+}
+
+// GetCompletedCalculation fetches the context and stored result of a
+// calculation that has been run, to run it again.
+func (client *Client) GetCompletedCalculation(ctx context.Context, calculation string) (patchwork.CompletedCalculation, error) {
+	var completed patchwork.CompletedCalculation
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", client.url("/api/calculations/completed/"+calculation), nil)
+		if err == nil {
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		return req, err
+	})
+	if err != nil {
+		return completed, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return completed, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	body, err := decodedBody(resp)
+	if err != nil {
+		return completed, errors.WithStack(err)
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&completed)
+	return completed, errors.WithStack(err)
+}
+
+// GetAgentConfig fetches the configuration the host has for agents, as the
+// JSON of an agent config file.
+func (client *Client) GetAgentConfig(ctx context.Context) ([]byte, error) {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", client.url("/api/agents/config"), nil)
+		if err == nil {
+			req.Header.Set("Accept", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	data, err := io.ReadAll(resp.Body)
+	return data, errors.WithStack(err)
+}
+
+// SendLogs posts log output and the progress (from 0 to 1) of a
+// calculation.
+func (client *Client) SendLogs(ctx context.Context, calculation string, logs string, progress float32) error {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST",
+			client.url("/api/calculations/logs/"+calculation+"?progress="+fmt.Sprintf("%f", progress)),
+			bytes.NewReader([]byte(logs)))
+		if err == nil {
+			req.Header.Set("Content-Type", "text/plain")
+		}
+		return req, err
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PresignUpload asks the host for a presigned URL to upload an output of a
+// calculation to.
+func (client *Client) PresignUpload(ctx context.Context, calculation string, upload patchwork.UploadRequest) (patchwork.PresignedUpload, error) {
+	var presigned patchwork.PresignedUpload
+	body, err := json.Marshal(upload)
+	if err != nil {
+		return presigned, errors.WithStack(err)
+	}
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", client.url("/api/calculations/uploads/"+calculation), bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return presigned, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return presigned, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&presigned)
+	return presigned, errors.WithStack(err)
+}
+
+// GetSignatures fetches the block signatures of the previous version the
+// host has of an output file of a calculation, for it to be sent as a delta.
+func (client *Client) GetSignatures(ctx context.Context, calculation string, name string) (patchwork.BlockSignatures, error) {
+	var signatures patchwork.BlockSignatures
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", client.url("/api/calculations/signatures/"+calculation+"/"+url.PathEscape(name)), nil)
+		if err == nil {
+			req.Header.Set("Accept", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return signatures, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return signatures, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&signatures)
+	return signatures, errors.WithStack(err)
+}
+
+// UploadDelta sends a delta, opened afresh for each attempt, against the
+// previous version of an output file at base, with the SHA-256 (hex) of the
+// new content for the host to check, and returns the artefact the host
+// stored.
+func (client *Client) UploadDelta(ctx context.Context, calculation string, name string, contentType string, base string, sha256 string, open func() (io.ReadCloser, error), size int64) (patchwork.Artefact, error) {
+	var artefact patchwork.Artefact
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", client.url("/api/calculations/deltas/"+calculation+"/"+url.PathEscape(name)), body)
+		if err != nil {
+			body.Close()
+			return req, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", patchwork.DeltaContentType)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Artefact-Content-Type", contentType)
+		req.Header.Set("X-Base-Uri", base)
+		req.Header.Set("X-Content-Sha256", sha256)
+		return req, nil
+	})
+	if err != nil {
+		return artefact, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return artefact, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&artefact)
+	return artefact, errors.WithStack(err)
+}
+
+// TusVersion is the version of the tus resumable upload protocol spoken by
+// UploadChunked.
+const TusVersion = "1.0.0"
+
+// UploadChunked uploads an output file of a calculation to the host with the
+// tus resumable upload protocol, in chunks of chunkSize bytes, and returns
+// the URL of the upload. A chunk that fails is retried, as other requests
+// are, from the offset the host reports having received, so the upload
+// resumes rather than starting again.
+func (client *Client) UploadChunked(ctx context.Context, calculation string, name string, contentType string, file io.ReaderAt, size int64, chunkSize int64) (string, error) {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(name)) +
+		",filetype " + base64.StdEncoding.EncodeToString([]byte(contentType))
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", client.url("/api/calculations/files/"+calculation), nil)
+		if err == nil {
+			req.Header.Set("Tus-Resumable", TusVersion)
+			req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+			req.Header.Set("Upload-Metadata", metadata)
+		}
+		return req, err
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return "", &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || len(resp.Header.Get("Location")) == 0 {
+		return "", errors.New("Upload of " + name + " has no location")
+	}
+	upload := location.String()
+	backoff := client.Backoff
+	attempt := 0
+	for offset := int64(0); offset < size; {
+		length := size - offset
+		if length > chunkSize {
+			length = chunkSize
+		}
+		next, err := client.patchChunk(ctx, upload, io.NewSectionReader(file, offset, length), offset, length)
+		if err == nil {
+			offset = next
+			attempt = 0
+			backoff = client.Backoff
+			continue
+		}
+		statusErr, isStatus := errors.Cause(err).(*StatusError)
+		transient := !isStatus || statusErr.StatusCode == 409 || statusErr.StatusCode == 429 || statusErr.StatusCode >= 500
+		if !transient || attempt >= client.Retries || ctx.Err() != nil {
+			return "", errors.WithStack(err)
+		}
+		client.Logger.Println("Upload of " + name + " failed at " + strconv.FormatInt(offset, 10) + " bytes, resuming: " + err.Error())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return "", errors.WithStack(ctx.Err())
+		case <-timer.C:
+		}
+		attempt++
+		backoff *= 2
+		offset, err = client.uploadOffset(ctx, upload)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+	return upload, nil
+}
+
+// patchChunk sends a chunk of a tus upload starting at offset, once, and
+// returns the offset the host has received up to.
+func (client *Client) patchChunk(ctx context.Context, upload string, chunk io.Reader, offset int64, length int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "PATCH", upload, chunk)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	req.ContentLength = length
+	client.authorize(req)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 204 && resp.StatusCode != 200 {
+		return 0, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	next, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || next <= offset || next > offset+length {
+		return 0, errors.New("Invalid Upload-Offset " + resp.Header.Get("Upload-Offset"))
+	}
+	return next, nil
+}
+
+// uploadOffset asks the host how much of a tus upload it has received.
+func (client *Client) uploadOffset(ctx context.Context, upload string) (int64, error) {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("HEAD", upload, nil)
+		if err == nil {
+			req.Header.Set("Tus-Resumable", TusVersion)
+		}
+		return req, err
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return 0, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return 0, errors.New("Invalid Upload-Offset " + resp.Header.Get("Upload-Offset"))
+	}
+	return offset, nil
+}
+
+// GetOutput fetches an output of a previous calculation, as it is encoded in
+// its result.
+func (client *Client) GetOutput(ctx context.Context, calculation string, output string) (json.RawMessage, error) {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", client.url("/api/calculations/outputs/"+url.PathEscape(calculation)+"/"+url.PathEscape(output)), nil)
+		if err == nil {
+			req.Header.Set("Accept", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	var value json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&value)
+	return value, errors.WithStack(err)
+}
+
+// GetOutputSchema fetches the JSON schema of the outputs of a type of
+// calculation, or returns nil if the host has none for it.
+func (client *Client) GetOutputSchema(ctx context.Context, calculationType string) (json.RawMessage, error) {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", client.url("/api/calculations/schemas/"+url.PathEscape(calculationType)), nil)
+		if err == nil {
+			req.Header.Set("Accept", "application/schema+json, application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	var schema json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&schema)
+	return schema, errors.WithStack(err)
+}
+
+// SendArtefact posts an output of a calculation that was left pending in its
+// result. The content of an artefact with a Path is encoded as it is sent,
+// reading the file again for each attempt.
+func (client *Client) SendArtefact(ctx context.Context, calculation string, output string, artefact patchwork.Artefact) error {
+	deferred := patchwork.DeferredArtefact{Output: output, Artefact: artefact}
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(deferred.WriteJSON(writer))
+		}()
+		req, err := http.NewRequest("POST", client.url("/api/calculations/artefacts/"+calculation), reader)
+		if err != nil {
+			reader.Close()
+			return req, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// SendAffinity reports the calculations whose inputs the agent has cached.
+func (client *Client) SendAffinity(ctx context.Context, affinity patchwork.Affinity) error {
+	body, err := json.Marshal(affinity)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", client.url("/api/agents/affinity"), bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, err
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 204 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// SendResult posts the result of a calculation. If the host rejects it as
+// too large, it is sent again gzip compressed, unless it already was.
+func (client *Client) SendResult(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	if client.Multipart {
+		return client.SendResultMultipart(ctx, calculation, response)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = client.PostResult(ctx, calculation, body, client.Compress)
+	if err == ErrResultTooLarge && !client.Compress {
+		client.Logger.Println("Result of " + strconv.Itoa(len(body)) + " bytes is too large, retrying compressed")
+		err = client.PostResult(ctx, calculation, body, true)
+	}
+	if err == ErrResultTooLarge {
+		return errors.New("Result of " + strconv.Itoa(len(body)) + " bytes is too large for the server, even compressed")
+	}
+	return err
+}
+
+// SendResultFile posts the encoded result of a calculation from a file,
+// without holding it in memory. If the host rejects it as too large, it is
+// sent again gzip compressed, unless it already was.
+func (client *Client) SendResultFile(ctx context.Context, calculation string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	open := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+	err = client.postResult(ctx, calculation, open, info.Size(), client.Compress)
+	if err == ErrResultTooLarge && !client.Compress {
+		client.Logger.Println("Result of " + strconv.FormatInt(info.Size(), 10) + " bytes is too large, retrying compressed")
+		err = client.postResult(ctx, calculation, open, info.Size(), true)
+	}
+	if err == ErrResultTooLarge {
+		return errors.New("Result of " + strconv.FormatInt(info.Size(), 10) + " bytes is too large for the server, even compressed")
+	}
+	return err
+}
+
+// SendResultMultipart posts the result of a calculation as multipart/form-data,
+// so that the host can stream artefacts to storage rather than decode them
+// from the JSON. The first part, result, is the response, in which artefacts
+// with content in a file have the URI part:<output>. Each follows in a part
+// named after its output, read from the file as it is sent.
+func (client *Client) SendResultMultipart(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	result := *response
+	result.Outputs = make(map[string]interface{}, len(response.Outputs))
+	parts := make([]string, 0)
+	for name, value := range response.Outputs {
+		if artefact, ok := value.(patchwork.Artefact); ok && len(artefact.Uri) == 0 && len(artefact.Path) > 0 {
+			parts = append(parts, name)
+			value = patchwork.Artefact{Name: artefact.Name, ContentType: artefact.ContentType, Uri: "part:" + name, Summary: artefact.Summary}
+		}
+		result.Outputs[name] = value
+	}
+	sort.Strings(parts)
+	body, err := json.Marshal(&result)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		url := client.url("/api/calculations/remote/" + calculation)
+		if len(client.ResultURL) > 0 {
+			url = client.ResultURL
+		}
+		reader, writer := io.Pipe()
+		go func() {
+			form := multipart.NewWriter(writer)
+			form.SetBoundary(boundary)
+			err := writePart(form, "result", "", "application/json", func(w io.Writer) error {
+				_, err := w.Write(body)
+				return err
+			})
+			for _, name := range parts {
+				if err != nil {
+					break
+				}
+				artefact := response.Outputs[name].(patchwork.Artefact)
+				err = writePart(form, name, artefact.Name, artefact.ContentType, func(w io.Writer) error {
+					file, err := os.Open(artefact.Path)
+					if err != nil {
+						return err
+					}
+					defer file.Close()
+					_, err = io.Copy(w, file)
+					return err
+				})
+			}
+			if err == nil {
+				err = form.Close()
+			}
+			writer.CloseWithError(err)
+		}()
+		req, err := http.NewRequest("POST", url, reader)
+		if err != nil {
+			reader.Close()
+			return req, err
+		}
+		req.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+		req.Header.Set("Expect", "100-continue")
+		return req, nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return errors.New("Result is too large for the server")
+	}
+	if resp.StatusCode != 200 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// SendResultScalarsFirst posts the result of a calculation with the
+// artefacts whose content is in files pending, so that the host has its
+// other outputs straight away. It then sends those artefacts, smallest
+// first, and tells the host the result is complete. Results posted to a
+// ResultURL are sent whole.
+func (client *Client) SendResultScalarsFirst(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	if len(client.ResultURL) > 0 {
+		return client.SendResult(ctx, calculation, response)
+	}
+	result := *response
+	result.Outputs = make(map[string]interface{}, len(response.Outputs))
+	pending := make([]string, 0)
+	// Artefacts already pending are deferred uploads, the last of which
+	// completes the result instead
+	complete := true
+	for name, value := range response.Outputs {
+		if artefact, ok := value.(patchwork.Artefact); ok {
+			if len(artefact.Uri) == 0 && len(artefact.Path) > 0 {
+				pending = append(pending, name)
+				value = patchwork.Artefact{Name: artefact.Name, ContentType: artefact.ContentType, Uri: patchwork.PendingUri,
+					Summary: artefact.Summary, Size: artefact.Size, Sha256: artefact.Sha256}
+			} else if artefact.Uri == patchwork.PendingUri {
+				complete = false
+			}
+		}
+		result.Outputs[name] = value
+	}
+	if len(pending) == 0 {
+		return client.SendResult(ctx, calculation, response)
+	}
+	sizes := make(map[string]int64, len(pending))
+	for _, name := range pending {
+		if info, err := os.Stat(response.Outputs[name].(patchwork.Artefact).Path); err == nil {
+			sizes[name] = info.Size()
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if sizes[pending[i]] != sizes[pending[j]] {
+			return sizes[pending[i]] < sizes[pending[j]]
+		}
+		return pending[i] < pending[j]
+	})
+	err := client.SendResult(ctx, calculation, &result)
+	if err != nil {
+		return err
+	}
+	for _, name := range pending {
+		client.Logger.Println("Sending output " + name + " of calculation " + calculation)
+		err = client.SendArtefact(ctx, calculation, name, response.Outputs[name].(patchwork.Artefact))
+		if err != nil {
+			return errors.Wrap(err, "Sending output "+name)
+		}
+	}
+	if !complete {
+		return nil
+	}
+	return client.CompleteResult(ctx, calculation)
+}
+
+// CompleteResult tells the host that all the outputs of a calculation whose
+// result was sent with pending artefacts have been sent.
+func (client *Client) CompleteResult(ctx context.Context, calculation string) error {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("POST", client.url("/api/calculations/complete/"+calculation), nil)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// writePart writes a part of a form, with a filename if one is given.
+func writePart(form *multipart.Writer, name string, filename string, contentType string, write func(io.Writer) error) error {
+	header := make(textproto.MIMEHeader)
+	disposition := map[string]string{"name": name}
+	if len(filename) > 0 {
+		disposition["filename"] = filename
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType("form-data", disposition))
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	return write(part)
+}
+
+// PostResult posts an encoded CalculationResponse, optionally gzip
+// compressed.
+func (client *Client) PostResult(ctx context.Context, calculation string, body []byte, compress bool) error {
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return client.postResult(ctx, calculation, open, int64(len(body)), compress)
+}
+
+// postResult posts an encoded CalculationResponse of the given size, opened
+// afresh for each attempt, compressing it as it is sent if asked to.
+func (client *Client) postResult(ctx context.Context, calculation string, open func() (io.ReadCloser, error), size int64, compress bool) error {
+	resp, err := client.do(ctx, func() (*http.Request, error) {
+		url := client.url("/api/calculations/remote/" + calculation)
+		if len(client.ResultURL) > 0 {
+			url = client.ResultURL
+		}
+		body, err := open()
+		if err != nil {
+			return nil, err
+		}
+		var reader io.ReadCloser = body
+		if compress {
+			reader = gzipReader(body)
+		}
+		req, err := http.NewRequest("POST", url, reader)
+		if err != nil {
+			reader.Close()
+			return req, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if compress {
+			req.Header.Set("Content-Encoding", "gzip")
+		} else {
+			req.ContentLength = size
+		}
+		// Give the server the chance to reject the result before it is sent
+		req.Header.Set("Expect", "100-continue")
+		return req, nil
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return ErrResultTooLarge
+	}
+	if resp.StatusCode != 200 {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// gzipReader compresses body as it is read.
+func gzipReader(body io.ReadCloser) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		defer body.Close()
+		compressor := gzip.NewWriter(writer)
+		_, err := io.Copy(compressor, body)
+		if err == nil {
+			err = compressor.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader
+}
@@ -0,0 +1,313 @@
+package patchworkclient
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"patchworkagent/patchwork"
+)
+
+func TestGetContextRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected authorization %s", r.Header.Get("Authorization"))
+		}
+		if attempts < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte(`{"owner": "alice", "inputs": {"length": 2.5}}`))
+	}))
+	defer server.Close()
+
+	client := New(server.URL+"/", "secret")
+	client.Backoff = time.Millisecond
+	calcContext, err := client.GetContext(context.Background(), "calc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || calcContext.Owner != "alice" || calcContext.Inputs["length"] != 2.5 {
+		t.Errorf("Unexpected context %v after %d attempts", calcContext, attempts)
+	}
+}
+
+func TestGetContextAlreadyRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(208)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "secret").GetContext(context.Background(), "calc1")
+	if err != ErrAlreadyRun {
+		t.Errorf("Expected ErrAlreadyRun, got %v", err)
+	}
+}
+
+func TestSendResultCompressesWhenTooLarge(t *testing.T) {
+	encodings := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(413)
+		}
+	}))
+	defer server.Close()
+
+	err := New(server.URL, "secret").SendResult(context.Background(), "calc1", patchwork.NewCalculationResponse())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encodings) != 2 || encodings[0] != "" || encodings[1] != "gzip" {
+		t.Errorf("Unexpected content encodings %v", encodings)
+	}
+}
+
+func TestSendResultFile(t *testing.T) {
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			w.WriteHeader(413)
+			return
+		}
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(reader)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "response.json")
+	os.WriteFile(path, []byte(`{"logs":[],"errors":[],"outputs":{}}`), 0644)
+
+	err := New(server.URL, "secret").SendResultFile(context.Background(), "calc1", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 1 || bodies[0] != `{"logs":[],"errors":[],"outputs":{}}` {
+		t.Errorf("Unexpected bodies %v", bodies)
+	}
+}
+
+func TestGetContextGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Unexpected accept encoding %s", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		compressor := gzip.NewWriter(w)
+		compressor.Write([]byte(`{"owner": "alice"}`))
+		compressor.Close()
+	}))
+	defer server.Close()
+
+	calcContext, err := New(server.URL, "secret").GetContext(context.Background(), "calc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calcContext.Owner != "alice" {
+		t.Errorf("Unexpected context %v", calcContext)
+	}
+}
+
+func TestSendResultCompressed(t *testing.T) {
+	encodings := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		w.WriteHeader(413)
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret")
+	client.Compress = true
+	err := client.SendResult(context.Background(), "calc1", patchwork.NewCalculationResponse())
+	if err == nil {
+		t.Error("Expected an error for a result too large even compressed")
+	}
+	if len(encodings) != 1 || encodings[0] != "gzip" {
+		t.Errorf("Unexpected content encodings %v", encodings)
+	}
+}
+
+func TestSendResultMultipart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "beam.vtu")
+	os.WriteFile(path, []byte("<VTKFile/>"), 0644)
+	attempts := 0
+	parts := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			data, _ := io.ReadAll(part)
+			parts[part.FormName()] = part.FileName() + " " + part.Header.Get("Content-Type") + " " + string(data)
+		}
+		// The result is streamed again when retried
+		if attempts == 1 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret")
+	client.Backoff = time.Millisecond
+	client.Multipart = true
+	response := patchwork.NewCalculationResponse()
+	response.Outputs["mesh"] = patchwork.Artefact{Name: "beam.vtu", ContentType: "application/x-vtu+xml", Path: path}
+	response.Outputs["mass"] = 12.5
+	err := client.SendResult(context.Background(), "calc1", response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected a retry, got %d attempts", attempts)
+	}
+	if parts["result"] != ` application/json {"logs":[],"errors":[],"outputs":{"mass":12.5,"mesh":{"name":"beam.vtu","contentType":"application/x-vtu+xml","uri":"part:mesh"}}}` {
+		t.Errorf("Unexpected result part %s", parts["result"])
+	}
+	if parts["mesh"] != "beam.vtu application/x-vtu+xml <VTKFile/>" {
+		t.Errorf("Unexpected artefact part %s", parts["mesh"])
+	}
+}
+
+func TestSendArtefactStreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "beam.vtu")
+	os.WriteFile(path, []byte(strings.Repeat("<VTKFile/>", 1000)), 0644)
+	artefact := patchwork.Artefact{Name: "beam.vtu", ContentType: "application/x-vtu+xml", Path: path}
+	expected, _ := json.Marshal(patchwork.DeferredArtefact{Output: "mesh", Artefact: artefact})
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		// The file is read again when retried
+		if len(bodies) == 1 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret")
+	client.Backoff = time.Millisecond
+	err := client.SendArtefact(context.Background(), "calc1", "mesh", artefact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 || bodies[0] != string(expected) || bodies[1] != string(expected) {
+		t.Errorf("Unexpected bodies %v", bodies)
+	}
+}
+
+func TestSendResultScalarsFirst(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "beam.vtu"), []byte("<VTKFile>large</VTKFile>"), 0644)
+	os.WriteFile(filepath.Join(dir, "plot.svg"), []byte("<svg/>"), 0644)
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+string(data))
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret")
+	response := patchwork.NewCalculationResponse()
+	response.Outputs["mesh"] = patchwork.Artefact{Name: "beam.vtu", ContentType: "application/x-vtu+xml", Path: filepath.Join(dir, "beam.vtu")}
+	response.Outputs["plot"] = patchwork.Artefact{Name: "plot.svg", ContentType: "image/svg+xml", Path: filepath.Join(dir, "plot.svg")}
+	response.Outputs["mass"] = 12.5
+	err := client.SendResultScalarsFirst(context.Background(), "calc1", response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`/api/calculations/remote/calc1 {"logs":[],"errors":[],"outputs":{"mass":12.5,"mesh":{"name":"beam.vtu","contentType":"application/x-vtu+xml","uri":"pending:"},"plot":{"name":"plot.svg","contentType":"image/svg+xml","uri":"pending:"}}}`,
+		`/api/calculations/artefacts/calc1 {"output":"plot","artefact":{"name":"plot.svg","contentType":"image/svg+xml","uri":"data:image/svg+xml;base64,PHN2Zy8+"}}`,
+		`/api/calculations/artefacts/calc1 {"output":"mesh","artefact":{"name":"beam.vtu","contentType":"application/x-vtu+xml","uri":"data:application/x-vtu+xml;base64,PFZUS0ZpbGU+bGFyZ2U8L1ZUS0ZpbGU+"}}`,
+		`/api/calculations/complete/calc1 `,
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected requests\n%s", strings.Join(requests, "\n"))
+	}
+
+	// Not completed while an artefact queued elsewhere is still to come
+	requests = requests[:0]
+	response.Outputs["mass"] = patchwork.Artefact{Name: "mass.csv", ContentType: "text/csv", Uri: patchwork.PendingUri}
+	err = client.SendResultScalarsFirst(context.Background(), "calc1", response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 || strings.HasPrefix(requests[2], "/api/calculations/complete/") {
+		t.Errorf("Unexpected requests\n%s", strings.Join(requests, "\n"))
+	}
+}
+
+func TestUploadChunked(t *testing.T) {
+	content := "0123456789abcdefghijklmnopqrstuvwxy"
+	received := make([]byte, 0)
+	patches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Tus-Resumable") != TusVersion || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected headers %v", r.Header)
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/calculations/files/calc1":
+			if r.Header.Get("Upload-Length") != "35" || r.Header.Get("Upload-Metadata") != "filename YmVhbS52dHU=,filetype dGV4dC9wbGFpbg==" {
+				t.Errorf("Unexpected upload %v", r.Header)
+			}
+			w.Header().Set("Location", "/files/f1")
+			w.WriteHeader(201)
+		case "PATCH /files/f1":
+			patches++
+			if r.Header.Get("Upload-Offset") != strconv.Itoa(len(received)) {
+				w.WriteHeader(409)
+				return
+			}
+			// The second chunk is cut off half way through
+			if patches == 2 {
+				chunk := make([]byte, 5)
+				io.ReadFull(r.Body, chunk)
+				received = append(received, chunk...)
+				w.WriteHeader(502)
+				return
+			}
+			chunk, _ := io.ReadAll(r.Body)
+			received = append(received, chunk...)
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(received)))
+			w.WriteHeader(204)
+		case "HEAD /files/f1":
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(received)))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL, "secret")
+	client.Backoff = time.Millisecond
+	uri, err := client.UploadChunked(context.Background(), "calc1", "beam.vtu", "text/plain", strings.NewReader(content), int64(len(content)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != server.URL+"/files/f1" || string(received) != content || patches != 4 {
+		t.Errorf("Upload to %s received %q in %d chunks", uri, received, patches)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PathTranslation converts workspace paths on the agent host into the paths
+// the command's execution backend (a container, WSL, a remote machine over
+// SSH) sees for the same directory. Mappings are prefix replacements tried in
+// order; Style then rewrites the result as a "posix", "windows" or "wsl"
+// (C:\work -> /mnt/c/work) path.
+type PathTranslation struct {
+	Mappings []PathMapping `json:"mappings"`
+	Style    string        `json:"style"`
+}
+
+type PathMapping struct {
+	Host    string `json:"host"`
+	Backend string `json:"backend"`
+}
+
+func (translation *PathTranslation) Validate() error {
+	switch translation.Style {
+	case "", "posix", "windows", "wsl":
+		return nil
+	default:
+		return errors.New("Unknown path style " + translation.Style)
+	}
+}
+
+func (translation *PathTranslation) Translate(path string) string {
+	if translation == nil {
+		return path
+	}
+	for _, mapping := range translation.Mappings {
+		if HasPathPrefix(path, mapping.Host) {
+			path = mapping.Backend + path[len(mapping.Host):]
+			break
+		}
+	}
+	switch translation.Style {
+	case "posix":
+		path = strings.ReplaceAll(path, "\\", "/")
+	case "windows":
+		path = strings.ReplaceAll(path, "/", "\\")
+	case "wsl":
+		path = strings.ReplaceAll(path, "\\", "/")
+		if len(path) >= 2 && path[1] == ':' {
+			path = "/mnt/" + strings.ToLower(path[:1]) + path[2:]
+		}
+	}
+	return path
+}
+
+// HasPathPrefix reports whether path is prefix or lies under it, treating
+// either kind of separator as equivalent.
+func HasPathPrefix(path string, prefix string) bool {
+	if len(prefix) == 0 || !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	if len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || strings.HasSuffix(prefix, "\\") {
+		return true
+	}
+	return path[len(prefix)] == '/' || path[len(prefix)] == '\\'
+}
+
+// ExpandCommand substitutes the {workspace} placeholder in the command with
+// the workspace path as seen by the execution backend.
+func ExpandCommand(command string, workspace string) string {
+	return strings.ReplaceAll(command, "{workspace}", workspace)
+}
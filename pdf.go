@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+// A4 pages, in points, with the same margin on every side.
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 50.0
+)
+
+// pdfDocument writes a simple PDF of text, tables and images, in Helvetica
+// on A4 pages, starting a new page when one is full.
+type pdfDocument struct {
+	// objects are numbered from 1, the catalog, then the page tree, the
+	// fonts and the resources shared by every page
+	objects [][]byte
+	pages   []int
+	images  []int
+	content bytes.Buffer
+	y       float64
+}
+
+const (
+	pdfCatalog = iota + 1
+	pdfPageTree
+	pdfFont
+	pdfBoldFont
+	pdfResources
+)
+
+func newPdfDocument() *pdfDocument {
+	doc := &pdfDocument{objects: make([][]byte, pdfResources), y: pdfPageHeight - pdfMargin}
+	doc.objects[pdfFont-1] = []byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	doc.objects[pdfBoldFont-1] = []byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	return doc
+}
+
+func (doc *pdfDocument) add(object []byte) int {
+	doc.objects = append(doc.objects, object)
+	return len(doc.objects)
+}
+
+func (doc *pdfDocument) addStream(dict string, data []byte) int {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream")
+	return doc.add(buf.Bytes())
+}
+
+// space starts a new page unless height points are left on this one.
+func (doc *pdfDocument) space(height float64) {
+	if doc.y-height >= pdfMargin || doc.content.Len() == 0 {
+		return
+	}
+	doc.endPage()
+}
+
+func (doc *pdfDocument) endPage() {
+	content := doc.addStream("", doc.content.Bytes())
+	doc.pages = append(doc.pages, doc.add([]byte(fmt.Sprintf(
+		"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %g %g] /Resources %d 0 R /Contents %d 0 R >>",
+		pdfPageTree, pdfPageWidth, pdfPageHeight, pdfResources, content))))
+	doc.content.Reset()
+	doc.y = pdfPageHeight - pdfMargin
+}
+
+// text writes a line at x, in the bold font if bold, without moving down.
+func (doc *pdfDocument) text(x float64, size float64, bold bool, line string) {
+	font := pdfFont
+	if bold {
+		font = pdfBoldFont
+	}
+	fmt.Fprintf(&doc.content, "BT /F%d %g Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, doc.y-size, pdfString(line))
+}
+
+// Paragraph writes text wrapped to the width of the page.
+func (doc *pdfDocument) Paragraph(size float64, bold bool, text string) {
+	for _, line := range wrapText(text, pdfPageWidth-2*pdfMargin, size) {
+		doc.space(size * 1.4)
+		doc.text(pdfMargin, size, bold, line)
+		doc.y -= size * 1.4
+	}
+}
+
+// Row writes a row of a table with equal columns, cutting short cells that
+// don't fit.
+func (doc *pdfDocument) Row(size float64, bold bool, cells []string) {
+	if len(cells) == 0 {
+		return
+	}
+	width := (pdfPageWidth - 2*pdfMargin) / float64(len(cells))
+	doc.space(size * 1.6)
+	for i, cell := range cells {
+		lines := wrapText(cell, width-6, size)
+		if len(lines) == 0 {
+			continue
+		}
+		if len(lines) > 1 || textWidth(lines[0], size) > width-6 {
+			lines[0] = strings.TrimRight(lines[0], " ") + "..."
+		}
+		doc.text(pdfMargin+float64(i)*width, size, bold, lines[0])
+	}
+	y := doc.y - size*1.6 + size*0.2
+	fmt.Fprintf(&doc.content, "0.8 G 0.5 w %.2f %.2f m %.2f %.2f l S 0 G\n", pdfMargin, y, pdfPageWidth-pdfMargin, y)
+	doc.y -= size * 1.6
+}
+
+// Skip moves down the page.
+func (doc *pdfDocument) Skip(height float64) {
+	doc.y -= height
+}
+
+// Image draws an image as wide as the page, or as large as fits on one, and
+// never scaled up.
+func (doc *pdfDocument) Image(img image.Image) {
+	bounds := img.Bounds()
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	if width == 0 || height == 0 {
+		return
+	}
+	scale := 1.0
+	if maxWidth := pdfPageWidth - 2*pdfMargin; width*scale > maxWidth {
+		scale = maxWidth / width
+	}
+	if maxHeight := pdfPageHeight - 2*pdfMargin; height*scale > maxHeight {
+		scale = maxHeight / height
+	}
+	var data bytes.Buffer
+	compressed := zlib.NewWriter(&data)
+	row := make([]byte, 0, 3*bounds.Dx())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			// Transparent pixels are drawn on white
+			white := 0xffff - a
+			row = append(row, byte((r+white)>>8), byte((g+white)>>8), byte((b+white)>>8))
+		}
+		compressed.Write(row)
+	}
+	compressed.Close()
+	id := doc.addStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+		bounds.Dx(), bounds.Dy()), data.Bytes())
+	doc.images = append(doc.images, id)
+	doc.space(height * scale)
+	fmt.Fprintf(&doc.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", width*scale, height*scale, pdfMargin, doc.y-height*scale, id)
+	doc.y -= height * scale
+}
+
+// WriteTo writes the document, ending its last page.
+func (doc *pdfDocument) WriteTo(w io.Writer) (int64, error) {
+	if doc.content.Len() > 0 || len(doc.pages) == 0 {
+		doc.endPage()
+	}
+	doc.objects[pdfCatalog-1] = []byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pdfPageTree))
+	kids := make([]string, len(doc.pages))
+	for i, page := range doc.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", page)
+	}
+	doc.objects[pdfPageTree-1] = []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	images := make([]string, len(doc.images))
+	for i, image := range doc.images {
+		images[i] = fmt.Sprintf("/Im%d %d 0 R", image, image)
+	}
+	doc.objects[pdfResources-1] = []byte(fmt.Sprintf("<< /Font << /F%d %d 0 R /F%d %d 0 R >> /XObject << %s >> >>",
+		pdfFont, pdfFont, pdfBoldFont, pdfBoldFont, strings.Join(images, " ")))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(doc.objects))
+	for i, object := range doc.objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n", i+1)
+		buf.Write(object)
+		buf.WriteString("\nendobj\n")
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(doc.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(doc.objects)+1, pdfCatalog, xref)
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// pdfString escapes text for a PDF string in WinAnsi, replacing characters
+// it can't encode with ?.
+func pdfString(text string) string {
+	var buf strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) || r > 0xff:
+			buf.WriteByte('?')
+		default:
+			buf.WriteByte(byte(r))
+		}
+	}
+	return buf.String()
+}
+
+// textWidth estimates the width of text in Helvetica, from the average width
+// of its glyphs.
+func textWidth(text string, size float64) float64 {
+	return float64(len([]rune(text))) * size * 0.55
+}
+
+// wrapText splits text into lines no wider than width, breaking between words
+// where it can.
+func wrapText(text string, width float64, size float64) []string {
+	lines := make([]string, 0)
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for textWidth(word, size) > width {
+				// Words too long for a line are broken anywhere
+				if len(line) > 0 {
+					lines = append(lines, line)
+					line = ""
+				}
+				fits := int(width / (size * 0.55))
+				if fits < 1 {
+					fits = 1
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:fits]))
+				word = string(runes[fits:])
+			}
+			if len(line) > 0 && textWidth(line+" "+word, size) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			if len(line) > 0 {
+				line += " "
+			}
+			line += word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The phases of running a calculation, in order: fetching its context,
+// expanding its inputs into the workspace, executing its command, collecting
+// its output files, packaging them into a result and uploading it.
+const (
+	PhaseFetch   = "fetch"
+	PhaseExpand  = "expand"
+	PhaseExecute = "execute"
+	PhaseCollect = "collect"
+	PhasePackage = "package"
+	PhaseUpload  = "upload"
+)
+
+var Phases = []string{PhaseFetch, PhaseExpand, PhaseExecute, PhaseCollect, PhasePackage, PhaseUpload}
+
+// PhaseEvent is sent to hooks as a phase of a calculation starts, and again
+// when it ends, with Done set, its Duration and any error it failed with.
+type PhaseEvent struct {
+	Phase       string
+	Calculation string
+	Logger      *log.Logger
+	Start       time.Time
+	Done        bool
+	Duration    time.Duration
+	Err         error
+}
+
+// PhaseHook is called as phases start and end. An error returned as a phase
+// starts fails the calculation; one returned as it ends is logged.
+type PhaseHook func(ctx context.Context, event PhaseEvent) error
+
+var phaseHooks = make(map[string][]PhaseHook)
+
+var phaseHookLock sync.RWMutex
+
+// RegisterPhaseHook adds a hook for a phase, or for every phase if it is
+// empty, such as for metrics, notifications or plugins.
+func RegisterPhaseHook(phase string, hook PhaseHook) error {
+	if len(phase) > 0 && !MatchesAny([]string{phase}, Phases...) {
+		return errors.New("Unknown phase " + phase)
+	}
+	phaseHookLock.Lock()
+	defer phaseHookLock.Unlock()
+	phaseHooks[phase] = append(phaseHooks[phase], hook)
+	return nil
+}
+
+func hooksFor(phase string) []PhaseHook {
+	phaseHookLock.RLock()
+	defer phaseHookLock.RUnlock()
+	return append(append([]PhaseHook{}, phaseHooks[""]...), phaseHooks[phase]...)
+}
+
+// runPhase runs a phase of a calculation, calling the hooks for it before and
+// after. The error of the phase is returned as it is.
+func runPhase(ctx context.Context, logger *log.Logger, calculation string, phase string, run func() error) error {
+	hooks := hooksFor(phase)
+	event := PhaseEvent{Phase: phase, Calculation: calculation, Logger: logger, Start: time.Now()}
+	for _, hook := range hooks {
+		if err := hook(ctx, event); err != nil {
+			return errors.Wrap(err, "Hook for phase "+phase+" failed")
+		}
+	}
+	err := run()
+	event.Done, event.Duration, event.Err = true, time.Since(event.Start), err
+	for _, hook := range hooks {
+		if hookErr := hook(ctx, event); hookErr != nil {
+			logger.Println("Hook for phase " + phase + " failed: " + hookErr.Error())
+		}
+	}
+	return err
+}
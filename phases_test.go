@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPhaseHooks(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "scalar-outputs", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := NewStubHost(t, "scalar-outputs", calcContext)
+	defer server.Close()
+
+	var events []string
+	var failed error
+	err = RegisterPhaseHook("", func(ctx context.Context, event PhaseEvent) error {
+		if event.Calculation != "scalar-outputs" {
+			return nil
+		}
+		if event.Done {
+			events = append(events, event.Phase+" done")
+			return nil
+		}
+		events = append(events, event.Phase)
+		if event.Phase == PhasePackage && failed != nil {
+			return failed
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if RegisterPhaseHook("compile", nil) == nil {
+		t.Error("Expected unknown phase to be refused")
+	}
+	run := func() error {
+		return RunCalculation(context.Background(), &Config{}, HelperCommand(t, "scalar-outputs"), &Job{
+			Host: server.URL, Token: "token", Calculation: "scalar-outputs", Dir: t.TempDir(), Timeout: 60,
+		})
+	}
+	if err := run(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	expected := "fetch,fetch done,expand,expand done,execute,execute done,collect,collect done,package,package done,upload,upload done"
+	if strings.Join(events, ",") != expected {
+		t.Errorf("Unexpected events %v", events)
+	}
+
+	// A hook failing as a phase starts fails the calculation
+	events, failed = nil, errors.New("quota exceeded")
+	if err := run(); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("Unexpected %v", err)
+	}
+	if events[len(events)-1] != PhasePackage {
+		t.Errorf("Unexpected events %v", events)
+	}
+	failed = nil
+}
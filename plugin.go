@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Plugin is an external handler for inputs and/or outputs, shipped as a
+// separate executable. The plugin is started afresh for every input or output
+// it handles, so it can be replaced without restarting the agent. It is sent a
+// single PluginRequest as JSON on stdin and must write a single PluginResponse
+// as JSON to stdout.
+//
+// Instead of a native Command, a plugin can be a WebAssembly (WASI) module,
+// which is run sandboxed by the configured WASM runtime with only the
+// workspace visible to it, mounted at /workspace.
+//
+// Inputs are glob patterns matched against input names and the name and
+// content type of input artefacts; Outputs are glob patterns matched against
+// output file names.
+type Plugin struct {
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	Wasm    string   `json:"wasm"`
+	Inputs  []string `json:"inputs"`
+	Outputs []string `json:"outputs"`
+}
+
+// DefaultWasmRuntime runs WASM plugins with wasmtime; {workspace} is replaced
+// by the workspace directory and the module path is appended.
+var DefaultWasmRuntime = []string{"wasmtime", "run", "--dir", "{workspace}::/workspace"}
+
+const wasmWorkspace = "/workspace"
+
+// PluginRequest asks a plugin to handle an input ("input" hook: write Content,
+// the value of input Name, into Dir) or an output ("output" hook: convert the
+// file at Path into outputs).
+type PluginRequest struct {
+	Hook    string      `json:"hook"`
+	Name    string      `json:"name"`
+	Dir     string      `json:"dir"`
+	Path    string      `json:"path,omitempty"`
+	Content interface{} `json:"content,omitempty"`
+}
+
+// PluginResponse reports whether the plugin handled the request; if not the
+// agent falls back to its built-in handling. Outputs replace the default
+// output entry for a handled output file.
+type PluginResponse struct {
+	Handled bool                   `json:"handled"`
+	Outputs map[string]interface{} `json:"outputs"`
+	Error   string                 `json:"error"`
+}
+
+func (plugin *Plugin) Validate() error {
+	if len(plugin.Command) == 0 && len(plugin.Wasm) == 0 {
+		return errors.New("Plugin " + plugin.Name + " has no command or wasm module")
+	}
+	for _, pattern := range append(append([]string{}, plugin.Inputs...), plugin.Outputs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrap(err, "Plugin "+plugin.Name+" pattern "+pattern)
+		}
+	}
+	return nil
+}
+
+func (plugin *Plugin) Call(config *Config, logger *log.Logger, request PluginRequest) (PluginResponse, error) {
+	var response PluginResponse
+	argv := plugin.Command
+	dir := request.Dir
+	if len(plugin.Wasm) > 0 {
+		// The module only sees the workspace, under its own path
+		runtime := config.WasmRuntime
+		if len(runtime) == 0 {
+			runtime = DefaultWasmRuntime
+		}
+		argv = make([]string, 0, len(runtime)+1)
+		for _, arg := range runtime {
+			argv = append(argv, ExpandCommand(arg, dir))
+		}
+		argv = append(argv, plugin.Wasm)
+		sandbox := &PathTranslation{Mappings: []PathMapping{{Host: dir, Backend: wasmWorkspace}}, Style: "posix"}
+		request.Dir = sandbox.Translate(request.Dir)
+		request.Path = sandbox.Translate(request.Path)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return response, errors.WithStack(err)
+	}
+	logger.Println("Calling plugin " + plugin.Name + " for " + request.Hook + " " + request.Name)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return response, errors.Wrap(err, "Plugin "+plugin.Name+" failed")
+	}
+	err = json.Unmarshal(out, &response)
+	if err != nil {
+		return response, errors.Wrap(err, "Plugin "+plugin.Name+" returned an invalid response")
+	}
+	if len(response.Error) > 0 {
+		return response, errors.New("Plugin " + plugin.Name + ": " + response.Error)
+	}
+	return response, nil
+}
+
+func MatchesAny(patterns []string, names ...string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched && len(name) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HandleInputWithPlugins offers an input to each plugin that claims it, in
+// order, until one handles it.
+func HandleInputWithPlugins(config *Config, logger *log.Logger, dirpath string, name string, content interface{}) (bool, error) {
+	names := []string{name}
+	if object, ok := content.(map[string]interface{}); ok {
+		for _, key := range []string{"name", "contentType"} {
+			if value, ok := object[key].(string); ok {
+				names = append(names, value)
+			}
+		}
+	}
+	for i := range config.Plugins {
+		plugin := &config.Plugins[i]
+		if !MatchesAny(plugin.Inputs, names...) {
+			continue
+		}
+		response, err := plugin.Call(config, logger, PluginRequest{Hook: "input", Name: name, Dir: dirpath, Content: content})
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if response.Handled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HandleOutputWithPlugins offers an output file to each plugin that claims
+// it, in order, until one handles it, returning the outputs it produced.
+func HandleOutputWithPlugins(config *Config, logger *log.Logger, dirpath string, file string) (map[string]interface{}, bool, error) {
+	name := filepath.Base(file)
+	for i := range config.Plugins {
+		plugin := &config.Plugins[i]
+		if !MatchesAny(plugin.Outputs, name) {
+			continue
+		}
+		response, err := plugin.Call(config, logger, PluginRequest{Hook: "output", Name: name, Dir: dirpath, Path: file})
+		if err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+		if response.Handled {
+			return response.Outputs, true, nil
+		}
+	}
+	return nil, false, nil
+}
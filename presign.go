@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"patchworkagent/patchwork"
+	"patchworkagent/patchworkclient"
+
+	"github.com/pkg/errors"
+)
+
+// Presigner uploads large outputs of a calculation to URLs presigned by its
+// host, so that the result only refers to them.
+type Presigner struct {
+	Config      *Config
+	Client      *patchworkclient.Client
+	Calculation string
+}
+
+// Upload asks the host for a presigned URL for an output file and PUTs the
+// file there, returning an artefact referring to it. If the host doesn't
+// support presigned uploads, ok is false and the output should be sent in
+// the result instead.
+func (presigner *Presigner) Upload(ctx context.Context, logger *log.Logger, path string, contentType string) (artefact patchwork.Artefact, ok bool, err error) {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	name := filepath.Base(path)
+	presigned, err := presigner.Client.PresignUpload(ctx, presigner.Calculation, patchwork.UploadRequest{
+		Name:        name,
+		ContentType: contentType,
+		Size:        info.Size(),
+	})
+	if statusErr, isStatus := errors.Cause(err).(*patchworkclient.StatusError); isStatus && statusErr.StatusCode == 404 {
+		logger.Println("Host doesn't support presigned uploads, sending " + name + " in the result")
+		return artefact, false, nil
+	}
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	request, err := http.NewRequestWithContext(ctx, "PUT", presigned.Url, file)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	request.ContentLength = info.Size()
+	request.Header.Set("Content-Type", contentType)
+	for header, value := range presigned.Headers {
+		request.Header.Set(header, value)
+	}
+	httpClient, err := ClientFor(presigner.Config, request.URL.Scheme+"://"+request.URL.Host)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	logger.Println("Uploading " + path + " to a presigned URL for " + presigned.Uri)
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return artefact, false, errors.New("Upload of " + name + " failed: " + response.Status)
+	}
+	return patchwork.Artefact{Name: name, ContentType: contentType, Uri: presigned.Uri}, true, nil
+}
+
+// DefaultChunkSize is the size of the chunks of chunked uploads if the
+// config doesn't give one.
+const DefaultChunkSize = 8 << 20
+
+// UploadChunked uploads an output file to the host in chunks that are
+// retried individually, returning an artefact referring to the upload. If
+// the host doesn't support chunked uploads, ok is false.
+func (presigner *Presigner) UploadChunked(ctx context.Context, logger *log.Logger, path string, contentType string) (artefact patchwork.Artefact, ok bool, err error) {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	chunkSize := presigner.Config.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	name := filepath.Base(path)
+	logger.Println("Uploading " + path + " in chunks of " + strconv.FormatInt(chunkSize, 10) + " bytes")
+	uri, err := presigner.Client.UploadChunked(ctx, presigner.Calculation, name, contentType, file, info.Size(), chunkSize)
+	if statusErr, isStatus := errors.Cause(err).(*patchworkclient.StatusError); isStatus && statusErr.StatusCode == 404 {
+		logger.Println("Host doesn't support chunked uploads")
+		return artefact, false, nil
+	}
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	return patchwork.Artefact{Name: name, ContentType: contentType, Uri: uri}, true, nil
+}
+
+// UploadDelta sends an output file to the host as a delta against the
+// previous version it has of the file, as when a new version of a
+// calculation changes little of a large output. If the host has no previous
+// version, or none of it is reused, ok is false.
+func (presigner *Presigner) UploadDelta(ctx context.Context, logger *log.Logger, path string, contentType string) (artefact patchwork.Artefact, ok bool, err error) {
+	name := filepath.Base(path)
+	signatures, err := presigner.Client.GetSignatures(ctx, presigner.Calculation, name)
+	if statusErr, isStatus := errors.Cause(err).(*patchworkclient.StatusError); isStatus && statusErr.StatusCode == 404 {
+		logger.Println("Host has no previous version of " + name + " to send a delta against")
+		return artefact, false, nil
+	}
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	file, err := OpenOutput(path)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	defer file.Close()
+	delta, err := os.CreateTemp("", "delta")
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	defer os.Remove(delta.Name())
+	defer delta.Close()
+	writer := bufio.NewWriter(delta)
+	copied, err := patchwork.WriteDelta(writer, file, signatures)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	if copied == 0 {
+		logger.Println("Output " + name + " has nothing in common with its previous version")
+		return artefact, false, nil
+	}
+	info, err := delta.Stat()
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	logger.Println("Uploading " + path + " as a delta of " + strconv.FormatInt(info.Size(), 10) + " bytes against " + signatures.Uri)
+	open := func() (io.ReadCloser, error) {
+		return os.Open(delta.Name())
+	}
+	artefact, err = presigner.Client.UploadDelta(ctx, presigner.Calculation, name, contentType, signatures.Uri, hash, open, info.Size())
+	if err != nil {
+		return artefact, false, errors.WithStack(err)
+	}
+	return patchwork.Artefact{Name: name, ContentType: contentType, Uri: artefact.Uri}, true, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// SpoolFile holds the result of a calculation in its workspace until it has
+// been sent, so that a result finished before a crash isn't lost. The
+// encoded response itself is in SpoolResponseFile, from which it is sent.
+const (
+	SpoolFile         = ".result.json"
+	SpoolResponseFile = ".response.json"
+)
+
+type SpooledResult struct {
+	Calculation string              `json:"calculation"`
+	Host        string              `json:"host"`
+	Callback    *patchwork.Callback `json:"callback,omitempty"`
+	// Response is only in results spooled by earlier versions, which didn't
+	// use SpoolResponseFile.
+	Response *patchwork.CalculationResponse `json:"response,omitempty"`
+}
+
+// SpoolResult writes the response to SpoolResponseFile, streaming the
+// content of its artefacts, then the rest of the result to SpoolFile.
+func SpoolResult(dirpath string, spooled SpooledResult, response *patchwork.CalculationResponse) error {
+	file, err := os.OpenFile(filepath.Join(dirpath, SpoolResponseFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	writer := bufio.NewWriter(file)
+	err = response.WriteJSON(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data, err := json.Marshal(spooled)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(dirpath, SpoolFile), data, 0600))
+}
+
+// ReconcileWorkspaces cleans up the workspaces left in dirpath by a server
+// that crashed, first sending any results spooled in them. Only workspaces
+// marked as created by the agent, by a process no longer running, are
+// removed, or those of earlier versions, which weren't marked, that hold a
+// spooled result. Those kept to be inspected are left, as are those whose
+// result couldn't be sent, to be tried again.
+func ReconcileWorkspaces(ctx context.Context, config *Config, dirpath string, host string, token string) {
+	entries, _ := os.ReadDir(dirpath)
+	for _, entry := range entries {
+		if !entry.IsDir() || !isWorkspaceName(entry.Name()) {
+			continue
+		}
+		workspace := filepath.Join(dirpath, entry.Name())
+		marked, running := workspaceOwned(workspace)
+		_, err := os.Stat(filepath.Join(workspace, SpoolFile))
+		spooled := err == nil
+		if running || !marked && !spooled {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(workspace, SessionFile)); err == nil {
+			log.Println("Keeping workspace " + workspace + " of a failed calculation")
+			continue
+		}
+		if spooled {
+			err = SendSpooledResult(ctx, config, workspace, host, token)
+			if err != nil {
+				log.Println(fmt.Sprintf("Keeping workspace %s, as the result spooled in it could not be sent: %+v", workspace, err))
+				continue
+			}
+		}
+		log.Println("Removing workspace " + workspace + " left by a previous run")
+		// Its inputs may have been left read-only whatever the config is now
+		SetInputsReadOnly(&Config{SeparateOutputs: true}, workspace, false)
+		os.RemoveAll(workspace)
+	}
+}
+
+// isWorkspaceName reports whether name is that of a workspace, calc- as
+// WorkspaceName gives or calc and digits as earlier versions created with
+// ioutil.TempDir.
+func isWorkspaceName(name string) bool {
+	if strings.HasPrefix(name, "calc-") {
+		return true
+	}
+	digits := strings.TrimPrefix(name, "calc")
+	return len(digits) > 0 && len(digits) < len(name) && len(strings.Trim(digits, "0123456789")) == 0
+}
+
+func SendSpooledResult(ctx context.Context, config *Config, workspace string, host string, token string) error {
+	data, err := os.ReadFile(filepath.Join(workspace, SpoolFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var spooled SpooledResult
+	err = json.Unmarshal(data, &spooled)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	calc := ResolveTenant(config, patchwork.CalculationPayload{Id: spooled.Calculation, Host: spooled.Host}, host, token)
+	logger := NewJobLogger(calc.Id)
+	logger.Println("Sending result spooled in " + workspace)
+	var sink ResultSink
+	sink, err = NewResultSink(config, logger, calc.Host, calc.Token)
+	if err == nil && spooled.Callback != nil {
+		sink, err = NewCallbackSink(config, logger, sink, spooled.Callback)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if spooled.Response != nil {
+		return errors.WithStack(sink.SendResult(ctx, calc.Id, spooled.Response))
+	}
+	return errors.WithStack(sink.SendResultFile(ctx, calc.Id, filepath.Join(workspace, SpoolResponseFile)))
+}
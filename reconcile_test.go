@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestReconcileWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	results := t.TempDir()
+	finished := filepath.Join(dir, "calc123")
+	legacy := filepath.Join(dir, "calc456")
+	unsent := filepath.Join(dir, "calc789")
+	operator := filepath.Join(dir, "calculations")
+	for _, workspace := range []string{finished, legacy, unsent, operator} {
+		os.Mkdir(workspace, 0755)
+	}
+	os.WriteFile(filepath.Join(legacy, "geometry.json"), []byte("{}"), 0644)
+	os.WriteFile(filepath.Join(unsent, SpoolFile), []byte("{"), 0600)
+	response := patchwork.NewCalculationResponse()
+	response.AddLogs("Solved")
+	err := SpoolResult(finished, SpooledResult{Calculation: "beam1", Host: "https://patchwork.example"}, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One left by an earlier run of the agent, and one still in use
+	unfinished, err := CreateWorkspace(dir, "fea", "beam2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(unfinished, WorkspaceMarkerFile), []byte(`{"hostname":"`+hostname(t)+`","pid":`+strconv.Itoa(os.Getpid())+`,"instance":"earlier"}`), 0600)
+	running, err := CreateWorkspace(dir, "fea", "beam3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ReconcileWorkspaces(context.Background(), &Config{ResultSink: "file:" + results}, dir, "", "")
+	if data, err := os.ReadFile(filepath.Join(results, "beam1.json")); err != nil || string(data) != `{"logs":["Solved"],"errors":[],"outputs":{}}` {
+		t.Errorf("Spooled result was not sent: %s %v", data, err)
+	}
+	for _, workspace := range []string{finished, unfinished} {
+		if _, err := os.Stat(workspace); !os.IsNotExist(err) {
+			t.Errorf("Workspace %s was not removed", workspace)
+		}
+	}
+	for _, workspace := range []string{legacy, unsent, operator, running} {
+		if _, err := os.Stat(workspace); err != nil {
+			t.Errorf("Expected %s to be kept: %v", workspace, err)
+		}
+	}
+}
+
+func hostname(t *testing.T) string {
+	name, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestIsWorkspaceName(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"calc-fea-beam-1-20260304T050607Z": true,
+		"calc123456789":                    true,
+		"calc":                             false,
+		"calculations":                     false,
+		"calculator":                       false,
+		"calc12a":                          false,
+	} {
+		if isWorkspaceName(name) != expected {
+			t.Errorf("Expected %s to be a workspace name: %v", name, expected)
+		}
+	}
+}
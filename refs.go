@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// CalculationRef is an input given as
+// {"calculationRef": {"id": ..., "output": ...}}, referring to an output of a
+// previous calculation rather than carrying it.
+type CalculationRef struct {
+	Id     string `json:"id"`
+	Output string `json:"output"`
+}
+
+// asCalculationRef returns the reference an input value is, if it is one.
+func asCalculationRef(content interface{}) (CalculationRef, bool) {
+	object, ok := content.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return CalculationRef{}, false
+	}
+	ref, ok := object["calculationRef"].(map[string]interface{})
+	if !ok {
+		return CalculationRef{}, false
+	}
+	id, ok1 := ref["id"].(string)
+	output, ok2 := ref["output"].(string)
+	if !ok1 || !ok2 || len(id) == 0 || len(output) == 0 {
+		return CalculationRef{}, false
+	}
+	return CalculationRef{Id: id, Output: output}, true
+}
+
+// ResolveCalculationRefs replaces inputs of a calculation that refer to
+// outputs of previous calculations with those outputs, fetched from its host,
+// to be written to the workspace as any other input. It fails if any can't be
+// fetched, as the calculation would be missing an input.
+func ResolveCalculationRefs(ctx context.Context, config *Config, logger *log.Logger, host string, token string, calcContext *patchwork.CalculationContext) error {
+	var client interface {
+		GetOutput(ctx context.Context, calculation string, output string) (json.RawMessage, error)
+	}
+	inputs := make(map[string]interface{}, len(calcContext.Inputs))
+	for name, content := range calcContext.Inputs {
+		inputs[name] = content
+		ref, ok := asCalculationRef(content)
+		if !ok {
+			continue
+		}
+		if len(host) == 0 {
+			return errors.New("Input " + name + " refers to calculation " + ref.Id + ", but there is no host to fetch it from")
+		}
+		if client == nil {
+			var err error
+			client, err = NewClient(config, logger, host, token)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		logger.Println("Fetching input " + name + " from output " + ref.Output + " of calculation " + ref.Id)
+		data, err := client.GetOutput(ctx, ref.Id, ref.Output)
+		if err != nil {
+			return errors.Wrap(err, "Input "+name+" refers to output "+strconv.Quote(ref.Output)+" of calculation "+ref.Id+", which could not be fetched")
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return errors.WithStack(err)
+		}
+		inputs[name] = value
+	}
+	calcContext.Inputs = inputs
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestResolveCalculationRefs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/calculations/outputs/c1/mass":
+			w.Write([]byte(`12.5`))
+		case "/api/calculations/outputs/c1/beam%20mesh":
+			w.Write([]byte(`{"name": "beam.stl", "contentType": "model/stl", "uri": "s3://results/beam.stl"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	logger := log.New(io.Discard, "", 0)
+	calcContext := patchwork.CalculationContext{Inputs: map[string]interface{}{
+		"mass":   map[string]interface{}{"calculationRef": map[string]interface{}{"id": "c1", "output": "mass"}},
+		"mesh":   map[string]interface{}{"calculationRef": map[string]interface{}{"id": "c1", "output": "beam mesh"}},
+		"length": 2.0,
+		"model":  map[string]interface{}{"calculationRef": "c1", "scale": 2.0},
+	}}
+	err := ResolveCalculationRefs(context.Background(), &Config{}, logger, server.URL, "token", &calcContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"mass":   12.5,
+		"mesh":   map[string]interface{}{"name": "beam.stl", "contentType": "model/stl", "uri": "s3://results/beam.stl"},
+		"length": 2.0,
+		"model":  map[string]interface{}{"calculationRef": "c1", "scale": 2.0},
+	}
+	if !reflect.DeepEqual(calcContext.Inputs, expected) {
+		t.Errorf("Inputs should be %v, were %v", expected, calcContext.Inputs)
+	}
+
+	calcContext.Inputs = map[string]interface{}{
+		"stress": map[string]interface{}{"calculationRef": map[string]interface{}{"id": "c2", "output": "stress"}},
+	}
+	if ResolveCalculationRefs(context.Background(), &Config{}, logger, server.URL, "token", &calcContext) == nil {
+		t.Error("A missing output should fail")
+	}
+	if ResolveCalculationRefs(context.Background(), &Config{}, logger, "", "", &calcContext) == nil {
+		t.Error("A reference without a host should fail")
+	}
+}
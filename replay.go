@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Replay runs a completed calculation again with the command for its type,
+// in a new workspace in dirpath, and prints how its outputs differ from those
+// the host stored for it. Like Diff, it returns 0 if they don't, 1 if they
+// do and 2 if the calculation could not be replayed.
+func Replay(ctx context.Context, out io.Writer, config *Config, command string, host string, token string, dirpath string, calculation string, timeout int, tolerance float64) int {
+	differences, err := replay(ctx, config, command, host, token, dirpath, calculation, timeout, tolerance)
+	if err != nil {
+		fmt.Fprintln(out, err.Error())
+		return 2
+	}
+	for _, difference := range differences {
+		fmt.Fprintln(out, difference)
+	}
+	if len(differences) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func replay(ctx context.Context, config *Config, command string, host string, token string, dirpath string, calculation string, timeout int, tolerance float64) ([]string, error) {
+	logger := NewJobLogger(calculation)
+	client, err := NewClient(config, logger, host, token)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	logger.Println("Fetching completed calculation " + calculation)
+	completed, err := client.GetCompletedCalculation(ctx, calculation)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not fetch calculation "+calculation)
+	}
+	command = config.CommandFor(completed.Context.Id.Type, command)
+	if len(command) == 0 {
+		return nil, errors.New("No command for calculations of type " + completed.Context.Id.Type)
+	}
+	dir, err := os.MkdirTemp(dirpath, "replay")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The outputs are only compared, so needn't be uploaded anywhere
+	replayConfig := *config
+	replayConfig.ArtefactStore = ""
+	cmdCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(timeout))
+	defer cancel()
+	logger.Println("Replaying calculation " + calculation + " in " + dir)
+	code, response, err := RunInWorkspace(cmdCtx, &replayConfig, logger, command, dir, completed.Context, host, token)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	differences := make([]string, 0)
+	if code != 0 {
+		differences = append(differences, "replay exited with "+strconv.Itoa(code))
+	}
+	return append(differences, DiffOutputs(completed.Result.Outputs, response.Outputs, "replay", tolerance)...), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/calculations/completed/calc1" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{
+			"context": {"id": {"type": "beam"}, "inputs": {"length": 2.5}},
+			"result": {"logs": [], "errors": [], "outputs": {"area.json": 4}}
+		}`))
+	}))
+	defer server.Close()
+
+	config := &Config{Commands: map[string]string{"beam": "cp length.json area.json"}}
+	var out bytes.Buffer
+	status := Replay(context.Background(), &out, config, "", server.URL, "secret", t.TempDir(), "calc1", 10, 0)
+	if status != 1 || out.String() != "output area.json: 4, replay 2.5\n" {
+		t.Errorf("Expected the area to differ, got %d: %s", status, out.String())
+	}
+
+	config.Commands["beam"] = "echo 4 > area.json"
+	out.Reset()
+	if status := Replay(context.Background(), &out, config, "", server.URL, "secret", t.TempDir(), "calc1", 10, 0); status != 0 {
+		t.Errorf("Expected no differences, got %d: %s", status, out.String())
+	}
+	out.Reset()
+	if status := Replay(context.Background(), &out, config, "", server.URL, "secret", t.TempDir(), "calc2", 10, 0); status != 2 {
+		t.Errorf("Expected an unknown calculation to fail, got %d: %s", status, out.String())
+	}
+}
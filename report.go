@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// Report renders a PDF summary of the outputs of every calculation, returned
+// as the output Name, by default report.pdf. Template is a text/template file
+// producing the lines of the report: # for a heading, | separating the
+// cells of a table row, ![](name) for an image output, and otherwise text.
+// The default lists the scalar outputs in a table, then draws the images.
+type Report struct {
+	Name     string `json:"name"`
+	Title    string `json:"title"`
+	Template string `json:"template"`
+}
+
+const defaultReportTemplate = `# {{.Title}}
+{{if .Outputs}}| Output | Value |
+{{range $name, $value := .Outputs}}| {{$name}} | {{$value}} |
+{{end}}{{end}}
+{{range .Images}}## {{.}}
+![]({{.}})
+{{end}}{{if .Errors}}## Errors
+{{range .Errors}}{{.}}
+{{end}}{{end}}`
+
+// maxReportPixels is the size of the largest image drawn in a report.
+const maxReportPixels = 4096 * 4096
+
+// ReportData is what the template of a report is given. Outputs are the
+// scalar outputs, and Images the names of the image outputs.
+type ReportData struct {
+	Title   string
+	Outputs map[string]interface{}
+	Images  []string
+	Errors  []string
+}
+
+func (report *Report) Validate() error {
+	if len(report.Name) > 0 && (strings.ContainsAny(report.Name, "/\\") || report.Name == "." || report.Name == "..") {
+		return errors.New("Report name " + report.Name + " isn't a file name")
+	}
+	_, err := report.parse()
+	return errors.WithStack(err)
+}
+
+func (report *Report) parse() (*template.Template, error) {
+	text := defaultReportTemplate
+	if len(report.Template) > 0 {
+		data, err := os.ReadFile(report.Template)
+		if err != nil {
+			return nil, errors.Wrap(err, "Report template")
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("report").Parse(text)
+	return tmpl, errors.Wrap(err, "Report template")
+}
+
+// AddReport renders the report of a response's outputs to a new directory in
+// dirpath, and adds it to the response. A report that can't be rendered is
+// reported as an error rather than failing the calculation.
+func AddReport(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, response *patchwork.CalculationResponse) error {
+	if config.Report == nil {
+		return nil
+	}
+	name := config.Report.Name
+	if len(name) == 0 {
+		name = "report.pdf"
+	}
+	if _, ok := response.Outputs[name]; ok {
+		response.AddErrors("The report was not returned, as there is an output " + name)
+		return nil
+	}
+	dir, err := os.MkdirTemp(dirpath, ".report")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	path := filepath.Join(dir, name)
+	logger.Println("Writing report to " + path)
+	err = RenderReport(config.Report, dirpath, response, path)
+	if err != nil {
+		logger.Println("Could not render report: " + err.Error())
+		response.AddErrors("The report could not be rendered: " + err.Error())
+		return nil
+	}
+	artefact, err := MakeArtefact(ctx, config, logger, presigner, path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response.SetOutput(name, artefact)
+	return nil
+}
+
+// RenderReport writes the report of a response's outputs as a PDF to path.
+// Image outputs are read from their files in dirpath.
+func RenderReport(report *Report, dirpath string, response *patchwork.CalculationResponse, path string) error {
+	tmpl, err := report.parse()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data := ReportData{Title: report.Title, Outputs: make(map[string]interface{}), Images: make([]string, 0), Errors: response.Errors}
+	if len(data.Title) == 0 {
+		data.Title = "Calculation report"
+	}
+	files := make(map[string]string)
+	for name, value := range response.Outputs {
+		switch value := value.(type) {
+		case float64, int, int64, string, bool:
+			data.Outputs[name] = value
+		case patchwork.Artefact:
+			if !strings.HasPrefix(value.ContentType, "image/") {
+				continue
+			}
+			file := value.Path
+			if len(file) == 0 {
+				if file, err = JoinWithin(dirpath, name); err != nil {
+					continue
+				}
+			}
+			data.Images = append(data.Images, name)
+			files[name] = file
+		}
+	}
+	sort.Strings(data.Images)
+	var lines bytes.Buffer
+	if err := tmpl.Execute(&lines, data); err != nil {
+		return errors.Wrap(err, "Report template")
+	}
+
+	doc := newPdfDocument()
+	// The first row of a table is its header
+	header := true
+	for _, line := range strings.Split(lines.String(), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		row := strings.HasPrefix(line, "|")
+		switch {
+		case strings.HasPrefix(line, "# "):
+			doc.Paragraph(18, true, strings.TrimPrefix(line, "# "))
+			doc.Skip(6)
+		case strings.HasPrefix(line, "## "):
+			doc.Skip(6)
+			doc.Paragraph(13, true, strings.TrimPrefix(line, "## "))
+		case row:
+			cells := strings.Split(strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|"), "|")
+			for i := range cells {
+				cells[i] = strings.TrimSpace(cells[i])
+			}
+			doc.Row(10, header, cells)
+		case strings.HasPrefix(line, "![](") && strings.HasSuffix(line, ")"):
+			name := strings.TrimSuffix(strings.TrimPrefix(line, "![]("), ")")
+			if err := drawImage(doc, files[name]); err != nil {
+				doc.Paragraph(10, false, "Image "+name+" could not be drawn: "+err.Error())
+			}
+		case len(line) == 0:
+			doc.Skip(6)
+		default:
+			doc.Paragraph(10, false, line)
+		}
+		header = !row
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	_, err = doc.WriteTo(file)
+	return errors.WithStack(err)
+}
+
+func drawImage(doc *pdfDocument, path string) error {
+	if len(path) == 0 {
+		return errors.New("No such image output")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	size, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if size.Width*size.Height > maxReportPixels {
+		return errors.New("Image is too large")
+	}
+	file.Seek(0, 0)
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	doc.Image(img)
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+// checkPdf checks that the cross-reference table of a PDF points at its
+// objects, returning its content.
+func checkPdf(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	if !strings.HasPrefix(content, "%PDF-1.4") || !strings.HasSuffix(content, "%%EOF\n") {
+		t.Fatalf("Not a PDF: %q", content[:10])
+	}
+	start := regexp.MustCompile(`startxref\n(\d+)\n`).FindStringSubmatch(content)
+	xref, _ := strconv.Atoi(start[1])
+	if !strings.HasPrefix(content[xref:], "xref\n") {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+	for i, entry := range regexp.MustCompile(`(\d{10}) 00000 n`).FindAllStringSubmatch(content[xref:], -1) {
+		offset, _ := strconv.Atoi(entry[1])
+		if !strings.HasPrefix(content[offset:], strconv.Itoa(i+1)+" 0 obj\n") {
+			t.Errorf("Object %d isn't at %d", i+1, offset)
+		}
+	}
+	return content
+}
+
+func TestAddReport(t *testing.T) {
+	dir := t.TempDir()
+	plot := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	plot.Set(5, 5, color.RGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	png.Encode(&buf, plot)
+	os.WriteFile(filepath.Join(dir, "plot.png"), buf.Bytes(), 0644)
+	os.WriteFile(filepath.Join(dir, "deck.inp"), []byte("*NODE"), 0644)
+
+	config := &Config{Report: &Report{Title: "Beam (static)"}}
+	response := patchwork.NewCalculationResponse()
+	response.SetOutput("mass", 12.5)
+	response.SetOutput("material", "steel")
+	response.SetOutput("plot.png", patchwork.Artefact{Name: "plot.png", ContentType: "image/png"})
+	response.SetOutput("deck.inp", patchwork.Artefact{Name: "deck.inp", ContentType: "text/plain", Path: filepath.Join(dir, "deck.inp")})
+	err := AddReport(context.Background(), config, log.New(io.Discard, "", 0), nil, dir, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, ok := response.Outputs["report.pdf"].(patchwork.Artefact)
+	if !ok || report.ContentType != "application/pdf" || len(response.Errors) > 0 {
+		t.Fatalf("Unexpected report %v, errors %v", response.Outputs["report.pdf"], response.Errors)
+	}
+	content := checkPdf(t, report.Path)
+	for _, expected := range []string{"(Beam \\(static\\))", "(mass)", "(12.5)", "(steel)", "(plot.png)", "/Subtype /Image /Width 40 /Height 30", "/Count 1"} {
+		if !strings.Contains(content, expected) {
+			t.Errorf("Report should contain %s", expected)
+		}
+	}
+	if strings.Contains(content, "deck.inp") {
+		t.Error("Report shouldn't include outputs that aren't images")
+	}
+}
+
+func TestRenderReportTemplate(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "report.tmpl")
+	os.WriteFile(template, []byte("# Loads\n{{range $i, $_ := .Errors}}| {{$i}} | x |\n{{end}}![](missing.png)\n"), 0644)
+	response := patchwork.NewCalculationResponse()
+	for i := 0; i < 100; i++ {
+		response.AddErrors("error")
+	}
+	path := filepath.Join(dir, "report.pdf")
+	if err := RenderReport(&Report{Template: template}, dir, response, path); err != nil {
+		t.Fatal(err)
+	}
+	content := checkPdf(t, path)
+	if !strings.Contains(content, "/Count 3") || !strings.Contains(content, "(Image missing.png could not be drawn: No such image output)") {
+		t.Error("Report should be three pages, noting the missing image")
+	}
+	if err := (&Report{Template: filepath.Join(dir, "missing.tmpl")}).Validate(); err == nil {
+		t.Error("A missing template should be invalid")
+	}
+}
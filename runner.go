@@ -8,63 +8,24 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"patchworkagent/patchwork"
+	"patchworkagent/patchworkclient"
+
 	"github.com/pkg/errors"
 )
 
-type Artefact struct {
-	name        string `json:"name"`
-	contentType string `json:"contentType"`
-	uri         string `json:"uri"`
-}
-
-type CalculationId struct {
-	DocumentType string `json:"documentType"`
-	Type         string `json:"type"`
-	Id           string `json:"id"`
-	Version      string `json:"version"`
-	Path         string `json:"path"`
-}
-
-type CalculationPayload struct {
-	Id    string `json:"id"`
-	Host  string `json:"host"`
-	Token string `json:"token"`
-}
-
-type PubSubPayload struct {
-	Message PubSubMessage `json:"message"`
-}
-
-type PubSubMessage struct {
-	MessageId   string `json:"messageId"`
-	PublishTime string `json:"publishTime"`
-	Data        string `json:"data"`
-}
-
-type CalculationContext struct {
-	Id           CalculationId          `json:"id"`
-	Owner        string                 `json:"owner"`
-	Inputs       map[string]interface{} `json:"inputs"`
-	FailedInputs map[string]string      `json:"failedInputs"`
-}
-
-type CalculationResponse struct {
-	Outputs map[string]interface{} `json:"outputs"`
-	Logs    []string               `json:"logs"`
-	Errors  []string               `json:"errors"`
-}
-
 func main() {
 	log.SetFlags(0)
 	log.Println("Patchwork Calculation Agent")
@@ -80,16 +41,350 @@ func main() {
 	tokenPtr := flag.String("t", "", "Security token")
 	concurrencyPtr := flag.String("concurrency", "4", "Concurrency if http server")
 	timeoutPtr := flag.String("timeout", "3600", "Timeout in s")
-	flag.Parse()
-	log.Println("Calculation command is " + *cmdPtr)
-	if len(*cmdPtr) == 0 {
-		log.Fatal("No command provided")
+	configPtr := flag.String("config", "", "Path to JSON config file")
+	agentIdPtr := flag.String("agent-id", "", "Identifier of this agent reported to the server (default hostname)")
+	selftestPtr := flag.String("selftest", "", "Smoke-test command to run before starting the server")
+	maxOutstandingPtr := flag.Int("max-outstanding", 0, "Maximum calculations accepted at once if http server, running or waiting, at least the concurrency (default unlimited)")
+	jsonPrecisionPtr := flag.Int("json-precision", 0, "Significant digits to round numbers in JSON outputs to (default no rounding)")
+	maxJsonSizePtr := flag.Int("max-json-size", 0, "Size in bytes above which JSON outputs are returned as artefacts (default no limit)")
+	prefetchPtr := flag.Int("prefetch", 0, "Number of waiting calculations that fetch their inputs in advance if http server")
+	maxTimeoutPtr := flag.Int("max-timeout", 0, "Maximum timeout in s a calculation may request if http server (default -timeout)")
+	maxWaitPtr := flag.Int("max-wait", 0, "Maximum time in s an accepted calculation waits to start if http server (default unlimited)")
+	maxOutputSizePtr := flag.Int64("max-output-size", 0, "Size in bytes above which output files are skipped (default no limit)")
+	resultSinkPtr := flag.String("result-sink", "", "Where to send results: patchwork (default), stdout, file:<path> or s3://bucket/key")
+	contextSourcePtr := flag.String("context-source", "", "Where to read contexts from: patchwork (default), file:<path> or s3://bucket/key")
+	maxJobsPtr := flag.Int("max-jobs-before-restart", 0, "Number of calculations after which the http server exits cleanly, to be restarted (default unlimited)")
+	shutdownGracePtr := flag.Int("shutdown-grace-period", 0, "Time in s to let running calculations finish on SIGTERM before cancelling them (default until they finish)")
+	keepFailedPtr := flag.Bool("keep-failed-workspaces", false, "Keep the workspaces of calculations whose command failed, to open a shell in with inspect")
+	idleTimeoutPtr := flag.Int("idle-timeout", 0, "Time in s without calculations after which the http server exits cleanly (default never)")
+	maxOutputFilesPtr := flag.Int("max-output-files", 0, "Number of output files above which a calculation fails, or they are archived with -output-overflow tar (default no limit)")
+	outputOverflowPtr := flag.String("output-overflow", "", "What to do with more than -max-output-files: fail (default) or tar")
+	artefactStorePtr := flag.String("artefact-store", "", "s3://bucket/prefix, gs://bucket/prefix or Azure container URL to upload output artefacts to instead of embedding them (default embed)")
+	uploadLimitPtr := flag.Int64("upload-limit", 0, "Bytes per second to limit uploads to (default no limit)")
+	downloadLimitPtr := flag.Int64("download-limit", 0, "Bytes per second to limit downloads to (default no limit)")
+	inputCachePtr := flag.String("input-cache", "", "Directory to cache decoded input artefacts in, to reuse them in later calculations")
+	maxLogSizePtr := flag.Int64("max-log-size", 0, "Size in bytes of stdout or stderr above which it is returned as an artefact, with only its end in the logs (default no limit)")
+	maxInlineSizePtr := flag.Int64("max-inline-size", 0, "Size in bytes above which output artefacts are uploaded to -artefact-store (default all)")
+	includePtr := flag.String("include", "", "Comma-separated glob patterns of the output files to return (default all)")
+	excludePtr := flag.String("exclude", "", "Comma-separated glob patterns of output files not to return")
+	configFromHostPtr := flag.Bool("config-from-host", false, "Fetch the config from /api/agents/config on the host instead of -config")
+	outputDetectionPtr := flag.String("output-detection", "", "How to detect changed output files: mtime (default) or hash")
+	dedupeInputsPtr := flag.Bool("dedupe-inputs", false, "Don't return output files identical to a file in the workspace before the command ran, such as an input")
+	outputDepthPtr := flag.Int("output-depth", 0, "How many levels of subdirectories to look for output files in")
+	directoryOutputsPtr := flag.String("directory-outputs", "", "Return directories written by the command as zip or tar archives (default skip them)")
+	preserveInputNamesPtr := flag.Bool("preserve-input-names", false, "Write input artefacts under their own names instead of those of their inputs")
+	keepInputArchivesPtr := flag.Bool("keep-input-archives", false, "Write zip and tar.gz inputs as they are instead of expanding them")
+	scalarsFirstPtr := flag.Bool("scalars-first", false, "Send results with their artefacts pending, then the artefacts, smallest first")
+	multipartResultsPtr := flag.Bool("multipart-results", false, "Send results as multipart/form-data with each artefact in its own part")
+	compressResultsPtr := flag.Bool("compress-results", false, "Send results gzip compressed (default only if the host rejects them as too large)")
+	tolerancePtr := flag.Float64("tolerance", 0, "Relative difference allowed between numbers compared by diff or replay")
+	keepJunkPtr := flag.Bool("keep-junk", false, "Return files such as .DS_Store, Thumbs.db, core dumps and editor swap files as outputs")
+	manifestPtr := flag.String("manifest", "", "File to write a JSON summary of a calculation run from the command line to, or - for stdout")
+	presignedUploadSizePtr := flag.Int64("presigned-upload-size", 0, "Size in bytes above which output artefacts are uploaded to a URL presigned by the host (default never)")
+	coerceOutputsPtr := flag.Bool("coerce-outputs", false, "Return small .txt and .csv output files holding a single value, row or column as values")
+	outputReleaseWaitPtr := flag.Int("output-release-wait", 0, "Time in s to wait for output files to be closed by other processes before packaging them (Windows)")
+	keepalivePtr := flag.Int("keepalive", 0, "Time in s between keepalives sent to the dispatcher while a calculation runs in server mode")
+	keepaliveModePtr := flag.String("keepalive-mode", "", "Keepalives to send: processing (102 Processing, the default) or whitespace")
+	successResponsePtr := flag.String("success-response", "", "Body of the response to the dispatcher for a calculation run in server mode: empty (the default) or summary, a JSON summary of the job")
+	tlsCertPtr := flag.String("tls-cert", "", "PEM certificate to serve HTTPS with in server mode, with -tls-key")
+	tlsKeyPtr := flag.String("tls-key", "", "PEM private key of the certificate given by -tls-cert")
+	tlsClientCaPtr := flag.String("tls-client-ca", "", "PEM bundle of CAs, one of which must have signed the certificate clients present in server mode")
+	adminAddressPtr := flag.String("admin-address", "", "Address, such as 127.0.0.1:9090, to serve health, version, capabilities and affinity on in server mode instead of port 8080")
+	outputCollisionsPtr := flag.String("output-collisions", "", "What to do with outputs named like another output or an input: last (default), suffix or error")
+	validateOutputsPtr := flag.Bool("validate-outputs", false, "Validate outputs against the schema of the calculation's type from its host")
+	optimizeImagesPtr := flag.Bool("optimize-images", false, "Convert BMP and TIFF output images to PNG")
+	maxImageSizePtr := flag.Int("max-image-size", 0, "Width and height in pixels to scale down larger output images to fit (default never)")
+	deltaUploadSizePtr := flag.Int64("delta-upload-size", 0, "Size in bytes above which output artefacts are sent to the host as a delta against their previous version, if it has one (default never)")
+	chunkedUploadSizePtr := flag.Int64("chunked-upload-size", 0, "Size in bytes above which output artefacts are uploaded to the host in resumable chunks (default never)")
+	separateOutputsPtr := flag.Bool("separate-outputs", false, "Expand inputs into a read-only inputs directory and return only the files written to an outputs directory")
+	// An optional subcommand comes before the flags
+	arguments := os.Args[1:]
+	subcommand := ""
+	if len(arguments) > 0 && IsSubcommand(arguments[0]) {
+		subcommand, arguments = arguments[0], arguments[1:]
+	}
+	flag.CommandLine.Parse(arguments)
+	switch subcommand {
+	case "completion":
+		script, err := Completion(flag.CommandLine, flag.Arg(0))
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Print(script)
+		return
+	case "man":
+		fmt.Print(ManPage(flag.CommandLine))
+		return
+	case "diff":
+		if flag.NArg() != 2 {
+			log.Fatal("diff needs two responses")
+		}
+		os.Exit(Diff(os.Stdout, flag.Arg(0), flag.Arg(1), *tolerancePtr))
+	case "run":
+		if flag.NArg() != 1 {
+			log.Fatal("run needs one calculation id")
+		}
+	case "serve":
+		if flag.NArg() != 0 {
+			log.Fatal("serve takes no arguments")
+		}
+	case "replay":
+		if flag.NArg() != 1 {
+			log.Fatal("replay needs one calculation id")
+		}
+	case "inspect":
+		if flag.NArg() != 1 {
+			log.Fatal("inspect needs one calculation id or workspace")
+		}
+		if err := Inspect(os.Stdout, dirpath, flag.Arg(0)); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
 	}
 	timeout, err := strconv.Atoi(*timeoutPtr)
+	if err != nil || timeout <= 0 {
+		log.Fatal("Invalid -timeout " + strconv.Quote(*timeoutPtr) + ", expected a number of seconds")
+	}
+	var config *Config
+	if *configFromHostPtr {
+		if len(*configPtr) > 0 {
+			log.Fatal("Only one of -config and -config-from-host can be given")
+		}
+		if len(*hostPtr) == 0 {
+			log.Fatal("No host provided to fetch the config from")
+		}
+		bootstrap := &Config{AgentId: *agentIdPtr}
+		if len(bootstrap.AgentId) == 0 {
+			bootstrap.AgentId, _ = os.Hostname()
+		}
+		config, err = FetchConfig(context.Background(), bootstrap, *hostPtr, *tokenPtr)
+	} else {
+		config, err = LoadConfig(*configPtr)
+	}
 	if err != nil {
-		timeout = 3600
+		log.Fatal(fmt.Sprintf("%+v\n", err))
+	}
+	if len(*cmdPtr) == 0 {
+		*cmdPtr = config.Command
+	}
+	if len(*cmdPtr) == 0 && len(config.Commands) == 0 && len(config.CommandsSource) == 0 {
+		log.Fatal("No command provided")
+	}
+	log.Println("Calculation command is " + *cmdPtr)
+	if len(*selftestPtr) > 0 {
+		if config.SelfTest == nil {
+			config.SelfTest = &SelfTest{}
+		}
+		config.SelfTest.Command = *selftestPtr
+	}
+	if len(*agentIdPtr) > 0 {
+		config.AgentId = *agentIdPtr
+	}
+	if len(config.AgentId) == 0 {
+		config.AgentId, _ = os.Hostname()
+	}
+	if *maxOutstandingPtr > 0 {
+		config.MaxOutstanding = *maxOutstandingPtr
+	}
+	if *jsonPrecisionPtr > 0 {
+		config.JsonPrecision = *jsonPrecisionPtr
+	}
+	if *maxJsonSizePtr > 0 {
+		config.MaxJsonSize = *maxJsonSizePtr
+	}
+	if *prefetchPtr > 0 {
+		config.Prefetch = *prefetchPtr
+	}
+	if *maxTimeoutPtr > 0 {
+		config.MaxTimeout = *maxTimeoutPtr
+	}
+	if *maxWaitPtr > 0 {
+		config.MaxWait = *maxWaitPtr
+	}
+	if *maxOutputSizePtr > 0 {
+		config.MaxOutputSize = *maxOutputSizePtr
+	}
+	if len(*resultSinkPtr) > 0 {
+		config.ResultSink = *resultSinkPtr
+		err = ValidateResultSink(config)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("%+v\n", err))
+		}
+	}
+	if len(*contextSourcePtr) > 0 {
+		config.ContextSource = *contextSourcePtr
+		err = ValidateContextSource(config)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("%+v\n", err))
+		}
+	}
+	if *maxJobsPtr > 0 {
+		config.MaxJobsBeforeRestart = *maxJobsPtr
+	}
+	if *idleTimeoutPtr > 0 {
+		config.IdleTimeout = *idleTimeoutPtr
+	}
+	if *shutdownGracePtr > 0 {
+		config.ShutdownGracePeriod = *shutdownGracePtr
+	}
+	if *keepFailedPtr {
+		config.KeepFailedWorkspaces = true
+	}
+	if *maxOutputFilesPtr > 0 {
+		config.MaxOutputFiles = *maxOutputFilesPtr
+	}
+	if len(*outputOverflowPtr) > 0 {
+		config.OutputOverflow = *outputOverflowPtr
+	}
+	if len(*outputDetectionPtr) > 0 {
+		config.OutputDetection = *outputDetectionPtr
+	}
+	if *dedupeInputsPtr {
+		config.DedupeInputs = true
+	}
+	if len(*includePtr) > 0 {
+		config.Include = strings.Split(*includePtr, ",")
+	}
+	if len(*excludePtr) > 0 {
+		config.Exclude = strings.Split(*excludePtr, ",")
+	}
+	for _, patterns := range [][]string{config.Include, config.Exclude} {
+		if err := ValidatePatterns(patterns); err != nil {
+			log.Fatal(fmt.Sprintf("%+v\n", err))
+		}
+	}
+	if *outputDepthPtr > 0 {
+		config.OutputDepth = *outputDepthPtr
+	}
+	if len(*directoryOutputsPtr) > 0 {
+		config.DirectoryOutputs = *directoryOutputsPtr
+	}
+	if len(*artefactStorePtr) > 0 {
+		config.ArtefactStore = *artefactStorePtr
+		err = ValidateArtefactStore(config)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("%+v\n", err))
+		}
+	}
+	if *maxInlineSizePtr > 0 {
+		config.MaxInlineSize = *maxInlineSizePtr
+	}
+	if *uploadLimitPtr > 0 || *downloadLimitPtr > 0 {
+		if config.Bandwidth == nil {
+			config.Bandwidth = &Bandwidth{}
+		}
+		if *uploadLimitPtr > 0 {
+			config.Bandwidth.Upload = *uploadLimitPtr
+		}
+		if *downloadLimitPtr > 0 {
+			config.Bandwidth.Download = *downloadLimitPtr
+		}
+	}
+	if len(*inputCachePtr) > 0 {
+		config.InputCache = *inputCachePtr
+	}
+	if *maxLogSizePtr > 0 {
+		config.MaxLogSize = *maxLogSizePtr
+	}
+	if *presignedUploadSizePtr > 0 {
+		config.PresignedUploadSize = *presignedUploadSizePtr
+	}
+	if *chunkedUploadSizePtr > 0 {
+		config.ChunkedUploadSize = *chunkedUploadSizePtr
+	}
+	if *deltaUploadSizePtr > 0 {
+		config.DeltaUploadSize = *deltaUploadSizePtr
+	}
+	if *optimizeImagesPtr {
+		config.OptimizeImages = true
+	}
+	if *validateOutputsPtr {
+		config.ValidateOutputs = true
+	}
+	if len(*outputCollisionsPtr) > 0 {
+		config.OutputCollisions = *outputCollisionsPtr
+	}
+	if *coerceOutputsPtr {
+		config.CoerceOutputs = true
+	}
+	if *outputReleaseWaitPtr > 0 {
+		config.OutputReleaseWait = *outputReleaseWaitPtr
+	}
+	if len(*adminAddressPtr) > 0 {
+		config.AdminAddress = *adminAddressPtr
+	}
+	if len(*tlsCertPtr) > 0 {
+		config.TlsCert = *tlsCertPtr
+	}
+	if len(*tlsKeyPtr) > 0 {
+		config.TlsKey = *tlsKeyPtr
+	}
+	if len(*tlsClientCaPtr) > 0 {
+		config.TlsClientCa = *tlsClientCaPtr
+	}
+	if len(*successResponsePtr) > 0 {
+		config.SuccessResponse = *successResponsePtr
+	}
+	if *keepalivePtr > 0 || len(*keepaliveModePtr) > 0 {
+		if config.Keepalive == nil {
+			config.Keepalive = &Keepalive{}
+		}
+		if *keepalivePtr > 0 {
+			config.Keepalive.Interval = *keepalivePtr
+		}
+		if len(*keepaliveModePtr) > 0 {
+			config.Keepalive.Mode = *keepaliveModePtr
+		}
+		if err := config.Keepalive.Validate(); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if *maxImageSizePtr > 0 {
+		config.MaxImageSize = *maxImageSizePtr
+	}
+	if *keepInputArchivesPtr {
+		config.KeepInputArchives = true
+	}
+	if *preserveInputNamesPtr {
+		config.PreserveInputNames = true
+	}
+	if *keepJunkPtr {
+		config.KeepJunkFiles = true
+	}
+	if *compressResultsPtr {
+		config.CompressResults = true
+	}
+	if *multipartResultsPtr {
+		config.MultipartResults = true
+	}
+	if *scalarsFirstPtr {
+		config.ScalarsFirst = true
+	}
+	if config.OutputOverflow != "" && config.OutputOverflow != "fail" && config.OutputOverflow != "tar" {
+		log.Fatal("Unknown output overflow " + config.OutputOverflow)
+	}
+	if config.OutputDetection != "" && config.OutputDetection != "mtime" && config.OutputDetection != "hash" {
+		log.Fatal("Unknown output detection " + config.OutputDetection)
+	}
+	if config.DirectoryOutputs != "" && config.DirectoryOutputs != "zip" && config.DirectoryOutputs != "tar" {
+		log.Fatal("Unknown directory outputs " + config.DirectoryOutputs)
+	}
+	if config.OutputCollisions != "" && config.OutputCollisions != "last" && config.OutputCollisions != "suffix" && config.OutputCollisions != "error" {
+		log.Fatal("Unknown output collisions " + config.OutputCollisions)
+	}
+	if config.SuccessResponse != "" && config.SuccessResponse != "empty" && config.SuccessResponse != "summary" {
+		log.Fatal("Unknown success response " + config.SuccessResponse)
+	}
+	if *separateOutputsPtr {
+		config.SeparateOutputs = true
 	}
 	args := flag.Args()
+	if subcommand == "replay" {
+		if len(*hostPtr) == 0 {
+			log.Fatal("No host provided")
+		}
+		os.Exit(Replay(context.Background(), os.Stdout, config, *cmdPtr, *hostPtr, *tokenPtr, dirpath, args[0], timeout, *tolerancePtr))
+	}
 	if len(args) > 0 {
 		// The calculation has been passed via the CLI
 		//if len(*tokenPtr) == 0 {
@@ -98,202 +393,739 @@ func main() {
 		if len(*hostPtr) == 0 {
 			log.Fatal("No host provided")
 		}
-		err = RunCalculation(*cmdPtr, *hostPtr, *tokenPtr, args[0], dirpath, timeout)
+		job := &Job{
+			Host:        *hostPtr,
+			Token:       *tokenPtr,
+			Calculation: args[0],
+			Dir:         dirpath,
+			Timeout:     timeout,
+		}
+		// The manifest also tells how the calculation failed, for the exit code
+		job.Manifest = &Manifest{}
+		err = RunCalculation(context.Background(), config, *cmdPtr, job)
+		if config.CostReport != nil {
+			if exportErr := config.CostReport.Export(); exportErr != nil {
+				log.Println(fmt.Sprintf("%+v\n", exportErr))
+			}
+		}
+		if len(*manifestPtr) > 0 {
+			if manifestErr := job.Manifest.Write(*manifestPtr); manifestErr != nil {
+				log.Println(fmt.Sprintf("%+v\n", manifestErr))
+			}
+		}
 		if err != nil {
-			log.Fatal(fmt.Sprintf("%+v\n", err))
+			log.Println(fmt.Sprintf("%+v\n", err))
 		}
+		os.Exit(job.Manifest.ExitStatus())
 	} else {
 		// Get the concurrency
 		concurrency, err := strconv.Atoi(*concurrencyPtr)
-		if err != nil {
-			concurrency = 4
+		if err != nil || concurrency <= 0 {
+			log.Fatal("Invalid -concurrency " + strconv.Quote(*concurrencyPtr) + ", expected a positive number")
 		}
 		// The calculation will be passed via HTTP
-		err = Server(*cmdPtr, *hostPtr, *tokenPtr, dirpath, concurrency, timeout)
+		err = Server(config, *cmdPtr, *hostPtr, *tokenPtr, dirpath, concurrency, timeout)
 		if err != nil {
 			log.Fatal(fmt.Sprintf("%+v\n", err))
 		}
 	}
 }
 
-func Server(command string, host string, token string, dirpath string, concurrency int, timeout int) error {
-	http.HandleFunc("/", limitNumClients(func(writer http.ResponseWriter, request *http.Request) {
-		if "POST" == strings.ToUpper(request.Method) {
-			// TODO: This should handle some different structures: Google Pubsub, or just a string etc
-			// RunCalculation()
-			dir, err := ioutil.TempDir(dirpath, "calc")
-			if err != nil {
-				log.Println(fmt.Sprintf("%+v\n", err))
-				writer.WriteHeader(500)
-			} else {
-				payload := StreamToString(request.Body)
-				if strings.HasPrefix(payload, "{") {
-					// Try to get a payload
-					var calc CalculationPayload
-					err = json.Unmarshal(StringToBytes(payload), &calc)
-					if err != nil {
-						// It might be in the Google PubSub format
-						var pubsub PubSubPayload
-						err = json.Unmarshal(StringToBytes(payload), &pubsub)
-						if err == nil {
-							data, err := base64.StdEncoding.DecodeString(pubsub.Message.Data)
-							if err == nil {
-								err = json.Unmarshal(data, &calc)
-								if err == nil {
-									err = RunCalculation(command, calc.Host, calc.Token, calc.Id, dir, timeout)
-								}
-							}
-						}
-					} else {
-						err = RunCalculation(command, calc.Host, calc.Token, calc.Id, dir, timeout)
-					}
-				} else {
-					err = RunCalculation(command, host, token, payload, dir, timeout)
+func Server(config *Config, command string, host string, token string, dirpath string, concurrency int, timeout int) error {
+	// Network operations and commands of calculations are cancelled when the
+	// server stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Monitoring is served with calculations unless given its own address
+	var draining int32
+	admin := http.DefaultServeMux
+	if len(config.AdminAddress) > 0 {
+		admin = http.NewServeMux()
+	}
+	HandleVersioned(admin, "/affinity", AffinityHandler(config))
+	HandleVersioned(admin, "/capabilities", CapabilitiesHandler(NewCapabilities(config, host, concurrency, timeout)))
+	HandleVersioned(admin, "/health", HealthHandler(&draining))
+	HandleVersioned(admin, "/version", VersionHandler())
+	HandleVersioned(admin, "/status", StatusHandler(config, dirpath))
+	tlsConfig, err := ServerTLSConfig(config)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(config.AdminAddress) > 0 {
+		adminServer, err := ListenAdmin(config, admin)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer adminServer.Close()
+	}
+	if config.CostReport != nil {
+		go config.CostReport.ExportEvery(ctx)
+	}
+	WatchCommands(ctx, config)
+	WatchDeferredUploads(ctx, config, host, token)
+	// Calculations waiting for a worker may fetch their inputs in advance
+	prefetch := make(chan struct{}, config.Prefetch)
+	// After the configured number of calculations, or when idle for the
+	// configured time, the server stops accepting more and exits once those
+	// running have finished, for its supervisor to restart it or to let the
+	// fleet scale down
+	server := &http.Server{Addr: ":8080", TLSConfig: tlsConfig}
+	var completed int32
+	var drainOnce sync.Once
+	drained := make(chan struct{})
+	// Calculations running when asked to stop get grace to finish and
+	// upload their results, after which they are cancelled
+	drain := func(reason string, grace time.Duration) {
+		drainOnce.Do(func() {
+			log.Println(reason + ", shutting down")
+			atomic.StoreInt32(&draining, 1)
+			go func() {
+				shutdownCtx := context.Background()
+				if grace > 0 {
+					var cancelShutdown context.CancelFunc
+					shutdownCtx, cancelShutdown = context.WithTimeout(shutdownCtx, grace)
+					defer cancelShutdown()
 				}
-				os.RemoveAll(dir)
-				if err != nil {
-					log.Println(fmt.Sprintf("%+v\n", err))
-					writer.WriteHeader(500)
-				} else {
-					writer.WriteHeader(200)
+				if server.Shutdown(shutdownCtx) != nil {
+					log.Println("Cancelling calculations still running after " + grace.String())
+					cancel()
+					server.Close()
 				}
+				close(drained)
+			}()
+		})
+	}
+	go watchTermination(ctx, func(signal os.Signal) {
+		drain("Received "+signal.String(), time.Second*time.Duration(config.ShutdownGracePeriod))
+	}, cancel)
+	activity := NewActivity()
+	if config.IdleTimeout > 0 {
+		go activity.WatchIdle(ctx, time.Second*time.Duration(config.IdleTimeout), func() {
+			drain("Idle for "+strconv.Itoa(config.IdleTimeout)+"s", 0)
+		})
+	}
+	jobs := limitNumClients(func(writer http.ResponseWriter, request *http.Request, waitTurn func() error) {
+		if "POST" != strings.ToUpper(request.Method) {
+			writer.WriteHeader(404)
+			return
+		}
+		activity.Begin()
+		defer activity.End()
+		if atomic.LoadInt32(&draining) != 0 {
+			writer.Header().Set("Retry-After", "60")
+			writer.WriteHeader(503)
+			return
+		}
+		calc, err := ParsePayload(StreamToString(request.Body), host, token)
+		if err != nil {
+			log.Println(fmt.Sprintf("%+v\n", err))
+			writer.WriteHeader(400)
+			return
+		}
+		calc = ResolveTenant(config, calc, host, token)
+		logger := NewJobLogger(calc.Id)
+		if config.Keepalive != nil {
+			keepalive := config.Keepalive.Start(writer)
+			defer keepalive.Stop()
+			writer = keepalive
+		}
+		queued := time.Now().UTC()
+		NotifyWebhooks(config, logger, WebhookEvent{Event: "queued", Calculation: calc.Id, QueuedAt: queued})
+		select {
+		case prefetch <- struct{}{}:
+			var once sync.Once
+			release := func() { once.Do(func() { <-prefetch }) }
+			defer release()
+			turn := waitTurn
+			waitTurn = func() error {
+				defer release()
+				return turn()
+			}
+		default:
+			err = waitTurn()
+			if err != nil {
+				writer.Header().Set("Retry-After", "60")
+				writer.WriteHeader(429)
+				return
 			}
+			waitTurn = nil
+		}
+		var manifest *Manifest
+		if config.SuccessResponse == "summary" {
+			manifest = &Manifest{}
+		}
+		job := &Job{
+			Host:        calc.Host,
+			Token:       calc.Token,
+			Calculation: calc.Id,
+			Workspaces:  dirpath,
+			Timeout:     JobTimeout(config, request, calc, timeout),
+			Context:     calc.Context,
+			Callback:    calc.Callback,
+			Include:     calc.Include,
+			Exclude:     calc.Exclude,
+			Queued:      queued,
+			WaitTurn:    waitTurn,
+			Logger:      logger,
+			Manifest:    manifest,
+		}
+		err = RunCalculation(ctx, config, command, job)
+		if len(job.Dir) > 0 && !job.Keep {
+			os.RemoveAll(job.Dir)
+		}
+		if err == ErrNoWorker {
+			writer.Header().Set("Retry-After", "60")
+			writer.WriteHeader(429)
+		} else if err == ErrLicenseUnavailable {
+			// Let the dispatcher deliver the calculation again later
+			logger.Println("Requeueing calculation as no license is available")
+			writer.WriteHeader(503)
+		} else if err != nil {
+			logger.Println(fmt.Sprintf("%+v\n", err))
+			writer.WriteHeader(500)
+		} else if manifest != nil {
+			data, _ := json.Marshal(manifest.Summary(config.AgentId))
+			writer.Header().Set("Content-Type", "application/json")
+			writer.WriteHeader(200)
+			writer.Write(data)
 		} else {
-			writer.WriteHeader(404)
+			writer.WriteHeader(200)
+		}
+		if err != ErrNoWorker && err != ErrLicenseUnavailable && config.MaxJobsBeforeRestart > 0 &&
+			atomic.AddInt32(&completed, 1) == int32(config.MaxJobsBeforeRestart) {
+			drain("Completed "+strconv.Itoa(config.MaxJobsBeforeRestart)+" calculations", 0)
 		}
-	}, concurrency))
-	log.Println("Starting server on port 8080")
-	err := http.ListenAndServe(":8080", nil)
+	}, concurrency, config.MaxOutstanding, time.Second*time.Duration(config.MaxWait))
+	// Requests turned away by middleware don't take up outstanding slots
+	handler, err := ChainMiddleware(config, jobs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	HandleVersioned(http.DefaultServeMux, "/", handler.ServeHTTP)
+	// Clean up after a crash, sending any results that were finished
+	ReconcileWorkspaces(ctx, config, dirpath, host, token)
+	// Don't accept any work until the solver is known to be working
+	if config.SelfTest != nil {
+		err := RunSelfTest(config, command, dirpath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if server.TLSConfig != nil {
+		log.Println("Starting server on port 8080 with TLS")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Println("Starting server on port 8080")
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-drained
+		if config.CostReport != nil {
+			return errors.WithStack(config.CostReport.Export())
+		}
+		return nil
+	}
 	return errors.WithStack(err)
 }
 
+// JobTimeout returns the timeout in s for a calculation, which the dispatcher
+// may override with the X-Timeout header or the timeoutSeconds field of the
+// payload, up to the configured maximum (by default the agent's timeout).
+func JobTimeout(config *Config, request *http.Request, calc patchwork.CalculationPayload, timeout int) int {
+	requested := 0
+	if header := request.Header.Get("X-Timeout"); len(header) > 0 {
+		requested, _ = strconv.Atoi(header)
+	}
+	if calc.TimeoutSeconds > 0 {
+		requested = calc.TimeoutSeconds
+	}
+	if requested <= 0 {
+		return timeout
+	}
+	maxTimeout := config.MaxTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = timeout
+	}
+	if requested > maxTimeout {
+		log.Println("Requested timeout " + strconv.Itoa(requested) + "s exceeds maximum of " + strconv.Itoa(maxTimeout) + "s")
+		return maxTimeout
+	}
+	return requested
+}
+
 // limitNumClients is HTTP handling middleware that ensures no more than
-// maxClients requests are passed concurrently to the given handler f.
-func limitNumClients(f http.HandlerFunc, maxClients int) http.HandlerFunc {
+// maxClients requests are run concurrently by the given handler f, which
+// must call waitTurn before it starts work and only continue if it returns
+// nil.
+// To apply back-pressure to the dispatcher, no more than maxOutstanding
+// requests (if positive, and at least maxClients) are accepted at once, and a
+// request that waits longer than maxWait (if positive) for its turn is turned
+// away; both are rejected with 429 so that the message is redelivered later,
+// rather than claimed by an agent that can't run it before its deadline.
+// Otherwise requests queue for their turn.
+func limitNumClients(f func(http.ResponseWriter, *http.Request, func() error), maxClients int, maxOutstanding int, maxWait time.Duration) http.HandlerFunc {
+	if maxOutstanding > 0 && maxOutstanding < maxClients {
+		maxOutstanding = maxClients
+	}
 	sema := make(chan struct{}, maxClients)
+	var outstanding chan struct{}
+	if maxOutstanding > 0 {
+		outstanding = make(chan struct{}, maxOutstanding)
+	}
 
 	return func(w http.ResponseWriter, req *http.Request) {
-		sema <- struct{}{}
-		defer func() { <-sema }()
-		f(w, req)
+		if outstanding != nil {
+			select {
+			case outstanding <- struct{}{}:
+				defer func() { <-outstanding }()
+			default:
+				log.Println("Rejecting request as " + strconv.Itoa(maxOutstanding) + " are already outstanding")
+				w.Header().Set("Retry-After", "60")
+				w.WriteHeader(429)
+				return
+			}
+		}
+		var expired <-chan time.Time
+		if maxWait > 0 {
+			timer := time.NewTimer(maxWait)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		acquired := false
+		defer func() {
+			if acquired {
+				<-sema
+			}
+		}()
+		f(w, req, func() error {
+			select {
+			case sema <- struct{}{}:
+				acquired = true
+				return nil
+			case <-expired:
+				log.Println("Rejecting request that waited " + maxWait.String() + " to start")
+				return ErrNoWorker
+			case <-req.Context().Done():
+				return ErrNoWorker
+			}
+		})
 	}
 }
 
-func RunCalculation(command string, host string, token string, calculation string, dirpath string, timeout int) error {
-	log.Println("Preparing calculation " + calculation)
+func RunCalculation(ctx context.Context, config *Config, command string, job *Job) (err error) {
+	host, token, calculation, dirpath := job.Host, job.Token, job.Calculation, job.Dir
+	config = config.WithOutputPatterns(job.Include, job.Exclude)
+	logger := job.Logger
+	if logger == nil {
+		logger = NewJobLogger(calculation)
+	}
+	// Tell the webhooks how the calculation ended, once any panic has been
+	// reported
+	queued := job.Queued
+	if queued.IsZero() {
+		queued = time.Now().UTC()
+	}
+	var started *time.Time
+	var exitCode *int
+	var response *patchwork.CalculationResponse
+	alreadyRun, timedOut := false, false
+	defer func() {
+		if alreadyRun {
+			return
+		}
+		event := WebhookEvent{Event: "finished", Calculation: calculation, QueuedAt: queued, StartedAt: started, ExitCode: exitCode}
+		if started != nil {
+			event.WaitTime = started.Sub(queued).Seconds()
+			event.RunTime = time.Since(*started).Seconds()
+		}
+		if err != nil {
+			event.Event = "failed"
+			event.Error = err.Error()
+		}
+		NotifyWebhooks(config, logger, event)
+	}()
+	if job.Manifest != nil {
+		defer func() {
+			job.Manifest.Fill(calculation, OutputsDir(config, dirpath), response, started, exitCode, timedOut, alreadyRun, time.Since(queued), err)
+		}()
+	}
+	// Report a panic as a failure of this calculation rather than losing it
+	defer func() {
+		if r := recover(); r != nil {
+			err = ReportPanic(ctx, config, logger, job, r)
+		}
+	}()
+	logger.Println("Preparing calculation " + calculation)
 	// Remove trailing slash from URL
 	host = strings.TrimSuffix(host, "/")
 
 	// Get all the data from the server about this calculation
-	log.Println("Fetching inputs of calculation " + calculation)
-	calcContext, err, abort := GetContext(host, token, calculation)
-	if abort {
+	var sink ResultSink
+	var presigner *Presigner
+	var calcContext patchwork.CalculationContext
+	var before Snapshot
+	err = runPhase(ctx, logger, calculation, PhaseFetch, func() error {
+		logger.Println("Fetching inputs of calculation " + calculation)
+		var source ContextSource
+		var err error
+		if job.Context != nil {
+			source = &EmbeddedSource{Context: *job.Context}
+		} else {
+			source, err = NewContextSource(config, logger, host, token)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		sink, err = NewResultSink(config, logger, host, token)
+		if err == nil && job.Callback != nil {
+			sink, err = NewCallbackSink(config, logger, sink, job.Callback)
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// Large outputs are uploaded to the host, or to URLs it presigns
+		if (config.PresignedUploadSize > 0 || config.ChunkedUploadSize > 0 || config.DeltaUploadSize > 0) && len(host) > 0 {
+			client, err := NewClient(config, logger, host, token)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			presigner = &Presigner{Config: config, Client: client, Calculation: calculation}
+		}
+		calcContext, err = source.GetContext(ctx, calculation)
+		if err == patchworkclient.ErrAlreadyRun {
+			alreadyRun = true
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		command = config.CommandFor(calcContext.Id.Type, command)
+		if len(command) == 0 {
+			return errors.New("No command for calculations of type " + calcContext.Id.Type)
+		}
 		return nil
+	})
+	if err != nil || alreadyRun {
+		return err
 	}
-	if err != nil {
-		return errors.WithStack(err)
+	if len(job.Workspaces) > 0 {
+		dirpath, err = CreateWorkspace(job.Workspaces, calcContext.Id.Type, calculation)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		job.Dir = dirpath
 	}
+	workspaces.Add(WorkspaceEntry{Calculation: calculation, Type: calcContext.Id.Type, Workspace: dirpath, Created: time.Now().UTC()})
+	defer workspaces.Remove(dirpath)
 
 	// Write the inputs to files in the working directory
-	log.Println("Expanding inputs of calculation " + calculation)
-	err = ExpandContext(dirpath, calcContext)
-	if err != nil {
+	defer SetInputsReadOnly(config, dirpath, false)
+	err = runPhase(ctx, logger, calculation, PhaseExpand, func() error {
+		logger.Println("Expanding inputs of calculation " + calculation)
+		err := ResolveCalculationRefs(ctx, config, logger, host, token, &calcContext)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = PrepareWorkspace(config, dirpath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = ExpandContext(ctx, config, logger, InputsDir(config, dirpath), calcContext)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		affinity.Record(config, host, calcContext)
+		err = SetInputsReadOnly(config, dirpath, true)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// Note the files present before running the calculation. Comparing
+		// against a timestamp instead misses files written within the coarse
+		// resolution of file modification times.
+		before, err = SnapshotFiles(config, OutputsDir(config, dirpath))
 		return errors.WithStack(err)
+	})
+	if err != nil {
+		return err
 	}
 
-	// Get a timestamp before running the calculation
-	t := time.Now()
+	// Wait for a worker if the inputs were fetched in advance
+	if job.WaitTurn != nil {
+		err = job.WaitTurn()
+		if err != nil {
+			return err
+		}
+	}
 
 	// Create a new context and add a timeout to it
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+	cmdCtx, cancel := context.WithTimeout(ctx, time.Second*time.Duration(job.Timeout))
+	defer cancel()
 
-	// Make a Cmd object
-	var cmd *exec.Cmd
-	if runtime.GOOS == "windows" {
-		cmd = exec.CommandContext(ctx, "cmd", "/c",
-			strings.TrimSuffix(strings.TrimPrefix(command, "\""), "\""))
-	} else {
-		cmd = exec.CommandContext(ctx, "bash", "-c",
-			strings.TrimSuffix(strings.TrimPrefix(command, "\""), "\""))
+	// A new version of the command may be run alongside it to compare them
+	var canaryRun *CanaryRun
+	if canary := config.CanaryFor(calcContext.Id.Type); canary != nil {
+		canaryRun = StartCanary(cmdCtx, config, logger, canary, dirpath, calcContext, host, token)
+		defer canaryRun.Remove()
 	}
-	cmd.Dir = dirpath
-	cmd.Env = make([]string, 2)
-	cmd.Env[0] = "HOST=" + host
-	cmd.Env[1] = "TOKEN=" + token
 
-	// Capture stdout/stderr
+	// Run the command, waiting and trying again while no license is available
 	var stdoutBuf, stderrBuf bytes.Buffer
-	cmd.Stdout = io.MultiWriter(os.Stdout, &stdoutBuf)
-	cmd.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+	var cpuTime time.Duration
+	err = runPhase(ctx, logger, calculation, PhaseExecute, func() error {
+		// Notify the server that we are now Running
+		err := sink.SendLogs(ctx, calculation, "", 0.0)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		now := time.Now().UTC()
+		started = &now
+		NotifyWebhooks(config, logger, WebhookEvent{Event: "started", Calculation: calculation, QueuedAt: queued, StartedAt: started,
+			WaitTime: started.Sub(queued).Seconds()})
+
+		for attempt := 1; ; attempt++ {
+			stdoutBuf.Reset()
+			stderrBuf.Reset()
+			logger.Println("Running calculation " + calculation)
+			code, cpu := RunCommand(cmdCtx, config, logger, calcContext.Id.Type, command, dirpath, host, token, SecretInputs(calcContext.Inputs), &stdoutBuf, &stderrBuf)
+			exitCode = &code
+			cpuTime += cpu
+			if !config.LicenseRetry.IsLicenseFailure(code, stdoutBuf.String(), stderrBuf.String()) {
+				break
+			}
+			if attempt > config.LicenseRetry.Attempts {
+				if config.LicenseRetry.Requeue {
+					return ErrLicenseUnavailable
+				}
+				break
+			}
+			logger.Println("License unavailable for calculation " + calculation +
+				", retrying in " + strconv.Itoa(config.LicenseRetry.Delay) + "s")
+			if config.LicenseRetry.Wait(cmdCtx) != nil {
+				break
+			}
+		}
 
-	// Notify the server that we are now Running
-	err = SendLogs(host, token, calculation, "", 0.0)
+		// We want to check the context error to see if the timeout was executed.
+		// The error returned by cmd.Output() will be OS specific based on what
+		// happens when a process is killed.
+		if cmdCtx.Err() == context.DeadlineExceeded {
+			timedOut = true
+			stderrBuf.WriteString("Command timed out")
+		}
+		return nil
+	})
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
+	outStr, errStr := string(stdoutBuf.Bytes()), string(stderrBuf.Bytes())
+	runTime := time.Since(*started)
+	workspaceSize := DirSize(dirpath)
 
-	// Run the command
-	log.Println("Running calculation " + calculation)
-	err = cmd.Run()
+	// Pull any configured scalar results out of stdout, and wait for the
+	// files changed during the task
+	var extracted map[string]interface{}
+	var pushed *GitPush
+	var pushErr error
+	err = runPhase(ctx, logger, calculation, PhaseCollect, func() error {
+		extracted = ExtractOutputs(config.OutputRules, outStr)
+		WaitForOutputs(config, logger, OutputsDir(config, dirpath))
+		if config.GitOutputs != nil && !timedOut && *exitCode == 0 {
+			pushed, pushErr = PushGitOutputs(ctx, config, logger, OutputsDir(config, dirpath), before, calculation, calcContext.Inputs)
+		}
+		return nil
+	})
 	if err != nil {
-		stderrBuf.WriteString(err.Error())
+		return err
 	}
 
-	// We want to check the context error to see if the timeout was executed.
-	// The error returned by cmd.Output() will be OS specific based on what
-	// happens when a process is killed.
-	if ctx.Err() == context.DeadlineExceeded {
-		stderrBuf.WriteString("Command timed out")
-	}
-	outStr, errStr := string(stdoutBuf.Bytes()), string(stderrBuf.Bytes())
+	// Package them to return to server
+	var responseSize int64
+	err = runPhase(ctx, logger, calculation, PhasePackage, func() error {
+		var err error
+		logger.Println("Packaging results of calculation " + calculation)
+		response, err = PackageResult(ctx, GitOutputsConfig(config, pushed), logger, presigner, OutputsDir(config, dirpath), before, outStr, errStr, extracted)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if config.GitOutputs != nil {
+			AddGitOutputs(config, logger, response, pushed, pushErr)
+		}
+		CheckInputCollisions(config, logger, calcContext.Inputs, response)
+		if canaryRun != nil {
+			report := canaryRun.Compare(*exitCode, response)
+			summary := "Canary " + canaryRun.Canary.Command + " exited with " + strconv.Itoa(report.ExitCode) + ", " +
+				strconv.Itoa(len(report.Differences)) + " differences"
+			response.AddLogs(append([]string{summary}, report.Differences...)...)
+			NotifyWebhooks(config, logger, WebhookEvent{Event: "canary", Calculation: calculation, QueuedAt: queued, StartedAt: started, Canary: &report})
+		}
+		if config.ValidateOutputs && len(host) > 0 {
+			ValidateOutputs(ctx, config, logger, host, token, calcContext.Id.Type, response)
+		}
+		if config.DeferredUploads != nil {
+			// Results sent scalars first are completed by the last upload
+			client, isClient := sink.(*patchworkclient.Client)
+			complete := isClient && client.ScalarsFirst && len(client.ResultURL) == 0
+			err = DeferUploads(config, logger, calculation, host, token, complete, response)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
 
-	// Find all files changed during the task and package them to return to server
-	log.Println("Packaging results of calculation " + calculation)
-	response, err := PackageResult(dirpath, t, outStr, errStr)
+		// Keep the result until it has been sent, in case the agent crashes
+		// (which also encodes it without holding its artefacts in memory)
+		err = SpoolResult(dirpath, SpooledResult{Calculation: calculation, Host: host, Callback: job.Callback}, response)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if info, statErr := os.Stat(filepath.Join(dirpath, SpoolResponseFile)); statErr == nil {
+			responseSize = info.Size()
+		}
+		return nil
+	})
 	if err != nil {
-		// Cleanup
-		cancel()
-		return errors.WithStack(err)
+		return err
+	}
+
+	// Keep the workspace of a failed command to be inspected
+	if config.KeepFailedWorkspaces && (timedOut || *exitCode != 0) {
+		session := Session{Calculation: calculation, Type: calcContext.Id.Type, Command: command, ExitCode: *exitCode, TimedOut: timedOut}
+		if err := SaveSession(config, dirpath, session, host, SecretInputs(calcContext.Inputs)); err != nil {
+			logger.Println("Could not save the session of the failed calculation: " + err.Error())
+		} else {
+			logger.Println("Keeping workspace " + dirpath + " of the failed calculation")
+			job.Keep = true
+		}
 	}
 
 	// Send the data to the server
-	log.Println("Uploading results of calculation " + calculation)
-	err = SendResult(host, token, calculation, response)
-	log.Println("Completing calculation " + calculation)
-	// Cleanup
-	cancel()
+	err = runPhase(ctx, logger, calculation, PhaseUpload, func() error {
+		var err error
+		logger.Println("Uploading results of calculation " + calculation)
+		client, isClient := sink.(*patchworkclient.Client)
+		if isClient && client.ScalarsFirst {
+			err = client.SendResultScalarsFirst(ctx, calculation, response)
+		} else if isClient && client.Multipart {
+			err = client.SendResultMultipart(ctx, calculation, response)
+		} else {
+			err = sink.SendResultFile(ctx, calculation, filepath.Join(dirpath, SpoolResponseFile))
+		}
+		if err == nil {
+			os.Remove(filepath.Join(dirpath, SpoolFile))
+			os.Remove(filepath.Join(dirpath, SpoolResponseFile))
+		}
+		return err
+	})
+	// Tell the host which calculations have their inputs cached here, for it
+	// to route follow-up versions to this agent
+	if _, isClient := sink.(*patchworkclient.Client); isClient && err == nil && len(config.InputCache) > 0 {
+		if err := affinity.Report(ctx, config, logger, host, token); err != nil {
+			logger.Println("Failed to report cached inputs to " + host + ": " + err.Error())
+		}
+	}
+	logger.Println("Completing calculation " + calculation)
+
+	// Account for the resources the calculation used
+	contextData, _ := json.Marshal(calcContext)
+	accounting.Record(Usage{
+		Calculation:      calculation,
+		Owner:            calcContext.Owner,
+		CpuSeconds:       cpuTime.Seconds(),
+		WorkspaceGBHours: float64(workspaceSize) / 1e9 * runTime.Hours(),
+		BytesIn:          int64(len(contextData)),
+		BytesOut:         responseSize,
+	})
 	return errors.WithStack(err)
 }
 
-func GetContext(host string, token string, calculation string) (CalculationContext, error, bool) {
-	var dat CalculationContext
-	var abort bool
-	abort = false
-	req, err := http.NewRequest("GET", host+"/api/calculations/remote/"+calculation, nil)
+// ReportPanic sends a failed result, with the stack trace in its errors,
+// for a calculation that panicked, and returns the panic as an error.
+func ReportPanic(ctx context.Context, config *Config, logger *log.Logger, job *Job, r interface{}) error {
+	calculation := job.Calculation
+	stack := string(debug.Stack())
+	logger.Println(fmt.Sprintf("Calculation %s panicked: %v\n%s", calculation, r, stack))
+	failure := errors.Errorf("Calculation panicked: %v", r)
+	response := patchwork.NewCalculationResponse()
+	response.AddErrors("Internal error in the calculation agent: " + fmt.Sprint(r))
+	response.AddErrors(TrimAndSplit(stack)...)
+	sink, err := NewResultSink(config, logger, strings.TrimSuffix(job.Host, "/"), job.Token)
+	if err == nil && job.Callback != nil {
+		sink, err = NewCallbackSink(config, logger, sink, job.Callback)
+	}
+	if err == nil {
+		err = sink.SendResult(ctx, calculation, response)
+	}
 	if err != nil {
-		return dat, errors.WithStack(err), abort
+		return errors.Wrap(failure, "Failed to report panic: "+err.Error())
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Accept", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	// HTTP code to indicate we already ran the calculation
-	if resp.StatusCode == 208 {
-		abort = true
-		return dat, nil, abort
+	return failure
+}
+
+// NewExecution is the calculation command to run in dirpath, with the
+// workspace, inputs and outputs substituted and in its environment.
+func NewExecution(config *Config, command string, dirpath string, host string, token string, secrets map[string]string) Execution {
+	// Refer to the workspace as the execution backend sees it
+	workspace := config.PathTranslation.Translate(dirpath)
+	inputs := config.PathTranslation.Translate(InputsDir(config, dirpath))
+	outputs := config.PathTranslation.Translate(OutputsDir(config, dirpath))
+	command = strings.NewReplacer("{inputs}", inputs, "{outputs}", outputs).Replace(ExpandCommand(command, workspace))
+
+	execution := Execution{Command: command, Dir: dirpath, Workspace: workspace}
+	execution.Env = []string{"HOST=" + host, "TOKEN=" + token, "WORKSPACE=" + workspace, "INPUTS=" + inputs, "OUTPUTS=" + outputs}
+	for name, value := range secrets {
+		execution.Env = append(execution.Env, name+"="+value)
 	}
+	return execution
+}
+
+// RunCommand runs the calculation command in dirpath, capturing its output,
+// and returns its exit code (-1 if it could not be run to completion) and the
+// CPU time it used.
+func RunCommand(ctx context.Context, config *Config, logger *log.Logger, calculationType string, command string, dirpath string, host string, token string, secrets map[string]string, stdout *bytes.Buffer, stderr *bytes.Buffer) (int, time.Duration) {
+	execution := NewExecution(config, command, dirpath, host, token, secrets)
+	executor, err := config.ExecutorFor(calculationType)
 	if err != nil {
-		return dat, errors.WithStack(err), abort
+		stderr.WriteString(err.Error())
+		return -1, 0
 	}
-	if resp.StatusCode != 200 {
-		return dat, errors.New(resp.Status), abort
+
+	// Capture stdout/stderr, echoing them a line at a time, without secrets
+	redactor := SecretRedactor(secrets)
+	stdoutEcho := NewLineWriter(os.Stdout, logger.Prefix())
+	stderrEcho := NewLineWriter(os.Stderr, logger.Prefix())
+	stdoutEcho.Redactor, stderrEcho.Redactor = redactor, redactor
+	start, errStart := stdout.Len(), stderr.Len()
+	execution.Stdout = io.MultiWriter(stdoutEcho, stdout)
+	execution.Stderr = io.MultiWriter(stderrEcho, stderr)
+
+	cpu, err := executor.Execute(ctx, execution)
+	stdoutEcho.Flush()
+	stderrEcho.Flush()
+	if len(secrets) > 0 {
+		redactBuffer(redactor, stdout, start)
+		redactBuffer(redactor, stderr, errStart)
+	}
+	if err == nil {
+		return 0, cpu
+	}
+	stderr.WriteString(err.Error())
+	if exitErr, ok := err.(interface{ ExitCode() int }); ok {
+		if message, ok := config.ExitCodeMessage(exitErr.ExitCode()); ok {
+			stderr.WriteString("\n" + message)
+		}
+		return exitErr.ExitCode(), cpu
 	}
-	err = json.Unmarshal(StreamToBytes(resp.Body), &dat)
-	return dat, errors.WithStack(err), abort
+	return -1, cpu
 }
 
-func ExpandContext(dirpath string, context CalculationContext) error {
+func ExpandContext(ctx context.Context, config *Config, logger *log.Logger, dirpath string, context patchwork.CalculationContext) error {
+	var files map[string]string
+	if config.PreserveInputNames {
+		files = PreservedInputFiles(logger, context.Inputs)
+	}
 	for name, content := range context.Inputs {
-		err := ExpandContextFile(dirpath, name, content)
+		err := ExpandContextFile(ctx, config, logger, dirpath, name, files[name], content)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -301,8 +1133,24 @@ func ExpandContext(dirpath string, context CalculationContext) error {
 	return nil
 }
 
-func ExpandContextFile(dirpath string, name string, content interface{}) error {
-	isArtefact, err := HandleAsArtefact(dirpath, name, content)
+// ExpandContextFile writes an input to the workspace. An artefact is written
+// to file, if given, instead of a name derived from that of the input.
+func ExpandContextFile(ctx context.Context, config *Config, logger *log.Logger, dirpath string, name string, file string, content interface{}) error {
+	if !ValidInputName(name) {
+		return errors.New("Invalid input name " + strconv.Quote(name))
+	}
+	if _, ok := SecretValue(content); ok {
+		logger.Println("Passing secret input " + name + " in $" + SecretEnvName(name))
+		return nil
+	}
+	handled, err := HandleInputWithPlugins(config, logger, dirpath, name, content)
+	if err != nil || handled {
+		return errors.WithStack(err)
+	}
+	if source, ok := asGitSource(content); ok {
+		return errors.WithStack(CloneGitInput(ctx, config, logger, dirpath, name, source))
+	}
+	isArtefact, err := HandleAsArtefact(ctx, config, logger, dirpath, name, file, content)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -311,8 +1159,12 @@ func ExpandContextFile(dirpath string, name string, content interface{}) error {
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		log.Println("Writing input file " + dirpath + "/" + name + ".json")
-		err = os.WriteFile(dirpath+"/"+name+".json", raw, os.ModePerm)
+		path, err := JoinWithin(dirpath, name+".json")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		logger.Println("Writing input file " + path)
+		err = os.WriteFile(path, raw, os.ModePerm)
 		return errors.WithStack(err)
 	}
 	return nil
@@ -343,147 +1195,446 @@ func TrimAndSplit(str string) []string {
 	return out
 }
 
-func StringsToJson(strs []string) string {
-	out := make([]string, len(strs))
-	for i, s := range strs {
-		sjson, err := json.Marshal(s)
-		if err != nil {
-			out[i] = "\"\""
-		} else {
-			out[i] = string(sjson)
-		}
+func PackageResult(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, before Snapshot, stdout string, stderr string, extracted map[string]interface{}) (*patchwork.CalculationResponse, error) {
+	response := patchwork.NewCalculationResponse()
+	response.AddLogs(TrimAndSplit(LogTail(config, stdout))...)
+	response.AddErrors(TrimAndSplit(LogTail(config, stderr))...)
+	err := packageOutputs(ctx, config, logger, presigner, dirpath, before, extracted, response)
+	if err != nil {
+		return response, errors.WithStack(err)
+	}
+	err = AddReport(ctx, config, logger, presigner, dirpath, response)
+	if err != nil {
+		return response, errors.WithStack(err)
 	}
-	return "[" + strings.Join(out, ", ") + "]"
+	// Logs are spilt to files once the outputs are found, so as not to be one
+	err = SpillLogs(ctx, config, logger, presigner, dirpath, stdout, stderr, response)
+	return response, errors.WithStack(err)
 }
 
-func PackageResult(dirpath string, since time.Time, stdout string, stderr string) (string, error) {
-	response := "{\n"
-	response += "\t\"logs\": " + StringsToJson(TrimAndSplit(stdout)) + ",\n"
-	response += "\t\"errors\": " + StringsToJson(TrimAndSplit(stderr)) + ",\n"
-	response += "\t\"outputs\": {\n"
-	files, err := GetChangedFiles(dirpath, since)
+// packageOutputs adds the outputs of a calculation to the response: those
+// listed in an output manifest, or else the files changed since the snapshot
+// before.
+func packageOutputs(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, before Snapshot, extracted map[string]interface{}, response *patchwork.CalculationResponse) error {
+	for name, value := range extracted {
+		response.SetOutput(name, value)
+	}
+	// An output manifest written by the command lists the outputs instead
+	manifest, manifestPath, err := FindOutputManifest(config, dirpath, before)
 	if err != nil {
-		return response, errors.WithStack(err)
+		logger.Println("Ignoring output manifest " + manifestPath + ": " + err.Error())
+		response.AddErrors("Output manifest was ignored: " + err.Error())
+	} else if manifest != nil {
+		logger.Println("Reading outputs listed in " + manifestPath)
+		return errors.WithStack(PackageOutputManifest(ctx, config, logger, presigner, dirpath, manifest, response))
+	}
+	files, err := GetChangedFiles(config, logger, dirpath, before)
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	first := true
+	kept := files[:0]
 	for _, file := range files {
-		var err error
-		filedata, err := HandleOutputFile(file)
+		if !config.KeepJunkFiles && IsJunkFile(filepath.Base(file)) {
+			logger.Println("Ignoring junk file " + file)
+			continue
+		}
+		if !IncludesOutput(config, OutputName(dirpath, file)) {
+			logger.Println("Excluding output file " + file)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	files = kept
+	if config.MaxOutputFiles > 0 && len(files) > config.MaxOutputFiles {
+		return errors.WithStack(TooManyOutputs(ctx, config, logger, presigner, dirpath, files, response))
+	}
+	for _, file := range files {
+		err = PackageOutput(ctx, config, logger, presigner, dirpath, OutputName(dirpath, file), file, response)
 		if err != nil {
-			return response, errors.WithStack(err)
+			return errors.WithStack(err)
 		}
-		if first {
-			first = false
-		} else {
-			response += ",\n"
+	}
+	return nil
+}
+
+// PackageOutputManifest adds the outputs listed in a manifest to the response.
+// Files listed must be in dirpath, and are returned even if they haven't
+// changed.
+func PackageOutputManifest(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, manifest OutputManifest, response *patchwork.CalculationResponse) error {
+	names := manifest.Names()
+	if config.MaxOutputFiles > 0 && len(names) > config.MaxOutputFiles {
+		return errors.New("The manifest lists " + strconv.Itoa(len(names)) + " outputs, more than the maximum of " +
+			strconv.Itoa(config.MaxOutputFiles))
+	}
+	for _, name := range names {
+		entry := manifest[name]
+		if len(entry.File) == 0 {
+			AddOutput(config, logger, response, name, entry.Value)
+			continue
+		}
+		file, err := JoinWithin(dirpath, entry.File)
+		if err != nil {
+			response.AddErrors("Output " + name + " was skipped because " + entry.File + " is outside the outputs")
+			continue
+		}
+		if _, err := os.Lstat(file); err != nil {
+			response.AddErrors("Output " + name + " was skipped because " + entry.File + " was not written")
+			continue
+		}
+		err = PackageOutput(ctx, config, logger, presigner, dirpath, name, file, response)
+		if err != nil {
+			return errors.WithStack(err)
 		}
-		response += "\t\t\"" + filepath.Base(file) + "\": " + filedata
 	}
-	response += "\n\t}\n}"
-	return response, nil
+	return nil
 }
 
-func HandleOutputFile(file string) (string, error) {
-	log.Println("Reading output file " + file)
+// PackageOutput adds an output file, or a directory as an archive, to the
+// response under a name.
+func PackageOutput(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, dirpath string, name string, file string, response *patchwork.CalculationResponse) error {
+	if info, err := os.Lstat(file); err == nil && info.IsDir() {
+		archive, err := ArchiveDirectory(config, logger, dirpath, file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		name += strings.TrimPrefix(filepath.Base(archive), filepath.Base(file))
+		file = archive
+	}
+	file, err := OptimizeImage(config, logger, dirpath, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	reason, err := CheckOutputFile(config, dirpath, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(reason) > 0 {
+		logger.Println("Skipping output file " + file + ": " + reason)
+		response.AddErrors("Output " + name + " was skipped because " + reason)
+		return nil
+	}
+	SliceDatasets(config, logger, name, file, response)
+	ParseSheets(config, logger, name, file, response)
+	outputs, handled, err := HandleOutputWithPlugins(config, logger, dirpath, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if handled {
+		for name, value := range outputs {
+			AddOutput(config, logger, response, name, value)
+		}
+		return nil
+	}
+	filedata, err := HandleOutputFile(ctx, config, logger, presigner, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	AddOutput(config, logger, response, name, filedata)
+	return nil
+}
+
+// HandleOutputFile returns the output value for a file: the content of a
+// JSON file, or an Artefact for anything else.
+func HandleOutputFile(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, file string) (interface{}, error) {
+	logger.Println("Reading output file " + file)
 	if strings.HasSuffix(file, ".json") {
-		data, err := os.ReadFile(file)
+		data, err := ReadOutput(file)
 		if err != nil {
-			return "", errors.WithStack(err)
+			return nil, errors.WithStack(err)
+		}
+		if !json.Valid(data) {
+			logger.Println("Output file " + file + " is not valid JSON")
+			artefact, err := MakeArtefact(ctx, config, logger, presigner, file)
+			return artefact, errors.WithStack(err)
+		}
+		compacted := false
+		if config.JsonPrecision > 0 {
+			rounded, err := CompactJson(data, config.JsonPrecision)
+			if err != nil {
+				logger.Println("Could not compact " + file + ": " + err.Error())
+			} else {
+				data, compacted = rounded, true
+			}
 		}
-		return string(data), nil
+		if config.MaxJsonSize > 0 && len(data) > config.MaxJsonSize {
+			artefact, err := MakeJsonArtefact(ctx, config, logger, presigner, file, data, compacted)
+			return artefact, errors.WithStack(err)
+		}
+		return json.RawMessage(data), nil
 	} else {
-		artefact, err := MakeArtefact(file)
+		if config.CoerceOutputs {
+			if value, ok := CoerceOutputFile(file); ok {
+				logger.Println("Returning output file " + file + " as a value")
+				return value, nil
+			}
+		}
+		artefact, err := MakeArtefact(ctx, config, logger, presigner, file)
 		return artefact, errors.WithStack(err)
 	}
 }
 
-func GetChangedFiles(dirpath string, since time.Time) ([]string, error) {
-	log.Println("Looking for files that have changed since " + since.Format(time.RFC3339))
-	changed := make([]string, 0)
-	files, err := ioutil.ReadDir(dirpath)
+// OutputName is the name of the output for a file in dirpath, its path
+// relative to dirpath.
+func OutputName(dirpath string, file string) string {
+	name, err := filepath.Rel(dirpath, file)
 	if err != nil {
-		return changed, errors.WithStack(err)
+		return filepath.Base(file)
 	}
-	for _, file := range files {
-		log.Println("Checking file " + file.Name() + " changed " + file.ModTime().Format(time.RFC3339))
-		if !file.IsDir() && file.ModTime().After(since) {
-			log.Println("Including file " + file.Name())
-			changed = append(changed, filepath.Join(dirpath, file.Name()))
-		}
+	return filepath.ToSlash(name)
+}
+
+// MakeArtefact returns an artefact for an output file: uploaded to the
+// artefact store or a URL presigned by the host if it is large, otherwise
+// with its content in a data URI. Files of known types are summarised.
+func MakeArtefact(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, path string) (patchwork.Artefact, error) {
+	if config.Encryption != nil {
+		return MakeEncryptedArtefact(ctx, config, logger, presigner, path)
+	}
+	artefact, err := uploadArtefact(ctx, config, logger, presigner, path)
+	if err == nil {
+		err = ChecksumArtefact(&artefact, path)
+	}
+	if err == nil {
+		artefact.Summary = SummariseFile(path, artefact.ContentType)
 	}
-	return changed, errors.WithStack(err)
+	return artefact, err
 }
 
-func SendLogs(host string, token string, calculation string, log string, progress float32) error {
-	req, err := http.NewRequest("POST", host+"/api/calculations/logs/"+calculation+"?progress="+fmt.Sprintf("%f", progress), strings.NewReader(log))
+func uploadArtefact(ctx context.Context, config *Config, logger *log.Logger, presigner *Presigner, path string) (patchwork.Artefact, error) {
+	info, err := os.Stat(path)
 	if err != nil {
-		return errors.WithStack(err)
+		return patchwork.Artefact{}, errors.WithStack(err)
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "text/plain")
-	_, err = http.DefaultClient.Do(req)
-	return errors.WithStack(err)
+	if config.DeferredUploads.Defers(info.Size(), time.Now()) {
+		contentType, err := ArtefactContentType(config, path)
+		if err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+		logger.Println("Deferring upload of " + filepath.Base(path) + " to the transfer window")
+		return patchwork.Artefact{Name: filepath.Base(path), ContentType: contentType, Uri: PendingUri, Path: path}, nil
+	}
+	if len(config.ArtefactStore) > 0 && info.Size() > config.MaxInlineSize {
+		return StoreArtefact(ctx, config, logger, path)
+	}
+	if presigner != nil && config.DeltaUploadSize > 0 && info.Size() > config.DeltaUploadSize {
+		contentType, err := ArtefactContentType(config, path)
+		if err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+		artefact, ok, err := presigner.UploadDelta(ctx, logger, path, contentType)
+		if err != nil || ok {
+			return artefact, errors.WithStack(err)
+		}
+	}
+	if presigner != nil && config.ChunkedUploadSize > 0 && info.Size() > config.ChunkedUploadSize {
+		contentType, err := ArtefactContentType(config, path)
+		if err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+		artefact, ok, err := presigner.UploadChunked(ctx, logger, path, contentType)
+		if err != nil || ok {
+			return artefact, errors.WithStack(err)
+		}
+	}
+	if presigner != nil && config.PresignedUploadSize > 0 && info.Size() > config.PresignedUploadSize {
+		contentType, err := ArtefactContentType(config, path)
+		if err != nil {
+			return patchwork.Artefact{}, errors.WithStack(err)
+		}
+		artefact, ok, err := presigner.Upload(ctx, logger, path, contentType)
+		if err != nil || ok {
+			return artefact, errors.WithStack(err)
+		}
+	}
+	logger.Println("Converting file to Artefact")
+	contentType, err := ArtefactContentType(config, path)
+	if err != nil {
+		return patchwork.Artefact{}, errors.WithStack(err)
+	}
+	logger.Println("Detected content-type of " + contentType)
+	// The content is encoded when the result is, without reading it all
+	// into memory
+	return patchwork.Artefact{Name: filepath.Base(path), ContentType: contentType, Path: path}, nil
 }
 
-func SendResult(host string, token string, calculation string, response string) error {
-	req, err := http.NewRequest("POST",
-		host+"/api/calculations/remote/"+calculation,
-		strings.NewReader(response))
-	if err != nil {
-		return errors.WithStack(err)
+func HandleAsArtefact(ctx context.Context, config *Config, logger *log.Logger, dirpath string, name string, file string, content interface{}) (bool, error) {
+	toexpand, ok := content.(map[string]interface{})
+	if !ok {
+		return false, nil
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
-	if resp.StatusCode != 200 {
-		return errors.New(resp.Status)
+	artefactName, ok1 := toexpand["name"].(string)
+	contentType, ok2 := toexpand["contentType"].(string)
+	uri, ok3 := toexpand["uri"].(string)
+	if ok1 && ok2 && ok3 {
+		artefact := patchwork.Artefact{
+			Name:        artefactName,
+			ContentType: contentType,
+			Uri:         uri,
+		}
+		artefact.Sha256, _ = toexpand["sha256"].(string)
+		if size, ok := toexpand["size"].(float64); ok {
+			artefact.Size = int64(size)
+		}
+		if len(file) > 0 {
+			return true, errors.WithStack(ReadArtefactAs(ctx, config, logger, dirpath, name, file, artefact))
+		}
+		return true, errors.WithStack(ReadArtefact(ctx, config, logger, dirpath, name, artefact))
 	}
-	return errors.WithStack(err)
+	return false, nil
 }
 
-func MakeArtefact(path string) (string, error) {
-	log.Println("Converting file to Artefact")
-	data, err := os.ReadFile(path)
+// ReadArtefact writes an input artefact to the workspace, decoding a data URI
+// or downloading an s3:// or gs:// URI, Azure blob or http(s) URL. Zip and
+// gzipped tar archives are expanded into a directory named after the input,
+// unless KeepInputArchives is set.
+func ReadArtefact(ctx context.Context, config *Config, logger *log.Logger, dirpath string, name string, artefact patchwork.Artefact) error {
+	extension := artefact.Name[strings.LastIndex(artefact.Name, ".")+1:]
+	if !ValidInputName(extension) {
+		return errors.New("Invalid artefact name " + artefact.Name)
+	}
+	return ReadArtefactAs(ctx, config, logger, dirpath, name, name+"."+extension, artefact)
+}
+
+// ReadArtefactAs writes an input artefact to file in the workspace, as
+// ReadArtefact does.
+func ReadArtefactAs(ctx context.Context, config *Config, logger *log.Logger, dirpath string, name string, file string, artefact patchwork.Artefact) error {
+	path, err := JoinWithin(dirpath, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = WriteArtefact(ctx, config, logger, path, artefact)
+	if err == nil {
+		var decrypted bool
+		decrypted, err = DecryptFile(ctx, config, path)
+		if decrypted && err == nil {
+			logger.Println("Decrypted " + file)
+		}
+	}
+	if err != nil || config.KeepInputArchives || !IsArchiveType(artefact.ContentType) {
+		return errors.WithStack(err)
+	}
+	target, err := JoinWithin(dirpath, name)
 	if err != nil {
-		return "", err
+		return errors.WithStack(err)
 	}
-	name := filepath.Base(path)
-	contentType := http.DetectContentType(data)
-	uri := "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
-	log.Println("Detected content-type of " + contentType)
-	uribytes, err := json.Marshal(uri)
+	expanded, err := ExpandArchive(logger, path, artefact.ContentType, target)
 	if err != nil {
-		return "", err
+		return errors.WithStack(err)
+	}
+	if expanded {
+		return errors.WithStack(os.Remove(path))
 	}
-	return "{\"name\": \"" + name + "\", \"contentType\": \"" + contentType + "\", \"uri\": " + string(uribytes) + "}", nil
+	return nil
 }
 
-func HandleAsArtefact(dirpath string, name string, content interface{}) (bool, error) {
-	if content != nil {
-		toexpand := content.(map[string]interface{})
-		if toexpand["name"] != nil && toexpand["uri"] != nil && toexpand["contentType"] != nil {
-			err := ReadArtefact(dirpath, name, Artefact{
-				name:        toexpand["name"].(string),
-				contentType: toexpand["contentType"].(string),
-				uri:         toexpand["uri"].(string),
-			})
-			return true, errors.WithStack(err)
-		}
+// WriteArtefact writes the content of an artefact to a file, checking its
+// size and SHA-256 if the artefact has them.
+func WriteArtefact(ctx context.Context, config *Config, logger *log.Logger, path string, artefact patchwork.Artefact) error {
+	err := writeArtefact(ctx, config, logger, path, artefact)
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	return false, nil
+	return errors.WithStack(VerifyArtefact(path, artefact))
 }
 
-func ReadArtefact(dirpath string, name string, artefact Artefact) error {
-	if !strings.HasPrefix(artefact.uri, "data:") {
-		return errors.New("Not a data URI")
+func writeArtefact(ctx context.Context, config *Config, logger *log.Logger, path string, artefact patchwork.Artefact) error {
+	if strings.HasPrefix(artefact.Uri, "s3://") {
+		location, err := ParseS3Location(artefact.Uri)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		logger.Println("Downloading input file " + path + " from " + artefact.Uri)
+		err = DownloadS3File(ctx, config, location, path)
+		return errors.WithStack(err)
 	}
-	b64 := strings.SplitN(artefact.uri, ",", 2)[1]
-	raw, err := base64.StdEncoding.DecodeString(b64)
+	if strings.HasPrefix(artefact.Uri, "gs://") {
+		location, err := ParseGCSLocation(artefact.Uri)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		logger.Println("Downloading input file " + path + " from " + artefact.Uri)
+		err = DownloadGCSFile(ctx, config, location, path)
+		return errors.WithStack(err)
+	}
+	if IsAzureBlobURL(artefact.Uri) {
+		logger.Println("Downloading input file " + path + " from " + WithoutQuery(artefact.Uri))
+		err := DownloadAzureBlob(ctx, config, artefact.Uri, path)
+		return errors.WithStack(err)
+	}
+	if IsHTTPURL(artefact.Uri) {
+		logger.Println("Downloading input file " + path + " from " + WithoutQuery(artefact.Uri))
+		err := DownloadHTTPFile(ctx, config, artefact.Uri, path)
+		return errors.WithStack(err)
+	}
+	if strings.HasPrefix(artefact.Uri, "ftp://") {
+		logger.Println("Downloading input file " + path + " from " + RedactedUrl(artefact.Uri))
+		err := DownloadFTPFile(ctx, config, artefact.Uri, path)
+		return errors.WithStack(err)
+	}
+	if strings.HasPrefix(artefact.Uri, "sftp://") {
+		logger.Println("Downloading input file " + path + " from " + RedactedUrl(artefact.Uri))
+		err := DownloadSFTPFile(ctx, config, artefact.Uri, path)
+		return errors.WithStack(err)
+	}
+	if len(config.InputCache) > 0 && strings.HasPrefix(artefact.Uri, "data:") {
+		return errors.WithStack(WriteCachedArtefact(ctx, config, logger, path, artefact))
+	}
+	_, content, err := DataUriReader(artefact.Uri)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logger.Println("Writing input file " + path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	extension := artefact.name[strings.LastIndex(artefact.name, ".")+1:]
-	log.Println("Writing input file " + dirpath + "/" + name + "." + extension)
-	err = os.WriteFile(dirpath+"/"+name+"."+extension, raw, os.ModePerm)
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	return errors.WithStack(err)
 }
+
+// ParseDataUri returns the content type and content of an RFC 2397 data URI,
+// which may be base64 or percent encoded.
+func ParseDataUri(uri string) (string, []byte, error) {
+	if !strings.HasPrefix(uri, "data:") {
+		return "", nil, errors.New("Not a data URI")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "data:"), ",", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("Data URI has no content")
+	}
+	contentType := parts[0]
+	if strings.HasSuffix(contentType, ";base64") {
+		raw, err := base64.StdEncoding.DecodeString(parts[1])
+		return strings.TrimSuffix(contentType, ";base64"), raw, errors.WithStack(err)
+	}
+	raw, err := url.PathUnescape(parts[1])
+	return contentType, StringToBytes(raw), errors.WithStack(err)
+}
+
+// DataUriReader returns the content type of an RFC 2397 data URI and a
+// reader of its content, decoded as it is read rather than all at once.
+func DataUriReader(uri string) (string, io.Reader, error) {
+	if !strings.HasPrefix(uri, "data:") {
+		return "", nil, errors.New("Not a data URI")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "data:"), ",", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("Data URI has no content")
+	}
+	contentType := parts[0]
+	if strings.HasSuffix(contentType, ";base64") {
+		return strings.TrimSuffix(contentType, ";base64"), base64.NewDecoder(base64.StdEncoding, strings.NewReader(parts[1])), nil
+	}
+	raw, err := url.PathUnescape(parts[1])
+	return contentType, strings.NewReader(raw), errors.WithStack(err)
+}
+
+// ValidInputName reports whether a name from the calculation context can be
+// used as a file name in the workspace without escaping it.
+func ValidInputName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"patchworkagent/patchwork"
+)
+
+func TestPackageResult(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "input.json"), []byte(`{"length": 2.5}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := SnapshotFiles(&Config{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "results.json"), []byte(`{"mass": 12.5}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "report.txt"), []byte("All good"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := PackageResult(context.Background(), &Config{}, log.Default(), nil, dir, before, "line 1\nline 2\n", "", map[string]interface{}{"maxStress": 412.3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Logs) != 2 || len(response.Errors) != 0 {
+		t.Errorf("Unexpected logs %v and errors %v", response.Logs, response.Errors)
+	}
+	if len(response.Outputs) != 3 {
+		t.Errorf("Unexpected outputs %v", response.Outputs)
+	}
+	if response.Outputs["maxStress"] != 412.3 {
+		t.Errorf("Unexpected maxStress %v", response.Outputs["maxStress"])
+	}
+	if string(response.Outputs["results.json"].(json.RawMessage)) != `{"mass": 12.5}` {
+		t.Errorf("Unexpected results.json %v", response.Outputs["results.json"])
+	}
+	artefact, err := json.Marshal(response.Outputs["report.txt"].(patchwork.Artefact))
+	if err != nil || string(artefact) != `{"name":"report.txt","contentType":"text/plain; charset=utf-8","uri":"data:text/plain; charset=utf-8;base64,QWxsIGdvb2Q=","size":8,"sha256":"9ca4e315b41a79a86182b6acab96fe89b0ceb92cbeb565971866ae8a3c37b4ba"}` {
+		t.Errorf("Unexpected artefact %s", artefact)
+	}
+}
+
+func TestLimitNumClients(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	var errs sync.Map
+	f := func(w http.ResponseWriter, req *http.Request, waitTurn func() error) {
+		if err := waitTurn(); err != nil {
+			errs.Store(req.URL.Path, err)
+			w.WriteHeader(429)
+			return
+		}
+		started <- struct{}{}
+		<-release
+	}
+	serve := func(handler http.HandlerFunc, path string) chan int {
+		code := make(chan int, 1)
+		go func() {
+			recorder := httptest.NewRecorder()
+			handler(recorder, httptest.NewRequest("POST", path, nil))
+			code <- recorder.Code
+		}()
+		return code
+	}
+
+	// By default calculations queue for their turn
+	handler := limitNumClients(f, 1, 0, 0)
+	first := serve(handler, "/first")
+	<-started
+	second, third := serve(handler, "/second"), serve(handler, "/third")
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+	for _, code := range []chan int{first, second, third} {
+		if c := <-code; c != 200 {
+			t.Errorf("Expected queued calculations to run, got %d", c)
+		}
+	}
+
+	// Beyond the outstanding limit they are turned away at once
+	handler = limitNumClients(f, 1, 1, 0)
+	first = serve(handler, "/first")
+	<-started
+	if c := <-serve(handler, "/rejected"); c != 429 {
+		t.Errorf("Expected 429 beyond the outstanding limit, got %d", c)
+	}
+	release <- struct{}{}
+	<-first
+
+	// Or once they have waited too long to start
+	handler = limitNumClients(f, 1, 0, 50*time.Millisecond)
+	first = serve(handler, "/first")
+	<-started
+	if c := <-serve(handler, "/expired"); c != 429 {
+		t.Errorf("Expected 429 after waiting, got %d", c)
+	}
+	if err, _ := errs.Load("/expired"); err != ErrNoWorker {
+		t.Errorf("Expected no worker, got %v", err)
+	}
+	release <- struct{}{}
+	<-first
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// S3Location is an object, or a prefix, given as s3://bucket/key.
+type S3Location struct {
+	Bucket string
+	Key    string
+}
+
+func ParseS3Location(location string) (S3Location, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return S3Location{}, errors.New("Not an s3:// location: " + location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(parts[0]) == 0 {
+		return S3Location{}, errors.New("No bucket in " + location)
+	}
+	s3 := S3Location{Bucket: parts[0]}
+	if len(parts) > 1 {
+		s3.Key = parts[1]
+	}
+	return s3, nil
+}
+
+func (s3 S3Location) String() string {
+	return "s3://" + s3.Bucket + "/" + s3.Key
+}
+
+// URL of the object, path-style at AWS_ENDPOINT_URL if set (for
+// S3-compatible stores), otherwise virtual-hosted at AWS.
+func (s3 S3Location) URL(region string) string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); len(endpoint) > 0 {
+		return strings.TrimSuffix(endpoint, "/") + "/" + s3.Bucket + "/" + awsEscape(s3.Key, false)
+	}
+	return "https://" + s3.Bucket + ".s3." + region + ".amazonaws.com/" + awsEscape(s3.Key, false)
+}
+
+func PutS3Object(ctx context.Context, config *Config, s3 S3Location, body []byte, contentType string) error {
+	response, err := s3Do(ctx, config, "PUT", s3, bytes.NewReader(body), int64(len(body)), sha256Hex(body), contentType)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+func GetS3Object(ctx context.Context, config *Config, s3 S3Location) ([]byte, error) {
+	response, err := s3Do(ctx, config, "GET", s3, nil, 0, sha256Hex(nil), "")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	return data, errors.WithStack(err)
+}
+
+// S3ObjectExists reports whether there is an object at a location.
+func S3ObjectExists(ctx context.Context, config *Config, s3 S3Location) (bool, error) {
+	response, err := s3Do(ctx, config, "HEAD", s3, nil, 0, sha256Hex(nil), "")
+	if err == nil {
+		response.Body.Close()
+	}
+	return exists(err)
+}
+
+// UploadS3File puts a file, whose SHA-256 is payloadHash, in an S3 object
+// without reading it all into memory. A single PUT is limited by S3 to 5 GB.
+func UploadS3File(ctx context.Context, config *Config, s3 S3Location, path string, contentType string, payloadHash string) error {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response, err := s3Do(ctx, config, "PUT", s3, file, info.Size(), payloadHash, contentType)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	response.Body.Close()
+	return nil
+}
+
+// HashFile returns the hex SHA-256 of a file.
+func HashFile(path string) (string, error) {
+	file, err := OpenOutput(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DownloadS3File writes an S3 object to a file without reading it all into
+// memory.
+func DownloadS3File(ctx context.Context, config *Config, s3 S3Location, path string) error {
+	response, err := s3Do(ctx, config, "GET", s3, nil, 0, sha256Hex(nil), "")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(file, response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
+
+// s3Do sends a signed request for an object, returning the response if it
+// succeeded. The caller must close its body.
+func s3Do(ctx context.Context, config *Config, method string, s3 S3Location, body io.Reader, length int64, payloadHash string, contentType string) (*http.Response, error) {
+	creds, err := AWSCredentialsFromEnv()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	objectUrl := s3.URL(creds.Region)
+	parsed, err := url.Parse(objectUrl)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	httpClient, err := ClientFor(config, parsed.Scheme+"://"+parsed.Host)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, objectUrl, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if body != nil {
+		request.ContentLength = length
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	SignAWSRequestWithHash(request, payloadHash, "s3", creds, time.Now())
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if response.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+		return nil, &StorageError{StatusCode: response.StatusCode, Message: method + " " + s3.String() + " failed: " + response.Status + " " + string(message)}
+	}
+	return response, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// configSchema is the JSON schema of the config file, which editors can use
+// too. Only the parts of JSON schema it uses are checked.
+//
+//go:embed config.schema.json
+var configSchema []byte
+
+type Schema struct {
+	Type                 string             `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	Required             []string           `json:"required"`
+}
+
+// ValidateConfigSchema checks a config file against the schema, returning
+// an error listing every field that doesn't match, one per line.
+func ValidateConfigSchema(data []byte) error {
+	var schema Schema
+	if err := json.Unmarshal(configSchema, &schema); err != nil {
+		return errors.WithStack(err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			line, column := position(data, syntax.Offset)
+			return errors.New("line " + strconv.Itoa(line) + " column " + strconv.Itoa(column) + ": " + syntax.Error())
+		}
+		return errors.WithStack(err)
+	}
+	problems := schema.Validate("", value)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// position returns the line and column, from 1, of the byte before an
+// offset, which for a syntax error is the one that was unexpected.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	return line, len(before) - bytes.LastIndexByte(before, '\n') - 1
+}
+
+// Validate returns the problems with a value decoded with UseNumber, each
+// prefixed with the path of the field.
+func (schema *Schema) Validate(path string, value interface{}) []string {
+	problems := make([]string, 0)
+	for _, violation := range schema.Violations(path, value) {
+		problems = append(problems, field(violation.Path)+": "+violation.Message)
+	}
+	return problems
+}
+
+// Violations returns the problems with a value decoded with UseNumber, at the
+// paths of the fields without a leading dot. Null is valid for any type, as
+// it is for the Go decoder.
+func (schema *Schema) Violations(path string, value interface{}) []patchwork.Violation {
+	problems := make([]patchwork.Violation, 0)
+	problem := func(path string, message string) {
+		problems = append(problems, patchwork.Violation{Path: strings.TrimPrefix(path, "."), Message: message})
+	}
+	if value == nil {
+		return problems
+	}
+	if !schema.matchesType(value) {
+		problem(path, "expected "+article(schema.Type)+", got "+describe(value))
+		return problems
+	}
+	if len(schema.Enum) > 0 && !schema.allows(value) {
+		allowed := make([]string, len(schema.Enum))
+		for i, option := range schema.Enum {
+			allowed[i] = describe(option)
+		}
+		message := describe(value) + " is not one of " + strings.Join(allowed, ", ")
+		if s, ok := value.(string); ok {
+			options := make([]string, 0)
+			for _, option := range schema.Enum {
+				if o, ok := option.(string); ok {
+					options = append(options, o)
+				}
+			}
+			message += didYouMean(s, options)
+		}
+		problem(path, message)
+	}
+	if number, ok := value.(json.Number); ok {
+		f, err := number.Float64()
+		if err == nil && schema.Minimum != nil && f < *schema.Minimum {
+			problem(path, number.String()+" is less than the minimum of "+strconv.FormatFloat(*schema.Minimum, 'f', -1, 64))
+		}
+		if err == nil && schema.Maximum != nil && f > *schema.Maximum {
+			problem(path, number.String()+" is more than the maximum of "+strconv.FormatFloat(*schema.Maximum, 'f', -1, 64))
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		known := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			known = append(known, name)
+		}
+		sort.Strings(known)
+		additional, closed := schema.additional()
+		for _, name := range schema.Required {
+			if _, ok := v[name]; !ok {
+				problem(path+"."+name, "missing")
+			}
+		}
+		for _, name := range names {
+			child := path + "." + name
+			if property, ok := schema.Properties[name]; ok {
+				problems = append(problems, property.Violations(child, v[name])...)
+			} else if additional != nil {
+				problems = append(problems, additional.Violations(child, v[name])...)
+			} else if closed {
+				problem(child, "unknown field"+didYouMean(name, known))
+			}
+		}
+	case []interface{}:
+		if schema.Items != nil {
+			for i, item := range v {
+				problems = append(problems, schema.Items.Violations(path+"["+strconv.Itoa(i)+"]", item)...)
+			}
+		}
+	}
+	return problems
+}
+
+// additional returns the schema of properties not listed, or whether they
+// aren't allowed at all.
+func (schema *Schema) additional() (*Schema, bool) {
+	raw := bytes.TrimSpace(schema.AdditionalProperties)
+	if string(raw) == "false" {
+		return nil, true
+	}
+	if len(raw) > 0 && raw[0] == '{' {
+		var additional Schema
+		if json.Unmarshal(raw, &additional) == nil {
+			return &additional, false
+		}
+	}
+	return nil, false
+}
+
+func (schema *Schema) matchesType(value interface{}) bool {
+	switch schema.Type {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := strconv.ParseInt(number.String(), 10, 64)
+		return err == nil
+	}
+	return true
+}
+
+func (schema *Schema) allows(value interface{}) bool {
+	for _, option := range schema.Enum {
+		if describe(option) == describe(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func field(path string) string {
+	path = strings.TrimPrefix(path, ".")
+	if len(path) == 0 {
+		return "config"
+	}
+	return path
+}
+
+func article(typeName string) string {
+	if strings.ContainsAny(typeName[:1], "aeiou") {
+		return "an " + typeName
+	}
+	return "a " + typeName
+}
+
+// describe returns a value as it would be written in JSON, for messages.
+func describe(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case json.Number:
+		return "number " + v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	}
+	return "null"
+}
+
+// didYouMean suggests the closest of the names to a misspelt one, if any is
+// close enough to be a typo.
+func didYouMean(name string, names []string) string {
+	best := ""
+	bestDistance := len(name)/3 + 1
+	for _, candidate := range names {
+		distance := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if distance < bestDistance {
+			best = candidate
+			bestDistance = distance
+		}
+	}
+	if len(best) == 0 {
+		return ""
+	}
+	return ", did you mean " + strconv.Quote(best) + "?"
+}
+
+// editDistance is the Levenshtein distance between two strings.
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigSchemaErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+  "outputRules": [{"name": "maxStress", "regx": "([0-9.]+)"}],
+  "maxWait": "30",
+  "outputOverflow": "tarr",
+  "seperateOutputs": true,
+  "prefetch": -1
+}`), 0644)
+	_, err := LoadConfig(path)
+	if err == nil {
+		t.Fatal("Expected the config to be rejected")
+	}
+	for _, expected := range []string{
+		`outputRules[0].regx: unknown field, did you mean "regex"?`,
+		`maxWait: expected an integer, got "30"`,
+		`outputOverflow: "tarr" is not one of "", "fail", "tar", did you mean "tar"?`,
+		`seperateOutputs: unknown field, did you mean "separateOutputs"?`,
+		`prefetch: -1 is less than the minimum of 0`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %s in:\n%s", expected, err.Error())
+		}
+	}
+
+	os.WriteFile(path, []byte("{\n  \"maxWait\": 30,\n  \"agentId\" \"a\"\n}"), 0644)
+	_, err = LoadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "line 3 column 13") {
+		t.Errorf("Expected the position of the syntax error, got %v", err)
+	}
+}
+
+// The schema must describe every field of the config, or it would be
+// rejected as unknown.
+func TestConfigSchemaComplete(t *testing.T) {
+	var schema Schema
+	if err := json.Unmarshal(configSchema, &schema); err != nil {
+		t.Fatal(err)
+	}
+	checkSchemaFields(t, "config", &schema, reflect.TypeOf(Config{}))
+}
+
+func checkSchemaFields(t *testing.T, path string, schema *Schema, typ reflect.Type) {
+	for typ.Kind() == reflect.Ptr || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+		if schema.Type == "array" {
+			schema = schema.Items
+		}
+	}
+	if typ.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) == 0 || name == "-" {
+			continue
+		}
+		property, ok := schema.Properties[name]
+		if !ok {
+			t.Errorf("%s.%s is missing from the schema", path, name)
+			continue
+		}
+		checkSchemaFields(t, path+"."+name, property, typ.Field(i).Type)
+	}
+}
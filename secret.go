@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// SecretValue returns the value of a secret input, one given as
+// {"secret": true, "value": ...}, which is passed to the command in an
+// environment variable rather than written to the workspace. Values other
+// than strings are passed as JSON.
+func SecretValue(content interface{}) (string, bool) {
+	input, ok := content.(map[string]interface{})
+	if !ok || input["secret"] != true {
+		return "", false
+	}
+	if value, ok := input["value"].(string); ok {
+		return value, true
+	}
+	data, err := json.Marshal(input["value"])
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// SecretEnvName is the environment variable a secret input is passed in: its
+// name in upper case, with anything but letters, digits and underscores
+// replaced by underscores.
+func SecretEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// SecretInputs returns the secret inputs of a calculation by the environment
+// variables they are passed in.
+func SecretInputs(inputs map[string]interface{}) map[string]string {
+	secrets := make(map[string]string)
+	for name, content := range inputs {
+		if value, ok := SecretValue(content); ok {
+			secrets[SecretEnvName(name)] = value
+		}
+	}
+	return secrets
+}
+
+// SecretRedactor replaces the values of secrets in the output of a command,
+// so that a command echoing one doesn't leak it into logs.
+func SecretRedactor(secrets map[string]string) *strings.Replacer {
+	pairs := make([]string, 0, 2*len(secrets))
+	for _, value := range secrets {
+		if len(value) > 0 {
+			pairs = append(pairs, value, "[secret]")
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+func TestSecretInputs(t *testing.T) {
+	dir := t.TempDir()
+	calcContext := patchwork.CalculationContext{Inputs: map[string]interface{}{
+		"license-key": map[string]interface{}{"secret": true, "value": "hunter2"},
+		"length":      2.5,
+	}}
+	if err := ExpandContext(context.Background(), &Config{}, log.Default(), dir, calcContext); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "license-key.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the secret not to be written to the workspace")
+	}
+	var stdout, stderr bytes.Buffer
+	code, _ := RunCommand(context.Background(), &Config{}, log.Default(), "", `echo "key $LICENSE_KEY"; cat length.json; echo $LICENSE_KEY >&2`,
+		dir, "", "", SecretInputs(calcContext.Inputs), &stdout, &stderr)
+	if code != 0 {
+		t.Fatalf("Unexpected exit code %d: %s", code, stderr.String())
+	}
+	if stdout.String() != "key [secret]\n2.5" || strings.TrimSpace(stderr.String()) != "[secret]" {
+		t.Errorf("Expected the secret redacted, got %q and %q", stdout.String(), stderr.String())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// SelfTest is a smoke-test calculation run when the server starts, so that a
+// broken solver install is caught before any real work is accepted. Inputs
+// are expanded like the inputs of a calculation context, the command (the
+// calculation command if empty) must exit with 0, its stdout must match
+// Expect if set, and each of Outputs must have been written.
+type SelfTest struct {
+	Command string                 `json:"command"`
+	Inputs  map[string]interface{} `json:"inputs"`
+	Expect  string                 `json:"expect"`
+	Outputs []string               `json:"outputs"`
+	Timeout int                    `json:"timeout"`
+}
+
+func RunSelfTest(config *Config, command string, dirpath string) error {
+	test := config.SelfTest
+	if len(test.Command) > 0 {
+		command = test.Command
+	}
+	timeout := test.Timeout
+	if timeout <= 0 {
+		timeout = 300
+	}
+	log.Println("Running self-test " + command)
+	dir, err := ioutil.TempDir(dirpath, "selftest")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+	// The timeout covers fetching the inputs too
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+	defer cancel()
+	err = PrepareWorkspace(config, dir)
+	if err == nil {
+		err = ExpandContext(ctx, config, log.Default(), InputsDir(config, dir), patchwork.CalculationContext{Inputs: test.Inputs})
+	}
+	if err == nil {
+		err = SetInputsReadOnly(config, dir, true)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Self-test inputs could not be expanded")
+	}
+	defer SetInputsReadOnly(config, dir, false)
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	exitCode, _ := RunCommand(ctx, config, log.Default(), "", command, dir, "", "", SecretInputs(test.Inputs), &stdoutBuf, &stderrBuf)
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("Self-test timed out after " + strconv.Itoa(timeout) + "s")
+	}
+	if exitCode != 0 {
+		return errors.New("Self-test exited with " + strconv.Itoa(exitCode) + ": " + stderrBuf.String())
+	}
+	if len(test.Expect) > 0 {
+		matched, err := regexp.MatchString(test.Expect, stdoutBuf.String())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !matched {
+			return errors.New("Self-test output did not match " + test.Expect)
+		}
+	}
+	for _, output := range test.Outputs {
+		if _, err := os.Stat(filepath.Join(OutputsDir(config, dir), output)); err != nil {
+			return errors.New("Self-test did not write " + output)
+		}
+	}
+	log.Println("Self-test passed")
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// SessionFile is saved in the workspace of a failed calculation that is
+// kept, for it to be inspected.
+const SessionFile = ".session.json"
+
+// Session is how the command of a failed calculation was run: in its
+// workspace, with the variables in Env. The token and the values of Secrets
+// aren't saved.
+type Session struct {
+	Calculation string   `json:"calculation"`
+	Type        string   `json:"type"`
+	Command     string   `json:"command"`
+	Env         []string `json:"env"`
+	Secrets     []string `json:"secrets"`
+	ExitCode    int      `json:"exitCode"`
+	TimedOut    bool     `json:"timedOut"`
+}
+
+// SaveSession saves the session of a failed calculation in its workspace.
+func SaveSession(config *Config, dirpath string, session Session, host string, secrets map[string]string) error {
+	execution := NewExecution(config, session.Command, dirpath, host, "", nil)
+	session.Command = execution.Command
+	for _, variable := range execution.Env {
+		if variable != "TOKEN=" {
+			session.Env = append(session.Env, variable)
+		}
+	}
+	for name := range secrets {
+		session.Secrets = append(session.Secrets, name)
+	}
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(filepath.Join(dirpath, SessionFile), data, 0600))
+}
+
+// FindSession finds the kept workspace of a failed calculation in dirpath,
+// by the id of the calculation or the path of the workspace.
+func FindSession(dirpath string, job string) (string, Session, error) {
+	candidates := []string{job}
+	if !filepath.IsAbs(job) {
+		workspaces, _ := filepath.Glob(filepath.Join(dirpath, "calc*"))
+		candidates = append(append(candidates, filepath.Join(dirpath, job)), workspaces...)
+	}
+	for _, workspace := range candidates {
+		var session Session
+		data, err := os.ReadFile(filepath.Join(workspace, SessionFile))
+		if err != nil || json.Unmarshal(data, &session) != nil {
+			continue
+		}
+		if workspace == job || workspace == filepath.Join(dirpath, job) || session.Calculation == job {
+			return workspace, session, nil
+		}
+	}
+	return "", Session{}, errors.New("No kept workspace of a failed calculation " + strconv.Quote(job) + " in " + dirpath)
+}
+
+// Inspect opens an interactive shell in the kept workspace of a failed
+// calculation, with the variables its command was run with.
+func Inspect(out io.Writer, dirpath string, job string) error {
+	workspace, session, err := FindSession(dirpath, job)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Calculation "+session.Calculation+" of type "+session.Type)
+	if session.TimedOut {
+		fmt.Fprintln(out, "Timed out running: "+session.Command)
+	} else {
+		fmt.Fprintln(out, "Exited with "+strconv.Itoa(session.ExitCode)+" running: "+session.Command)
+	}
+	for _, secret := range session.Secrets {
+		if _, ok := os.LookupEnv(secret); !ok {
+			fmt.Fprintln(out, "Secret "+secret+" isn't set, as it wasn't saved")
+		}
+	}
+	fmt.Fprintln(out, "Opening a shell in "+workspace+"; run $PATCHWORK_COMMAND to run the command again")
+	shell := os.Getenv("SHELL")
+	if runtime.GOOS == "windows" {
+		shell = "cmd"
+	} else if len(shell) == 0 {
+		shell = "bash"
+	}
+	cmd := exec.Command(shell)
+	cmd.Dir = workspace
+	cmd.Env = append(append(os.Environ(), session.Env...), "PATCHWORK_COMMAND="+session.Command)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		// How the shell exited is up to the user
+		return nil
+	}
+	return errors.WithStack(err)
+}
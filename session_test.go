@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestKeepFailedWorkspace(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "failing-command", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := NewStubHost(t, "failing-command", calcContext)
+	defer server.Close()
+	dirpath := t.TempDir()
+	workspace, _ := os.MkdirTemp(dirpath, "calc")
+	job := &Job{Host: server.URL, Token: "token", Calculation: "failing-command", Dir: workspace, Timeout: 60}
+	err = RunCalculation(context.Background(), &Config{KeepFailedWorkspaces: true}, HelperCommand(t, "failing-command"), job)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !job.Keep {
+		t.Fatal("Expected the workspace to be kept")
+	}
+
+	// It is found by the calculation or its path, without the token
+	for _, name := range []string{"failing-command", workspace, filepath.Base(workspace)} {
+		found, session, err := FindSession(dirpath, name)
+		if err != nil || found != workspace || session.ExitCode != 3 {
+			t.Errorf("%s: unexpected %s %+v %v", name, found, session, err)
+		}
+		if strings.Contains(strings.Join(session.Env, " "), "TOKEN") || !strings.Contains(strings.Join(session.Env, " "), "WORKSPACE="+workspace) {
+			t.Errorf("Unexpected environment %v", session.Env)
+		}
+	}
+	if _, _, err := FindSession(dirpath, "other"); err == nil {
+		t.Error("Expected no session for another calculation")
+	}
+	ReconcileWorkspaces(context.Background(), &Config{}, dirpath, server.URL, "token")
+	if _, err := os.Stat(workspace); err != nil {
+		t.Error("Expected the kept workspace to be left by reconciling")
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	shell := filepath.Join(t.TempDir(), "shell")
+	os.WriteFile(shell, []byte("#!/bin/sh\necho \"$PWD|$WORKSPACE|$PATCHWORK_COMMAND\" > \"$OUT\"\nexit 1\n"), 0755)
+	t.Setenv("SHELL", shell)
+	t.Setenv("OUT", filepath.Join(t.TempDir(), "out"))
+	var out bytes.Buffer
+	if err := Inspect(&out, dirpath, "failing-command"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !strings.Contains(out.String(), "Exited with 3") {
+		t.Errorf("Unexpected %s", out.String())
+	}
+	data, _ := os.ReadFile(os.Getenv("OUT"))
+	resolved, _ := filepath.EvalSymlinks(workspace)
+	if parts := strings.Split(strings.TrimSpace(string(data)), "|"); len(parts) != 3 || (parts[0] != workspace && parts[0] != resolved) || parts[1] != workspace || len(parts[2]) == 0 {
+		t.Errorf("Unexpected shell environment %s", data)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SftpPasswordEnv passes the password of an sftp:// URL to the askpass script
+// that gives it to ssh.
+const SftpPasswordEnv = "PATCHWORK_SFTP_PASSWORD"
+
+// DownloadSFTPFile fetches a file from an SFTP server to a file with the
+// OpenSSH sftp client, logged in as the user of the URL or of a matching
+// artefactAuth, with its password or private key. The server must be in the
+// known hosts, as sftp never prompts.
+func DownloadSFTPFile(ctx context.Context, config *Config, fileUrl string, path string) error {
+	parsed, err := url.Parse(fileUrl)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Paths are absolute, or relative to the home directory after /~/
+	file := parsed.Path
+	if strings.HasPrefix(file, "/~/") {
+		file = file[3:]
+	}
+	if len(strings.Trim(file, "/")) == 0 || strings.ContainsAny(file, "\r\n\x00") {
+		return errors.New("Invalid file in " + parsed.Redacted())
+	}
+	host := parsed.Hostname()
+	if len(host) == 0 || strings.HasPrefix(host, "-") {
+		return errors.New("Invalid host in " + parsed.Redacted())
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	user, password, auth := ftpCredentials(config, parsed)
+	if len(user) > 0 {
+		host = user + "@" + host
+	}
+	var args []string
+	env := os.Environ()
+	if len(password) > 0 {
+		// ssh reads passwords from a terminal, or from SSH_ASKPASS if forced
+		askpass, err := writeAskpass()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer os.RemoveAll(filepath.Dir(askpass))
+		env = append(env, SftpPasswordEnv+"="+password, "SSH_ASKPASS="+askpass, "SSH_ASKPASS_REQUIRE=force")
+		args = append(args, "-o", "BatchMode=no", "-o", "NumberOfPasswordPrompts=1")
+	}
+	if len(auth.PrivateKey) > 0 {
+		args = append(args, "-i", auth.PrivateKey, "-o", "IdentitiesOnly=yes")
+	}
+	if len(auth.KnownHosts) > 0 {
+		args = append(args, "-o", "UserKnownHostsFile="+auth.KnownHosts)
+	}
+	if len(parsed.Port()) > 0 {
+		args = append(args, "-P", parsed.Port())
+	}
+	args = append(args, "-b", "-", "--", host)
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader("get " + sftpQuote(file) + " " + sftpQuote(path) + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("Could not download " + parsed.Redacted() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// sftpQuote quotes a path for an sftp batch file.
+func sftpQuote(path string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(path) + `"`
+}
+
+// writeAskpass writes a script, in a directory of its own, that prints the
+// password in SftpPasswordEnv for ssh.
+func writeAskpass() (string, error) {
+	dir, err := os.MkdirTemp("", "askpass")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if runtime.GOOS == "windows" {
+		script := filepath.Join(dir, "askpass.cmd")
+		err = os.WriteFile(script, []byte("@echo off\r\nsetlocal EnableDelayedExpansion\r\necho !"+SftpPasswordEnv+"!\r\n"), 0700)
+		return script, errors.WithStack(err)
+	}
+	script := filepath.Join(dir, "askpass")
+	err = os.WriteFile(script, []byte("#!/bin/sh\nprintf '%s\\n' \"$"+SftpPasswordEnv+"\"\n"), 0700)
+	return script, errors.WithStack(err)
+}
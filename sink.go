@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"patchworkagent/patchwork"
+	"patchworkagent/patchworkclient"
+
+	"github.com/pkg/errors"
+)
+
+// ResultSink receives the progress and result of a calculation. By default
+// this is the Patchwork API of the calculation's host, but results can
+// instead be written to files, stdout or object storage for pipelines that
+// don't post back to a Patchwork server.
+type ResultSink interface {
+	SendLogs(ctx context.Context, calculation string, logs string, progress float32) error
+	SendResult(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error
+	// SendResultFile sends a result encoded in a file, without reading it
+	// all into memory.
+	SendResultFile(ctx context.Context, calculation string, path string) error
+}
+
+// NewResultSink returns the sink configured with resultSink: "patchwork" (or
+// empty) for the host's API, "stdout", "file:<path>" or "s3://bucket/key".
+// In a path or key, {calculation} is replaced by the calculation id; without
+// it, the path or key is a directory or prefix holding <calculation>.json.
+func NewResultSink(config *Config, logger *log.Logger, host string, token string) (ResultSink, error) {
+	sink := config.ResultSink
+	switch {
+	case len(sink) == 0 || sink == "patchwork":
+		client, err := NewClient(config, logger, host, token)
+		return client, errors.WithStack(err)
+	case sink == "stdout":
+		return &StdoutSink{}, nil
+	case strings.HasPrefix(sink, "file:"):
+		return &FileSink{Path: strings.TrimPrefix(sink, "file:")}, nil
+	case strings.HasPrefix(sink, "s3://"):
+		location, err := ParseS3Location(sink)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &S3Sink{Config: config, Location: location}, nil
+	default:
+		return nil, errors.New("Unknown result sink " + sink)
+	}
+}
+
+// ValidateResultSink checks the configured sink without connecting to it.
+func ValidateResultSink(config *Config) error {
+	sink := config.ResultSink
+	if len(sink) == 0 || sink == "patchwork" || sink == "stdout" ||
+		(strings.HasPrefix(sink, "file:") && len(sink) > len("file:")) {
+		return nil
+	}
+	if strings.HasPrefix(sink, "s3://") {
+		_, err := ParseS3Location(sink)
+		return errors.WithStack(err)
+	}
+	return errors.New("Unknown result sink " + sink)
+}
+
+// CalculationPath substitutes the calculation id into the path or key of a
+// sink or source.
+func CalculationPath(path string, calculation string, separator string) string {
+	if strings.Contains(path, "{calculation}") {
+		return strings.ReplaceAll(path, "{calculation}", calculation)
+	}
+	if len(path) > 0 && !strings.HasSuffix(path, separator) {
+		path += separator
+	}
+	return path + calculation + ".json"
+}
+
+type StdoutSink struct {
+	mutex sync.Mutex
+}
+
+func (sink *StdoutSink) SendLogs(ctx context.Context, calculation string, logs string, progress float32) error {
+	return nil
+}
+
+// SendResult writes the result as one line of JSON, with the calculation id.
+func (sink *StdoutSink) SendResult(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	data, err := json.Marshal(map[string]interface{}{"calculation": calculation, "result": response})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return errors.WithStack(err)
+}
+
+func (sink *StdoutSink) SendResultFile(ctx context.Context, calculation string, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	id, err := json.Marshal(calculation)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	_, err = io.WriteString(os.Stdout, `{"calculation":`+string(id)+`,"result":`)
+	if err == nil {
+		_, err = io.Copy(os.Stdout, file)
+	}
+	if err == nil {
+		_, err = io.WriteString(os.Stdout, "}\n")
+	}
+	return errors.WithStack(err)
+}
+
+type FileSink struct {
+	Path string
+}
+
+func (sink *FileSink) SendLogs(ctx context.Context, calculation string, logs string, progress float32) error {
+	return nil
+}
+
+func (sink *FileSink) SendResult(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !ValidInputName(calculation) {
+		return errors.New("Invalid calculation id " + calculation)
+	}
+	path := CalculationPath(sink.Path, calculation, string(filepath.Separator))
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(path, data, 0644))
+}
+
+func (sink *FileSink) SendResultFile(ctx context.Context, calculation string, path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer source.Close()
+	if !ValidInputName(calculation) {
+		return errors.New("Invalid calculation id " + calculation)
+	}
+	target := CalculationPath(sink.Path, calculation, string(filepath.Separator))
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	file, err := os.Create(target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(file, source)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
+
+type S3Sink struct {
+	Config   *Config
+	Location S3Location
+}
+
+func (sink *S3Sink) SendLogs(ctx context.Context, calculation string, logs string, progress float32) error {
+	return nil
+}
+
+func (sink *S3Sink) SendResult(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	location := S3Location{Bucket: sink.Location.Bucket, Key: CalculationPath(sink.Location.Key, calculation, "/")}
+	return errors.WithStack(PutS3Object(ctx, sink.Config, location, data, "application/json"))
+}
+
+func (sink *S3Sink) SendResultFile(ctx context.Context, calculation string, path string) error {
+	hash, err := HashFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	location := S3Location{Bucket: sink.Location.Bucket, Key: CalculationPath(sink.Location.Key, calculation, "/")}
+	return errors.WithStack(UploadS3File(ctx, sink.Config, location, path, "application/json", hash))
+}
+
+// CallbackSink posts the result of a calculation to the callback given in its
+// payload, and everything else to the configured sink.
+type CallbackSink struct {
+	ResultSink
+	Client *patchworkclient.Client
+}
+
+func NewCallbackSink(config *Config, logger *log.Logger, sink ResultSink, callback *patchwork.Callback) (*CallbackSink, error) {
+	client, err := NewClient(config, logger, callback.Url, "")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	client.ResultURL = callback.Url
+	if len(callback.Authorization) > 0 {
+		client.Header.Set("Authorization", callback.Authorization)
+	}
+	return &CallbackSink{ResultSink: sink, Client: client}, nil
+}
+
+func (sink *CallbackSink) SendResult(ctx context.Context, calculation string, response *patchwork.CalculationResponse) error {
+	return errors.WithStack(sink.Client.SendResult(ctx, calculation, response))
+}
+
+func (sink *CallbackSink) SendResultFile(ctx context.Context, calculation string, path string) error {
+	return errors.WithStack(sink.Client.SendResultFile(ctx, calculation, path))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Snapshot is the state of the files in a directory and its subdirectories
+// before a calculation runs, by their paths relative to it.
+type Snapshot map[string]FileState
+
+// FileState is when a file was last modified and, with OutputDetection
+// "hash" or DedupeInputs, the SHA-256 of its content. Those of a directory
+// are the latest of anything in it and a hash of the names and hashes of its
+// entries.
+type FileState struct {
+	ModTime time.Time
+	Hash    string
+}
+
+// SnapshotFiles records the state of the files in dirpath, so that the files
+// written or changed since can be found by GetChangedFiles.
+func SnapshotFiles(config *Config, dirpath string) (Snapshot, error) {
+	snapshot := make(Snapshot)
+	_, err := snapshotDir(config, dirpath, "", snapshot)
+	return snapshot, errors.WithStack(err)
+}
+
+// snapshotDir records the files in dir, whose names start with prefix, and
+// returns the state of dir from them.
+func snapshotDir(config *Config, dir string, prefix string, snapshot Snapshot) (FileState, error) {
+	var state FileState
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return state, errors.WithStack(err)
+	}
+	hashes := make([]string, 0, len(files))
+	for _, file := range files {
+		name := prefix + file.Name()
+		path := filepath.Join(dir, file.Name())
+		var entry FileState
+		if file.IsDir() {
+			entry, err = snapshotDir(config, path, name+"/", snapshot)
+			if file.ModTime().After(entry.ModTime) {
+				entry.ModTime = file.ModTime()
+			}
+		} else {
+			entry.ModTime = file.ModTime()
+			if config.hashesFiles() {
+				entry.Hash, err = hashEntry(path, file)
+			}
+		}
+		if err != nil {
+			return state, err
+		}
+		snapshot[name] = entry
+		hashes = append(hashes, file.Name()+"\x00"+entry.Hash)
+		if entry.ModTime.After(state.ModTime) {
+			state.ModTime = entry.ModTime
+		}
+	}
+	if config.hashesFiles() {
+		state.Hash = treeHash(hashes)
+	}
+	return state, nil
+}
+
+// fileState returns the state of a file or directory, as it was recorded
+// by SnapshotFiles.
+func fileState(config *Config, path string, info os.FileInfo) (FileState, error) {
+	if info.IsDir() {
+		return snapshotDir(config, path, "", make(Snapshot))
+	}
+	state := FileState{ModTime: info.ModTime()}
+	if !config.hashesFiles() {
+		return state, nil
+	}
+	hash, err := hashEntry(path, info)
+	state.Hash = hash
+	return state, err
+}
+
+func (config *Config) hashesFiles() bool {
+	return config.OutputDetection == "hash" || config.DedupeInputs
+}
+
+// hashEntry returns the SHA-256 of a regular file, or of where a symbolic
+// link points. Anything else, which may block if it is read, has no hash.
+func hashEntry(path string, info os.FileInfo) (string, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return treeHash([]string{"->" + target}), nil
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil
+	}
+	return HashFile(path)
+}
+
+func treeHash(entries []string) string {
+	hash := sha256.New()
+	for _, entry := range entries {
+		hash.Write([]byte(entry + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Changed reports whether a file has changed since it was in the state
+// before, by its hash with OutputDetection "hash" or else when it was
+// modified.
+func (state FileState) Changed(config *Config, before FileState) bool {
+	if config.OutputDetection == "hash" {
+		return state.Hash != before.Hash
+	}
+	return !state.ModTime.Equal(before.ModTime)
+}
+
+// GetChangedFiles returns the files in dirpath written or changed since the
+// snapshot before, looking OutputDepth levels into subdirectories. Deeper
+// directories are returned too if they are returned as archives. With
+// DedupeInputs, files identical to one in the snapshot, such as an input
+// whose modification time was bumped, aren't returned.
+func GetChangedFiles(config *Config, logger *log.Logger, dirpath string, before Snapshot) ([]string, error) {
+	logger.Println("Looking for files that have changed")
+	var existing map[string]bool
+	if config.DedupeInputs {
+		existing = make(map[string]bool)
+		for _, state := range before {
+			existing[state.Hash] = true
+		}
+	}
+	changed, err := getChangedFiles(config, logger, dirpath, "", 0, before, existing, make([]string, 0))
+	return changed, errors.WithStack(err)
+}
+
+func getChangedFiles(config *Config, logger *log.Logger, dir string, prefix string, depth int, before Snapshot, existing map[string]bool, changed []string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return changed, errors.WithStack(err)
+	}
+	for _, file := range files {
+		name := prefix + file.Name()
+		path := filepath.Join(dir, file.Name())
+		if file.IsDir() && depth < config.OutputDepth {
+			changed, err = getChangedFiles(config, logger, path, name+"/", depth+1, before, existing, changed)
+			if err != nil {
+				return changed, err
+			}
+			continue
+		}
+		if file.IsDir() && len(config.DirectoryOutputs) == 0 {
+			continue
+		}
+		state, err := fileState(config, path, file)
+		if err != nil {
+			return changed, err
+		}
+		logger.Println("Checking file " + name + " changed " + state.ModTime.Format(time.RFC3339))
+		previous, existed := before[name]
+		if !existed || state.Changed(config, previous) {
+			// Empty files are all alike, so are always returned
+			if len(state.Hash) > 0 && existing[state.Hash] && (file.IsDir() || file.Size() > 0) {
+				logger.Println("Excluding file " + name + " as it is identical to an input")
+				continue
+			}
+			logger.Println("Including file " + name)
+			changed = append(changed, path)
+		}
+	}
+	return changed, nil
+}
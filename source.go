@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// ContextSource provides the context of a calculation. By default this is
+// the Patchwork API of the calculation's host, but contexts can instead be
+// read from files or object storage, or carried in the dispatch payload.
+type ContextSource interface {
+	GetContext(ctx context.Context, calculation string) (patchwork.CalculationContext, error)
+}
+
+// NewContextSource returns the source configured with contextSource:
+// "patchwork" (or empty) for the host's API, "file:<path>" or
+// "s3://bucket/key", with {calculation} substituted as for result sinks.
+func NewContextSource(config *Config, logger *log.Logger, host string, token string) (ContextSource, error) {
+	source := config.ContextSource
+	switch {
+	case len(source) == 0 || source == "patchwork":
+		client, err := NewClient(config, logger, host, token)
+		return client, errors.WithStack(err)
+	case strings.HasPrefix(source, "file:"):
+		return &FileSource{Path: strings.TrimPrefix(source, "file:")}, nil
+	case strings.HasPrefix(source, "s3://"):
+		location, err := ParseS3Location(source)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return &S3Source{Config: config, Location: location}, nil
+	default:
+		return nil, errors.New("Unknown context source " + source)
+	}
+}
+
+// ValidateContextSource checks the configured source without connecting to
+// it.
+func ValidateContextSource(config *Config) error {
+	source := config.ContextSource
+	if len(source) == 0 || source == "patchwork" ||
+		(strings.HasPrefix(source, "file:") && len(source) > len("file:")) {
+		return nil
+	}
+	if strings.HasPrefix(source, "s3://") {
+		_, err := ParseS3Location(source)
+		return errors.WithStack(err)
+	}
+	return errors.New("Unknown context source " + source)
+}
+
+// EmbeddedSource is the context carried in the payload that dispatched the
+// calculation.
+type EmbeddedSource struct {
+	Context patchwork.CalculationContext
+}
+
+func (source *EmbeddedSource) GetContext(ctx context.Context, calculation string) (patchwork.CalculationContext, error) {
+	return source.Context, nil
+}
+
+type FileSource struct {
+	Path string
+}
+
+func (source *FileSource) GetContext(ctx context.Context, calculation string) (patchwork.CalculationContext, error) {
+	var calcContext patchwork.CalculationContext
+	if !ValidInputName(calculation) {
+		return calcContext, errors.New("Invalid calculation id " + calculation)
+	}
+	data, err := os.ReadFile(CalculationPath(source.Path, calculation, string(filepath.Separator)))
+	if err != nil {
+		return calcContext, errors.WithStack(err)
+	}
+	err = json.Unmarshal(data, &calcContext)
+	return calcContext, errors.WithStack(err)
+}
+
+type S3Source struct {
+	Config   *Config
+	Location S3Location
+}
+
+func (source *S3Source) GetContext(ctx context.Context, calculation string) (patchwork.CalculationContext, error) {
+	var calcContext patchwork.CalculationContext
+	location := S3Location{Bucket: source.Location.Bucket, Key: CalculationPath(source.Location.Key, calculation, "/")}
+	data, err := GetS3Object(ctx, source.Config, location)
+	if err != nil {
+		return calcContext, errors.WithStack(err)
+	}
+	err = json.Unmarshal(data, &calcContext)
+	return calcContext, errors.WithStack(err)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSource(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "calc1.json"), []byte(`{"id": {"id": "calc1"}, "inputs": {"geometry": {"length": 2}}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := NewContextSource(&Config{ContextSource: "file:" + dir}, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calcContext, err := source.GetContext(context.Background(), "calc1")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if calcContext.Id.Id != "calc1" || calcContext.Inputs["geometry"] == nil {
+		t.Errorf("Unexpected context %+v", calcContext)
+	}
+	if _, err := source.GetContext(context.Background(), "calc2"); err == nil {
+		t.Error("Expected an error for a missing context")
+	}
+}
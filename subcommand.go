@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Subcommand is a first argument selecting what the agent does. Without one,
+// it runs the calculation given as an argument, or else serves.
+type Subcommand struct {
+	Name     string
+	Argument string
+	Usage    string
+}
+
+var Subcommands = []Subcommand{
+	{Name: "run", Argument: "calculation", Usage: "Run a calculation and exit"},
+	{Name: "serve", Usage: "Run calculations POSTed to port 8080"},
+	{Name: "completion", Argument: "bash|zsh|fish", Usage: "Print a shell completion script"},
+	{Name: "man", Usage: "Print the man page"},
+	{Name: "diff", Argument: "response1 response2", Usage: "Compare the outputs of two calculation responses"},
+	{Name: "replay", Argument: "calculation", Usage: "Run a completed calculation again and compare its outputs"},
+	{Name: "inspect", Argument: "calculation|workspace", Usage: "Open a shell in the kept workspace of a failed calculation"},
+}
+
+// fileFlags take a file name, so are completed with files.
+var fileFlags = map[string]bool{"config": true, "manifest": true}
+
+func IsSubcommand(name string) bool {
+	for _, subcommand := range Subcommands {
+		if subcommand.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func subcommandNames() []string {
+	names := make([]string, len(Subcommands))
+	for i, subcommand := range Subcommands {
+		names[i] = subcommand.Name
+	}
+	return names
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+// sortedFlags returns the flags of a flag set in lexical order.
+func sortedFlags(flags *flag.FlagSet) []*flag.Flag {
+	sorted := make([]*flag.Flag, 0)
+	flags.VisitAll(func(f *flag.Flag) {
+		sorted = append(sorted, f)
+	})
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// Completion returns the completion script for a shell of the subcommands
+// and flags.
+func Completion(flags *flag.FlagSet, shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bashCompletion(flags), nil
+	case "zsh":
+		return zshCompletion(flags), nil
+	case "fish":
+		return fishCompletion(flags), nil
+	}
+	return "", errors.New("Unknown shell " + strconv.Quote(shell) + ", expected bash, zsh or fish")
+}
+
+func bashCompletion(flags *flag.FlagSet) string {
+	names := make([]string, 0)
+	files := make([]string, 0)
+	for _, f := range sortedFlags(flags) {
+		names = append(names, "-"+f.Name)
+		if fileFlags[f.Name] {
+			files = append(files, "-"+f.Name)
+		}
+	}
+	var script strings.Builder
+	script.WriteString("_patchworkagent() {\n")
+	script.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	script.WriteString("    case \"$prev\" in\n")
+	script.WriteString("        " + strings.Join(files, "|") + ") COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n")
+	script.WriteString("        completion) COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")); return ;;\n")
+	script.WriteString("    esac\n")
+	script.WriteString("    if [[ $COMP_CWORD -eq 1 && \"$cur\" != -* ]]; then\n")
+	script.WriteString("        COMPREPLY=($(compgen -W \"" + strings.Join(subcommandNames(), " ") + "\" -- \"$cur\"))\n")
+	script.WriteString("        return\n")
+	script.WriteString("    fi\n")
+	script.WriteString("    COMPREPLY=($(compgen -W \"" + strings.Join(names, " ") + "\" -- \"$cur\"))\n")
+	script.WriteString("}\n")
+	script.WriteString("complete -F _patchworkagent patchworkagent\n")
+	return script.String()
+}
+
+func zshCompletion(flags *flag.FlagSet) string {
+	escape := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]")
+	var script strings.Builder
+	script.WriteString("#compdef patchworkagent\n\n")
+	script.WriteString("_arguments \\\n")
+	for _, f := range sortedFlags(flags) {
+		spec := "-" + f.Name + "[" + escape.Replace(f.Usage) + "]"
+		if !isBoolFlag(f) {
+			name, _ := flag.UnquoteUsage(f)
+			if fileFlags[f.Name] {
+				spec += ":" + name + ":_files"
+			} else {
+				spec += ":" + name + ":"
+			}
+		}
+		script.WriteString("  '" + spec + "' \\\n")
+	}
+	script.WriteString("  '1:subcommand:(" + strings.Join(subcommandNames(), " ") + ")' \\\n")
+	script.WriteString("  '*::argument:'\n")
+	return script.String()
+}
+
+func fishCompletion(flags *flag.FlagSet) string {
+	escape := strings.NewReplacer("\\", "\\\\", "'", "\\'")
+	var script strings.Builder
+	for _, subcommand := range Subcommands {
+		script.WriteString("complete -c patchworkagent -f -n '__fish_use_subcommand' -a " + subcommand.Name +
+			" -d '" + escape.Replace(subcommand.Usage) + "'\n")
+	}
+	script.WriteString("complete -c patchworkagent -f -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+	for _, f := range sortedFlags(flags) {
+		line := "complete -c patchworkagent -o " + f.Name
+		if fileFlags[f.Name] {
+			line += " -r -F"
+		} else if !isBoolFlag(f) {
+			line += " -r -f"
+		}
+		script.WriteString(line + " -d '" + escape.Replace(f.Usage) + "'\n")
+	}
+	return script.String()
+}
+
+// ManPage returns the man page, in roff, of the subcommands and flags.
+func ManPage(flags *flag.FlagSet) string {
+	escape := strings.NewReplacer("\\", "\\e", "-", "\\-")
+	var page strings.Builder
+	page.WriteString(".TH PATCHWORKAGENT 1 \"\" \"patchworkagent " + escape.Replace(Version) + "\" \"User Commands\"\n")
+	page.WriteString(".SH NAME\n")
+	page.WriteString("patchworkagent \\- run Patchwork calculations with a command\n")
+	page.WriteString(".SH SYNOPSIS\n")
+	page.WriteString(".B patchworkagent\n")
+	page.WriteString("[\\fIsubcommand\\fR] [\\fIoptions\\fR] [\\fIcalculation\\fR]\n")
+	page.WriteString(".SH DESCRIPTION\n")
+	page.WriteString("Runs the command given with \\fB\\-c\\fR for calculations of a Patchwork host, " +
+		"sending back its output files. Given a calculation, it runs that and exits; " +
+		"otherwise it serves calculations POSTed to port 8080.\n")
+	page.WriteString(".SH COMMANDS\n")
+	for _, subcommand := range Subcommands {
+		page.WriteString(".TP\n")
+		page.WriteString("\\fB" + subcommand.Name + "\\fR")
+		if len(subcommand.Argument) > 0 {
+			page.WriteString(" \\fI" + escape.Replace(subcommand.Argument) + "\\fR")
+		}
+		page.WriteString("\n" + escape.Replace(subcommand.Usage) + "\n")
+	}
+	page.WriteString(".SH OPTIONS\n")
+	for _, f := range sortedFlags(flags) {
+		page.WriteString(".TP\n")
+		page.WriteString("\\fB\\-" + escape.Replace(f.Name) + "\\fR")
+		name, usage := flag.UnquoteUsage(f)
+		if len(name) > 0 {
+			page.WriteString(" \\fI" + escape.Replace(name) + "\\fR")
+		}
+		page.WriteString("\n" + escape.Replace(usage))
+		if len(f.DefValue) > 0 && f.DefValue != "0" && f.DefValue != "false" {
+			page.WriteString(" (default " + escape.Replace(f.DefValue) + ")")
+		}
+		page.WriteString("\n")
+	}
+	page.WriteString(".SH EXIT STATUS\n")
+	for _, status := range []struct {
+		code    int
+		meaning string
+	}{
+		{0, "The calculation succeeded, or had already been run"},
+		{1, "Invalid flags or config"},
+		{ExitFetchFailed, "Fetching or expanding the inputs failed"},
+		{ExitExecutionFailed, "The command exited with an error"},
+		{ExitTimeout, "The command timed out"},
+		{ExitUploadFailed, "Packaging or uploading the result failed"},
+		{ExitRequeued, "The license was unavailable, run it again later"},
+	} {
+		page.WriteString(".TP\n" + strconv.Itoa(status.code) + "\n" + status.meaning + "\n")
+	}
+	return page.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("patchworkagent", flag.ContinueOnError)
+	flags.String("config", "", "Path to JSON config file")
+	flags.Int("max-json-size", 0, "Size in bytes above which JSON outputs are returned as [artefacts]")
+	flags.Bool("keep-junk", false, "Return junk files as outputs")
+	return flags
+}
+
+func TestCompletion(t *testing.T) {
+	flags := testFlags()
+	bash, err := Completion(flags, "bash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(bash, "-config -keep-junk -max-json-size") || !strings.Contains(bash, "run serve completion man") {
+		t.Errorf("Unexpected bash completion:\n%s", bash)
+	}
+	if _, err := exec.LookPath("bash"); err == nil {
+		check := exec.Command("bash", "-n")
+		check.Stdin = strings.NewReader(bash)
+		if output, err := check.CombinedOutput(); err != nil {
+			t.Errorf("Invalid bash completion: %s", output)
+		}
+	}
+	zsh, _ := Completion(flags, "zsh")
+	if !strings.Contains(zsh, `'-config[Path to JSON config file]:string:_files'`) ||
+		!strings.Contains(zsh, `'-max-json-size[Size in bytes above which JSON outputs are returned as \[artefacts\]]:int:'`) ||
+		!strings.Contains(zsh, `'-keep-junk[Return junk files as outputs]' \`) {
+		t.Errorf("Unexpected zsh completion:\n%s", zsh)
+	}
+	fish, _ := Completion(flags, "fish")
+	if !strings.Contains(fish, "complete -c patchworkagent -o config -r -F -d 'Path to JSON config file'") {
+		t.Errorf("Unexpected fish completion:\n%s", fish)
+	}
+	if _, err := Completion(flags, "powershell"); err == nil {
+		t.Error("Expected an error for an unknown shell")
+	}
+}
+
+func TestManPage(t *testing.T) {
+	page := ManPage(testFlags())
+	for _, expected := range []string{".SH OPTIONS", "\\fB\\-max\\-json\\-size\\fR \\fIint\\fR", "\\fBrun\\fR \\fIcalculation\\fR", ".TP\n11\n"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("Expected %q in man page:\n%s", expected, page)
+		}
+	}
+}
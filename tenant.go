@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// Tenant holds the settings for talking to one Patchwork host: the token to
+// use when a payload doesn't carry one, and the proxy and CA bundle for its
+// HTTP client.
+type Tenant struct {
+	Host     string `json:"host"`
+	Token    string `json:"token"`
+	Proxy    string `json:"proxy"`
+	CaBundle string `json:"caBundle"`
+}
+
+func (tenant *Tenant) Validate() error {
+	if len(tenant.Host) == 0 {
+		return errors.New("Tenant has no host")
+	}
+	if len(tenant.Proxy) > 0 {
+		if _, err := url.Parse(tenant.Proxy); err != nil {
+			return errors.Wrap(err, "Tenant "+tenant.Host+" proxy")
+		}
+	}
+	if len(tenant.CaBundle) > 0 {
+		if _, err := os.Stat(tenant.CaBundle); err != nil {
+			return errors.Wrap(err, "Tenant "+tenant.Host+" CA bundle")
+		}
+	}
+	return nil
+}
+
+func (config *Config) Tenant(host string) *Tenant {
+	host = strings.TrimSuffix(host, "/")
+	for i := range config.Tenants {
+		if strings.TrimSuffix(config.Tenants[i].Host, "/") == host {
+			return &config.Tenants[i]
+		}
+	}
+	return nil
+}
+
+// ResolveTenant fills in the host and token of a payload that doesn't carry
+// them: the host defaults to the agent's, and the token to the tenant's, or
+// the agent's for its own host.
+func ResolveTenant(config *Config, calc patchwork.CalculationPayload, host string, token string) patchwork.CalculationPayload {
+	if len(calc.Host) == 0 {
+		calc.Host = host
+	}
+	if len(calc.Token) == 0 {
+		if tenant := config.Tenant(calc.Host); tenant != nil && len(tenant.Token) > 0 {
+			calc.Token = tenant.Token
+		} else if strings.TrimSuffix(calc.Host, "/") == strings.TrimSuffix(host, "/") {
+			calc.Token = token
+		}
+	}
+	return calc
+}
+
+// clients holds a separate HTTP client, with its own connection pool, for
+// each configured tenant, and one shared by every other host, as payloads
+// can name any number of those.
+var clients = struct {
+	sync.Mutex
+	byHost map[string]*http.Client
+	shared *http.Client
+}{byHost: make(map[string]*http.Client)}
+
+// ClientFor returns the HTTP client to use for a host, configured with the
+// proxy and CA bundle of its tenant if it has one, and throttled to the
+// bandwidth limits.
+func ClientFor(config *Config, host string) (*http.Client, error) {
+	host = strings.TrimSuffix(host, "/")
+	clients.Lock()
+	defer clients.Unlock()
+	if client, ok := clients.byHost[host]; ok {
+		return client, nil
+	}
+	tenant := config.Tenant(host)
+	if tenant == nil && clients.shared != nil {
+		return clients.shared, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tenant != nil {
+		if len(tenant.Proxy) > 0 {
+			proxy, err := url.Parse(tenant.Proxy)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+		if len(tenant.CaBundle) > 0 {
+			pem, err := os.ReadFile(tenant.CaBundle)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("No certificates found in " + tenant.CaBundle)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+	}
+	client := &http.Client{Transport: transport}
+	if config.Bandwidth != nil {
+		client.Transport = &ThrottledTransport{Transport: transport, Bandwidth: config.Bandwidth}
+	}
+	if tenant != nil {
+		clients.byHost[host] = client
+	} else {
+		clients.shared = client
+	}
+	return client, nil
+}
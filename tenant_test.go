@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestClientFor(t *testing.T) {
+	config := &Config{Tenants: []Tenant{{Host: "https://tenant.example", Proxy: "http://proxy.example:3128"}}}
+	tenant, err := ClientFor(config, "https://tenant.example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ClientFor(config, "https://tenant.example"); again != tenant {
+		t.Error("Expected the tenant's client to be reused")
+	}
+	// Hosts named only by payloads share a client rather than each keeping
+	// a connection pool
+	shared, _ := ClientFor(config, "https://other.example")
+	if shared == tenant {
+		t.Error("Expected other hosts not to use the tenant's proxy")
+	}
+	for i := 0; i < 100; i++ {
+		if client, _ := ClientFor(config, "https://host"+strconv.Itoa(i)+".example"); client != shared {
+			t.Fatal("Expected other hosts to share a client")
+		}
+	}
+	clients.Lock()
+	defer clients.Unlock()
+	if _, ok := clients.byHost["https://other.example"]; ok {
+		t.Error("Expected only tenants to have clients of their own")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	image.RegisterFormat("tiff", "II*\x00", decodeTiff, decodeTiffConfig)
+	image.RegisterFormat("tiff", "MM\x00*", decodeTiff, decodeTiffConfig)
+}
+
+// TIFF tags, compressions and photometric interpretations that are read.
+const (
+	tiffWidth           = 256
+	tiffHeight          = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffStripByteCounts = 279
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffColorMap        = 320
+	tiffExtraSamples    = 338
+
+	tiffNone     = 1
+	tiffLzw      = 5
+	tiffDeflate  = 8
+	tiffPackBits = 32773
+	// The compression Adobe used for Deflate before it was standardised
+	tiffOldDeflate = 32946
+
+	tiffWhiteIsZero = 0
+	tiffBlackIsZero = 1
+	tiffRgb         = 2
+	tiffPalette     = 3
+)
+
+// tiffImage is the first image of a TIFF file. Single strips or multiple,
+// uncompressed, LZW, Deflate or PackBits compressed, of 1, 8 or 16 bit
+// samples in grey, RGB or palette colour, with any alpha, are supported.
+type tiffImage struct {
+	data  []byte
+	order binary.ByteOrder
+	tags  map[uint16][]uint32
+}
+
+func readTiff(r io.Reader) (*tiffImage, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	tiff := &tiffImage{data: data, tags: make(map[uint16][]uint32)}
+	switch {
+	case bytes.HasPrefix(data, []byte("II*\x00")):
+		tiff.order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM\x00*")):
+		tiff.order = binary.BigEndian
+	default:
+		return nil, errors.New("Not a TIFF")
+	}
+	ifd := int(tiff.order.Uint32(data[4:]))
+	if ifd < 8 || ifd+2 > len(data) {
+		return nil, errors.New("Invalid TIFF directory")
+	}
+	count := int(tiff.order.Uint16(data[ifd:]))
+	if ifd+2+12*count > len(data) {
+		return nil, errors.New("Truncated TIFF directory")
+	}
+	for i := 0; i < count; i++ {
+		entry := data[ifd+2+12*i:]
+		tag, kind, n := tiff.order.Uint16(entry), tiff.order.Uint16(entry[2:]), int(tiff.order.Uint32(entry[4:]))
+		size := map[uint16]int{1: 1, 3: 2, 4: 4}[kind]
+		if size == 0 {
+			// Only tags of bytes, shorts and longs are needed
+			continue
+		}
+		values := entry[8:12]
+		if n*size > 4 {
+			offset := int(tiff.order.Uint32(entry[8:]))
+			if n > len(data) || offset < 0 || offset+n*size > len(data) {
+				return nil, errors.New("Invalid TIFF tag " + strconv.Itoa(int(tag)))
+			}
+			values = data[offset:]
+		}
+		tiff.tags[tag] = make([]uint32, n)
+		for j := 0; j < n; j++ {
+			switch size {
+			case 1:
+				tiff.tags[tag][j] = uint32(values[j])
+			case 2:
+				tiff.tags[tag][j] = uint32(tiff.order.Uint16(values[2*j:]))
+			case 4:
+				tiff.tags[tag][j] = tiff.order.Uint32(values[4*j:])
+			}
+		}
+	}
+	return tiff, nil
+}
+
+// tag returns the first value of a tag, or otherwise its default.
+func (tiff *tiffImage) tag(tag uint16, otherwise uint32) uint32 {
+	if values := tiff.tags[tag]; len(values) > 0 {
+		return values[0]
+	}
+	return otherwise
+}
+
+func (tiff *tiffImage) config() (image.Config, error) {
+	width, height := int(tiff.tag(tiffWidth, 0)), int(tiff.tag(tiffHeight, 0))
+	if width <= 0 || height <= 0 || int64(width)*int64(height) > 1<<30 {
+		return image.Config{}, errors.New("Invalid TIFF size")
+	}
+	return image.Config{ColorModel: color.NRGBA64Model, Width: width, Height: height}, nil
+}
+
+func decodeTiffConfig(r io.Reader) (image.Config, error) {
+	tiff, err := readTiff(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return tiff.config()
+}
+
+func decodeTiff(r io.Reader) (image.Image, error) {
+	tiff, err := readTiff(r)
+	if err != nil {
+		return nil, err
+	}
+	config, err := tiff.config()
+	if err != nil {
+		return nil, err
+	}
+	width, height := config.Width, config.Height
+	samples := int(tiff.tag(tiffSamplesPerPixel, 1))
+	depth := int(tiff.tag(tiffBitsPerSample, 1))
+	photometric := tiff.tag(tiffPhotometric, tiffBlackIsZero)
+	colors := map[uint32]int{tiffWhiteIsZero: 1, tiffBlackIsZero: 1, tiffRgb: 3, tiffPalette: 1}[photometric]
+	if colors == 0 || samples < colors || samples > 4 || (depth != 1 && depth != 8 && depth != 16) ||
+		(depth == 1 && samples != 1) || tiff.tag(tiffPlanarConfig, 1) != 1 {
+		return nil, errors.New("Unsupported TIFF of " + strconv.Itoa(samples) + " samples of " + strconv.Itoa(depth) + " bits")
+	}
+	alpha := samples > colors && len(tiff.tags[tiffExtraSamples]) > 0
+	var palette []uint32
+	if photometric == tiffPalette {
+		palette = tiff.tags[tiffColorMap]
+		if len(palette) != 3<<depth {
+			return nil, errors.New("Invalid TIFF color map")
+		}
+	}
+
+	// Strips of rows are decompressed one after another into the pixels
+	rowSize := (width*samples*depth + 7) / 8
+	pixels := make([]byte, 0, rowSize*height)
+	offsets, counts := tiff.tags[tiffStripOffsets], tiff.tags[tiffStripByteCounts]
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, errors.New("TIFF has no strips, or is tiled")
+	}
+	for i, offset := range offsets {
+		if int64(offset)+int64(counts[i]) > int64(len(tiff.data)) {
+			return nil, errors.New("Truncated TIFF")
+		}
+		strip := tiff.data[offset : offset+counts[i]]
+		var decoded []byte
+		switch tiff.tag(tiffCompression, tiffNone) {
+		case tiffNone:
+			decoded = strip
+		case tiffLzw:
+			decoded, err = decodeTiffLzw(strip, cap(pixels)-len(pixels))
+		case tiffDeflate, tiffOldDeflate:
+			var reader io.ReadCloser
+			reader, err = zlib.NewReader(bytes.NewReader(strip))
+			if err == nil {
+				decoded, err = io.ReadAll(io.LimitReader(reader, int64(cap(pixels)-len(pixels))))
+			}
+		case tiffPackBits:
+			decoded, err = decodePackBits(strip, cap(pixels)-len(pixels))
+		default:
+			return nil, errors.New("Unsupported TIFF compression " + strconv.Itoa(int(tiff.tag(tiffCompression, 0))))
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid TIFF strip")
+		}
+		if len(decoded) > cap(pixels)-len(pixels) {
+			decoded = decoded[:cap(pixels)-len(pixels)]
+		}
+		pixels = append(pixels, decoded...)
+	}
+	if len(pixels) < rowSize*height {
+		return nil, errors.New("Truncated TIFF")
+	}
+	if tiff.tag(tiffPredictor, 1) == 2 && depth == 8 {
+		// Horizontal differencing
+		for y := 0; y < height; y++ {
+			row := pixels[y*rowSize : (y+1)*rowSize]
+			for x := samples; x < len(row); x++ {
+				row[x] += row[x-samples]
+			}
+		}
+	}
+
+	img := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	sample := func(y int, index int) uint16 {
+		row := pixels[y*rowSize:]
+		switch depth {
+		case 1:
+			if row[index/8]&(0x80>>(index%8)) != 0 {
+				return 0xffff
+			}
+			return 0
+		case 8:
+			return uint16(row[index]) * 0x101
+		}
+		return tiff.order.Uint16(row[2*index:])
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c color.NRGBA64
+			first := sample(y, x*samples)
+			switch photometric {
+			case tiffWhiteIsZero:
+				c = color.NRGBA64{0xffff - first, 0xffff - first, 0xffff - first, 0xffff}
+			case tiffBlackIsZero:
+				c = color.NRGBA64{first, first, first, 0xffff}
+			case tiffRgb:
+				c = color.NRGBA64{first, sample(y, x*samples+1), sample(y, x*samples+2), 0xffff}
+			case tiffPalette:
+				index := int(first) >> (16 - depth)
+				c = color.NRGBA64{uint16(palette[index]), uint16(palette[index+1<<depth]), uint16(palette[index+2<<depth]), 0xffff}
+			}
+			if alpha {
+				c.A = sample(y, x*samples+colors)
+			}
+			img.SetNRGBA64(x, y, c)
+		}
+	}
+	return img, nil
+}
+
+// decodeTiffLzw decompresses a strip compressed with the LZW of TIFF, which
+// unlike compress/lzw widens codes one code early, up to limit bytes.
+func decodeTiffLzw(data []byte, limit int) ([]byte, error) {
+	const clear, end = 256, 257
+	out := make([]byte, 0)
+	table := make([][]byte, 258, 4096)
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+	width, bit, prev := 9, 0, -1
+	for len(out) < limit {
+		if bit+width > 8*len(data) {
+			break
+		}
+		code := 0
+		for i := 0; i < width; i++ {
+			code = code<<1 | int(data[(bit+i)/8]>>(7-(bit+i)%8)&1)
+		}
+		bit += width
+		if code == end {
+			break
+		}
+		if code == clear {
+			table, width, prev = table[:258], 9, -1
+			continue
+		}
+		var entry []byte
+		switch {
+		case prev < 0 && code < 256:
+			entry = table[code]
+		case prev >= 0 && code < len(table):
+			entry = table[code]
+		case prev >= 0 && code == len(table):
+			entry = append(append([]byte{}, table[prev]...), table[prev][0])
+		default:
+			return nil, errors.New("Invalid LZW code")
+		}
+		out = append(out, entry...)
+		// Encoders clear the table before it is full
+		if prev >= 0 && len(table) < 4096 {
+			table = append(table, append(append([]byte{}, table[prev]...), entry[0]))
+		}
+		prev = code
+		if len(table) == 1<<width-1 && width < 12 {
+			width++
+		}
+	}
+	return out, nil
+}
+
+// decodePackBits decompresses a strip compressed with PackBits, up to limit
+// bytes.
+func decodePackBits(data []byte, limit int) ([]byte, error) {
+	out := make([]byte, 0)
+	for i := 0; i < len(data) && len(out) < limit; {
+		n := int(int8(data[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(data) {
+				return nil, errors.New("Truncated PackBits")
+			}
+			out = append(out, data[i:i+n+1]...)
+			i += n + 1
+		case n > -128:
+			if i >= len(data) {
+				return nil, errors.New("Truncated PackBits")
+			}
+			out = append(out, bytes.Repeat(data[i:i+1], 1-n)...)
+			i++
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ServerTLSConfig returns the TLS configuration to serve calculations with,
+// or nil to serve plaintext. With TlsClientCa set, clients must present a
+// certificate signed by one of its CAs.
+func ServerTLSConfig(config *Config) (*tls.Config, error) {
+	if len(config.TlsCert) == 0 && len(config.TlsKey) == 0 {
+		if len(config.TlsClientCa) > 0 {
+			return nil, errors.New("tlsClientCa requires tlsCert and tlsKey")
+		}
+		return nil, nil
+	}
+	if len(config.TlsCert) == 0 || len(config.TlsKey) == 0 {
+		return nil, errors.New("tlsCert and tlsKey must be given together")
+	}
+	keyPair := &reloadingKeyPair{certFile: config.TlsCert, keyFile: config.TlsKey}
+	if _, err := keyPair.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: keyPair.GetCertificate,
+	}
+	if len(config.TlsClientCa) > 0 {
+		pem, err := os.ReadFile(config.TlsClientCa)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + config.TlsClientCa)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// reloadingKeyPair reads the certificate again when either file changes, so
+// that rotated certificates are served without a restart.
+type reloadingKeyPair struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	modified time.Time
+	cert     *tls.Certificate
+}
+
+func (k *reloadingKeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	modified := time.Time{}
+	for _, file := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if k.cert != nil {
+				return k.cert, nil
+			}
+			return nil, errors.WithStack(err)
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	if k.cert != nil && !modified.After(k.modified) {
+		return k.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		if k.cert != nil {
+			// Probably caught between writing the certificate and the key
+			return k.cert, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	k.cert = &cert
+	k.modified = modified
+	return k.cert, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a certificate and key for name signed by parent,
+// or self-signed if nil, returning their paths
+func writeCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPath := filepath.Join(t.TempDir(), name+".pem")
+	keyPath := filepath.Join(t.TempDir(), name+".key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key, certPath, keyPath
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca, caKey, caPath, _ := writeCertificate(t, "ca", nil, nil)
+	_, _, certPath, keyPath := writeCertificate(t, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCertificate(t, "client", ca, caKey)
+	_, _, strangerCert, strangerKey := writeCertificate(t, "stranger", nil, nil)
+
+	for _, config := range []*Config{{TlsCert: certPath}, {TlsClientCa: caPath}, {TlsCert: certPath, TlsKey: caPath}} {
+		if _, err := ServerTLSConfig(config); err == nil {
+			t.Errorf("Expected %+v to be rejected", config)
+		}
+	}
+	if tlsConfig, err := ServerTLSConfig(&Config{}); err != nil || tlsConfig != nil {
+		t.Fatalf("Expected plaintext, got %v %v", tlsConfig, err)
+	}
+
+	tlsConfig, err := ServerTLSConfig(&Config{TlsCert: certPath, TlsKey: keyPath, TlsClientCa: caPath})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{TLSConfig: tlsConfig, Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+	})}
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	get := func(certFile, keyFile string) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if len(certFile) > 0 {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		response, err := client.Get("https://" + listener.Addr().String())
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+	if err := get(clientCert, clientKey); err != nil {
+		t.Errorf("Expected the client certificate to be accepted: %v", err)
+	}
+	if err := get("", ""); err == nil {
+		t.Error("Expected a client without a certificate to be rejected")
+	}
+	if err := get(strangerCert, strangerKey); err == nil {
+		t.Error("Expected a certificate from another CA to be rejected")
+	}
+}
@@ -0,0 +1,5 @@
+package main
+
+// Version of the agent, set at build time with
+// go build -ldflags "-X main.Version=1.2.3"
+var Version = "dev"
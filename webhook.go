@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Webhook is notified of the lifecycle events of calculations: "queued" when
+// the server accepts one, "started" when its command starts, "finished" when
+// its result has been sent and "failed" when it could not be completed, as
+// well as "canary" with the comparison of a canary's result.
+type Webhook struct {
+	Url           string   `json:"url"`
+	Events        []string `json:"events"`
+	Authorization string   `json:"authorization"`
+}
+
+var webhookEvents = []string{"queued", "started", "finished", "failed", "canary"}
+
+func (webhook *Webhook) Validate() error {
+	parsed, err := url.Parse(webhook.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return errors.New("Invalid webhook URL " + webhook.Url)
+	}
+	for _, event := range webhook.Events {
+		if !MatchesAny([]string{event}, webhookEvents...) {
+			return errors.New("Unknown webhook event " + event)
+		}
+	}
+	return nil
+}
+
+// WebhookEvent is the body POSTed to a webhook. Durations are in seconds.
+type WebhookEvent struct {
+	Event       string     `json:"event"`
+	Calculation string     `json:"calculation"`
+	AgentId     string     `json:"agentId"`
+	Time        time.Time  `json:"time"`
+	QueuedAt    time.Time  `json:"queuedAt"`
+	StartedAt   *time.Time `json:"startedAt,omitempty"`
+	WaitTime    float64    `json:"waitTime,omitempty"`
+	RunTime     float64    `json:"runTime,omitempty"`
+	ExitCode    *int       `json:"exitCode,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	// Canary is how the result of a canary differed, in "canary" events.
+	Canary *CanaryReport `json:"canary,omitempty"`
+}
+
+// NotifyWebhooks posts an event to the webhooks subscribed to it, in the
+// background so that a slow webhook doesn't hold up the calculation.
+func NotifyWebhooks(config *Config, logger *log.Logger, event WebhookEvent) {
+	event.AgentId = config.AgentId
+	event.Time = time.Now().UTC()
+	for i := range config.Webhooks {
+		webhook := &config.Webhooks[i]
+		if len(webhook.Events) > 0 && !MatchesAny(webhook.Events, event.Event) {
+			continue
+		}
+		go func() {
+			err := webhook.Post(config, event)
+			if err != nil {
+				logger.Println("Webhook " + webhook.Url + " failed: " + err.Error())
+			}
+		}()
+	}
+}
+
+func (webhook *Webhook) Post(config *Config, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	parsed, err := url.Parse(webhook.Url)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	client, err := ClientFor(config, parsed.Scheme+"://"+parsed.Host)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for name, values := range AgentHeaders(config) {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(webhook.Authorization) > 0 {
+		request.Header.Set("Authorization", webhook.Authorization)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return errors.New("Webhook responded " + response.Status)
+	}
+	return nil
+}
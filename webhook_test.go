@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "failing-command", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := NewStubHost(t, "failing-command", calcContext)
+	defer server.Close()
+	events := make(chan WebhookEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+
+	config := &Config{AgentId: "agent1", Webhooks: []Webhook{{Url: webhook.URL, Events: []string{"started", "finished"}}}}
+	err = RunCalculation(context.Background(), config, HelperCommand(t, "failing-command"), &Job{
+		Host:        server.URL,
+		Token:       "token",
+		Calculation: "failing-command",
+		Dir:         t.TempDir(),
+		Timeout:     60,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	received := make(map[string]WebhookEvent)
+	for len(received) < 2 {
+		select {
+		case event := <-events:
+			received[event.Event] = event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Only received %v", received)
+		}
+	}
+	finished := received["finished"]
+	if finished.Calculation != "failing-command" || finished.AgentId != "agent1" || finished.StartedAt == nil {
+		t.Errorf("Unexpected event %+v", finished)
+	}
+	if finished.ExitCode == nil || *finished.ExitCode != 3 {
+		t.Errorf("Expected exit code 3 in %+v", finished)
+	}
+}
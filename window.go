@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeWindow is a time of day, from From to To as HH:MM in local time, on
+// Days (mon to sun, or every day if empty). A window ending before it starts
+// runs past midnight.
+type TimeWindow struct {
+	Days []string `json:"days"`
+	From string   `json:"from"`
+	To   string   `json:"to"`
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (window *TimeWindow) Validate() error {
+	if _, err := time.Parse("15:04", window.From); err != nil {
+		return errors.New("Invalid start " + window.From + ", expected HH:MM")
+	}
+	if _, err := time.Parse("15:04", window.To); err != nil {
+		return errors.New("Invalid end " + window.To + ", expected HH:MM")
+	}
+	for _, day := range window.Days {
+		if weekday(day) < 0 {
+			return errors.New("Unknown day " + day + ", expected one of " + strings.Join(weekdays, ", "))
+		}
+	}
+	return nil
+}
+
+func weekday(day string) time.Weekday {
+	for i, name := range weekdays {
+		if strings.EqualFold(day, name) {
+			return time.Weekday(i)
+		}
+	}
+	return -1
+}
+
+// Covers reports whether a time is in the window.
+func (window *TimeWindow) Covers(now time.Time) bool {
+	from, _ := time.Parse("15:04", window.From)
+	to, _ := time.Parse("15:04", window.To)
+	minute := now.Hour()*60 + now.Minute()
+	start, end := from.Hour()*60+from.Minute(), to.Hour()*60+to.Minute()
+	// A window past midnight started the day before, after midnight
+	day := now.Weekday()
+	if end <= start && minute < end {
+		day = (day + 6) % 7
+	}
+	if len(window.Days) > 0 {
+		found := false
+		for _, name := range window.Days {
+			found = found || weekday(name) == day
+		}
+		if !found {
+			return false
+		}
+	}
+	if end <= start {
+		return minute >= start || minute < end
+	}
+	return minute >= start && minute < end
+}
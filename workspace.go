@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// With SeparateOutputs set, the inputs of a calculation are expanded into an
+// inputs directory of the workspace, which is made read-only while the
+// command runs, and only the files the command writes to the outputs
+// directory are returned.
+
+func InputsDir(config *Config, dirpath string) string {
+	if config.SeparateOutputs {
+		return filepath.Join(dirpath, "inputs")
+	}
+	return dirpath
+}
+
+func OutputsDir(config *Config, dirpath string) string {
+	if config.SeparateOutputs {
+		return filepath.Join(dirpath, "outputs")
+	}
+	return dirpath
+}
+
+// PrepareWorkspace creates the inputs and outputs directories, unlocking the
+// inputs left by a previous calculation in the same directory.
+func PrepareWorkspace(config *Config, dirpath string) error {
+	if !config.SeparateOutputs {
+		return nil
+	}
+	inputs := InputsDir(config, dirpath)
+	if _, err := os.Stat(inputs); err == nil {
+		if err := SetInputsReadOnly(config, dirpath, false); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err := os.MkdirAll(inputs, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.MkdirAll(OutputsDir(config, dirpath), 0755))
+}
+
+// SetInputsReadOnly makes the inputs directory and the files in it read-only,
+// or writable again.
+func SetInputsReadOnly(config *Config, dirpath string, readOnly bool) error {
+	if !config.SeparateOutputs {
+		return nil
+	}
+	fileMode, dirMode := os.FileMode(0644), os.FileMode(0755)
+	if readOnly {
+		fileMode, dirMode = 0444, 0555
+	}
+	inputs := InputsDir(config, dirpath)
+	// The directory must be writable to change what is in it
+	if !readOnly {
+		if err := os.Chmod(inputs, dirMode); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	err := filepath.Walk(inputs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == inputs {
+			return nil
+		}
+		if info.IsDir() {
+			return os.Chmod(path, dirMode)
+		}
+		return os.Chmod(path, fileMode)
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if readOnly {
+		return errors.WithStack(os.Chmod(inputs, dirMode))
+	}
+	return nil
+}
+
+// RunInWorkspace expands the inputs of a calculation into a workspace and
+// runs a command in it, returning its exit code and result without sending
+// it anywhere. Its outputs are left in the workspace.
+func RunInWorkspace(ctx context.Context, config *Config, logger *log.Logger, command string, dir string, calcContext patchwork.CalculationContext, host string, token string) (int, *patchwork.CalculationResponse, error) {
+	err := PrepareWorkspace(config, dir)
+	if err != nil {
+		return -1, nil, errors.WithStack(err)
+	}
+	err = ExpandContext(ctx, config, logger, InputsDir(config, dir), calcContext)
+	if err != nil {
+		return -1, nil, errors.WithStack(err)
+	}
+	before, err := SnapshotFiles(config, OutputsDir(config, dir))
+	if err != nil {
+		return -1, nil, errors.WithStack(err)
+	}
+	var stdout, stderr bytes.Buffer
+	code, _ := RunCommand(ctx, config, logger, calcContext.Id.Type, command, dir, host, token, SecretInputs(calcContext.Inputs), &stdout, &stderr)
+	extracted := ExtractOutputs(config.OutputRules, stdout.String())
+	response, err := PackageResult(ctx, config, logger, nil, OutputsDir(config, dir), before, stdout.String(), stderr.String(), extracted)
+	return code, response, errors.WithStack(err)
+}
+
+// WorkspaceName is the name of the workspace of a calculation,
+// calc-<type>-<id>-<timestamp>, so that disk usage and stray processes can be
+// traced to it.
+func WorkspaceName(calculationType string, calculation string, created time.Time) string {
+	return "calc-" + workspaceNamePart(calculationType) + "-" + workspaceNamePart(calculation) + "-" + created.UTC().Format("20060102T150405Z")
+}
+
+// workspaceNamePart is part of a workspace name, with only characters safe in
+// file names on every platform.
+func workspaceNamePart(part string) string {
+	part = strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' {
+			return c
+		}
+		return '_'
+	}, part)
+	if len(part) > 40 {
+		part = part[:40]
+	}
+	if len(strings.Trim(part, "._")) == 0 {
+		return "unknown"
+	}
+	return part
+}
+
+// CreateWorkspace creates the workspace of a calculation in dirpath, with a
+// suffix if a workspace of the same calculation was created in the same
+// second.
+func CreateWorkspace(dirpath string, calculationType string, calculation string) (string, error) {
+	name := filepath.Join(dirpath, WorkspaceName(calculationType, calculation, time.Now()))
+	for attempt := 1; ; attempt++ {
+		path := name
+		if attempt > 1 {
+			path += "-" + strconv.Itoa(attempt)
+		}
+		err := os.Mkdir(path, 0700)
+		if err == nil {
+			return path, errors.WithStack(markWorkspace(path))
+		}
+		if !os.IsExist(err) {
+			return path, errors.WithStack(err)
+		}
+	}
+}
+
+// WorkspaceMarkerFile marks a directory as a workspace the agent created,
+// recording the process that owns it, so that only those are reclaimed after
+// a crash.
+const WorkspaceMarkerFile = ".workspace.json"
+
+type workspaceOwner struct {
+	Hostname string `json:"hostname"`
+	Pid      int    `json:"pid"`
+	Instance string `json:"instance"`
+}
+
+// agentInstance tells this run of the agent from an earlier one with the
+// same process id, as is usual in containers.
+var agentInstance = func() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}()
+
+func markWorkspace(dirpath string) error {
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(workspaceOwner{Hostname: hostname, Pid: os.Getpid(), Instance: agentInstance})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(filepath.Join(dirpath, WorkspaceMarkerFile), data, 0600))
+}
+
+// workspaceOwned reports whether the workspace is marked as created by the
+// agent, and whether the process that created it may still be running. The
+// owner of a workspace marked on another machine can't be checked, so it is
+// taken to be running.
+func workspaceOwned(dirpath string) (bool, bool) {
+	data, err := os.ReadFile(filepath.Join(dirpath, WorkspaceMarkerFile))
+	if err != nil {
+		return false, false
+	}
+	var owner workspaceOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return true, false
+	}
+	hostname, _ := os.Hostname()
+	if owner.Hostname != hostname {
+		return true, true
+	}
+	if owner.Pid == os.Getpid() {
+		return true, owner.Instance == agentInstance
+	}
+	return true, processRunning(owner.Pid)
+}
+
+// processRunning reports whether a process with the given id exists. On
+// Windows finding it opens it, which fails once it has exited.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer process.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// WorkspaceEntry is the workspace a calculation is running in.
+type WorkspaceEntry struct {
+	Calculation string    `json:"calculation"`
+	Type        string    `json:"type"`
+	Workspace   string    `json:"workspace"`
+	Created     time.Time `json:"created"`
+}
+
+// Workspaces are those of the calculations running.
+type Workspaces struct {
+	mutex   sync.Mutex
+	entries map[string]WorkspaceEntry
+}
+
+var workspaces = &Workspaces{entries: make(map[string]WorkspaceEntry)}
+
+func (workspaces *Workspaces) Add(entry WorkspaceEntry) {
+	workspaces.mutex.Lock()
+	defer workspaces.mutex.Unlock()
+	workspaces.entries[entry.Workspace] = entry
+}
+
+func (workspaces *Workspaces) Remove(workspace string) {
+	workspaces.mutex.Lock()
+	defer workspaces.mutex.Unlock()
+	delete(workspaces.entries, workspace)
+}
+
+// Entries returns the workspaces, oldest first.
+func (workspaces *Workspaces) Entries() []WorkspaceEntry {
+	workspaces.mutex.Lock()
+	defer workspaces.mutex.Unlock()
+	entries := make([]WorkspaceEntry, 0, len(workspaces.entries))
+	for _, entry := range workspaces.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+	return entries
+}
+
+// StatusHandler serves the workspaces of the calculations running, and those
+// of failed calculations kept in dirpath.
+func StatusHandler(config *Config, dirpath string) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if "GET" != request.Method {
+			writer.WriteHeader(404)
+			return
+		}
+		kept := make([]WorkspaceEntry, 0)
+		paths, _ := filepath.Glob(filepath.Join(dirpath, "calc*"))
+		for _, path := range paths {
+			data, err := os.ReadFile(filepath.Join(path, SessionFile))
+			var session Session
+			if err != nil || json.Unmarshal(data, &session) != nil {
+				continue
+			}
+			entry := WorkspaceEntry{Calculation: session.Calculation, Type: session.Type, Workspace: path}
+			if info, err := os.Stat(path); err == nil {
+				entry.Created = info.ModTime().UTC()
+			}
+			kept = append(kept, entry)
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"agentId":    config.AgentId,
+			"workspaces": workspaces.Entries(),
+			"kept":       kept,
+		})
+	}
+}
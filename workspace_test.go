@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceName(t *testing.T) {
+	created := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	for _, c := range []struct{ calculationType, calculation, expected string }{
+		{"fea", "beam-1", "calc-fea-beam-1-20260304T050607Z"},
+		{"cfd/steady", "../wing 2", "calc-cfd_steady-.._wing_2-20260304T050607Z"},
+		{"", "..", "calc-unknown-unknown-20260304T050607Z"},
+	} {
+		if name := WorkspaceName(c.calculationType, c.calculation, created); name != c.expected {
+			t.Errorf("Expected %s, got %s", c.expected, name)
+		}
+	}
+
+	dir := t.TempDir()
+	first, err := CreateWorkspace(dir, "fea", "beam-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CreateWorkspace(dir, "fea", "beam-1")
+	if err != nil || second == first || !strings.HasPrefix(filepath.Base(first), "calc-fea-beam-1-") {
+		t.Errorf("Unexpected %s %s %v", first, second, err)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	calcContext, err := os.ReadFile(filepath.Join("testdata", "golden", "scalar-outputs", "context.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := NewStubHost(t, "scalar-outputs", calcContext)
+	defer server.Close()
+	dirpath := t.TempDir()
+	config := &Config{AgentId: "agent1"}
+
+	// The workspace is served while the command runs
+	var status struct {
+		Workspaces []WorkspaceEntry `json:"workspaces"`
+	}
+	RegisterPhaseHook(PhaseExecute, func(ctx context.Context, event PhaseEvent) error {
+		if event.Calculation == "scalar-outputs" && !event.Done {
+			recorder := httptest.NewRecorder()
+			StatusHandler(config, dirpath)(recorder, httptest.NewRequest("GET", "/status", nil))
+			json.Unmarshal(recorder.Body.Bytes(), &status)
+		}
+		return nil
+	})
+	job := &Job{Host: server.URL, Token: "token", Calculation: "scalar-outputs", Workspaces: dirpath, Timeout: 60}
+	if err := RunCalculation(context.Background(), config, HelperCommand(t, "scalar-outputs"), job); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if filepath.Dir(job.Dir) != dirpath || !strings.HasPrefix(filepath.Base(job.Dir), "calc-") {
+		t.Errorf("Unexpected workspace %s", job.Dir)
+	}
+	found := false
+	for _, entry := range status.Workspaces {
+		found = found || entry.Workspace == job.Dir && entry.Calculation == "scalar-outputs"
+	}
+	if !found {
+		t.Errorf("Workspace %s not in %+v", job.Dir, status.Workspaces)
+	}
+	for _, entry := range workspaces.Entries() {
+		if entry.Workspace == job.Dir {
+			t.Error("Expected the workspace to be removed once the calculation finished")
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"patchworkagent/patchwork"
+
+	"github.com/pkg/errors"
+)
+
+// SheetOutput returns a range of cells of a sheet of Excel (.xlsx) output
+// files matching the glob pattern File as the output Name, alongside the file
+// itself. The range, such as B2:D10, defaults to all the cells used, and a
+// single cell is returned as a value rather than rows. With Header, the
+// first row of the range names the values of the rest, returned as objects.
+type SheetOutput struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Sheet  string `json:"sheet"`
+	Range  string `json:"range"`
+	Header bool   `json:"header"`
+}
+
+func (output *SheetOutput) Validate() error {
+	if len(output.Name) == 0 {
+		return errors.New("Sheet output has no name")
+	}
+	if len(output.Range) > 0 {
+		if _, _, _, _, err := parseRange(output.Range); err != nil {
+			return errors.Wrap(err, "Sheet output "+output.Name)
+		}
+	}
+	_, err := path.Match(output.File, "")
+	return errors.Wrap(err, "Sheet output "+output.Name+" file pattern "+output.File)
+}
+
+// ParseSheets adds the sheet outputs of an output file to a response, adding
+// an error for any that can't be read.
+func ParseSheets(config *Config, logger *log.Logger, name string, file string, response *patchwork.CalculationResponse) {
+	for _, output := range config.SheetOutputs {
+		if matched, _ := path.Match(output.File, name); !matched {
+			continue
+		}
+		logger.Println("Reading output " + output.Name + " from " + name)
+		value, err := ReadSheet(file, output)
+		if err != nil {
+			logger.Println("Could not read output " + output.Name + ": " + err.Error())
+			response.AddErrors("Output " + output.Name + " could not be read from " + name + ": " + err.Error())
+			continue
+		}
+		AddOutput(config, logger, response, output.Name, value)
+	}
+}
+
+// ReadSheet reads the range of cells of a sheet output from an .xlsx file.
+// Numbers, including dates, are returned as numbers, empty cells as null and
+// errors such as #DIV/0! as strings.
+func ReadSheet(file string, output SheetOutput) (interface{}, error) {
+	archive, err := zip.OpenReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Not an xlsx file")
+	}
+	defer archive.Close()
+	sheetPath, err := findSheet(&archive.Reader, output.Sheet)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var sst struct {
+		Items []struct {
+			Text string `xml:"t"`
+			Runs []struct {
+				Text string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	if err := readZipXml(&archive.Reader, "xl/sharedStrings.xml", &sst); err != nil && err != errNotInZip {
+		return nil, errors.WithStack(err)
+	}
+	strs := make([]string, len(sst.Items))
+	for i, item := range sst.Items {
+		strs[i] = item.Text
+		for _, run := range item.Runs {
+			strs[i] += run.Text
+		}
+	}
+	var sheet struct {
+		Rows []struct {
+			Ref   int `xml:"r,attr"`
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Type   string `xml:"t,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := readZipXml(&archive.Reader, sheetPath, &sheet); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cells := make(map[[2]int]interface{})
+	maxRow, maxCol := 0, 0
+	// References of rows and cells may be left out, for the next in order
+	r := 0
+	for _, row := range sheet.Rows {
+		r++
+		col := 0
+		if row.Ref > 0 {
+			r = row.Ref
+		}
+		for _, cell := range row.Cells {
+			col++
+			if len(cell.Ref) > 0 {
+				col, r, err = parseCell(cell.Ref)
+				if err != nil {
+					return nil, errors.WithStack(err)
+				}
+			}
+			var value interface{}
+			switch cell.Type {
+			case "s":
+				i, err := strconv.Atoi(cell.Value)
+				if err != nil || i < 0 || i >= len(strs) {
+					return nil, errors.New("Invalid shared string in " + cell.Ref)
+				}
+				value = strs[i]
+			case "inlineStr":
+				value = cell.Inline
+			case "str", "e", "d":
+				value = cell.Value
+			case "b":
+				value = cell.Value == "1"
+			default:
+				if len(cell.Value) > 0 {
+					f, err := strconv.ParseFloat(cell.Value, 64)
+					if err != nil {
+						return nil, errors.New("Invalid number in " + cell.Ref)
+					}
+					value = f
+				}
+			}
+			cells[[2]int{r, col}] = value
+			if r > maxRow {
+				maxRow = r
+			}
+			if col > maxCol {
+				maxCol = col
+			}
+		}
+	}
+	fromCol, fromRow, toCol, toRow := 1, 1, maxCol, maxRow
+	if len(output.Range) > 0 {
+		fromCol, fromRow, toCol, toRow, _ = parseRange(output.Range)
+	}
+	if fromCol == toCol && fromRow == toRow && !output.Header {
+		return cells[[2]int{fromRow, fromCol}], nil
+	}
+	if (toRow-fromRow+1)*(toCol-fromCol+1) > maxDatasetValues {
+		return nil, errors.New("Range has more than " + strconv.Itoa(maxDatasetValues) + " cells")
+	}
+	rows := make([]interface{}, 0)
+	for r := fromRow; r <= toRow; r++ {
+		row := make([]interface{}, 0)
+		for col := fromCol; col <= toCol; col++ {
+			row = append(row, cells[[2]int{r, col}])
+		}
+		rows = append(rows, row)
+	}
+	if !output.Header || len(rows) == 0 {
+		return rows, nil
+	}
+	header := rows[0].([]interface{})
+	objects := make([]interface{}, 0)
+	for _, row := range rows[1:] {
+		object := make(map[string]interface{})
+		for i, value := range row.([]interface{}) {
+			if header[i] != nil && header[i] != "" {
+				object[fmt.Sprint(header[i])] = value
+			}
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+var errNotInZip = errors.New("Not in the archive")
+
+func readZipXml(archive *zip.Reader, name string, v interface{}) error {
+	for _, file := range archive.File {
+		if file.Name != name {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer reader.Close()
+		return errors.Wrap(xml.NewDecoder(reader).Decode(v), "Invalid "+name)
+	}
+	return errNotInZip
+}
+
+// findSheet returns the path in the archive of a sheet, or of the first one
+// if name is empty.
+func findSheet(archive *zip.Reader, name string) (string, error) {
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			Id   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := readZipXml(archive, "xl/workbook.xml", &workbook); err != nil {
+		return "", errors.Wrap(err, "Not an xlsx file")
+	}
+	var rels struct {
+		Relationships []struct {
+			Id     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := readZipXml(archive, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return "", errors.Wrap(err, "Not an xlsx file")
+	}
+	for _, sheet := range workbook.Sheets {
+		if len(name) > 0 && sheet.Name != name {
+			continue
+		}
+		for _, rel := range rels.Relationships {
+			if rel.Id != sheet.Id {
+				continue
+			}
+			// Targets are relative to xl/, unless absolute
+			if strings.HasPrefix(rel.Target, "/") {
+				return strings.TrimPrefix(rel.Target, "/"), nil
+			}
+			return path.Join("xl", rel.Target), nil
+		}
+	}
+	if len(name) == 0 {
+		return "", errors.New("No sheets")
+	}
+	return "", errors.New("No sheet " + name)
+}
+
+// parseCell returns the column and row, from 1, of a cell reference such as
+// B12, ignoring any $.
+func parseCell(ref string) (int, int, error) {
+	ref = strings.ReplaceAll(strings.ToUpper(ref), "$", "")
+	col, i := 0, 0
+	for ; i < len(ref) && ref[i] >= 'A' && ref[i] <= 'Z'; i++ {
+		col = col*26 + int(ref[i]-'A'+1)
+	}
+	row, err := strconv.Atoi(ref[i:])
+	if i == 0 || i > 3 || err != nil || row < 1 {
+		return 0, 0, errors.New("Invalid cell " + ref)
+	}
+	return col, row, nil
+}
+
+// parseRange returns the first and last column and row of a range such as
+// A1:C10, or of a single cell.
+func parseRange(ref string) (int, int, int, int, error) {
+	from, to, found := strings.Cut(ref, ":")
+	if !found {
+		to = from
+	}
+	fromCol, fromRow, err := parseCell(from)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	toCol, toRow, err := parseCell(to)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if toCol < fromCol || toRow < fromRow {
+		return 0, 0, 0, 0, errors.New("Invalid range " + ref)
+	}
+	return fromCol, fromRow, toCol, toRow, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"patchworkagent/patchwork"
+)
+
+// xlsxFixture writes a workbook with a Summary sheet, whose results are on
+// a second sheet, with a header row of shared strings.
+func xlsxFixture(t *testing.T, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	for name, content := range map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Summary" sheetId="1" r:id="rId1"/><sheet name="Results" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/></Relationships>`,
+		"xl/sharedStrings.xml": `<sst><si><t>node</t></si><si><r><t>disp</t></r><r><t>lacement</t></r></si><si><t>ok</t></si></sst>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>
+<row r="1"><c r="A1" t="inlineStr"><is><t>Mass</t></is></c><c r="B1"><v>12.5</v></c></row>
+<row r="3"><c r="A3" t="b"><v>1</v></c><c r="C3" t="e"><v>#DIV/0!</v></c></row>
+</sheetData></worksheet>`,
+		"xl/worksheets/sheet2.xml": `<worksheet><sheetData>
+<row><c t="s"><v>0</v></c><c t="s"><v>1</v></c></row>
+<row><c><v>1</v></c><c><v>0.25</v></c></row>
+<row><c><v>2</v></c><c t="s"><v>2</v></c></row>
+</sheetData></worksheet>`,
+	} {
+		writer, _ := archive.Create(name)
+		writer.Write([]byte(content))
+	}
+	archive.Close()
+	file.Close()
+}
+
+func TestReadSheet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.xlsx")
+	xlsxFixture(t, path)
+	for _, test := range []struct {
+		output SheetOutput
+		value  interface{}
+	}{
+		{SheetOutput{Range: "B1"}, 12.5},
+		{SheetOutput{Sheet: "Summary", Range: "$A$1:B1"}, []interface{}{[]interface{}{"Mass", 12.5}}},
+		{SheetOutput{}, []interface{}{
+			[]interface{}{"Mass", 12.5, nil},
+			[]interface{}{nil, nil, nil},
+			[]interface{}{true, nil, "#DIV/0!"},
+		}},
+		{SheetOutput{Sheet: "Results", Header: true}, []interface{}{
+			map[string]interface{}{"node": 1.0, "displacement": 0.25},
+			map[string]interface{}{"node": 2.0, "displacement": "ok"},
+		}},
+	} {
+		value, err := ReadSheet(path, test.output)
+		if err != nil || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("Reading %+v should give %v, gave %v %v", test.output, test.value, value, err)
+		}
+	}
+	if _, err := ReadSheet(path, SheetOutput{Sheet: "Loads"}); err == nil {
+		t.Error("Reading a missing sheet should fail")
+	}
+}
+
+func TestParseSheets(t *testing.T) {
+	dir := t.TempDir()
+	xlsxFixture(t, filepath.Join(dir, "report.xlsx"))
+	config := &Config{SheetOutputs: []SheetOutput{
+		{Name: "mass", File: "*.xlsx", Range: "B1"},
+		{Name: "loads", File: "*.xlsx", Sheet: "Loads"},
+		{Name: "other", File: "*.xls"},
+	}}
+	response := patchwork.NewCalculationResponse()
+	ParseSheets(config, log.New(io.Discard, "", 0), "report.xlsx", filepath.Join(dir, "report.xlsx"), response)
+	if response.Outputs["mass"] != 12.5 || len(response.Outputs) != 1 || len(response.Errors) != 1 {
+		t.Errorf("Unexpected outputs %v and errors %v", response.Outputs, response.Errors)
+	}
+}